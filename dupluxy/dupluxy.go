@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -15,12 +16,16 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	_ "net/http/pprof"
 
 	"github.com/gilbertchen/cli"
+	"github.com/gilbertchen/gopass"
 
 	duplicacy "github.com/dupluxy/dupluxy/src"
 )
@@ -75,6 +80,9 @@ func getRepositoryPreference(context *cli.Context, storageName string) (reposito
 			repository = duplicacy.Preferences[0].RepositoryPath
 			duplicacy.LOG_INFO("REPOSITORY_SET", "Repository set to %s", repository)
 		}
+		duplicacy.SetRunReportPreference(duplicacy.Preferences[0])
+		duplicacy.SetLogContext("storage", duplicacy.Preferences[0].Name)
+		duplicacy.SetLogContext("snapshot_id", duplicacy.Preferences[0].SnapshotID)
 		return repository, &duplicacy.Preferences[0]
 	}
 
@@ -90,6 +98,9 @@ func getRepositoryPreference(context *cli.Context, storageName string) (reposito
 		duplicacy.LOG_INFO("REPOSITORY_SET", "Repository set to %s", repository)
 	}
 
+	duplicacy.SetRunReportPreference(*preference)
+	duplicacy.SetLogContext("storage", preference.Name)
+	duplicacy.SetLogContext("snapshot_id", preference.SnapshotID)
 	return repository, preference
 }
 
@@ -146,6 +157,32 @@ func setGlobalOptions(context *cli.Context) {
 		duplicacy.SetLoggingLevel(duplicacy.DEBUG)
 	}
 
+	if format := context.GlobalString("log-format"); format != "" {
+		err := duplicacy.SetLogFormat(format)
+		if err != nil {
+			fmt.Fprintf(context.App.Writer, "The log format must be 'text' or 'json'.\n\n")
+			os.Exit(ArgumentExitCode)
+		}
+	}
+
+	if logFile := context.GlobalString("log-file"); logFile != "" {
+		err := duplicacy.SetLogFile(logFile, int64(context.GlobalInt("log-file-max-size"))*1024*1024,
+			context.GlobalInt("log-file-keep"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open the log file %s: %v\n", logFile, err)
+			os.Exit(ArgumentExitCode)
+		}
+	}
+
+	if context.GlobalBool("log-journald") {
+		err := duplicacy.EnableJournal()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect to journald: %v\n", err)
+			os.Exit(ArgumentExitCode)
+		}
+	}
+	duplicacy.SetLogContext("command", context.Command.Name)
+
 	if context.GlobalBool("print-memory-usage") {
 		go duplicacy.PrintMemoryUsage()
 	}
@@ -167,6 +204,8 @@ func setGlobalOptions(context *cli.Context) {
 	}
 
 	duplicacy.RunInBackground = context.GlobalBool("background")
+
+	duplicacy.StartRunReport(context.Command.Name)
 }
 
 func runScript(context *cli.Context, storageName string, phase string) bool {
@@ -199,7 +238,21 @@ func runScript(context *cli.Context, storageName string, phase string) bool {
 
 	duplicacy.LOG_INFO("SCRIPT_RUN", "Running script %s", script)
 
-	output, err := exec.Command(script, os.Args...).CombinedOutput()
+	// The report of the command so far is passed as a JSON file and as environment variables.  Scripts only run
+	// before the command and after it has succeeded, so they never get the report of a failed run; use the webhook
+	// or the metrics for failures.
+	cmd := exec.Command(script, os.Args...)
+	if report := duplicacy.GetRunReport(0); report != nil {
+		reportPath, err := report.WriteFile()
+		if err != nil {
+			duplicacy.LOG_WARN("SCRIPT_REPORT", "Failed to write the report for the script: %v", err)
+		} else {
+			defer os.Remove(reportPath)
+			cmd.Env = append(os.Environ(), report.GetEnvironment(reportPath)...)
+		}
+	}
+
+	output, err := cmd.CombinedOutput()
 	for _, line := range strings.Split(string(output), "\n") {
 		line := strings.TrimSpace(line)
 		if line != "" {
@@ -215,6 +268,49 @@ func runScript(context *cli.Context, storageName string, phase string) bool {
 	return true
 }
 
+// lockRepository acquires the local lock on the storage of the repository so that no other backup or exclusive prune
+// can use it at the same time.  It returns the function that releases the lock.
+func lockRepository(preference *duplicacy.Preference, command string) (release func()) {
+	lock, err := duplicacy.AcquireLocalLock(preference.Name, command)
+	if err != nil {
+		duplicacy.LOG_ERROR("REPOSITORY_LOCKED", "Failed to lock the storage %s of the repository: %v",
+			preference.Name, err)
+		return func() {}
+	}
+	return lock.Release
+}
+
+// getStorageThreads returns the number of threads to create the storage with for an operation running 'threads'
+// threads.  If a lease is to be taken on the storage, one more thread is created for renewing it in the background.
+func getStorageThreads(preference *duplicacy.Preference, threads int) int {
+	if preference.RemoteLock && !preference.AppendOnly {
+		return threads + 1
+	}
+	return threads
+}
+
+// lockStorage takes a lease on the storage if remote locks are enabled for it, either a shared one or, for an exclusive
+// prune, an exclusive one.  The lease uses the storage thread 'threadIndex', which must be the extra one created as
+// returned by getStorageThreads.  It returns the function that releases the lease.
+func lockStorage(preference *duplicacy.Preference, manager *duplicacy.SnapshotManager, command string,
+	exclusive bool, threadIndex int) (release func()) {
+	if !preference.RemoteLock {
+		return func() {}
+	}
+	if preference.AppendOnly {
+		duplicacy.LOG_WARN("STORAGE_LOCK_SKIPPED", "No lease is taken on the storage %s in the append-only mode",
+			preference.StorageURL)
+		return func() {}
+	}
+	lock, err := manager.AcquireRemoteLock(command, exclusive, threadIndex)
+	if err != nil {
+		duplicacy.LOG_ERROR("STORAGE_LOCKED", "Failed to acquire a lease on the storage %s: %v",
+			preference.StorageURL, err)
+		return func() {}
+	}
+	return lock.Release
+}
+
 func loadRSAPrivateKey(keyFile string, passphrase string, preference *duplicacy.Preference, backupManager *duplicacy.BackupManager, resetPasswords bool) {
 	if keyFile == "" {
 		return
@@ -495,8 +591,20 @@ func configRepository(context *cli.Context, init bool) {
 			compressionLevel = duplicacy.ZSTD_COMPRESSION_LEVEL_DEFAULT
 		}
 
+		fileBoundarySize := 0
+		if context.String("file-boundary-size") != "" {
+			fileBoundarySize = duplicacy.AtoSize(context.String("file-boundary-size"))
+			if fileBoundarySize == 0 {
+				fmt.Fprintf(context.App.Writer, "Invalid file boundary size: %s.\n\n",
+					context.String("file-boundary-size"))
+				cli.ShowCommandHelp(context, context.Command.Name)
+				os.Exit(ArgumentExitCode)
+			}
+		}
+
 		duplicacy.ConfigStorage(storage, iterations, compressionLevel, averageChunkSize, maximumChunkSize,
-			minimumChunkSize, storagePassword, otherConfig, bitCopy, context.String("key"), dataShards, parityShards)
+			minimumChunkSize, storagePassword, otherConfig, bitCopy, context.String("key"), dataShards, parityShards,
+			fileBoundarySize)
 	}
 
 	duplicacy.Preferences = append(duplicacy.Preferences, preference)
@@ -607,6 +715,37 @@ func setPreference(context *cli.Context) {
 		newPreference.ExcludeByAttribute = triBool.IsTrue()
 	}
 
+	if context.IsSet("object-lock") {
+		newPreference.ObjectLockDays = context.Int("object-lock")
+		if newPreference.ObjectLockDays < 0 {
+			fmt.Fprintf(context.App.Writer, "Invalid number of days for object lock: %d\n", newPreference.ObjectLockDays)
+			os.Exit(ArgumentExitCode)
+		}
+	}
+
+	triBool = context.Generic("append-only").(*TriBool)
+	if triBool.IsSet() {
+		newPreference.AppendOnly = triBool.IsTrue()
+	}
+
+	triBool = context.Generic("remote-lock").(*TriBool)
+	if triBool.IsSet() {
+		newPreference.RemoteLock = triBool.IsTrue()
+	}
+
+	if newPreference.AppendOnly && newPreference.RemoteLock {
+		fmt.Fprintf(context.App.Writer, "Remote locks can't be used in the append-only mode, which can't remove leases\n")
+		os.Exit(ArgumentExitCode)
+	}
+
+	if mode := context.String("object-lock-mode"); mode != "" {
+		if mode != "governance" && mode != "compliance" {
+			fmt.Fprintf(context.App.Writer, "Invalid object lock mode: %s\n", mode)
+			os.Exit(ArgumentExitCode)
+		}
+		newPreference.ObjectLockMode = mode
+	}
+
 	key := context.String("key")
 	value := context.String("value")
 
@@ -756,6 +895,8 @@ func backupRepository(context *cli.Context) {
 		return
 	}
 
+	defer lockRepository(preference, "backup")()
+
 	runScript(context, preference.Name, "pre")
 
 	threads := context.Int("threads")
@@ -764,7 +905,7 @@ func backupRepository(context *cli.Context) {
 	}
 
 	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
-	storage := duplicacy.CreateStorage(*preference, false, threads)
+	storage := duplicacy.CreateStorage(*preference, false, getStorageThreads(preference, threads))
 	if storage == nil {
 		return
 	}
@@ -788,13 +929,23 @@ func backupRepository(context *cli.Context) {
 	uploadRateLimit := context.Int("limit-rate")
 	enumOnly := context.Bool("enum-only")
 	storage.SetRateLimits(0, uploadRateLimit)
-	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password,
-		duplicacy.NewBackupManagerOptions(preference))
+
+	options := duplicacy.NewBackupManagerOptions(preference)
+	options.ListingThreads = context.Int("list-threads")
+	if context.Bool("ctime") {
+		options.CompareChangeTime = true
+	}
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, options)
 	duplicacy.SavePassword(*preference, "password", password)
 
 	backupManager.SetupSnapshotCache(preference.Name)
 	backupManager.SetDryRun(dryRun)
 
+	if !dryRun && !enumOnly {
+		defer lockStorage(preference, backupManager.SnapshotManager, "backup", false, threads)()
+	}
+
 	zstdLevel := context.String("zstd-level")
 	if zstdLevel != "" {
 		if level, found := duplicacy.ZSTD_COMPRESSION_LEVELS[zstdLevel]; found {
@@ -808,11 +959,52 @@ func backupRepository(context *cli.Context) {
 
 	metadataChunkSize := context.Int("metadata-chunk-size")
 	maximumInMemoryEntries := context.Int("max-in-memory-entries")
-	backupManager.Backup(repository, quickMode, threads, context.String("t"), showStatistics, enableVSS, vssTimeout, enumOnly, metadataChunkSize, maximumInMemoryEntries)
+	_, err := backupManager.BackupContext(getInterruptibleContext(), repository, &duplicacy.BackupOptions{
+		QuickMode:              quickMode,
+		Threads:                threads,
+		Tag:                    context.String("t"),
+		ShowStatistics:         showStatistics,
+		ShadowCopy:             enableVSS,
+		ShadowCopyTimeout:      vssTimeout,
+		EnumOnly:               enumOnly,
+		MetadataChunkSize:      metadataChunkSize,
+		MaximumInMemoryEntries: maximumInMemoryEntries,
+	})
+	exitOnError(err)
 
 	runScript(context, preference.Name, "post")
 }
 
+func watchRepository(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	// Record changes for the specified storage, or every storage that this repository is backed up to
+	var cachePaths []string
+	preferencePath := duplicacy.GetDuplicacyPreferencePath()
+	for _, p := range duplicacy.Preferences {
+		if (context.String("storage") != "" && p.Name != preference.Name) || p.BackupProhibited {
+			continue
+		}
+		cachePaths = append(cachePaths, path.Join(preferencePath, "cache", p.Name))
+	}
+
+	if len(cachePaths) == 0 {
+		duplicacy.LOG_ERROR("WATCH_STORAGE", "Backup from this repository is disabled for all storages")
+		return
+	}
+
+	duplicacy.WatchRepository(repository, cachePaths)
+}
+
 func restoreRepository(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
@@ -887,7 +1079,7 @@ func restoreRepository(context *cli.Context) {
 	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
 
 	backupManager.SetupSnapshotCache(preference.Name)
-	failed := backupManager.Restore(repository, revision, &duplicacy.RestoreOptions{
+	_, err := backupManager.RestoreContext(getInterruptibleContext(), repository, revision, &duplicacy.RestoreOptions{
 		Threads:        threads,
 		Patterns:       patterns,
 		InPlace:        true,
@@ -897,10 +1089,7 @@ func restoreRepository(context *cli.Context) {
 		ShowStatistics: context.Bool("stats"),
 		AllowFailures:  context.Bool("persist"),
 	})
-	if failed > 0 {
-		duplicacy.LOG_ERROR("RESTORE_FAIL", "%d file(s) were not restored correctly", failed)
-		return
-	}
+	exitOnError(err)
 
 	runScript(context, preference.Name, "post")
 }
@@ -1014,12 +1203,408 @@ func checkSnapshots(context *cli.Context) {
 	rewrite := context.Bool("rewrite")
 	persist := context.Bool("persist")
 
+	var verifyBudget *duplicacy.VerifyBudget
+	if context.String("verify-budget") != "" {
+		var err error
+		verifyBudget, err = duplicacy.ParseVerifyBudget(context.String("verify-budget"))
+		if err != nil {
+			duplicacy.LOG_ERROR("CHECK_BUDGET", "Invalid verification budget: %v", err)
+			return
+		}
+	}
+
+	if preference.AppendOnly || context.Bool("append-only") {
+		if !duplicacy.VerifyAppendOnly(storage) {
+			duplicacy.LOG_WARN("APPEND_ONLY_FAILED", "Backup clients in the append-only mode should be given "+
+				"credentials that only allow listing, downloading and uploading files")
+		}
+	}
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SnapshotManager.SetRemoteChecksums(context.Bool("remote-checksums"))
+	backupManager.SnapshotManager.CheckSnapshots(id, revisions, tag, showStatistics, showTabular, checkFiles, checkChunks, searchFossils, resurrect, rewrite, threads, persist,
+		verifyBudget, context.Bool("ledger-in-storage"))
+
+	runScript(context, preference.Name, "post")
+}
+
+func repairSnapshots(context *cli.Context) {
+
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+
+	runScript(context, preference.Name, "pre")
+
+	threads := context.Int("threads")
+	if threads < 1 {
+		threads = 1
+	}
+
+	storage := duplicacy.CreateStorage(*preference, false, threads)
+	if storage == nil {
+		return
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	snapshotID := preference.SnapshotID
+	if context.String("id") != "" {
+		snapshotID = context.String("id")
+	}
+
+	// Files can only be re-sourced from the repository if it is the one the snapshot was created from
+	source := context.String("source")
+	if source == "" && snapshotID == preference.SnapshotID && !context.Bool("no-source") {
+		source = repository
+	}
+
+	tag := context.String("t")
+	if tag == "" {
+		tag = "repaired"
+	}
+
+	backupManager := duplicacy.CreateBackupManager(snapshotID, storage, repository, password, nil)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SetDryRun(context.Bool("dry-run"))
+
+	lostFiles, unrepairedRevisions := backupManager.RepairSnapshots(source, getRevisions(context), tag, threads)
+	if lostFiles == nil {
+		return
+	}
+
+	var revisions []int
+	for revision := range lostFiles {
+		revisions = append(revisions, revision)
+	}
+	sort.Ints(revisions)
+
+	if len(revisions) == 0 && len(unrepairedRevisions) == 0 {
+		duplicacy.LOG_INFO("REPAIR_NONE", "No revisions needed to be repaired")
+	}
+	for _, revision := range revisions {
+		duplicacy.LOG_INFO("REPAIR_SUMMARY", "Revision %d: %d files lost", revision, len(lostFiles[revision]))
+		for _, file := range lostFiles[revision] {
+			duplicacy.LOG_INFO("REPAIR_SUMMARY", "  %s", file)
+		}
+	}
+	for _, revision := range unrepairedRevisions {
+		duplicacy.LOG_WARN("REPAIR_SUMMARY", "Revision %d: can't be repaired", revision)
+	}
+	if len(unrepairedRevisions) > 0 {
+		duplicacy.LOG_ERROR("REPAIR_INCOMPLETE", "%d revisions couldn't be repaired and can only be deleted",
+			len(unrepairedRevisions))
+		return
+	}
+
+	runScript(context, preference.Name, "post")
+}
+
+func manageSecrets(context *cli.Context) {
+
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	operations := 0
+	for _, option := range []string{"add", "rotate", "remove"} {
+		if context.String(option) != "" {
+			operations++
+		}
+	}
+	for _, option := range []string{"list", "change-passphrase"} {
+		if context.Bool(option) {
+			operations++
+		}
+	}
+	if operations != 1 {
+		fmt.Fprintf(context.App.Writer, "Exactly one of -add, -rotate, -remove, -list and -change-passphrase must be specified.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	getRepositoryPreference(context, "")
+
+	// Reads a new passphrase from the key file if one is given, or from the terminal.  When creating the store the
+	// passphrase can also come from the sources used to unlock it.
+	getNewPassphrase := func(creating bool) string {
+		if keyFile := context.String("key-file"); keyFile != "" {
+			content, err := os.ReadFile(keyFile)
+			if err != nil {
+				duplicacy.LOG_ERROR("SECRETS_KEY_FILE", "Failed to read the key file %s: %v", keyFile, err)
+				return ""
+			}
+			return strings.TrimRight(string(content), "\r\n")
+		}
+		if creating {
+			if passphrase := duplicacy.GetSecretsPassphrase(""); passphrase != "" {
+				return passphrase
+			}
+		}
+		fmt.Printf("Enter a new passphrase for the secrets store:")
+		passphrase, err := gopass.GetPasswdMasked()
+		if err != nil {
+			duplicacy.LOG_ERROR("SECRETS_PASSPHRASE", "Failed to read the passphrase: %v", err)
+			return ""
+		}
+		fmt.Printf("Re-enter the new passphrase:")
+		repeated, err := gopass.GetPasswdMasked()
+		if err != nil {
+			duplicacy.LOG_ERROR("SECRETS_PASSPHRASE", "Failed to read the passphrase: %v", err)
+			return ""
+		}
+		if string(repeated) != string(passphrase) {
+			duplicacy.LOG_ERROR("SECRETS_PASSPHRASE", "The new passphrases do not match")
+			return ""
+		}
+		return string(passphrase)
+	}
+
+	var store *duplicacy.SecretStore
+	var err error
+	if duplicacy.SecretStoreExists() {
+		passphrase := duplicacy.GetSecretsPassphrase("Enter the passphrase of the secrets store:")
+		store, err = duplicacy.OpenSecretStore(passphrase)
+		if err != nil {
+			duplicacy.LOG_ERROR("SECRETS_OPEN", "Failed to open the secrets store: %v", err)
+			return
+		}
+	} else if context.String("add") != "" {
+		duplicacy.LOG_INFO("SECRETS_CREATE", "Creating a new secrets store")
+		store, err = duplicacy.OpenSecretStore(getNewPassphrase(true))
+		if err != nil {
+			duplicacy.LOG_ERROR("SECRETS_OPEN", "Failed to create the secrets store: %v", err)
+			return
+		}
+	} else {
+		duplicacy.LOG_ERROR("SECRETS_NONE", "The repository doesn't have a secrets store; use -add to create one")
+		return
+	}
+
+	// Reads the value of a secret from stdin or the terminal; values are never taken from the command line
+	getValue := func(name string) string {
+		var value string
+		if context.Bool("stdin") {
+			scanner := bufio.NewScanner(os.Stdin)
+			scanner.Scan()
+			value = scanner.Text()
+		} else {
+			fmt.Printf("Enter the value of %s:", name)
+			valueInBytes, err := gopass.GetPasswdMasked()
+			if err != nil {
+				duplicacy.LOG_ERROR("SECRETS_READ", "Failed to read the value: %v", err)
+				return ""
+			}
+			value = string(valueInBytes)
+		}
+		if value == "" {
+			duplicacy.LOG_ERROR("SECRETS_EMPTY", "The value of %s can't be empty", name)
+		}
+		return value
+	}
+
+	if name := context.String("add"); name != "" {
+		if _, found := store.Get(name); found {
+			duplicacy.LOG_ERROR("SECRETS_EXIST", "The secret %s already exists; use -rotate to change its value", name)
+			return
+		}
+		store.Set(name, getValue(name))
+	} else if name := context.String("rotate"); name != "" {
+		if _, found := store.Get(name); !found {
+			duplicacy.LOG_ERROR("SECRETS_MISSING", "The secret %s doesn't exist", name)
+			return
+		}
+		store.Set(name, getValue(name))
+	} else if name := context.String("remove"); name != "" {
+		if !store.Remove(name) {
+			duplicacy.LOG_ERROR("SECRETS_MISSING", "The secret %s doesn't exist", name)
+			return
+		}
+	} else if context.Bool("change-passphrase") {
+		store.SetPassphrase(getNewPassphrase(false))
+	} else {
+		for _, name := range store.List() {
+			modifiedAt := time.Unix(store.Secrets[name].ModifiedAt, 0).Format("2006-01-02 15:04:05")
+			duplicacy.LOG_INFO("SECRETS_LIST", "%s (modified %s)", name, modifiedAt)
+		}
+		return
+	}
+
+	err = store.Save()
+	if err != nil {
+		duplicacy.LOG_ERROR("SECRETS_SAVE", "Failed to save the secrets store: %v", err)
+		return
+	}
+
+	if name := context.String("add"); name != "" {
+		duplicacy.LOG_INFO("SECRETS_ADD", "The secret %s has been added", name)
+	} else if name := context.String("rotate"); name != "" {
+		duplicacy.LOG_INFO("SECRETS_ROTATE", "The secret %s has been changed", name)
+	} else if name := context.String("remove"); name != "" {
+		duplicacy.LOG_INFO("SECRETS_REMOVE", "The secret %s has been removed", name)
+	} else {
+		duplicacy.LOG_INFO("SECRETS_PASSPHRASE", "The passphrase of the secrets store has been changed")
+	}
+}
+
+func convertStorage(context *cli.Context) {
+
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	dataShards := 0
+	parityShards := 0
+	shards := context.String("erasure-coding")
+	if shards == "" {
+		fmt.Fprintf(context.App.Writer, "The -erasure-coding option is required.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	} else if shards != "none" {
+		shardsRegex := regexp.MustCompile(`^([0-9]+):([0-9]+)$`)
+		matched := shardsRegex.FindStringSubmatch(shards)
+		if matched == nil {
+			duplicacy.LOG_ERROR("STORAGE_ERASURECODE", "Invalid erasure coding parameters: %s", shards)
+			return
+		}
+		dataShards, _ = strconv.Atoi(matched[1])
+		parityShards, _ = strconv.Atoi(matched[2])
+		if dataShards == 0 || dataShards > 256 || parityShards == 0 || parityShards > dataShards {
+			duplicacy.LOG_ERROR("STORAGE_ERASURECODE", "Invalid erasure coding parameters: %s", shards)
+			return
+		}
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+
+	runScript(context, preference.Name, "pre")
+
+	threads := context.Int("threads")
+	if threads < 1 {
+		threads = 1
+	}
+
+	storage := duplicacy.CreateStorage(*preference, false, threads)
+	if storage == nil {
+		return
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, nil)
+	duplicacy.SavePassword(*preference, "password", password)
+
 	backupManager.SetupSnapshotCache(preference.Name)
-	backupManager.SnapshotManager.CheckSnapshots(id, revisions, tag, showStatistics, showTabular, checkFiles, checkChunks, searchFossils, resurrect, rewrite, threads, persist)
+	backupManager.SetDryRun(context.Bool("dry-run"))
+
+	iterations := context.Int("iterations")
+	if !backupManager.SnapshotManager.ConvertErasureCoding(dataShards, parityShards, password, iterations, threads) {
+		return
+	}
 
 	runScript(context, preference.Name, "post")
 }
 
+func runDaemon(context *cli.Context) {
+
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	jobFilePath := context.String("config")
+	if jobFilePath == "" {
+		fmt.Fprintf(context.App.Writer, "The -config option is required.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	jobFile, err := duplicacy.LoadJobFile(jobFilePath)
+	if err != nil {
+		duplicacy.LOG_ERROR("JOB_FILE", "%v", err)
+		return
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		duplicacy.LOG_ERROR("JOB_EXECUTABLE", "Failed to locate the executable: %v", err)
+		return
+	}
+
+	// Jobs can't prompt for passwords so they must only read them from the keyring or the credential sources
+	globalOptions := []string{"-background"}
+	if !ScriptEnabled {
+		globalOptions = append(globalOptions, "-no-script")
+	}
+	if format := context.GlobalString("log-format"); format != "" {
+		globalOptions = append(globalOptions, "-log-format", format)
+	}
+	if context.GlobalBool("log-journald") {
+		globalOptions = append(globalOptions, "-log-journald")
+	}
+
+	scheduler, err := duplicacy.CreateJobScheduler(jobFile, duplicacy.CreateJobProcessRunner(executable, globalOptions))
+	if err != nil {
+		duplicacy.LOG_ERROR("JOB_STATE", "%v", err)
+		return
+	}
+
+	if context.Bool("list") {
+		for _, job := range jobFile.GetJobs() {
+			duplicacy.LOG_INFO("JOB_LIST", "%s: %s %s, next run at %s", job.Name, job.Repository.Path,
+				strings.Join(job.GetArguments(), " "), scheduler.GetNextRun(job, time.Now()).Format("2006-01-02 15:04"))
+		}
+		return
+	}
+
+	// Stop starting new jobs on SIGINT or SIGTERM, and exit once the running ones have completed
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range signals {
+			duplicacy.LOG_INFO("DAEMON_STOP", "Stopping the daemon")
+			scheduler.Stop()
+		}
+	}()
+
+	duplicacy.LOG_INFO("DAEMON_START", "Running %d jobs from %s", len(jobFile.GetJobs()), jobFilePath)
+	scheduler.Run()
+}
+
 func printFile(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
@@ -1148,25 +1733,120 @@ func showHistory(context *cli.Context) {
 		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
 	}
 
-	snapshotID := preference.SnapshotID
-	if context.String("id") != "" {
-		snapshotID = context.String("id")
+	snapshotID := preference.SnapshotID
+	if context.String("id") != "" {
+		snapshotID = context.String("id")
+	}
+
+	path := context.Args()[0]
+
+	revisions := getRevisions(context)
+	showLocalHash := context.Bool("hash")
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, nil)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SnapshotManager.ShowHistory(repository, snapshotID, revisions, path, showLocalHash)
+
+	runScript(context, preference.Name, "post")
+}
+
+func pruneSnapshots(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	threads := context.Int("threads")
+	if threads < 1 {
+		threads = 1
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	runScript(context, preference.Name, "pre")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, getStorageThreads(preference, threads))
+	if storage == nil {
+		return
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	revisions := getRevisions(context)
+	tags := context.StringSlice("t")
+	retentions := context.StringSlice("keep")
+
+	// Calendar rules are passed as retention policies in the form of 'daily:14'
+	for _, bucket := range []string{"last", "hourly", "daily", "weekly", "monthly", "yearly"} {
+		if count := context.String("keep-" + bucket); count != "" {
+			retentions = append(retentions, bucket+":"+count)
+		}
+	}
+	if within := context.String("keep-within"); within != "" {
+		retentions = append(retentions, "within:"+within)
+	}
+	for _, tag := range context.StringSlice("keep-tag") {
+		retentions = append(retentions, "tag:"+tag)
+	}
+
+	var location *time.Location
+	if timezone := context.String("timezone"); timezone != "" {
+		var err error
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			fmt.Fprintf(context.App.Writer, "Invalid time zone %s: %v\n", timezone, err)
+			os.Exit(ArgumentExitCode)
+		}
+	}
+
+	selfID := preference.SnapshotID
+	snapshotID := preference.SnapshotID
+	if context.Bool("all") {
+		snapshotID = ""
+	} else if context.String("id") != "" {
+		snapshotID = context.String("id")
+	}
+
+	ignoredIDs := context.StringSlice("ignore")
+	exhaustive := context.Bool("exhaustive")
+	exclusive := context.Bool("exclusive")
+	dryRun := context.Bool("dry-run")
+	deleteOnly := context.Bool("delete-only")
+	collectOnly := context.Bool("collect-only")
+
+	if !storage.IsMoveFileImplemented() && !exclusive {
+		fmt.Fprintf(context.App.Writer, "The --exclusive option must be enabled for storage %s\n",
+			preference.StorageURL)
+		os.Exit(ArgumentExitCode)
 	}
 
-	path := context.Args()[0]
-
-	revisions := getRevisions(context)
-	showLocalHash := context.Bool("hash")
 	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, nil)
 	duplicacy.SavePassword(*preference, "password", password)
 
 	backupManager.SetupSnapshotCache(preference.Name)
-	backupManager.SnapshotManager.ShowHistory(repository, snapshotID, revisions, path, showLocalHash)
+
+	// An exclusive prune deletes chunks that a running backup may still reference
+	if exclusive && !dryRun {
+		defer lockRepository(preference, "prune")()
+		defer lockStorage(preference, backupManager.SnapshotManager, "prune", true, threads)()
+	}
+
+	backupManager.SnapshotManager.PruneSnapshots(selfID, snapshotID, revisions, tags, retentions, location,
+		exhaustive, exclusive, ignoredIDs, dryRun, deleteOnly, collectOnly, threads)
 
 	runScript(context, preference.Name, "post")
 }
 
-func pruneSnapshots(context *cli.Context) {
+func pinSnapshots(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
@@ -1176,9 +1856,11 @@ func pruneSnapshots(context *cli.Context) {
 		os.Exit(ArgumentExitCode)
 	}
 
-	threads := context.Int("threads")
-	if threads < 1 {
-		threads = 1
+	revisions := getRevisions(context)
+	if len(revisions) == 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires at least one revision.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
 	repository, preference := getRepositoryPreference(context, "")
@@ -1186,7 +1868,7 @@ func pruneSnapshots(context *cli.Context) {
 	runScript(context, preference.Name, "pre")
 
 	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
-	storage := duplicacy.CreateStorage(*preference, false, threads)
+	storage := duplicacy.CreateStorage(*preference, false, 1)
 	if storage == nil {
 		return
 	}
@@ -1196,36 +1878,20 @@ func pruneSnapshots(context *cli.Context) {
 		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
 	}
 
-	revisions := getRevisions(context)
-	tags := context.StringSlice("t")
-	retentions := context.StringSlice("keep")
-	selfID := preference.SnapshotID
 	snapshotID := preference.SnapshotID
-	if context.Bool("all") {
-		snapshotID = ""
-	} else if context.String("id") != "" {
+	if context.String("id") != "" {
 		snapshotID = context.String("id")
 	}
 
-	ignoredIDs := context.StringSlice("ignore")
-	exhaustive := context.Bool("exhaustive")
-	exclusive := context.Bool("exclusive")
-	dryRun := context.Bool("dry-run")
-	deleteOnly := context.Bool("delete-only")
-	collectOnly := context.Bool("collect-only")
-
-	if !storage.IsMoveFileImplemented() && !exclusive {
-		fmt.Fprintf(context.App.Writer, "The --exclusive option must be enabled for storage %s\n",
-			preference.StorageURL)
-		os.Exit(ArgumentExitCode)
-	}
-
 	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, nil)
 	duplicacy.SavePassword(*preference, "password", password)
 
 	backupManager.SetupSnapshotCache(preference.Name)
-	backupManager.SnapshotManager.PruneSnapshots(selfID, snapshotID, revisions, tags, retentions,
-		exhaustive, exclusive, ignoredIDs, dryRun, deleteOnly, collectOnly, threads)
+	if context.Command.Name == "pin" {
+		backupManager.SnapshotManager.PinSnapshot(snapshotID, revisions, context.String("reason"))
+	} else {
+		backupManager.SnapshotManager.UnpinSnapshot(snapshotID, revisions)
+	}
 
 	runScript(context, preference.Name, "post")
 }
@@ -1285,7 +1951,7 @@ func copySnapshots(context *cli.Context) {
 	}
 
 	duplicacy.LOG_INFO("STORAGE_SET", "Destination storage set to %s", destination.StorageURL)
-	destinationStorage := duplicacy.CreateStorage(*destination, false, uploadingThreads)
+	destinationStorage := duplicacy.CreateStorage(*destination, false, getStorageThreads(destination, uploadingThreads))
 	if destinationStorage == nil {
 		return
 	}
@@ -1310,6 +1976,8 @@ func copySnapshots(context *cli.Context) {
 		snapshotID = context.String("id")
 	}
 
+	defer lockStorage(destination, destinationManager.SnapshotManager, "copy", false, uploadingThreads)()
+
 	sourceManager.CopySnapshots(destinationManager, snapshotID, revisions, uploadingThreads, downloadingThreads)
 	runScript(context, source.Name, "post")
 }
@@ -1368,6 +2036,9 @@ func infoStorage(context *cli.Context) {
 		duplicacy.LOG_INFO("STORAGE_NOT_INITIALIZED", "The storage has not been initialized")
 	} else {
 		config.Print()
+		if context.Bool("append-only") {
+			duplicacy.VerifyAppendOnly(storage)
+		}
 	}
 
 	dirs, _, err := storage.ListFiles(0, "snapshots/")
@@ -1497,6 +2168,11 @@ func main() {
 					Usage:    "enable erasure coding to protect against storage corruption",
 					Argument: "<data shards>:<parity shards>",
 				},
+				cli.StringFlag{
+					Name:     "file-boundary-size",
+					Usage:    "start a new chunk for files of this size or larger, and pack smaller files by directory",
+					Argument: "<size>",
+				},
 			},
 			Usage:     "Initialize the storage if necessary and the current directory as the repository",
 			ArgsUsage: "<snapshot id> <storage url>",
@@ -1574,12 +2250,36 @@ func main() {
 					Usage:    "the maximum number of entries kept in memory (defaults to 1M)",
 					Argument: "<number>",
 				},
+				cli.IntFlag{
+					Name:     "list-threads",
+					Value:    1,
+					Usage:    "number of threads used to read directories when listing local files",
+					Argument: "<n>",
+				},
+				cli.BoolFlag{
+					Name:  "ctime",
+					Usage: "in quick mode, also back up files whose change time or inode number has changed",
+				},
 			},
 			Usage:     "Save a snapshot of the repository to the storage",
 			ArgsUsage: " ",
 			Action:    backupRepository,
 		},
 
+		{
+			Name: "watch",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "record changes only for backups to the specified storage",
+					Argument: "<storage name>",
+				},
+			},
+			Usage:     "Watch the repository for changes so that quick mode backups can skip unchanged directories (Linux only)",
+			ArgsUsage: " ",
+			Action:    watchRepository,
+		},
+
 		{
 			Name: "restore",
 			Flags: []cli.Flag{
@@ -1728,13 +2428,30 @@ func main() {
 					Name:  "rewrite",
 					Usage: "rewrite chunks with recoverable corruption",
 				},
+				cli.BoolFlag{
+					Name:  "append-only",
+					Usage: "verify that the storage credentials don't allow deleting or renaming files",
+				},
 				cli.BoolFlag{
 					Name:  "files",
-					Usage: "verify the integrity of every file",
+					Usage: "verify the integrity of every file not verified by an earlier check",
 				},
 				cli.BoolFlag{
 					Name:  "chunks",
-					Usage: "verify the integrity of every chunk",
+					Usage: "verify the integrity of every chunk not verified by an earlier check",
+				},
+				cli.StringFlag{
+					Name:     "verify-budget",
+					Usage:    "with -chunks or -files, also verify again previously verified chunks, least recently verified first, up to a size (e.g. 100GB), a duration (e.g. 2h) or a percentage (e.g. 5%)",
+					Argument: "<budget>",
+				},
+				cli.BoolFlag{
+					Name:  "remote-checksums",
+					Usage: "compare checksums reported by the storage (S3, B2, GCS, Azure) with those recorded at upload time",
+				},
+				cli.BoolFlag{
+					Name:  "ledger-in-storage",
+					Usage: "also keep the ledger of verified chunks in the storage so it is shared by all clients",
 				},
 				cli.BoolFlag{
 					Name:  "stats",
@@ -1774,6 +2491,143 @@ func main() {
 			ArgsUsage: " ",
 			Action:    checkSnapshots,
 		},
+		{
+			Name: "repair",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "repair revisions with the specified snapshot id instead of the default one",
+					Argument: "<snapshot id>",
+				},
+				cli.StringSliceFlag{
+					Name:     "r",
+					Usage:    "the revision number of the snapshot to repair (all revisions if not specified)",
+					Argument: "<revision>",
+				},
+				cli.StringFlag{
+					Name:     "source",
+					Usage:    "re-source files referencing missing chunks from the specified directory (default to the repository if the snapshot id is the default one)",
+					Argument: "<directory>",
+				},
+				cli.BoolFlag{
+					Name:  "no-source",
+					Usage: "do not re-source files from the repository; files referencing missing chunks are removed",
+				},
+				cli.StringFlag{
+					Name:     "t",
+					Usage:    "the tag of repaired revisions (default to 'repaired')",
+					Argument: "<tag>",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "report which files would be lost or re-sourced without modifying the storage",
+				},
+				cli.IntFlag{
+					Name:     "threads",
+					Value:    1,
+					Usage:    "number of uploading threads",
+					Argument: "<n>",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "repair snapshots in the specified storage",
+					Argument: "<storage name>",
+				},
+			},
+			Usage:     "Rewrite revisions that reference missing chunks, removing or re-sourcing the affected files",
+			ArgsUsage: " ",
+			Action:    repairSnapshots,
+		},
+		{
+			Name: "convert",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "erasure-coding",
+					Usage:    "convert chunks to erasure coding with the specified data and parity shards, or to no erasure coding with 'none'",
+					Argument: "<data shards>:<parity shards>",
+				},
+				cli.IntFlag{
+					Name:     "iterations",
+					Usage:    "the number of iterations used in storage key derivation for the new config (default is that of the current config)",
+					Argument: "<i>",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "report which chunks would be converted without modifying the storage",
+				},
+				cli.IntFlag{
+					Name:     "threads",
+					Value:    1,
+					Usage:    "number of threads used to convert chunks",
+					Argument: "<n>",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "convert the specified storage",
+					Argument: "<storage name>",
+				},
+			},
+			Usage:     "Rewrite all chunks in the storage in place with a different erasure coding setting",
+			ArgsUsage: " ",
+			Action:    convertStorage,
+		},
+		{
+			Name: "daemon",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "config",
+					Usage:    "the TOML file describing the repositories and the jobs to run on them",
+					Argument: "<job file>",
+				},
+				cli.BoolFlag{
+					Name:  "list",
+					Usage: "list the jobs and when they will run next, then exit",
+				},
+			},
+			Usage:     "Run backup, prune, check and copy jobs on multiple repositories on a schedule",
+			ArgsUsage: " ",
+			Action:    runDaemon,
+		},
+		{
+			Name: "secrets",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "add",
+					Usage:    "add a secret named like a preference key, e.g. 'password' or '<storage>_s3_secret'",
+					Argument: "<name>",
+				},
+				cli.StringFlag{
+					Name:     "rotate",
+					Usage:    "change the value of an existing secret",
+					Argument: "<name>",
+				},
+				cli.StringFlag{
+					Name:     "remove",
+					Usage:    "remove a secret",
+					Argument: "<name>",
+				},
+				cli.BoolFlag{
+					Name:  "list",
+					Usage: "list the names of stored secrets without their values",
+				},
+				cli.BoolFlag{
+					Name:  "change-passphrase",
+					Usage: "encrypt the secrets store with a new passphrase or key file",
+				},
+				cli.StringFlag{
+					Name:     "key-file",
+					Usage:    "use the content of the file as the new passphrase when creating the store or changing the passphrase",
+					Argument: "<file>",
+				},
+				cli.BoolFlag{
+					Name:  "stdin",
+					Usage: "read the value of the secret from the standard input instead of the terminal",
+				},
+			},
+			Usage:     "Manage the encrypted secrets store that keeps passwords and tokens out of the preferences file",
+			ArgsUsage: " ",
+			Action:    manageSecrets,
+		},
 		{
 			Name: "cat",
 			Flags: []cli.Flag{
@@ -1898,9 +2752,54 @@ func main() {
 				},
 				cli.StringSliceFlag{
 					Name:     "keep",
-					Usage:    "keep 1 snapshot every n days for snapshots older than m days",
+					Usage:    "keep 1 snapshot every n days for snapshots older than m days, or a calendar rule such as daily:14",
 					Argument: "<n:m>",
 				},
+				cli.StringFlag{
+					Name:     "keep-last",
+					Usage:    "keep the last n snapshots",
+					Argument: "<n|all>",
+				},
+				cli.StringFlag{
+					Name:     "keep-hourly",
+					Usage:    "keep the last snapshot of each of the last n hours",
+					Argument: "<n|all>",
+				},
+				cli.StringFlag{
+					Name:     "keep-daily",
+					Usage:    "keep the last snapshot of each of the last n days",
+					Argument: "<n|all>",
+				},
+				cli.StringFlag{
+					Name:     "keep-weekly",
+					Usage:    "keep the last snapshot of each of the last n weeks (ending on Sundays)",
+					Argument: "<n|all>",
+				},
+				cli.StringFlag{
+					Name:     "keep-monthly",
+					Usage:    "keep the last snapshot of each of the last n months",
+					Argument: "<n|all>",
+				},
+				cli.StringFlag{
+					Name:     "keep-yearly",
+					Usage:    "keep the last snapshot of each of the last n years",
+					Argument: "<n|all>",
+				},
+				cli.StringFlag{
+					Name:     "keep-within",
+					Usage:    "keep all snapshots created within the specified period, such as 1y6m, 2w, or 3d12h",
+					Argument: "<duration>",
+				},
+				cli.StringSliceFlag{
+					Name:     "keep-tag",
+					Usage:    "keep all snapshots with the specified tag",
+					Argument: "<tag>",
+				},
+				cli.StringFlag{
+					Name:     "timezone",
+					Usage:    "the time zone that determines the boundaries of hours, days, weeks, months, and years",
+					Argument: "<zone>",
+				},
 				cli.BoolFlag{
 					Name:  "exhaustive",
 					Usage: "remove all unreferenced chunks (not just those referenced by deleted snapshots)",
@@ -1934,7 +2833,7 @@ func main() {
 				cli.IntFlag{
 					Name:     "threads",
 					Value:    1,
-					Usage:    "number of threads used to prune unreferenced chunks",
+					Usage:    "number of threads used to load snapshots and prune unreferenced chunks",
 					Argument: "<n>",
 				},
 			},
@@ -1943,6 +2842,59 @@ func main() {
 			Action:    pruneSnapshots,
 		},
 
+		{
+			Name: "pin",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "pin revisions with the specified snapshot id instead of the default one",
+					Argument: "<snapshot id>",
+				},
+				cli.StringSliceFlag{
+					Name:     "r",
+					Usage:    "the revision number of the snapshot to pin",
+					Argument: "<revision>",
+				},
+				cli.StringFlag{
+					Name:     "reason",
+					Usage:    "the reason for the hold, to be shown by the list command",
+					Argument: "<reason>",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "pin revisions in the specified storage",
+					Argument: "<storage name>",
+				},
+			},
+			Usage:     "Place a hold on revisions so that they will never be deleted by prune",
+			ArgsUsage: " ",
+			Action:    pinSnapshots,
+		},
+
+		{
+			Name: "unpin",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "unpin revisions with the specified snapshot id instead of the default one",
+					Argument: "<snapshot id>",
+				},
+				cli.StringSliceFlag{
+					Name:     "r",
+					Usage:    "the revision number of the snapshot to unpin",
+					Argument: "<revision>",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "unpin revisions in the specified storage",
+					Argument: "<storage name>",
+				},
+			},
+			Usage:     "Remove the hold on revisions placed by the pin command",
+			ArgsUsage: " ",
+			Action:    pinSnapshots,
+		},
+
 		{
 			Name: "password",
 			Flags: []cli.Flag{
@@ -2023,6 +2975,11 @@ func main() {
 					Usage:    "enable erasure coding to protect against storage corruption",
 					Argument: "<data shards>:<parity shards>",
 				},
+				cli.StringFlag{
+					Name:     "file-boundary-size",
+					Usage:    "start a new chunk for files of this size or larger, and pack smaller files by directory",
+					Argument: "<size>",
+				},
 			},
 			Usage:     "Add an additional storage to be used for the existing repository",
 			ArgsUsage: "<storage name> <snapshot id> <storage url>",
@@ -2086,6 +3043,28 @@ func main() {
 					Usage:    "specify the path of the filters file containing include/exclude patterns",
 					Argument: "<file path>",
 				},
+				cli.IntFlag{
+					Name:     "object-lock",
+					Usage:    "lock uploaded chunks and snapshot files for the specified number of days (0 to disable)",
+					Argument: "<days>",
+				},
+				cli.StringFlag{
+					Name:     "object-lock-mode",
+					Usage:    "the S3 Object Lock mode, either governance (default) or compliance",
+					Argument: "<mode>",
+				},
+				cli.GenericFlag{
+					Name:  "append-only",
+					Usage: "never delete or rename files in the storage; prune must be run from a trusted host",
+					Value: &TriBool{},
+					Arg:   "true",
+				},
+				cli.GenericFlag{
+					Name:  "remote-lock",
+					Usage: "take a lease in the storage during backups and exclusive prunes so they can't overlap",
+					Value: &TriBool{},
+					Arg:   "true",
+				},
 			},
 			Usage:     "Change the options for the default or specified storage",
 			ArgsUsage: " ",
@@ -2175,6 +3154,10 @@ func main() {
 					Name:  "reset-passwords",
 					Usage: "take passwords from input rather than keychain/keyring",
 				},
+				cli.BoolFlag{
+					Name:  "append-only",
+					Usage: "verify that the storage credentials don't allow deleting or renaming files",
+				},
 			},
 			Usage:     "Show the information about the specified storage",
 			ArgsUsage: "<storage url>",
@@ -2267,6 +3250,32 @@ func main() {
 			Name:  "log",
 			Usage: "enable log-style output",
 		},
+		cli.StringFlag{
+			Name:     "log-format",
+			Usage:    "print logs as 'text' (the default) or as one 'json' object per line",
+			Argument: "<format>",
+		},
+		cli.StringFlag{
+			Name:     "log-file",
+			Usage:    "write logs to the specified file instead of the standard output",
+			Argument: "<file>",
+		},
+		cli.IntFlag{
+			Name:     "log-file-max-size",
+			Value:    10,
+			Usage:    "rotate the log file when it grows larger than the specified size in MB (0 to never rotate)",
+			Argument: "<size>",
+		},
+		cli.IntFlag{
+			Name:     "log-file-keep",
+			Value:    5,
+			Usage:    "the number of rotated log files to keep",
+			Argument: "<n>",
+		},
+		cli.BoolFlag{
+			Name:  "log-journald",
+			Usage: "send logs to journald with the log id and other fields",
+		},
 		cli.BoolFlag{
 			Name:  "stack",
 			Usage: "print the stack trace when an error occurs",
@@ -2314,19 +3323,14 @@ func main() {
 		os.Exit(2)
 	}
 
-	// If the program is interrupted, call the RunAtError function.
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for range c {
-			duplicacy.RunAtError()
-			os.Exit(1)
-		}
-	}()
+	// If the program is interrupted, stop a backup or a restore cleanly, or call the RunAtError function and exit.
+	handleInterrupts()
 
 	err := app.Run(os.Args)
 	if err != nil {
 		os.Exit(2)
 	}
 
+	duplicacy.FinishRunReport(0)
+
 }
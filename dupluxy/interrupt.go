@@ -0,0 +1,77 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	duplicacy "github.com/dupluxy/dupluxy/src"
+)
+
+// The function that stops the running command cleanly on SIGINT or SIGTERM; nil if the command has to be stopped by
+// exiting right away.
+var cancelCommand context.CancelFunc
+var cancelCommandLock sync.Mutex
+
+// handleInterrupts stops the running command on SIGINT or SIGTERM.  A backup or a restore is canceled so that it can
+// save its progress and clean up before exiting; any other command, or a second signal, exits immediately after
+// calling RunAtError.  Either way the exit code is InterruptedExitCode.
+func handleInterrupts() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range signals {
+			cancelCommandLock.Lock()
+			cancel := cancelCommand
+			cancelCommand = nil
+			cancelCommandLock.Unlock()
+
+			if cancel != nil {
+				duplicacy.LOG_WARN("COMMAND_INTERRUPTED", "Interrupted; stopping after the chunks being transferred "+
+					"(interrupt again to exit immediately)")
+				cancel()
+				continue
+			}
+
+			duplicacy.RunAtError()
+			duplicacy.ReleaseLocks()
+			duplicacy.FinishRunReport(duplicacy.InterruptedExitCode)
+			os.Exit(duplicacy.InterruptedExitCode)
+		}
+	}()
+}
+
+// getInterruptibleContext returns the context for a command that can be stopped cleanly by handleInterrupts.
+func getInterruptibleContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelCommandLock.Lock()
+	cancelCommand = cancel
+	cancelCommandLock.Unlock()
+	return ctx
+}
+
+// exitOnError exits with the exit code for 'err' returned by one of the context-aware methods, after finishing the run
+// report.  An exception has already been logged when it was raised.
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+
+	exitCode := duplicacy.GetExitCode(err)
+	if exitCode == duplicacy.InterruptedExitCode {
+		duplicacy.LOG_WARN("COMMAND_INTERRUPTED", "The command has been interrupted")
+	} else if exitCode != 100 {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	duplicacy.ReleaseLocks()
+	duplicacy.FinishRunReport(exitCode)
+	os.Exit(exitCode)
+}
@@ -0,0 +1,379 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Error makes Exception usable as an error.  The methods of the API below return the exception raised by LOG_ERROR,
+// LOG_FATAL or LOG_ASSERT as an error instead of exiting the process.
+func (e Exception) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the cause of the exception, which is the error of the context when the operation was canceled, so
+// that errors.Is(err, context.Canceled) can be used.
+func (e Exception) Unwrap() error {
+	return e.Err
+}
+
+// Progress describes how far an operation has got.  It is passed to the ProgressFunction of the operation every time a
+// chunk has been uploaded, downloaded, copied or verified, and periodically during a prune.
+type Progress struct {
+	Operation     string  // backup, restore, copy, check or prune
+	Phase         string  // What the operation is doing, e.g. 'Uploading chunks'
+	Done          int64   // The number of bytes or items done
+	Total         int64   // The number of bytes or items to be done; 0 if unknown
+	Speed         int64   // Bytes per second, if known
+	RemainingTime int64   // The estimated remaining time in seconds; -1 if unknown
+	Percentage    float64 // Done out of Total in percent
+}
+
+type ProgressFunction func(progress Progress)
+
+// BackupOptions contains the arguments of BackupManager.Backup.
+type BackupOptions struct {
+	QuickMode              bool
+	Threads                int
+	Tag                    string
+	ShowStatistics         bool
+	ShadowCopy             bool
+	ShadowCopyTimeout      int
+	EnumOnly               bool
+	MetadataChunkSize      int
+	MaximumInMemoryEntries int
+	Progress               ProgressFunction
+}
+
+// CopyOptions contains the arguments of BackupManager.CopySnapshots.
+type CopyOptions struct {
+	Revisions          []int
+	UploadingThreads   int
+	DownloadingThreads int
+	Progress           ProgressFunction
+}
+
+// CheckOptions contains the arguments of SnapshotManager.CheckSnapshots.
+type CheckOptions struct {
+	Revisions       []int
+	Tag             string
+	ShowStatistics  bool
+	ShowTabular     bool
+	CheckFiles      bool
+	CheckChunks     bool
+	SearchFossils   bool
+	Resurrect       bool
+	RewriteChunks   bool
+	Threads         int
+	AllowFailures   bool
+	VerifyBudget    *VerifyBudget
+	LedgerInStorage bool
+	Progress        ProgressFunction
+}
+
+// PruneOptions contains the arguments of SnapshotManager.PruneSnapshots.
+type PruneOptions struct {
+	Revisions   []int
+	Tags        []string
+	Retentions  []string
+	Location    *time.Location
+	Exhaustive  bool
+	Exclusive   bool
+	IgnoredIDs  []string
+	DryRun      bool
+	DeleteOnly  bool
+	CollectOnly bool
+	Threads     int
+	Progress    ProgressFunction
+}
+
+// apiOperation is the operation started by one of the methods below.  The goroutines working for it check its context
+// to stop early, and record the first failure in it instead of exiting the process.
+type apiOperation struct {
+	command  string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	progress ProgressFunction
+
+	lock sync.Mutex
+	err  error
+}
+
+// Operations are serialized because they share package level state such as RunAtError and the run report.
+var operationLock sync.Mutex
+
+var currentOperation *apiOperation
+var currentOperationLock sync.RWMutex
+
+func getCurrentOperation() *apiOperation {
+	currentOperationLock.RLock()
+	defer currentOperationLock.RUnlock()
+	return currentOperation
+}
+
+func setCurrentOperation(operation *apiOperation) {
+	currentOperationLock.Lock()
+	defer currentOperationLock.Unlock()
+	currentOperation = operation
+}
+
+// fail records the value recovered from a panic as the error of the operation if it is the first one, and cancels the
+// operation so that all other goroutines stop.
+func (operation *apiOperation) fail(r interface{}) {
+	var err error
+	switch e := r.(type) {
+	case Exception:
+		err = e
+	case error:
+		err = fmt.Errorf("unexpected error: %w\n%s", e, debug.Stack())
+	default:
+		err = fmt.Errorf("unexpected error: %v\n%s", e, debug.Stack())
+	}
+
+	operation.lock.Lock()
+	if operation.err == nil {
+		operation.err = err
+	}
+	operation.lock.Unlock()
+	operation.cancel()
+}
+
+func (operation *apiOperation) getError() error {
+	operation.lock.Lock()
+	defer operation.lock.Unlock()
+	return operation.err
+}
+
+// catchOperationException is called by CatchLogException.  It returns true if the panic has been recorded by the
+// running operation, in which case the process must not exit.  A goroutine that notices the cancellation after the
+// operation has returned just stops.
+func catchOperationException(r interface{}) bool {
+	if e, ok := r.(Exception); ok && e.LogID == "OPERATION_CANCELED" {
+		return true
+	}
+	operation := getCurrentOperation()
+	if operation == nil {
+		return false
+	}
+	operation.fail(r)
+	return true
+}
+
+// raiseCanceled raises the exception that stops a goroutine working for the canceled operation.
+func (operation *apiOperation) raiseCanceled() {
+	LOG_DEBUG("OPERATION_CANCELED", "The %s operation has been canceled", operation.command)
+	panic(Exception{
+		Level:   ERROR,
+		LogID:   "OPERATION_CANCELED",
+		Message: fmt.Sprintf("The %s operation has been canceled", operation.command),
+		Err:     operation.ctx.Err(),
+	})
+}
+
+// checkCanceled raises an exception if the running operation has been canceled, either by its caller or because one of
+// its goroutines has failed.  It does nothing if no operation has been started through the API.
+func checkCanceled() {
+	operation := getCurrentOperation()
+	if operation != nil && operation.ctx.Err() != nil {
+		operation.raiseCanceled()
+	}
+}
+
+// isOperationCanceled returns true if the running operation has been canceled.
+func isOperationCanceled() bool {
+	operation := getCurrentOperation()
+	return operation != nil && operation.ctx.Err() != nil
+}
+
+// operationDone returns a channel that is closed when the running operation is canceled.  Without a running operation
+// it returns nil, which blocks forever in a select.
+func operationDone() <-chan struct{} {
+	operation := getCurrentOperation()
+	if operation == nil {
+		return nil
+	}
+	return operation.ctx.Done()
+}
+
+// sendEntry sends 'entry' to 'channel', unless the running operation is canceled while waiting for the receiver.
+func sendEntry(channel chan *Entry, entry *Entry) {
+	operation := getCurrentOperation()
+	if operation == nil {
+		channel <- entry
+		return
+	}
+	select {
+	case channel <- entry:
+	case <-operation.ctx.Done():
+		operation.raiseCanceled()
+	}
+}
+
+// receiveEntry receives an entry from 'channel', unless the running operation is canceled while waiting for the
+// sender.
+func receiveEntry(channel chan *Entry) (entry *Entry, ok bool) {
+	operation := getCurrentOperation()
+	if operation == nil {
+		entry, ok = <-channel
+		return entry, ok
+	}
+	select {
+	case entry, ok = <-channel:
+		return entry, ok
+	case <-operation.ctx.Done():
+		operation.raiseCanceled()
+		return nil, false
+	}
+}
+
+// reportProgress passes 'progress' to the ProgressFunction of the running operation, if there is one.
+func reportProgress(phase string, done int64, total int64, speed int64, remainingTime int64) {
+	operation := getCurrentOperation()
+	if operation == nil || operation.progress == nil {
+		return
+	}
+
+	progress := Progress{
+		Operation:     operation.command,
+		Phase:         phase,
+		Done:          done,
+		Total:         total,
+		Speed:         speed,
+		RemainingTime: remainingTime,
+	}
+	if total > 0 {
+		progress.Percentage = float64(done) / float64(total) * 100.0
+	}
+	operation.progress(progress)
+}
+
+// runOperation runs 'run' as the operation 'command'.  Any exception raised by it or by the goroutines it starts is
+// returned as an error, after RunAtError has been called.  The report returned has the warnings and errors logged and,
+// for a backup or a check, its statistics.
+func runOperation(ctx context.Context, command string, snapshotID string, progress ProgressFunction,
+	run func() bool) (report *RunReport, err error) {
+
+	operationLock.Lock()
+	defer operationLock.Unlock()
+
+	operationContext, cancel := context.WithCancel(ctx)
+	operation := &apiOperation{
+		command:  command,
+		ctx:      operationContext,
+		cancel:   cancel,
+		progress: progress,
+	}
+
+	// A command that collects its own report gets the warnings and statistics of the operation added to it
+	runReportLock.Lock()
+	ownReport := runReport == nil
+	runReportLock.Unlock()
+	if ownReport {
+		StartRunReport(command)
+		runReportLock.Lock()
+		runReport.SnapshotID = snapshotID
+		runReportLock.Unlock()
+	}
+
+	setCurrentOperation(operation)
+
+	defer func() {
+		if r := recover(); r != nil {
+			operation.fail(r)
+		}
+		cancel()
+
+		err = operation.getError()
+		exitCode := 0
+		if err != nil {
+			exitCode = duplicacyExitCode
+			func() {
+				defer func() {
+					recover()
+				}()
+				RunAtError()
+			}()
+		}
+		RunAtError = func() {}
+		setCurrentOperation(nil)
+
+		report = GetRunReport(exitCode)
+		if ownReport {
+			runReportLock.Lock()
+			runReport = nil
+			runReportLock.Unlock()
+		}
+	}()
+
+	checkCanceled()
+	if !run() && operation.getError() == nil {
+		operation.fail(Exception{
+			Level:   ERROR,
+			LogID:   "OPERATION_FAILED",
+			Message: fmt.Sprintf("The %s operation failed", command),
+		})
+	}
+	return
+}
+
+// BackupContext is the same as Backup but returns errors instead of exiting the process, and stops as soon as 'ctx'
+// is canceled.  An incomplete backup is saved to be resumed by the next backup, like an interrupted one.
+func (manager *BackupManager) BackupContext(ctx context.Context, top string, options *BackupOptions) (*RunReport, error) {
+	return runOperation(ctx, "backup", manager.snapshotID, options.Progress, func() bool {
+		return manager.Backup(top, options.QuickMode, options.Threads, options.Tag, options.ShowStatistics,
+			options.ShadowCopy, options.ShadowCopyTimeout, options.EnumOnly, options.MetadataChunkSize,
+			options.MaximumInMemoryEntries)
+	})
+}
+
+// RestoreContext is the same as Restore but returns errors instead of exiting the process, and stops as soon as 'ctx'
+// is canceled.  Files that can't be restored with options.AllowFailures set make it return an error too.
+func (manager *BackupManager) RestoreContext(ctx context.Context, top string, revision int,
+	options *RestoreOptions) (*RunReport, error) {
+	return runOperation(ctx, "restore", manager.snapshotID, options.Progress, func() bool {
+		failed := manager.Restore(top, revision, options)
+		if failed > 0 {
+			LOG_ERROR("RESTORE_FAIL", "%d file(s) were not restored correctly", failed)
+		}
+		return true
+	})
+}
+
+// CopySnapshotsContext is the same as CopySnapshots but returns errors instead of exiting the process, and stops as
+// soon as 'ctx' is canceled.
+func (manager *BackupManager) CopySnapshotsContext(ctx context.Context, otherManager *BackupManager, snapshotID string,
+	options *CopyOptions) (*RunReport, error) {
+	return runOperation(ctx, "copy", snapshotID, options.Progress, func() bool {
+		return manager.CopySnapshots(otherManager, snapshotID, options.Revisions, options.UploadingThreads,
+			options.DownloadingThreads)
+	})
+}
+
+// CheckSnapshotsContext is the same as CheckSnapshots but returns errors instead of exiting the process, and stops as
+// soon as 'ctx' is canceled.
+func (manager *SnapshotManager) CheckSnapshotsContext(ctx context.Context, snapshotID string,
+	options *CheckOptions) (*RunReport, error) {
+	return runOperation(ctx, "check", snapshotID, options.Progress, func() bool {
+		return manager.CheckSnapshots(snapshotID, options.Revisions, options.Tag, options.ShowStatistics,
+			options.ShowTabular, options.CheckFiles, options.CheckChunks, options.SearchFossils, options.Resurrect,
+			options.RewriteChunks, options.Threads, options.AllowFailures, options.VerifyBudget, options.LedgerInStorage)
+	})
+}
+
+// PruneSnapshotsContext is the same as PruneSnapshots but returns errors instead of exiting the process, and stops as
+// soon as 'ctx' is canceled.  A prune stopped in the middle can be resumed from its checkpoint by the next prune.
+func (manager *SnapshotManager) PruneSnapshotsContext(ctx context.Context, selfID string, snapshotID string,
+	options *PruneOptions) (*RunReport, error) {
+	return runOperation(ctx, "prune", snapshotID, options.Progress, func() bool {
+		return manager.PruneSnapshots(selfID, snapshotID, options.Revisions, options.Tags, options.Retentions, options.Location,
+			options.Exhaustive, options.Exclusive, options.IgnoredIDs, options.DryRun, options.DeleteOnly,
+			options.CollectOnly, options.Threads)
+	})
+}
@@ -0,0 +1,219 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOperationContext(t *testing.T) {
+
+	SetLoggingLevel(INFO)
+
+	// Errors are expected, so logs go to a buffer instead of failing the test
+	var logs bytes.Buffer
+	testingT = nil
+	logOutput = &logs
+	defer func() {
+		logOutput = nil
+		if t.Failed() {
+			t.Log(logs.String())
+		}
+	}()
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "api")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir+"/repository/.duplicacy", 0700)
+	os.MkdirAll(testDir+"/restore/.duplicacy", 0700)
+	defer os.RemoveAll(testDir)
+
+	for _, file := range []string{"file1", "file2", "file3"} {
+		createRandomFile(testDir+"/repository/"+file, 1000000)
+	}
+
+	storage, err := CreateFileStorage(testDir+"/storage", false, 1)
+	if err != nil {
+		t.Fatalf("Failed to create the storage: %v", err)
+	}
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository/.duplicacy")
+	backupManager := CreateBackupManager("host1", storage, testDir, "", nil)
+	backupManager.SetupSnapshotCache("default")
+
+	var progressCalls int64
+	backupOptions := &BackupOptions{
+		QuickMode:              true,
+		Threads:                2,
+		MetadataChunkSize:      1024,
+		MaximumInMemoryEntries: 1024,
+		Progress: func(progress Progress) {
+			if progress.Operation != "backup" || progress.Total == 0 {
+				t.Errorf("Unexpected progress %+v", progress)
+			}
+			atomic.AddInt64(&progressCalls, 1)
+		},
+	}
+
+	report, err := backupManager.BackupContext(context.Background(), testDir+"/repository", backupOptions)
+	if err != nil {
+		t.Fatalf("The backup failed: %v", err)
+	}
+	if report.Revision != 1 || report.Backup == nil || report.Backup.Files != 3 || report.ExitCode != 0 {
+		t.Errorf("The backup report is %+v", report)
+	}
+	if atomic.LoadInt64(&progressCalls) == 0 {
+		t.Errorf("The progress of the backup was not reported")
+	}
+
+	// Cancel the next backup once the first chunk has been uploaded
+	for _, file := range []string{"file1", "file2", "file3"} {
+		modifyFile(testDir+"/repository/"+file, 0.5)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	backupOptions.Progress = func(progress Progress) {
+		cancel()
+	}
+	_, err = backupManager.BackupContext(ctx, testDir+"/repository", backupOptions)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("The canceled backup returned %v", err)
+	}
+	if _, err := os.Stat(testDir + "/storage/snapshots/host1/2"); err == nil {
+		t.Errorf("The canceled backup created a revision")
+	}
+
+	// A failure is returned as an exception
+	SetDuplicacyPreferencePath(testDir + "/restore/.duplicacy")
+	_, err = backupManager.RestoreContext(context.Background(), testDir+"/restore", 5, &RestoreOptions{Threads: 1})
+	var exception Exception
+	if !errors.As(err, &exception) || exception.Level != ERROR || exception.LogID == "" {
+		t.Errorf("The restore of a missing revision returned %v", err)
+	}
+
+	_, err = backupManager.RestoreContext(ctx, testDir+"/restore", 1, &RestoreOptions{Threads: 1})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("The restore with a canceled context returned %v", err)
+	}
+
+	// Operations still work after a cancellation
+	SetDuplicacyPreferencePath(testDir + "/repository/.duplicacy")
+	backupOptions.Progress = nil
+	report, err = backupManager.BackupContext(context.Background(), testDir+"/repository", backupOptions)
+	if err != nil || report.Revision != 2 {
+		t.Fatalf("The backup after the cancellation returned %v", err)
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/restore/.duplicacy")
+	_, err = backupManager.RestoreContext(context.Background(), testDir+"/restore", 2, &RestoreOptions{
+		Threads:   2,
+		Overwrite: true,
+	})
+	if err != nil {
+		t.Fatalf("The restore failed: %v", err)
+	}
+	for _, file := range []string{"file1", "file2", "file3"} {
+		if getFileHash(testDir+"/repository/"+file) != getFileHash(testDir+"/restore/"+file) {
+			t.Errorf("File %s was not restored correctly", file)
+		}
+	}
+
+	report, err = backupManager.SnapshotManager.CheckSnapshotsContext(context.Background(), "host1",
+		&CheckOptions{Threads: 1})
+	if err != nil || report.Check == nil || report.Check.Revisions != 2 {
+		t.Errorf("The check returned %v with the report %+v", err, report)
+	}
+}
+
+func TestOperationInterrupted(t *testing.T) {
+
+	SetLoggingLevel(INFO)
+
+	var logs bytes.Buffer
+	testingT = nil
+	logOutput = &logs
+	defer func() {
+		logOutput = nil
+		if t.Failed() {
+			t.Log(logs.String())
+		}
+	}()
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "interrupted")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir+"/repository/.duplicacy", 0700)
+	os.MkdirAll(testDir+"/restore/.duplicacy", 0700)
+	defer os.RemoveAll(testDir)
+
+	files := []string{"file1", "file2", "file3"}
+	for _, file := range files {
+		createRandomFile(testDir+"/repository/"+file, 1000000)
+	}
+
+	storage, err := CreateFileStorage(testDir+"/storage", false, 1)
+	if err != nil {
+		t.Fatalf("Failed to create the storage: %v", err)
+	}
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository/.duplicacy")
+	backupManager := CreateBackupManager("host1", storage, testDir, "", nil)
+	backupManager.SetupSnapshotCache("default")
+
+	// An interrupted hash mode backup leaves an incomplete snapshot to be resumed
+	ctx, cancel := context.WithCancel(context.Background())
+	backupOptions := &BackupOptions{
+		Threads:                2,
+		MetadataChunkSize:      1024,
+		MaximumInMemoryEntries: 1024,
+		Progress: func(progress Progress) {
+			cancel()
+		},
+	}
+	_, err = backupManager.BackupContext(ctx, testDir+"/repository", backupOptions)
+	if GetExitCode(err) != InterruptedExitCode {
+		t.Errorf("The interrupted backup returned %v", err)
+	}
+	if _, err := os.Stat(path.Join(backupManager.cachePath, "incomplete_snapshot")); err != nil {
+		t.Errorf("The incomplete snapshot was not saved: %v", err)
+	}
+
+	backupOptions.Progress = nil
+	report, err := backupManager.BackupContext(context.Background(), testDir+"/repository", backupOptions)
+	if err != nil || report.Revision != 1 {
+		t.Fatalf("The resumed backup returned %v", err)
+	}
+
+	// An interrupted restore doesn't leave partially restored files behind
+	SetDuplicacyPreferencePath(testDir + "/restore/.duplicacy")
+	ctx, cancel = context.WithCancel(context.Background())
+	_, err = backupManager.RestoreContext(ctx, testDir+"/restore", 1, &RestoreOptions{
+		Threads: 1,
+		InPlace: true,
+		Progress: func(progress Progress) {
+			cancel()
+		},
+	})
+	if GetExitCode(err) != InterruptedExitCode {
+		t.Errorf("The interrupted restore returned %v", err)
+	}
+	for _, file := range files {
+		if _, err := os.Stat(testDir + "/restore/" + file); err != nil {
+			continue
+		}
+		if getFileHash(testDir+"/repository/"+file) != getFileHash(testDir+"/restore/"+file) {
+			t.Errorf("File %s was partially restored", file)
+		}
+	}
+}
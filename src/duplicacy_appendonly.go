@@ -0,0 +1,56 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// VerifyAppendOnly checks that the credentials used to access the storage do not allow deleting or renaming files,
+// which is what backup clients in the append-only mode are expected to be given.  It uploads a small probe file and
+// then tries to remove and rename it.  The probe file has the '.tmp' suffix so that a later 'prune -exhaustive' run
+// from a trusted host will collect it.  Returns true if both operations have been refused.
+func VerifyAppendOnly(storage Storage) bool {
+
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		LOG_ERROR("APPEND_ONLY_PROBE", "Failed to generate a random file name: %v", err)
+		return false
+	}
+
+	probePath := "chunks/append_only_probe." + hex.EncodeToString(suffix) + ".tmp"
+	err = storage.UploadFile(0, probePath, suffix)
+	if err != nil {
+		LOG_ERROR("APPEND_ONLY_PROBE", "Failed to upload the probe file %s: %v", probePath, err)
+		return false
+	}
+
+	// Some storages report success even if the file wasn't deleted, so check if the file is really gone.
+	err = storage.DeleteFile(0, probePath)
+	if err == nil {
+		exist, _, _, _ := storage.GetFileInfo(0, probePath)
+		if !exist {
+			LOG_WARN("APPEND_ONLY_DELETE", "The storage credentials allow this client to delete files")
+			return false
+		}
+	}
+	LOG_DEBUG("APPEND_ONLY_DELETE", "Deleting the probe file %s was refused: %v", probePath, err)
+
+	movedPath := "chunks/append_only_probe." + hex.EncodeToString(suffix) + ".moved.tmp"
+	err = storage.MoveFile(0, probePath, movedPath)
+	if err == nil {
+		exist, _, _, _ := storage.GetFileInfo(0, probePath)
+		if !exist {
+			LOG_WARN("APPEND_ONLY_RENAME", "The storage credentials allow this client to rename files")
+			return false
+		}
+	}
+	LOG_DEBUG("APPEND_ONLY_RENAME", "Renaming the probe file %s was refused: %v", probePath, err)
+
+	LOG_INFO("APPEND_ONLY_VERIFIED", "The storage credentials do not allow this client to delete or rename files")
+	return true
+}
@@ -5,6 +5,9 @@
 package duplicacy
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"strings"
 
@@ -114,6 +117,54 @@ func (azureStorage *AzureStorage) ListFiles(threadIndex int, dir string) (files
 
 }
 
+// ListFilesWithChecksums returns all files under 'dir' with their sizes and MD5 checksums.  Azure computes the
+// Content-MD5 property for blobs uploaded in a single request, which is how UploadFile uploads them.
+func (azureStorage *AzureStorage) ListFilesWithChecksums(threadIndex int, dir string) (files []string, sizes []int64, checksums []string, err error) {
+
+	if len(dir) > 0 && dir[len(dir)-1] != '/' {
+		dir += "/"
+	}
+	dirLength := len(dir)
+
+	parameters := storage.ListBlobsParameters{
+		Prefix:    dir,
+		Delimiter: "",
+	}
+
+	for {
+
+		results, err := azureStorage.containers[threadIndex].ListBlobs(parameters)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		for _, blob := range results.Blobs {
+			files = append(files, blob.Name[dirLength:])
+			sizes = append(sizes, blob.Properties.ContentLength)
+
+			checksum := ""
+			if digest, err := base64.StdEncoding.DecodeString(blob.Properties.ContentMD5); err == nil && len(digest) == md5.Size {
+				checksum = "md5:" + hex.EncodeToString(digest)
+			}
+			checksums = append(checksums, checksum)
+		}
+
+		if results.NextMarker == "" {
+			break
+		}
+
+		parameters.Marker = results.NextMarker
+	}
+
+	return files, sizes, checksums, nil
+}
+
+// ComputeChecksum returns the MD5 of the content.
+func (storage *AzureStorage) ComputeChecksum(content []byte) string {
+	digest := md5.Sum(content)
+	return "md5:" + hex.EncodeToString(digest[:])
+}
+
 // DeleteFile deletes the file or directory at 'filePath'.
 func (storage *AzureStorage) DeleteFile(threadIndex int, filePath string) (err error) {
 	_, err = storage.containers[threadIndex].GetBlobReference(filePath).DeleteIfExists(nil)
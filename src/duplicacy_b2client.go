@@ -386,6 +386,7 @@ type B2Entry struct {
 	Action          string
 	Size            int64
 	UploadTimestamp int64
+	ContentSha1     string
 }
 
 type B2ListFileNamesOutput struct {
@@ -493,7 +494,9 @@ func (client *B2Client) ListFileNames(threadIndex int, startFileName string, sin
 			}
 			fileUploadTimestamp, _ := strconv.ParseInt(responseHeader.Get("X-Bz-Upload-Timestamp"), 0, 64)
 
-			return []*B2Entry{{fileID, fileName[len(client.StorageDir):], fileAction, fileSize, fileUploadTimestamp}}, nil
+			fileContentSha1 := responseHeader.Get("X-Bz-Content-Sha1")
+
+			return []*B2Entry{{fileID, fileName[len(client.StorageDir):], fileAction, fileSize, fileUploadTimestamp, fileContentSha1}}, nil
 		}
 
 		if err = json.NewDecoder(readCloser).Decode(&output); err != nil {
@@ -5,6 +5,8 @@
 package duplicacy
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"strings"
 )
 
@@ -91,6 +93,51 @@ func (storage *B2Storage) ListFiles(threadIndex int, dir string) (files []string
 	return files, sizes, nil
 }
 
+// ListFilesWithChecksums returns all files under 'dir' with their sizes and SHA1 checksums.  Like ListFiles, hidden
+// chunks are returned as fossils.
+func (storage *B2Storage) ListFilesWithChecksums(threadIndex int, dir string) (files []string, sizes []int64, checksums []string, err error) {
+	for len(dir) > 0 && dir[len(dir)-1] == '/' {
+		dir = dir[:len(dir)-1]
+	}
+	length := len(dir) + 1
+
+	entries, err := storage.client.ListFileNames(threadIndex, dir, false, dir == "chunks")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	lastFile := ""
+	for _, entry := range entries {
+		if entry.FileName == lastFile {
+			continue
+		}
+		lastFile = entry.FileName
+		if entry.Action == "hide" {
+			files = append(files, entry.FileName[length:]+".fsl")
+		} else {
+			files = append(files, entry.FileName[length:])
+		}
+		sizes = append(sizes, entry.Size)
+
+		// Files uploaded with the checksum at the end have the 'unverified:' prefix; large files may have none
+		checksum := strings.TrimPrefix(entry.ContentSha1, "unverified:")
+		if len(checksum) == 40 {
+			checksum = "sha1:" + strings.ToLower(checksum)
+		} else {
+			checksum = ""
+		}
+		checksums = append(checksums, checksum)
+	}
+
+	return files, sizes, checksums, nil
+}
+
+// ComputeChecksum returns the SHA1 of the content, which UploadFile passes to B2 for verification.
+func (storage *B2Storage) ComputeChecksum(content []byte) string {
+	digest := sha1.Sum(content)
+	return "sha1:" + hex.EncodeToString(digest[:])
+}
+
 // DeleteFile deletes the file or directory at 'filePath'.
 func (storage *B2Storage) DeleteFile(threadIndex int, filePath string) (err error) {
 
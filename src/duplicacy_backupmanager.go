@@ -50,6 +50,8 @@ type BackupManagerOptions struct {
 	IncludeSpecials    bool
 	FileFlagsMask      uint32
 	OneFileSystem      bool
+	CompareChangeTime  bool // in quick mode, also treat files with a different change time or inode as modified
+	ListingThreads     int  // number of directories to read concurrently when listing local files
 }
 
 func NewBackupManagerOptions(p *Preference) *BackupManagerOptions {
@@ -64,6 +66,7 @@ func NewBackupManagerOptions(p *Preference) *BackupManagerOptions {
 		IncludeSpecials:    p.IncludeSpecials,
 		FileFlagsMask:      uint32(p.FileFlagsMask),
 		OneFileSystem:      p.OneFileSystem,
+		CompareChangeTime:  p.CompareChangeTime,
 	}
 }
 
@@ -76,6 +79,7 @@ type RestoreOptions struct {
 	DeleteMode     bool
 	ShowStatistics bool
 	AllowFailures  bool
+	Progress       ProgressFunction // Only used by RestoreContext
 }
 
 func (manager *BackupManager) SetDryRun(dryRun bool) {
@@ -203,6 +207,10 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 		remoteSnapshot = CreateEmptySnapshot(manager.snapshotID)
 	} else {
 		LOG_INFO("BACKUP_START", "Last backup at revision %d found", remoteSnapshot.Revision)
+		if remoteSnapshot.Host != "" && remoteSnapshot.Host != hostname {
+			LOG_WARN("SNAPSHOT_HOST", "The last backup of snapshot %s was made on host %s; make sure the snapshot id "+
+				"is not used by a repository on another host", manager.snapshotID, remoteSnapshot.Host)
+		}
 	}
 
 	hashMode := remoteSnapshot.Revision == 0 || !quickMode
@@ -266,6 +274,7 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 
 	localSnapshot := CreateEmptySnapshot(manager.snapshotID)
 	localSnapshot.Revision = remoteSnapshot.Revision + 1
+	SetLogContext("revision", localSnapshot.Revision)
 
 	localListingChannel := make(chan *Entry)
 	remoteListingChannel := make(chan *Entry)
@@ -274,6 +283,17 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 	var skippedDirectories []string
 	var skippedFiles []string
 
+	// The inode index is only maintained if the repository is being watched for changes; unchanged directories can
+	// be skipped only when there is a remote listing to copy their files from
+	var inodeIndex *InodeIndex
+	if !manager.config.dryRun && !enumOnly {
+		lastRevision := remoteSnapshot.Revision
+		if hashMode {
+			lastRevision = 0
+		}
+		inodeIndex = LoadInodeIndex(manager.cachePath, lastRevision)
+	}
+
 	LOG_INFO("BACKUP_INDEXING", "Indexing %s", top)
 	go func() {
 		// List local files
@@ -288,6 +308,9 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 				IncludeFileFlags:   manager.options.IncludeFileFlags,
 				IncludeSpecials:    manager.options.IncludeSpecials,
 				OneFileSystem:      manager.options.OneFileSystem,
+				IncludeInodeInfo:   manager.options.CompareChangeTime,
+				ListingThreads:     manager.options.ListingThreads,
+				InodeIndex:         inodeIndex,
 			})
 	}()
 
@@ -298,7 +321,7 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 		if incompleteSnapshot != nil {
 			// If there is an incomplete snapshot, always use it
 			incompleteSnapshot.ReadEntries(func(entry *Entry) error {
-				remoteListingChannel <- entry
+				sendEntry(remoteListingChannel, entry)
 				return nil
 			})
 		} else if hashMode {
@@ -306,7 +329,7 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 		} else {
 			// List remote files in the previous snapshot
 			remoteSnapshot.ListRemoteFiles(manager.config, chunkOperator, func(entry *Entry) bool {
-				remoteListingChannel <- entry
+				sendEntry(remoteListingChannel, entry)
 				return true
 			})
 		}
@@ -321,11 +344,48 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 	}
 	lastPreservedChunk := -1
 
+	// preserveEntry makes the local entry refer to the chunks of the unmodified remote entry
+	preserveEntry := func(localEntry *Entry, remoteEntry *Entry) {
+		if localEntry.Size > 0 {
+			localEntry.Hash = remoteEntry.Hash
+			localEntry.StartOffset = remoteEntry.StartOffset
+			localEntry.EndOffset = remoteEntry.EndOffset
+			delta := remoteEntry.StartChunk - len(localEntryList.PreservedChunkHashes)
+			if lastPreservedChunk != remoteEntry.StartChunk {
+				lastPreservedChunk = remoteEntry.StartChunk
+				localEntryList.AddPreservedChunk(remoteSnapshot.ChunkHashes[lastPreservedChunk], remoteSnapshot.ChunkLengths[lastPreservedChunk])
+			} else {
+				delta++
+			}
+
+			for i := remoteEntry.StartChunk + 1; i <= remoteEntry.EndChunk; i++ {
+				localEntryList.AddPreservedChunk(remoteSnapshot.ChunkHashes[i], remoteSnapshot.ChunkLengths[i])
+				lastPreservedChunk = i
+			}
+
+			localEntry.StartChunk = remoteEntry.StartChunk - delta
+			localEntry.EndChunk = remoteEntry.EndChunk - delta
+			preservedFileSize += localEntry.Size
+		}
+	}
+
+	// Remote entries under directories skipped by the local listing are copied over as they are
+	copySkippedEntry := func(remoteEntry *Entry) {
+		if inodeIndex == nil || !inodeIndex.IsInSkippedDirectory(remoteEntry.Path) {
+			return
+		}
+		localEntry := remoteEntry.Copy()
+		if localEntry.IsFile() {
+			preserveEntry(localEntry, remoteEntry)
+		}
+		localEntryList.AddEntry(localEntry)
+	}
+
 	// Now compare local files with remote files one by one
 	var remoteEntry *Entry
 	remoteListingOK := true
 	for {
-		localEntry := <-localListingChannel
+		localEntry, _ := receiveEntry(localListingChannel)
 		if localEntry == nil {
 			break
 		}
@@ -339,7 +399,7 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 				compareResult = localEntry.Compare(remoteEntry)
 			} else {
 				if remoteListingOK {
-					remoteEntry, remoteListingOK = <-remoteListingChannel
+					remoteEntry, remoteListingOK = receiveEntry(remoteListingChannel)
 				}
 				if !remoteListingOK {
 					compareResult = -1
@@ -351,33 +411,14 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 			if compareResult <= 0 {
 				break
 			}
+			copySkippedEntry(remoteEntry)
 			remoteEntry = nil
 		}
 
 		if compareResult == 0 {
 			// No need to check if it is in hash mode -- in that case remote listing is nil
-			if localEntry.IsSameAs(remoteEntry) && localEntry.IsFile() {
-				if localEntry.Size > 0 {
-					localEntry.Hash = remoteEntry.Hash
-					localEntry.StartOffset = remoteEntry.StartOffset
-					localEntry.EndOffset = remoteEntry.EndOffset
-					delta := remoteEntry.StartChunk - len(localEntryList.PreservedChunkHashes)
-					if lastPreservedChunk != remoteEntry.StartChunk {
-						lastPreservedChunk = remoteEntry.StartChunk
-						localEntryList.AddPreservedChunk(remoteSnapshot.ChunkHashes[lastPreservedChunk], remoteSnapshot.ChunkLengths[lastPreservedChunk])
-					} else {
-						delta++
-					}
-
-					for i := remoteEntry.StartChunk + 1; i <= remoteEntry.EndChunk; i++ {
-						localEntryList.AddPreservedChunk(remoteSnapshot.ChunkHashes[i], remoteSnapshot.ChunkLengths[i])
-						lastPreservedChunk = i
-					}
-
-					localEntry.StartChunk = remoteEntry.StartChunk - delta
-					localEntry.EndChunk = remoteEntry.EndChunk - delta
-					preservedFileSize += localEntry.Size
-				}
+			if localEntry.IsSameAs(remoteEntry) && localEntry.IsSameInode(remoteEntry) && localEntry.IsFile() {
+				preserveEntry(localEntry, remoteEntry)
 			} else {
 				totalModifiedFileSize += localEntry.Size
 				if localEntry.Size > 0 {
@@ -397,6 +438,20 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 		localEntryList.AddEntry(localEntry)
 	}
 
+	if inodeIndex != nil && inodeIndex.NumberOfSkippedDirectories() > 0 {
+		if remoteEntry != nil {
+			copySkippedEntry(remoteEntry)
+		}
+		for {
+			remoteEntry, remoteListingOK = receiveEntry(remoteListingChannel)
+			if !remoteListingOK {
+				break
+			}
+			copySkippedEntry(remoteEntry)
+		}
+		LOG_INFO("BACKUP_JOURNAL", "%d unchanged directories were not listed", inodeIndex.NumberOfSkippedDirectories())
+	}
+
 	if enumOnly {
 		return true
 	}
@@ -432,9 +487,14 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 
 	var once sync.Once
 	if hashMode && !manager.config.dryRun {
-		// In case an error occurs during a hash mode backup, save the incomplete snapshot
+		// In case an error occurs during a hash mode backup, save the incomplete snapshot.  If the backup has been
+		// interrupted, the chunks being uploaded are allowed to complete first so they are recorded too.
 		RunAtError = func() {
 			once.Do(func() {
+				if isOperationCanceled() {
+					LOG_INFO("BACKUP_INTERRUPTED", "Waiting for the chunks being uploaded")
+					chunkOperator.drain()
+				}
 				localEntryList.SaveIncompleteSnapshot()
 			})
 		}
@@ -468,7 +528,7 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 
 		uploadedModifiedFileSize := atomic.AddInt64(&uploadedModifiedFileSize, int64(chunkSize))
 
-		if (IsTracing() || showStatistics) && totalModifiedFileSize > 0 {
+		if totalModifiedFileSize > 0 {
 			now := time.Now().Unix()
 			if now <= startUploadingTime {
 				now = startUploadingTime + 1
@@ -478,9 +538,12 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 			if speed > 0 {
 				remainingTime = (totalModifiedFileSize-uploadedModifiedFileSize)/speed + 1
 			}
-			percentage := float32(uploadedModifiedFileSize * 1000 / totalModifiedFileSize)
-			LOG_INFO("UPLOAD_PROGRESS", "%s chunk %d size %d, %sB/s %s %.1f%%", action, chunkIndex,
-				chunkSize, PrettySize(speed), PrettyTime(remainingTime), percentage/10)
+			reportProgress("Uploading chunks", uploadedModifiedFileSize, totalModifiedFileSize, speed, remainingTime)
+			if IsTracing() || showStatistics {
+				percentage := float32(uploadedModifiedFileSize * 1000 / totalModifiedFileSize)
+				LOG_INFO("UPLOAD_PROGRESS", "%s chunk %d size %d, %sB/s %s %.1f%%", action, chunkIndex,
+					chunkSize, PrettySize(speed), PrettyTime(remainingTime), percentage/10)
+			}
 		}
 
 		manager.config.PutChunk(chunk)
@@ -518,8 +581,13 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 		}
 	}
 
+	// With a file boundary size, large files always start a new chunk and small files only share chunks with
+	// other small files from the same directory
+	lastPackedDirectory := ""
+
 	// These are files to be uploaded; directories and links are excluded
 	for i := range localEntryList.ModifiedEntries {
+		checkCanceled()
 		entry := &localEntryList.ModifiedEntries[i]
 		LOG_TRACE("PACK_START", "Packing %s", entry.Path)
 		fullPath := joinPath(shadowTop, entry.Path)
@@ -529,6 +597,19 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 			skippedFiles = append(skippedFiles, entry.Path)
 			continue
 		}
+		if manager.config.FileBoundarySize > 0 {
+			directory := path.Dir(entry.Path)
+			isLarge := entry.Size >= int64(manager.config.FileBoundarySize)
+			if isLarge || directory != lastPackedDirectory {
+				LOG_TRACE("PACK_BOUNDARY", "Starting a new chunk for %s", entry.Path)
+				fileChunkMaker.ForceChunkBoundary(uploadChunkFunc)
+			}
+			if isLarge {
+				lastPackedDirectory = ""
+			} else {
+				lastPackedDirectory = directory
+			}
+		}
 		entry.Size, entry.Hash = fileChunkMaker.AddData(file, uploadChunkFunc)
 		if !showStatistics || IsTracing() || RunInBackground {
 			LOG_INFO("PACK_END", "Packed %s (%d)", entry.Path, entry.Size)
@@ -577,7 +658,7 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 
 	totalMetadataChunkLength, numberOfNewMetadataChunks,
 		totalUploadedMetadataChunkLength, totalUploadedMetadataChunkBytes :=
-		manager.UploadSnapshot(chunkOperator, top, localSnapshot, localEntryList, chunkCache, metadataChunkSize)
+		manager.UploadSnapshot(chunkOperator, top, localSnapshot, localEntryList, chunkCache, metadataChunkSize, false)
 
 	if showStatistics && !RunInBackground {
 		for _, entry := range localEntryList.ModifiedEntries {
@@ -589,11 +670,11 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 	}
 
 	for _, dir := range skippedDirectories {
-		LOG_WARN("SKIP_DIRECTORY", "Subdirectory %s cannot be listed", dir)
+		LOG_WARN("SKIP_DIRECTORY", "Subdirectory %s cannot be listed", LogField("path", dir))
 	}
 
 	for _, file := range skippedFiles {
-		LOG_WARN("SKIP_FILE", "File %s cannot be opened", file)
+		LOG_WARN("SKIP_FILE", "File %s cannot be opened", LogField("path", file))
 	}
 
 	if !manager.config.dryRun {
@@ -604,8 +685,38 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 	RunAtError = func() {}
 	deleteIncompleteSnapshot(manager.cachePath)
 
+	if inodeIndex != nil {
+		for _, dir := range skippedDirectories {
+			inodeIndex.Forget(dir)
+		}
+		for _, file := range skippedFiles {
+			inodeIndex.Forget(file)
+		}
+		inodeIndex.Save(localSnapshot.Revision)
+	}
+
 	totalMetadataChunks := len(localSnapshot.FileSequence) + len(localSnapshot.ChunkSequence) +
 		len(localSnapshot.LengthSequence)
+
+	setRunReportBackup(localSnapshot.Revision, &BackupReport{
+		Files:                      localEntryList.NumberOfEntries - int64(len(skippedFiles)),
+		FileBytes:                  preservedFileSize + uploadedFileSize,
+		NewFiles:                   int64(len(localEntryList.ModifiedEntries)),
+		NewFileBytes:               uploadedFileSize,
+		SkippedDirectories:         len(skippedDirectories),
+		SkippedFiles:               len(skippedFiles),
+		FileChunks:                 int64(len(localSnapshot.ChunkHashes)),
+		FileChunkBytes:             totalFileChunkLength,
+		NewFileChunks:              numberOfNewFileChunks,
+		NewFileChunkBytes:          totalUploadedFileChunkLength,
+		UploadedFileChunkBytes:     totalUploadedFileChunkBytes,
+		MetadataChunks:             int64(totalMetadataChunks),
+		MetadataChunkBytes:         totalMetadataChunkLength,
+		NewMetadataChunks:          int64(numberOfNewMetadataChunks),
+		NewMetadataChunkBytes:      totalUploadedMetadataChunkLength,
+		UploadedMetadataChunkBytes: totalUploadedMetadataChunkBytes,
+	})
+
 	if showStatistics {
 
 		LOG_INFO("BACKUP_STATS", "Files: %d total, %s bytes; %d new, %s bytes",
@@ -681,6 +792,8 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 		options.Threads = 1
 	}
 
+	SetLogContext("revision", revision)
+
 	patterns := options.Patterns
 
 	overwrite := options.Overwrite
@@ -760,6 +873,7 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 				IncludeFileFlags:   manager.options.IncludeFileFlags,
 				IncludeSpecials:    manager.options.IncludeSpecials,
 				OneFileSystem:      manager.options.OneFileSystem,
+				ListingThreads:     manager.options.ListingThreads,
 			})
 	}()
 
@@ -769,7 +883,7 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 		// List remote files
 		defer CatchLogException()
 		remoteSnapshot.ListRemoteFiles(manager.config, chunkOperator, func(entry *Entry) bool {
-			remoteListingChannel <- entry
+			sendEntry(remoteListingChannel, entry)
 			return true
 		})
 		close(remoteListingChannel)
@@ -791,7 +905,7 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 		} else if entry.IsHardLinkChild() {
 			i, err := entry.GetHardLinkId()
 			if err != nil {
-				LOG_ERROR("RESTORE_HARDLINK", "Decode error for hard link entry %s: %v", entry.Path, err)
+				LOG_ERROR("RESTORE_HARDLINK", "Decode error for hard link entry %s: %v", LogField("path", entry.Path), err)
 				return false
 			}
 			if !hardLinkTable[i].willExist {
@@ -799,7 +913,7 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 			} else {
 				sourcePath := joinPath(top, hardLinkTable[i].entry.Path)
 				if err := MakeHardlink(sourcePath, fullPath); err != nil {
-					LOG_ERROR("RESTORE_HARDLINK", "Failed to create hard link %s to %s: %v", fullPath, sourcePath, err)
+					LOG_ERROR("RESTORE_HARDLINK", "Failed to create hard link %s to %s: %v", LogField("path", fullPath), sourcePath, err)
 				}
 				LOG_TRACE("DOWNLOAD_DONE", "Hard linked %s to %s", entry.Path, hardLinkTable[i].entry.Path)
 				return true
@@ -808,7 +922,11 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 		return false
 	}
 
-	for remoteEntry := range remoteListingChannel {
+	for {
+		remoteEntry, remoteListingOK := receiveEntry(remoteListingChannel)
+		if !remoteListingOK {
+			break
+		}
 
 		if remoteEntry.IsHardLinkRoot() {
 			hardLinkTable = append(hardLinkTable, hardLinkEntry{remoteEntry, false})
@@ -823,7 +941,7 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 
 		for {
 			if localEntry == nil && localListingOK {
-				localEntry, localListingOK = <-localListingChannel
+				localEntry, localListingOK = receiveEntry(localListingChannel)
 			}
 			if localEntry == nil {
 				compareResult = 1
@@ -943,7 +1061,7 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 			} else if remoteEntry.IsHardLinkChild() {
 				i, err := remoteEntry.GetHardLinkId()
 				if err != nil {
-					LOG_ERROR("RESTORE_HARDLINK", "Decode error for hard link entry %s: %v", remoteEntry.Path, err)
+					LOG_ERROR("RESTORE_HARDLINK", "Decode error for hard link entry %s: %v", LogField("path", remoteEntry.Path), err)
 					return 0
 				}
 				if !hardLinkTable[i].willExist {
@@ -965,7 +1083,7 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 	}
 
 	for localListingOK {
-		localEntry, localListingOK = <-localListingChannel
+		localEntry, localListingOK = receiveEntry(localListingChannel)
 		if localEntry != nil {
 			extraFiles = append(extraFiles, localEntry.Path)
 		}
@@ -1004,6 +1122,7 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 
 	// Now download files one by one
 	for _, file := range fileEntries {
+		checkCanceled()
 
 		fullPath := joinPath(top, file.Path)
 		stat, _ := os.Stat(fullPath)
@@ -1092,7 +1211,7 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 
 			if sourceStat == nil {
 				LOG_WERROR(allowFailures, "RESTORE_HARDLINK",
-					"Target %s for hard link %s is missing", sourcePath, linkEntry.Path)
+					"Target %s for hard link %s is missing", sourcePath, LogField("path", linkEntry.Path))
 				continue
 			}
 			if !overwrite {
@@ -1104,10 +1223,10 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 		}
 
 		if err := MakeHardlink(sourcePath, fullPath); err != nil {
-			LOG_ERROR("RESTORE_HARDLINK", "Failed to create hard link %s to %s: %v", fullPath, sourcePath, err)
+			LOG_ERROR("RESTORE_HARDLINK", "Failed to create hard link %s to %s: %v", LogField("path", fullPath), sourcePath, err)
 			return 0
 		}
-		LOG_TRACE("RESTORE_HARDLINK", "Hard linked %s to %s", linkEntry.Path, hardLinkTable[i].entry.Path)
+		LOG_TRACE("RESTORE_HARDLINK", "Hard linked %s to %s", LogField("path", linkEntry.Path), hardLinkTable[i].entry.Path)
 	}
 
 	if options.DeleteMode && len(patterns) == 0 {
@@ -1156,9 +1275,10 @@ func (manager *BackupManager) Restore(top string, revision int, options *Restore
 }
 
 // UploadSnapshot uploads the specified snapshot to the storage. It turns Files, ChunkHashes, and ChunkLengths into
-// sequences of chunks, and uploads these chunks, and finally the snapshot file.
+// sequences of chunks, and uploads these chunks, and finally the snapshot file.  Unless 'overwrite' is true, an
+// existing snapshot file at the same revision is never replaced and the snapshot is renumbered instead.
 func (manager *BackupManager) UploadSnapshot(chunkOperator *ChunkOperator, top string, snapshot *Snapshot,
-	entryList *EntryList, chunkCache map[string]bool, metadataChunkSize int) (totalMetadataChunkSize int64,
+	entryList *EntryList, chunkCache map[string]bool, metadataChunkSize int, overwrite bool) (totalMetadataChunkSize int64,
 	numberOfNewMetadataChunks int, totalUploadedMetadataChunkSize int64,
 	totalUploadedMetadataChunkBytes int64) {
 
@@ -1272,7 +1392,7 @@ func (manager *BackupManager) UploadSnapshot(chunkOperator *ChunkOperator, top s
 			return err
 		}
 
-		metadataChunkMaker.AddData(buffer, uploadChunkFunc)
+		metadataChunkMaker.AddEntry(entry.Path, buffer.Bytes(), uploadChunkFunc)
 		return nil
 	}
 
@@ -1285,7 +1405,7 @@ func (manager *BackupManager) UploadSnapshot(chunkOperator *ChunkOperator, top s
 	snapshot.ChunkHashes = chunkHashes
 	snapshot.ChunkLengths = chunkLengths
 
-	metadataChunkMaker.AddData(nil, uploadChunkFunc)
+	metadataChunkMaker.ForceChunkBoundary(uploadChunkFunc)
 	snapshot.SetSequence("files", chunkSequence)
 
 	// Chunk and length sequences can be encoded and loaded into memory directly
@@ -1321,13 +1441,67 @@ func (manager *BackupManager) UploadSnapshot(chunkOperator *ChunkOperator, top s
 		return int64(0), 0, int64(0), int64(0)
 	}
 
-	path := fmt.Sprintf("snapshots/%s/%d", manager.snapshotID, snapshot.Revision)
-	if !manager.config.dryRun {
+	if !manager.config.dryRun && overwrite {
+		path := fmt.Sprintf("snapshots/%s/%d", manager.snapshotID, snapshot.Revision)
 		manager.SnapshotManager.UploadFile(path, path, description)
+	} else if !manager.config.dryRun {
+		manager.uploadSnapshotFile(snapshot, description)
 	}
 	return totalMetadataChunkSize, numberOfNewMetadataChunks, totalUploadedMetadataChunkSize, totalUploadedMetadataChunkBytes
 }
 
+// How many times a backup can find the revision it was going to create taken by another backup of the same snapshot
+// id before giving up.
+const maximumRevisionCollisions = 3
+
+// uploadSnapshotFile uploads the snapshot file without overwriting a revision created by another backup of the same
+// snapshot id since this backup started.  If the revision has been taken, the snapshot is saved as the next revision
+// instead; its chunks don't depend on the revision number.
+func (manager *BackupManager) uploadSnapshotFile(snapshot *Snapshot, description []byte) {
+
+	for collisions := 0; ; collisions++ {
+		path := fmt.Sprintf("snapshots/%s/%d", manager.snapshotID, snapshot.Revision)
+		if !manager.SnapshotManager.UploadFileIfNotExist(path, path, description) {
+			return
+		}
+
+		if collisions >= maximumRevisionCollisions {
+			LOG_ERROR("SNAPSHOT_COLLISION", "Revision %d of snapshot %s has also been created by another backup",
+				snapshot.Revision, manager.snapshotID)
+			return
+		}
+
+		other := manager.SnapshotManager.DownloadSnapshot(manager.snapshotID, snapshot.Revision)
+		if other != nil && other.Host != snapshot.Host {
+			LOG_WARN("SNAPSHOT_HOST", "Revision %d of snapshot %s has been created on host %s; the same snapshot id "+
+				"may be used by repositories on different hosts", other.Revision, manager.snapshotID, other.Host)
+		}
+
+		revisions, err := manager.SnapshotManager.ListSnapshotRevisions(manager.snapshotID)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to list the revisions of the snapshot %s: %v", manager.snapshotID, err)
+			return
+		}
+		revision := snapshot.Revision + 1
+		for _, existingRevision := range revisions {
+			if existingRevision >= revision {
+				revision = existingRevision + 1
+			}
+		}
+
+		LOG_WARN("SNAPSHOT_COLLISION", "Revision %d of snapshot %s has been created by another backup; saving this "+
+			"backup as revision %d", snapshot.Revision, manager.snapshotID, revision)
+		snapshot.Revision = revision
+		SetLogContext("revision", revision)
+
+		description, err = snapshot.MarshalJSON()
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_MARSHAL", "Failed to encode the snapshot %s: %v", manager.snapshotID, err)
+			return
+		}
+	}
+}
+
 // Restore downloads a file from the storage.  If 'inPlace' is false, the download file is saved first to a temporary
 // file under the .duplicacy directory and then replaces the existing one.  Otherwise, the existing file will be
 // overwritten directly.
@@ -1348,6 +1522,10 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 	temporaryPath := path.Join(preferencePath, "temporary")
 	fullPath := joinPath(top, entry.Path)
 
+	// Whether the file has been created or partially overwritten for in-place writing
+	isCreatedInPlace := false
+	isUpdatedInPlace := false
+
 	defer func() {
 		if existingFile != nil {
 			existingFile.Close()
@@ -1359,6 +1537,18 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 		if temporaryPath != fullPath {
 			os.Remove(temporaryPath)
 		}
+
+		// If the restore is interrupted or fails while writing in place, a file just created is removed, while an
+		// existing file can only be left as it is until the next restore
+		if r := recover(); r != nil {
+			if isCreatedInPlace {
+				os.Remove(fullPath)
+			} else if isUpdatedInPlace {
+				LOG_WARN("DOWNLOAD_INCOMPLETE", "File %s has been partially restored in place",
+					LogField("path", entry.Path))
+			}
+			panic(r)
+		}
 	}()
 
 	// These are used to break the existing file into chunks.
@@ -1384,6 +1574,7 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 					LOG_ERROR("DOWNLOAD_CREATE", "Failed to create the file %s for in-place writing: %v", fullPath, err)
 					return false, nil
 				}
+				isCreatedInPlace = true
 				err = entry.RestoreEarlyFileFlags(existingFile, fileFlagsMask)
 				if err != nil {
 					LOG_WARN("DOWNLOAD_FLAGS", "Failed to set early file flags on %s: %v", fullPath, err)
@@ -1562,6 +1753,7 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 			if err != nil {
 				LOG_ERROR("DOWNLOAD_CREATE", "Failed to create the file %s for in-place writing", fullPath)
 			}
+			isCreatedInPlace = true
 		} else {
 			// Close and reopen in a different mode
 			existingFile.Close()
@@ -1570,6 +1762,7 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 				LOG_ERROR("DOWNLOAD_OPEN", "Failed to open the file %s for in-place writing", fullPath)
 				return false, nil
 			}
+			isUpdatedInPlace = !isCreatedInPlace
 		}
 		err = entry.RestoreEarlyFileFlags(existingFile, fileFlagsMask)
 		if err != nil {
@@ -1943,6 +2136,7 @@ func (manager *BackupManager) CopySnapshots(otherManager *BackupManager, snapsho
 		speed := int64(float64(atomic.LoadInt64(&uploadedBytes)) / elapsedTime)
 		remainingTime := int64(float64(len(chunksToCopy)-chunkIndex-1) / float64(chunkIndex+1) * elapsedTime)
 		percentage := float64(chunkIndex+1) / float64(len(chunksToCopy)) * 100.0
+		reportProgress("Copying chunks", int64(chunkIndex+1), int64(len(chunksToCopy)), speed, remainingTime)
 		LOG_INFO("COPY_PROGRESS", "%s chunk %s (%d/%d) %sB/s %s %.1f%%",
 			action, chunk.GetID(), chunkIndex+1, len(chunksToCopy),
 			PrettySize(speed), PrettyTime(remainingTime), percentage)
@@ -1967,6 +2161,7 @@ func (manager *BackupManager) CopySnapshots(otherManager *BackupManager, snapsho
 
 	chunkDownloader.Stop()
 	chunkUploader.Stop()
+	checkCanceled()
 
 	LOG_INFO("SNAPSHOT_COPY", "Copied %d new chunks and skipped %d existing chunks", copiedChunks, len(chunks)-copiedChunks)
 
@@ -5,13 +5,19 @@
 package duplicacy
 
 import (
+	"bytes"
+	"context"
 	crypto_rand "crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"path"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -239,11 +245,11 @@ func TestBackupManager(t *testing.T) {
 	}
 
 	if *testFixedChunkSize {
-		if !ConfigStorage(storage, 16384, 100, 64*1024, 64*1024, 64*1024, password, nil, false, "", dataShards, parityShards) {
+		if !ConfigStorage(storage, 16384, 100, 64*1024, 64*1024, 64*1024, password, nil, false, "", dataShards, parityShards, *testFileBoundarySize) {
 			t.Errorf("Failed to initialize the storage")
 		}
 	} else {
-		if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, password, nil, false, "", dataShards, parityShards) {
+		if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, password, nil, false, "", dataShards, parityShards, *testFileBoundarySize) {
 			t.Errorf("Failed to initialize the storage")
 		}
 	}
@@ -390,30 +396,281 @@ func TestBackupManager(t *testing.T) {
 	}
 
 	backupManager.SnapshotManager.CheckSnapshots( /*snapshotID*/ "host1" /*revisions*/, []int{1, 2, 3} /*tag*/, "" /*showStatistics*/, false,
-		/*showTabular*/ false /*checkFiles*/, false /*checkChunks*/, false /*searchFossils*/, false /*resurrect*/, false /*rewiret*/, false, 1 /*allowFailures*/, false)
-	backupManager.SnapshotManager.PruneSnapshots("host1", "host1" /*revisions*/, []int{1} /*tags*/, nil /*retentions*/, nil,
+		/*showTabular*/ false /*checkFiles*/, false /*checkChunks*/, false /*searchFossils*/, false /*resurrect*/, false /*rewiret*/, false, 1 /*allowFailures*/, false /*verifyBudget*/, nil /*ledgerInStorage*/, false)
+	backupManager.SnapshotManager.PruneSnapshots("host1", "host1" /*revisions*/, []int{1} /*tags*/, nil /*retentions*/, nil /*location*/, nil,
 		/*exhaustive*/ false /*exclusive=*/, false /*ignoredIDs*/, nil /*dryRun*/, false /*deleteOnly*/, false /*collectOnly*/, false, 1)
 	numberOfSnapshots = backupManager.SnapshotManager.ListSnapshots( /*snapshotID*/ "host1" /*revisionsToList*/, nil /*tag*/, "" /*showFiles*/, false /*showChunks*/, false)
 	if numberOfSnapshots != 2 {
 		t.Errorf("Expected 2 snapshots but got %d", numberOfSnapshots)
 	}
 	backupManager.SnapshotManager.CheckSnapshots( /*snapshotID*/ "host1" /*revisions*/, []int{2, 3} /*tag*/, "" /*showStatistics*/, false,
-		/*showTabular*/ false /*checkFiles*/, false /*checkChunks*/, false /*searchFossils*/, false /*resurrect*/, false /*rewiret*/, false, 1 /*allowFailures*/, false)
+		/*showTabular*/ false /*checkFiles*/, false /*checkChunks*/, false /*searchFossils*/, false /*resurrect*/, false /*rewiret*/, false, 1 /*allowFailures*/, false /*verifyBudget*/, nil /*ledgerInStorage*/, false)
 	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, false, threads, "fourth", false, false, 0, false, 1024, 1024)
-	backupManager.SnapshotManager.PruneSnapshots("host1", "host1" /*revisions*/, nil /*tags*/, nil /*retentions*/, nil,
+	backupManager.SnapshotManager.PruneSnapshots("host1", "host1" /*revisions*/, nil /*tags*/, nil /*retentions*/, nil /*location*/, nil,
 		/*exhaustive*/ false /*exclusive=*/, true /*ignoredIDs*/, nil /*dryRun*/, false /*deleteOnly*/, false /*collectOnly*/, false, 1)
 	numberOfSnapshots = backupManager.SnapshotManager.ListSnapshots( /*snapshotID*/ "host1" /*revisionsToList*/, nil /*tag*/, "" /*showFiles*/, false /*showChunks*/, false)
 	if numberOfSnapshots != 3 {
 		t.Errorf("Expected 3 snapshots but got %d", numberOfSnapshots)
 	}
 	backupManager.SnapshotManager.CheckSnapshots( /*snapshotID*/ "host1" /*revisions*/, []int{2, 3, 4} /*tag*/, "" /*showStatistics*/, false,
-		/*showTabular*/ false /*checkFiles*/, false /*checkChunks*/, false /*searchFossils*/, false /*resurrect*/, false /*rewiret*/, false, 1 /*allowFailures*/, false)
+		/*showTabular*/ false /*checkFiles*/, false /*checkChunks*/, false /*searchFossils*/, false /*resurrect*/, false /*rewiret*/, false, 1 /*allowFailures*/, false /*verifyBudget*/, nil /*ledgerInStorage*/, false)
 
 	/*buf := make([]byte, 1<<16)
 	  runtime.Stack(buf, true)
 	  fmt.Printf("%s", buf)*/
 }
 
+// TestBackupManagerChangeJournal checks that directories without changes recorded in the change journal are not
+// listed, and that their files are copied from the last snapshot
+func TestBackupManagerChangeJournal(t *testing.T) {
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	if runtime.GOOS != "linux" {
+		t.Skip("change journals are only supported on Linux")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	os.MkdirAll(testDir+"/repository1/dir1", 0700)
+	os.MkdirAll(testDir+"/repository1/dir2/dir3", 0700)
+	os.Mkdir(testDir+"/repository1/.duplicacy", 0700)
+	os.Mkdir(testDir+"/repository2", 0700)
+	os.Mkdir(testDir+"/repository2/.duplicacy", 0700)
+
+	files := []string{"file1", "dir1/file2", "dir2/file3", "dir2/dir3/file4"}
+	for _, f := range files {
+		createRandomFile(testDir+"/repository1/"+f, 100000)
+	}
+
+	threads := 1
+	storage, err := loadStorage(testDir+"/storage", threads)
+	if err != nil {
+		t.Errorf("Failed to create storage: %v", err)
+		return
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0, 0) {
+		t.Errorf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository1/.duplicacy")
+	backupManager := CreateBackupManager("host1", storage, testDir, "", nil)
+	backupManager.SetupSnapshotCache("default")
+
+	// Pretend this process is the watch session
+	session := fmt.Sprintf("%d 0", os.Getpid())
+	appendChangeJournal(backupManager.cachePath, session, nil, false)
+	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, true, threads, "first", false, false, 0, false, 1024, 1024)
+
+	for _, f := range files {
+		modifyFile(testDir+"/repository1/"+f, 0.5)
+	}
+	appendChangeJournal(backupManager.cachePath, session, []string{"", "dir1/"}, false)
+	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, true, threads, "second", false, false, 0, false, 1024, 1024)
+
+	appendChangeJournal(backupManager.cachePath, session, nil, false)
+	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, false, threads, "third", false, false, 0, false, 1024, 1024)
+
+	// Changes in dir2 are not in the journal so they are only picked up by the hash mode backup
+	for revision, modified := range map[int][]bool{2: {true, true, false, false}, 3: {true, true, true, true}} {
+		os.RemoveAll(testDir + "/repository2")
+		os.MkdirAll(testDir+"/repository2/.duplicacy", 0700)
+		SetDuplicacyPreferencePath(testDir + "/repository2/.duplicacy")
+		failedFiles := backupManager.Restore(testDir+"/repository2", revision, &RestoreOptions{
+			Threads:   threads,
+			Overwrite: true,
+		})
+		assertRestoreFailures(t, failedFiles, 0)
+
+		for i, f := range files {
+			hash1 := getFileHash(testDir + "/repository1/" + f)
+			hash2 := getFileHash(testDir + "/repository2/" + f)
+			if (hash1 == hash2) != modified[i] {
+				t.Errorf("Revision %d: file %s has the hash %s while the repository has %s", revision, f, hash2, hash1)
+			}
+		}
+	}
+}
+
+// TestBackupManagerChangeJournalHardLinks checks that a directory with a hard link deep below it is still listed
+// when it hasn't changed, so the hard links are numbered the same way as the rest of the snapshot
+func TestBackupManagerChangeJournalHardLinks(t *testing.T) {
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	if runtime.GOOS != "linux" {
+		t.Skip("change journals are only supported on Linux")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	os.MkdirAll(testDir+"/repository1/dir1/dir2", 0700)
+	os.Mkdir(testDir+"/repository1/.duplicacy", 0700)
+	createRandomFile(testDir+"/repository1/dir1/dir2/file1", 100000)
+	os.Link(testDir+"/repository1/dir1/dir2/file1", testDir+"/repository1/dir1/dir2/link1")
+
+	threads := 1
+	storage, err := loadStorage(testDir+"/storage", threads)
+	if err != nil {
+		t.Errorf("Failed to create storage: %v", err)
+		return
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0, 0) {
+		t.Errorf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository1/.duplicacy")
+	backupManager := CreateBackupManager("host1", storage, testDir, "", nil)
+	backupManager.SetupSnapshotCache("default")
+
+	session := fmt.Sprintf("%d 0", os.Getpid())
+	appendChangeJournal(backupManager.cachePath, session, nil, false)
+	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, true, threads, "first", false, false, 0, false, 1024, 1024)
+
+	// New hard links listed before dir1 take the numbers the links under dir1 had in the first backup
+	createRandomFile(testDir+"/repository1/a_file", 100000)
+	os.Link(testDir+"/repository1/a_file", testDir+"/repository1/a_link")
+	appendChangeJournal(backupManager.cachePath, session, []string{""}, false)
+	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, true, threads, "second", false, false, 0, false, 1024, 1024)
+
+	files := []string{"a_file", "a_link", "dir1/dir2/file1", "dir1/dir2/link1"}
+	for revision := 1; revision <= 2; revision++ {
+		os.RemoveAll(testDir + "/repository2")
+		os.MkdirAll(testDir+"/repository2/.duplicacy", 0700)
+		SetDuplicacyPreferencePath(testDir + "/repository2/.duplicacy")
+		failedFiles := backupManager.Restore(testDir+"/repository2", revision, &RestoreOptions{
+			Threads:   threads,
+			Overwrite: true,
+		})
+		assertRestoreFailures(t, failedFiles, 0)
+
+		for _, f := range files {
+			if revision == 1 && strings.HasPrefix(f, "a_") {
+				continue
+			}
+			hash1 := getFileHash(testDir + "/repository1/" + f)
+			hash2 := getFileHash(testDir + "/repository2/" + f)
+			if hash1 != hash2 {
+				t.Errorf("Revision %d: file %s has the hash %s while the repository has %s", revision, f, hash2, hash1)
+			}
+		}
+	}
+}
+
+// TestBackupManagerChangeTime checks that a quick mode backup picks up a modified file whose size and modification
+// time have been preserved, but only when change times are compared
+func TestBackupManagerChangeTime(t *testing.T) {
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("change times are not available on Windows")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	os.MkdirAll(testDir+"/repository1/.duplicacy", 0700)
+	createRandomFile(testDir+"/repository1/file1", 100000)
+	stat, _ := os.Stat(testDir + "/repository1/file1")
+
+	threads := 1
+	storage, err := loadStorage(testDir+"/storage", threads)
+	if err != nil {
+		t.Errorf("Failed to create storage: %v", err)
+		return
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0, 0) {
+		t.Errorf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository1/.duplicacy")
+
+	for i, compareChangeTime := range []bool{false, true} {
+		backupManager := CreateBackupManager("host1", storage, testDir, "", &BackupManagerOptions{
+			CompareChangeTime: compareChangeTime,
+		})
+		backupManager.SetupSnapshotCache("default")
+		backupManager.Backup(testDir+"/repository1" /*quickMode=*/, true, threads, "", false, false, 0, false, 1024, 1024)
+
+		hash := getFileHash(testDir + "/repository1/file1")
+		modifyFile(testDir+"/repository1/file1", 0.5)
+		os.Chtimes(testDir+"/repository1/file1", stat.ModTime(), stat.ModTime())
+		if getFileHash(testDir+"/repository1/file1") == hash {
+			t.Errorf("The file was not modified")
+		}
+
+		backupManager.Backup(testDir+"/repository1" /*quickMode=*/, true, threads, "", false, false, 0, false, 1024, 1024)
+
+		var hashes []string
+		for _, revision := range []int{2*i + 1, 2*i + 2} {
+			snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", revision)
+			backupManager.SnapshotManager.DownloadSnapshotSequences(snapshot)
+			backupManager.SnapshotManager.CreateChunkOperator(false, false, threads, false)
+			snapshot.ListRemoteFiles(backupManager.config, backupManager.SnapshotManager.chunkOperator, func(entry *Entry) bool {
+				if entry.Path == "file1" {
+					hashes = append(hashes, entry.Hash)
+				}
+				return true
+			})
+		}
+
+		if len(hashes) != 2 || (hashes[0] != hashes[1]) != compareChangeTime {
+			t.Errorf("Comparing change times: %t, file hashes in two revisions: %v", compareChangeTime, hashes)
+		}
+	}
+}
+
 // Create file with random file with certain seed
 func createRandomFileSeeded(path string, maxSize int, seed int64) {
 	r := rand.New(rand.NewSource(seed))
@@ -534,7 +791,7 @@ func TestPersistRestore(t *testing.T) {
 	time.Sleep(time.Duration(delay) * time.Second)
 	cleanStorage(unencStorage)
 
-	if !ConfigStorage(unencStorage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0) {
+	if !ConfigStorage(unencStorage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0, 0) {
 		t.Errorf("Failed to initialize the unencrypted storage")
 	}
 	time.Sleep(time.Duration(delay) * time.Second)
@@ -553,7 +810,7 @@ func TestPersistRestore(t *testing.T) {
 	time.Sleep(time.Duration(delay) * time.Second)
 	cleanStorage(storage)
 
-	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, password, unencConfig, true, "", 0, 0) {
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, password, unencConfig, true, "", 0, 0, 0) {
 		t.Errorf("Failed to initialize the encrypted storage")
 	}
 	time.Sleep(time.Duration(delay) * time.Second)
@@ -579,11 +836,11 @@ func TestPersistRestore(t *testing.T) {
 	// check snapshots
 	unencBackupManager.SnapshotManager.CheckSnapshots( /*snapshotID*/ "host1" /*revisions*/, []int{1} /*tag*/, "",
 		/*showStatistics*/ true /*showTabular*/, false /*checkFiles*/, true /*checkChunks*/, false,
-		/*searchFossils*/ false /*resurrect*/, false /*rewiret*/, false, 1 /*allowFailures*/, false)
+		/*searchFossils*/ false /*resurrect*/, false /*rewiret*/, false, 1 /*allowFailures*/, false /*verifyBudget*/, nil /*ledgerInStorage*/, false)
 
 	encBackupManager.SnapshotManager.CheckSnapshots( /*snapshotID*/ "host1" /*revisions*/, []int{1} /*tag*/, "",
 		/*showStatistics*/ true /*showTabular*/, false /*checkFiles*/, true /*checkChunks*/, false,
-		/*searchFossils*/ false /*resurrect*/, false /*rewiret*/, false, 1 /*allowFailures*/, false)
+		/*searchFossils*/ false /*resurrect*/, false /*rewiret*/, false, 1 /*allowFailures*/, false /*verifyBudget*/, nil /*ledgerInStorage*/, false)
 
 	// check functions
 	checkAllUncorrupted := func(cmpRepository string) {
@@ -692,11 +949,11 @@ func TestPersistRestore(t *testing.T) {
 		// this would cause a panic and os.Exit from duplicacy_log if allowFailures == false
 		unencBackupManager.SnapshotManager.CheckSnapshots( /*snapshotID*/ "host1" /*revisions*/, []int{1} /*tag*/, "",
 			/*showStatistics*/ true /*showTabular*/, false /*checkFiles*/, true /*checkChunks*/, false,
-			/*searchFossils*/ false /*resurrect*/, false /*rewrite*/, false, 1 /*allowFailures*/, true)
+			/*searchFossils*/ false /*resurrect*/, false /*rewrite*/, false, 1 /*allowFailures*/, true /*verifyBudget*/, nil /*ledgerInStorage*/, false)
 
 		encBackupManager.SnapshotManager.CheckSnapshots( /*snapshotID*/ "host1" /*revisions*/, []int{1} /*tag*/, "",
 			/*showStatistics*/ true /*showTabular*/, false /*checkFiles*/, true /*checkChunks*/, false,
-			/*searchFossils*/ false /*resurrect*/, false /*rewrite*/, false, 1 /*allowFailures*/, true)
+			/*searchFossils*/ false /*resurrect*/, false /*rewrite*/, false, 1 /*allowFailures*/, true /*verifyBudget*/, nil /*ledgerInStorage*/, false)
 
 		// test restore corrupted, inPlace = true, corrupted files will have hash failures
 		os.RemoveAll(testDir + "/repository2")
@@ -829,3 +1086,135 @@ func TestPersistRestore(t *testing.T) {
 	}
 
 }
+
+func TestRevisionCollision(t *testing.T) {
+
+	SetLoggingLevel(INFO)
+
+	var logs bytes.Buffer
+	testingT = nil
+	logOutput = &logs
+	defer func() {
+		logOutput = nil
+		if t.Failed() {
+			t.Log(logs.String())
+		}
+	}()
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "collision")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir+"/repository/.duplicacy", 0700)
+	defer os.RemoveAll(testDir)
+
+	for _, file := range []string{"file1", "file2"} {
+		createRandomFile(testDir+"/repository/"+file, 1000000)
+	}
+
+	storage, err := CreateFileStorage(testDir+"/storage", false, 1)
+	if err != nil {
+		t.Fatalf("Failed to create the storage: %v", err)
+	}
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	exist, err := storage.UploadFileIfNotExist(0, "snapshots/test/1", []byte("first"))
+	if err != nil || exist {
+		t.Errorf("The first conditional upload returned %t, %v", exist, err)
+	}
+	exist, err = storage.UploadFileIfNotExist(0, "snapshots/test/1", []byte("second"))
+	content, _ := os.ReadFile(testDir + "/storage/snapshots/test/1")
+	if err != nil || !exist || string(content) != "first" {
+		t.Errorf("The second conditional upload returned %t, %v and left '%s'", exist, err, content)
+	}
+
+	// An append-only storage doesn't report an existing file as a refused overwrite
+	appendOnlyStorage, err := CreateFileStorage(testDir+"/append-only", false, 1)
+	if err != nil {
+		t.Fatalf("Failed to create the storage: %v", err)
+	}
+	appendOnlyStorage.rejectDeletions = true
+	exist, err = appendOnlyStorage.UploadFileIfNotExist(0, "snapshots/test/1", []byte("first"))
+	if err != nil || exist {
+		t.Errorf("The first conditional upload to the append-only storage returned %t, %v", exist, err)
+	}
+	exist, err = appendOnlyStorage.UploadFileIfNotExist(0, "snapshots/test/1", []byte("second"))
+	content, _ = os.ReadFile(testDir + "/append-only/snapshots/test/1")
+	if err != nil || !exist || string(content) != "first" {
+		t.Errorf("The second conditional upload to the append-only storage returned %t, %v and left '%s'", exist, err,
+			content)
+	}
+	if appendOnlyStorage.UploadFile(0, "snapshots/test/1", []byte("second")) == nil {
+		t.Errorf("The file in the append-only storage was overwritten")
+	}
+
+	// The files are written to temporary files first, which are not left behind
+	for _, dir := range []string{testDir + "/storage/snapshots/test", testDir + "/append-only/snapshots/test"} {
+		files, _ := os.ReadDir(dir)
+		if len(files) != 1 {
+			t.Errorf("%d files left in %s", len(files), dir)
+		}
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository/.duplicacy")
+	backupManager := CreateBackupManager("host1", storage, testDir, "", nil)
+	backupManager.SetupSnapshotCache("default")
+
+	backupOptions := &BackupOptions{
+		QuickMode:              true,
+		Threads:                1,
+		MetadataChunkSize:      1024,
+		MaximumInMemoryEntries: 1024,
+	}
+	_, err = backupManager.BackupContext(context.Background(), testDir+"/repository", backupOptions)
+	if err != nil {
+		t.Fatalf("The backup failed: %v", err)
+	}
+
+	// Another backup of the same snapshot id creates revision 2 while this one is uploading chunks
+	for _, file := range []string{"file1", "file2"} {
+		modifyFile(testDir+"/repository/"+file, 0.5)
+	}
+	var once sync.Once
+	backupOptions.Progress = func(progress Progress) {
+		once.Do(func() {
+			content, _ := os.ReadFile(testDir + "/storage/snapshots/host1/1")
+			os.WriteFile(testDir+"/storage/snapshots/host1/2", content, 0644)
+		})
+	}
+	report, err := backupManager.BackupContext(context.Background(), testDir+"/repository", backupOptions)
+	if err != nil {
+		t.Fatalf("The backup failed: %v", err)
+	}
+	if report.Revision != 3 {
+		t.Errorf("The backup created revision %d instead of 3", report.Revision)
+	}
+
+	collisions := 0
+	for _, message := range report.Messages {
+		if message.LogID == "SNAPSHOT_COLLISION" {
+			collisions++
+		}
+	}
+	if collisions != 1 {
+		t.Errorf("The collision was reported %d times", collisions)
+	}
+
+	snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", 3)
+	if snapshot == nil || snapshot.Revision != 3 {
+		t.Errorf("The renumbered snapshot is %+v", snapshot)
+	}
+
+	// A retried upload that finds the revision it has already uploaded is not a collision
+	description, _ := snapshot.MarshalJSON()
+	snapshotPath := "snapshots/host1/4"
+	if backupManager.SnapshotManager.UploadFileIfNotExist(snapshotPath, snapshotPath, description) {
+		t.Errorf("The new revision was found to exist")
+	}
+	if backupManager.SnapshotManager.UploadFileIfNotExist(snapshotPath, snapshotPath, description) {
+		t.Errorf("The revision uploaded again with the same content was taken as a collision")
+	}
+	if !backupManager.SnapshotManager.UploadFileIfNotExist(snapshotPath, snapshotPath, []byte("{}")) {
+		t.Errorf("A revision with a different content was not taken as a collision")
+	}
+}
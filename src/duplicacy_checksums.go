@@ -0,0 +1,181 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Checksums of uploaded chunks are appended to this file in the snapshot cache, one '<chunk id> <checksum>' per line.
+// Later lines override earlier ones.
+const chunkChecksumFile = "chunk_checksums"
+
+var chunkChecksumLock sync.Mutex
+
+// recordChunkChecksum adds the checksum of a chunk that has just been uploaded to the checksum index.
+func (operator *ChunkOperator) recordChunkChecksum(chunkID string, content []byte) {
+
+	checksumStorage, ok := operator.storage.(ChecksumStorage)
+	if !ok || operator.snapshotCache == nil {
+		return
+	}
+
+	chunkChecksumLock.Lock()
+	defer chunkChecksumLock.Unlock()
+
+	checksumPath := path.Join(operator.snapshotCache.storageDir, chunkChecksumFile)
+	file, err := os.OpenFile(checksumPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		LOG_WARN("CHUNK_CHECKSUM", "Failed to open the checksum index %s: %v", checksumPath, err)
+		return
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s %s\n", chunkID, checksumStorage.ComputeChecksum(content))
+	if err != nil {
+		LOG_WARN("CHUNK_CHECKSUM", "Failed to record the checksum of chunk %s: %v", chunkID, err)
+	}
+}
+
+// loadChunkChecksums reads the checksum index from the snapshot cache.
+func (manager *SnapshotManager) loadChunkChecksums() (checksums map[string]string, err error) {
+
+	checksums = make(map[string]string)
+
+	file, err := os.Open(path.Join(manager.snapshotCache.storageDir, chunkChecksumFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return checksums, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			checksums[fields[0]] = fields[1]
+		}
+	}
+	return checksums, scanner.Err()
+}
+
+// saveChunkChecksums replaces the checksum index in the snapshot cache.
+func (manager *SnapshotManager) saveChunkChecksums(checksums map[string]string) (err error) {
+
+	chunkChecksumLock.Lock()
+	defer chunkChecksumLock.Unlock()
+
+	checksumPath := path.Join(manager.snapshotCache.storageDir, chunkChecksumFile)
+	temporaryPath := checksumPath + ".tmp"
+
+	file, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for chunkID, checksum := range checksums {
+		fmt.Fprintf(writer, "%s %s\n", chunkID, checksum)
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+
+	return os.Rename(temporaryPath, checksumPath)
+}
+
+// checkRemoteChecksums lists all chunks along with the checksums reported by the storage and compares them with the
+// checksums recorded when the chunks were uploaded.  Chunks without a recorded checksum, for instance those uploaded
+// by other clients, get the reported checksum recorded so that any change will be detected by later checks.  'visit'
+// is called for every file listed.  Returns the number of chunks whose checksums don't match.
+func (manager *SnapshotManager) checkRemoteChecksums(visit func(file string, size int64)) (mismatches int, ok bool) {
+
+	checksumStorage, isChecksumStorage := manager.storage.(ChecksumStorage)
+	if !isChecksumStorage {
+		LOG_ERROR("CHECK_CHECKSUMS", "The storage does not report checksums of files")
+		return 0, false
+	}
+
+	recordedChecksums, err := manager.loadChunkChecksums()
+	if err != nil {
+		LOG_ERROR("CHECK_CHECKSUMS", "Failed to load the checksum index: %v", err)
+		return 0, false
+	}
+
+	LOG_INFO("SNAPSHOT_CHECK", "Listing all chunks with checksums")
+	files, sizes, checksums, err := checksumStorage.ListFilesWithChecksums(0, chunkDir)
+	if err != nil {
+		LOG_ERROR("LIST_FILES", "Failed to list the directory %s: %v", chunkDir, err)
+		return 0, false
+	}
+
+	listedChecksums := make(map[string]string)
+	matches := 0
+	unavailable := 0
+	firstRecorded := 0
+	for i, file := range files {
+		visit(file, sizes[i])
+
+		if len(file) == 0 || file[len(file)-1] == '/' || strings.HasSuffix(file, ".tmp") {
+			continue
+		}
+
+		chunkID := strings.Replace(strings.TrimSuffix(file, ".fsl"), "/", "", -1)
+		checksum := checksums[i]
+		if checksum == "" {
+			unavailable++
+			if recordedChecksum, found := recordedChecksums[chunkID]; found {
+				listedChecksums[chunkID] = recordedChecksum
+			}
+			continue
+		}
+
+		listedChecksums[chunkID] = checksum
+		recordedChecksum, found := recordedChecksums[chunkID]
+		if !found {
+			firstRecorded++
+			continue
+		}
+
+		if recordedChecksum != checksum {
+			LOG_WARN("CHUNK_CHECKSUM", "Chunk %s has a checksum of %s in the storage but %s was recorded when it was uploaded",
+				chunkID, checksum, recordedChecksum)
+			// Keep the recorded checksum so the chunk will be reported again
+			listedChecksums[chunkID] = recordedChecksum
+			mismatches++
+		} else {
+			matches++
+		}
+	}
+
+	LOG_INFO("SNAPSHOT_CHECK", "Checksums of %d chunks match those recorded at upload time; %d chunks have no checksum "+
+		"in the storage; %d checksums have been recorded for the first time", matches, unavailable, firstRecorded)
+
+	if mismatches > 0 && matches == 0 {
+		LOG_WARN("CHUNK_CHECKSUM", "No checksums match; the storage may not report checksums of the content, for "+
+			"instance if objects are encrypted with a key managed by the storage service")
+	}
+
+	// Chunks no longer in the storage are dropped from the index
+	err = manager.saveChunkChecksums(listedChecksums)
+	if err != nil {
+		LOG_WARN("CHUNK_CHECKSUM", "Failed to save the checksum index: %v", err)
+	}
+
+	return mismatches, true
+}
@@ -341,37 +341,42 @@ func (chunk *Chunk) Encrypt(encryptionKey []byte, derivationKey string, isMetada
 		return
 	}
 
-	// Start erasure coding
-	encoder, err := reedsolomon.New(chunk.config.DataShards, chunk.config.ParityShards)
+	return encodeErasureCoding(chunk.buffer, encryptedBuffer, chunk.config.DataShards, chunk.config.ParityShards)
+}
+
+// encodeErasureCoding writes the data in 'input' to 'output' in the erasure coding format, with 'dataShards' data
+// shards and 'parityShards' parity shards.  'input' is padded and grown in place to hold the parity shards.
+func encodeErasureCoding(output *bytes.Buffer, input *bytes.Buffer, dataShards int, parityShards int) error {
+
+	encoder, err := reedsolomon.New(dataShards, parityShards)
 	if err != nil {
 		return err
 	}
-	chunkSize := len(encryptedBuffer.Bytes())
-	shardSize := (chunkSize + chunk.config.DataShards - 1) / chunk.config.DataShards
+	chunkSize := len(input.Bytes())
+	shardSize := (chunkSize + dataShards - 1) / dataShards
 	// Append zeros to make the last shard to have the same size as other
-	encryptedBuffer.Write(make([]byte, shardSize * chunk.config.DataShards - chunkSize))
+	input.Write(make([]byte, shardSize * dataShards - chunkSize))
 	// Grow the buffer for parity shards
-	encryptedBuffer.Grow(shardSize * chunk.config.ParityShards)
+	input.Grow(shardSize * parityShards)
 	// Now create one slice for each shard, reusing the data in the buffer
-	data := make([][]byte, chunk.config.DataShards + chunk.config.ParityShards)
-	for i := 0; i < chunk.config.DataShards + chunk.config.ParityShards; i++ {
-		data[i] = encryptedBuffer.Bytes()[i * shardSize: (i + 1) * shardSize]
+	data := make([][]byte, dataShards + parityShards)
+	for i := 0; i < dataShards + parityShards; i++ {
+		data[i] = input.Bytes()[i * shardSize: (i + 1) * shardSize]
 	}
 	// This populates the parity shard
 	encoder.Encode(data)
 
-	// Prepare the chunk to be uploaded
-	chunk.buffer.Reset()
+	output.Reset()
 	// First the banner
-	chunk.buffer.Write([]byte(ERASURE_CODING_BANNER))
+	output.Write([]byte(ERASURE_CODING_BANNER))
 	// Then the header which includes the chunk size, data/parity and a 2-byte checksum
 	header := make([]byte, 14)
 	binary.LittleEndian.PutUint64(header[0:], uint64(chunkSize))
-	binary.LittleEndian.PutUint16(header[8:], uint16(chunk.config.DataShards))
-	binary.LittleEndian.PutUint16(header[10:], uint16(chunk.config.ParityShards))
+	binary.LittleEndian.PutUint16(header[8:], uint16(dataShards))
+	binary.LittleEndian.PutUint16(header[10:], uint16(parityShards))
 	header[12] = header[0] ^ header[2] ^ header[4] ^ header[6] ^ header[8] ^ header[10]
 	header[13] = header[1] ^ header[3] ^ header[5] ^ header[7] ^ header[9] ^ header[11]
-	chunk.buffer.Write(header)
+	output.Write(header)
 	// Calculate the highway hash for each shard
 	hashKey := make([]byte, 32)
 	for _, part := range data {
@@ -383,19 +388,224 @@ func (chunk *Chunk) Encrypt(encryptionKey []byte, derivationKey string, isMetada
 		if err != nil {
 			return err
 		}
-		chunk.buffer.Write(hasher.Sum(nil))
+		output.Write(hasher.Sum(nil))
 	}
 
 	// Copy the data
 	for _, part := range data {
-		chunk.buffer.Write(part)
+		output.Write(part)
 	}
 	// Append the header again for redundancy
-	chunk.buffer.Write(header)
+	output.Write(header)
 
 	return nil
 }
 
+// decodeErasureCoding verifies the shards in 'buffer', which must start with the erasure coding banner, and returns a
+// buffer containing only the original data, which is reconstructed from the parity shards if any data shard is
+// corrupted.  The parameters are read from the header, so chunks encoded with any number of shards can be decoded.
+// 'buffer' is released if a new buffer has to be allocated for the reconstructed data.
+func decodeErasureCoding(buffer *bytes.Buffer) (decoded *bytes.Buffer, rewriteNeeded bool, err error) {
+
+	bannerLength := len(ERASURE_CODING_BANNER)
+	if len(buffer.Bytes()) < bannerLength + 14 {
+		return buffer, false, fmt.Errorf("Erasure coding header truncated (%d bytes)", len(buffer.Bytes()))
+	}
+	// Check the header checksum
+	header := buffer.Bytes()[bannerLength: bannerLength + 14]
+	if header[12] != header[0] ^ header[2] ^ header[4] ^ header[6] ^ header[8] ^ header[10] ||
+	   header[13] != header[1] ^ header[3] ^ header[5] ^ header[7] ^ header[9] ^ header[11] {
+		return buffer, false, fmt.Errorf("Erasure coding header corrupted (%x)", header)
+	}
+
+	// Read the parameters
+	chunkSize := int(binary.LittleEndian.Uint64(header[0:8]))
+	dataShards := int(binary.LittleEndian.Uint16(header[8:10]))
+	parityShards := int(binary.LittleEndian.Uint16(header[10:12]))
+	if dataShards == 0 {
+		return buffer, false, fmt.Errorf("Erasure coding header has no data shards (%x)", header)
+	}
+	shardSize := (chunkSize + dataShards - 1) / dataShards
+	// This is the length the chunk file should have
+	expectedLength := bannerLength + 2 * len(header) + (dataShards + parityShards) * (shardSize + 32)
+	// The minimum length that can be recovered from
+	minimumLength := bannerLength + len(header) + (dataShards + parityShards) * 32 + dataShards * shardSize
+	LOG_DEBUG("CHUNK_ERASURECODE", "Chunk size: %d bytes, data size: %d, parity: %d/%d", chunkSize, len(buffer.Bytes()), dataShards, parityShards)
+	if len(buffer.Bytes()) > expectedLength {
+		LOG_WARN("CHUNK_ERASURECODE", "Chunk has %d bytes (instead of %d)", len(buffer.Bytes()), expectedLength)
+	} else if len(buffer.Bytes()) == expectedLength {
+		// Correct size; fall through
+	} else if len(buffer.Bytes()) > minimumLength {
+		LOG_WARN("CHUNK_ERASURECODE", "Chunk is truncated (%d out of %d bytes)", len(buffer.Bytes()), expectedLength)
+	} else {
+		return buffer, false, fmt.Errorf("Not enough chunk data for recovery; chunk size: %d bytes, data size: %d, parity: %d/%d", chunkSize, len(buffer.Bytes()), dataShards, parityShards)
+	}
+
+	// Where the hashes start
+	hashOffset := bannerLength + len(header)
+	// Where the data start
+	dataOffset := hashOffset + (dataShards + parityShards) * 32
+
+	data := make([][]byte, dataShards + parityShards)
+	recoveryNeeded := false
+	hashKey := make([]byte, 32)
+	availableShards := 0
+	wrongHashDetected := false
+
+	for i := 0; i < dataShards + parityShards; i++ {
+		start := dataOffset + i * shardSize
+		if start + shardSize > len(buffer.Bytes()) {
+			// the current shard is incomplete
+			break
+		}
+		// Now verify the hash
+		hasher, err := highwayhash.New(hashKey)
+		if err != nil {
+			return buffer, false, err
+		}
+		_, err = hasher.Write(buffer.Bytes()[start: start + shardSize])
+		if err != nil {
+			return buffer, false, err
+		}
+
+		matched := bytes.Compare(hasher.Sum(nil), buffer.Bytes()[hashOffset + i * 32: hashOffset + (i + 1) * 32]) == 0
+
+		if !matched && runtime.GOARCH == "arm64" {
+			hasher, err := wronghighwayhash.New(hashKey)
+			if err == nil {
+				_, err = hasher.Write(buffer.Bytes()[start: start + shardSize])
+				if err == nil {
+					matched = bytes.Compare(hasher.Sum(nil), buffer.Bytes()[hashOffset + i * 32: hashOffset + (i + 1) * 32]) == 0
+					if matched && !wrongHashDetected {
+						LOG_WARN("CHUNK_ERASURECODE", "Hash for shard %d was calculated with a wrong version of highwayhash", i)
+						wrongHashDetected = true
+						rewriteNeeded = true
+					}
+				}
+			}
+		}
+
+		if !matched {
+			if i < dataShards {
+				recoveryNeeded = true
+				rewriteNeeded = true
+			}
+		} else {
+			// The shard is good
+			data[i] = buffer.Bytes()[start: start + shardSize]
+			availableShards++
+			if availableShards >= dataShards {
+				// We have enough shards to recover; skip the remaining shards
+				break
+			}
+		}
+	}
+
+	if !recoveryNeeded {
+		// Remove the padding zeros from the last shard
+		buffer.Truncate(dataOffset + chunkSize)
+		// Skip the header and hashes
+		buffer.Read(buffer.Bytes()[:dataOffset])
+	} else {
+		if availableShards < dataShards {
+			return buffer, false, fmt.Errorf("Not enough chunk data for recover; only %d out of %d shards are complete", availableShards, dataShards + parityShards)
+		}
+
+		// Show the validity of shards using a string of * and -
+		slots := ""
+		for _, part := range data {
+			if len(part) != 0 {
+				slots += "*"
+			} else {
+				slots += "-"
+			}
+		}
+
+		LOG_WARN("CHUNK_ERASURECODE", "Recovering a %d byte chunk from %d byte shards: %s", chunkSize, shardSize, slots)
+		encoder, err := reedsolomon.New(dataShards, parityShards)
+		if err != nil {
+			return buffer, false, err
+		}
+		err = encoder.Reconstruct(data)
+		if err != nil {
+			return buffer, false, err
+		}
+		LOG_DEBUG("CHUNK_ERASURECODE", "Chunk data successfully recovered")
+		recovered := AllocateChunkBuffer()
+		recovered.Reset()
+		for i := 0; i < dataShards; i++ {
+			recovered.Write(data[i])
+		}
+		recovered.Truncate(chunkSize)
+
+		ReleaseChunkBuffer(buffer)
+		buffer = recovered
+	}
+
+	return buffer, rewriteNeeded, nil
+}
+
+// GetErasureCoding returns the numbers of data and parity shards of the chunk file content stored in the buffer, which
+// are both 0 if the content isn't encoded with erasure coding.  'valid' is false if the erasure coding header is
+// corrupted at both the start and the end of the content.
+func (chunk *Chunk) GetErasureCoding() (dataShards int, parityShards int, valid bool) {
+
+	content := chunk.buffer.Bytes()
+	bannerLength := len(ERASURE_CODING_BANNER)
+	if len(content) <= bannerLength || string(content[:bannerLength]) != ERASURE_CODING_BANNER {
+		return 0, 0, true
+	}
+
+	for _, offset := range []int{bannerLength, len(content) - 14} {
+		if offset < bannerLength || offset+14 > len(content) {
+			continue
+		}
+		header := content[offset : offset+14]
+		if header[12] == header[0]^header[2]^header[4]^header[6]^header[8]^header[10] &&
+			header[13] == header[1]^header[3]^header[5]^header[7]^header[9]^header[11] {
+			return int(binary.LittleEndian.Uint16(header[8:10])), int(binary.LittleEndian.Uint16(header[10:12])), true
+		}
+	}
+	return 0, 0, false
+}
+
+// ConvertErasureCoding re-encodes the chunk file content stored in the buffer, as downloaded from the storage, with
+// 'dataShards' data shards and 'parityShards' parity shards, or removes the erasure coding if either is 0.  The
+// content isn't decrypted so no keys are needed.  Returns false if the content is already in the requested format.
+func (chunk *Chunk) ConvertErasureCoding(dataShards int, parityShards int) (converted bool, err error) {
+
+	if dataShards == 0 || parityShards == 0 {
+		dataShards, parityShards = 0, 0
+	}
+
+	currentDataShards, currentParityShards, valid := chunk.GetErasureCoding()
+	if valid && currentDataShards == dataShards && currentParityShards == parityShards {
+		return false, nil
+	}
+
+	if !valid || currentDataShards != 0 {
+		chunk.buffer, _, err = decodeErasureCoding(chunk.buffer)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if dataShards == 0 {
+		return true, nil
+	}
+
+	encodedBuffer := AllocateChunkBuffer()
+	err = encodeErasureCoding(encodedBuffer, chunk.buffer, dataShards, parityShards)
+	if err != nil {
+		ReleaseChunkBuffer(encodedBuffer)
+		return false, err
+	}
+
+	chunk.buffer, encodedBuffer = encodedBuffer, chunk.buffer
+	ReleaseChunkBuffer(encodedBuffer)
+	return true, nil
+}
+
 // This is to ensure compatibility with Vertical Backup, which still uses HMAC-SHA256 (instead of HMAC-BLAKE2) to
 // derive the key used to encrypt/decrypt files and chunks.
 
@@ -425,138 +635,10 @@ func (chunk *Chunk) Decrypt(encryptionKey []byte, derivationKey string) (err err
 
 	if len(encryptedBuffer.Bytes()) > bannerLength && string(encryptedBuffer.Bytes()[:bannerLength]) == ERASURE_CODING_BANNER {
 
-		// The chunk was encoded with erasure coding
-		if len(encryptedBuffer.Bytes()) < bannerLength + 14 {
-			return fmt.Errorf("Erasure coding header truncated (%d bytes)", len(encryptedBuffer.Bytes())), false
-		}
-		// Check the header checksum
-		header := encryptedBuffer.Bytes()[bannerLength: bannerLength + 14]
-		if header[12] != header[0] ^ header[2] ^ header[4] ^ header[6] ^ header[8] ^ header[10] ||
-		   header[13] != header[1] ^ header[3] ^ header[5] ^ header[7] ^ header[9] ^ header[11] {
-			return fmt.Errorf("Erasure coding header corrupted (%x)", header), false
-		}
-
-		// Read the parameters
-		chunkSize := int(binary.LittleEndian.Uint64(header[0:8]))
-		dataShards := int(binary.LittleEndian.Uint16(header[8:10]))
-		parityShards := int(binary.LittleEndian.Uint16(header[10:12]))
-		shardSize := (chunkSize + chunk.config.DataShards - 1) / chunk.config.DataShards
-		// This is the length the chunk file should have
-		expectedLength := bannerLength + 2 * len(header) + (dataShards + parityShards) * (shardSize + 32)
-		// The minimum length that can be recovered from
-		minimumLength := bannerLength + len(header) + (dataShards + parityShards) * 32 + dataShards * shardSize
-		LOG_DEBUG("CHUNK_ERASURECODE", "Chunk size: %d bytes, data size: %d, parity: %d/%d", chunkSize, len(encryptedBuffer.Bytes()), dataShards, parityShards)
-		if len(encryptedBuffer.Bytes()) > expectedLength {
-			LOG_WARN("CHUNK_ERASURECODE", "Chunk has %d bytes (instead of %d)", len(encryptedBuffer.Bytes()), expectedLength)
-		} else if len(encryptedBuffer.Bytes()) == expectedLength {
-			// Correct size; fall through
-		} else if len(encryptedBuffer.Bytes()) > minimumLength {
-			LOG_WARN("CHUNK_ERASURECODE", "Chunk is truncated (%d out of %d bytes)", len(encryptedBuffer.Bytes()), expectedLength)
-		} else {
-			return fmt.Errorf("Not enough chunk data for recovery; chunk size: %d bytes, data size: %d, parity: %d/%d", chunkSize, len(encryptedBuffer.Bytes()), dataShards, parityShards), false
-		}
-
-		// Where the hashes start
-		hashOffset := bannerLength + len(header)
-		// Where the data start
-		dataOffset := hashOffset + (dataShards + parityShards) * 32
-
-		data := make([][]byte, dataShards + parityShards)
-		recoveryNeeded := false
-		hashKey := make([]byte, 32)
-		availableShards := 0
-		wrongHashDetected := false
-
-		for i := 0; i < dataShards + parityShards; i++ {
-			start := dataOffset + i * shardSize
-			if start + shardSize > len(encryptedBuffer.Bytes()) {
-				// the current shard is incomplete
-				break
-			}
-			// Now verify the hash
-			hasher, err := highwayhash.New(hashKey)
-			if err != nil {
-				return err, false
-			}
-			_, err = hasher.Write(encryptedBuffer.Bytes()[start: start + shardSize])
-			if err != nil {
-				return err, false
-			}
-
-			matched := bytes.Compare(hasher.Sum(nil), encryptedBuffer.Bytes()[hashOffset + i * 32: hashOffset + (i + 1) * 32]) == 0
-
-			if !matched && runtime.GOARCH == "arm64" {
-				hasher, err := wronghighwayhash.New(hashKey)
-				if err == nil {
-					_, err = hasher.Write(encryptedBuffer.Bytes()[start: start + shardSize])
-					if err == nil {
-						matched = bytes.Compare(hasher.Sum(nil), encryptedBuffer.Bytes()[hashOffset + i * 32: hashOffset + (i + 1) * 32]) == 0
-						if matched && !wrongHashDetected {
-							LOG_WARN("CHUNK_ERASURECODE", "Hash for shard %d was calculated with a wrong version of highwayhash", i)
-							wrongHashDetected = true
-							rewriteNeeded = true
-						}
-					}
-				}
-			}
-
-			if !matched {
-				if i < dataShards {
-					recoveryNeeded = true
-					rewriteNeeded = true
-				}
-			} else {
-				// The shard is good
-				data[i] = encryptedBuffer.Bytes()[start: start + shardSize]
-				availableShards++
-				if availableShards >= dataShards {
-					// We have enough shards to recover; skip the remaining shards
-					break
-				}
-			}
-		}
-
-		if !recoveryNeeded {
-			// Remove the padding zeros from the last shard
-			encryptedBuffer.Truncate(dataOffset + chunkSize)
-			// Skip the header and hashes
-			encryptedBuffer.Read(encryptedBuffer.Bytes()[:dataOffset])
-		} else {
-			if availableShards < dataShards {
-				return fmt.Errorf("Not enough chunk data for recover; only %d out of %d shards are complete", availableShards, dataShards + parityShards), false
-			}
-
-			// Show the validity of shards using a string of * and -
-			slots := ""
-			for _, part := range data {
-				if len(part) != 0 {
-					slots += "*"
-				} else {
-					slots += "-"
-				}
-			}
-
-			LOG_WARN("CHUNK_ERASURECODE", "Recovering a %d byte chunk from %d byte shards: %s", chunkSize, shardSize, slots)
-			encoder, err := reedsolomon.New(dataShards, parityShards)
-			if err != nil {
-				return err, false
-			}
-			err = encoder.Reconstruct(data)
-			if err != nil {
-				return err, false
-			}
-			LOG_DEBUG("CHUNK_ERASURECODE", "Chunk data successfully recovered")
-			buffer := AllocateChunkBuffer()
-			buffer.Reset()
-			for i := 0; i < dataShards; i++ {
-				buffer.Write(data[i])
-			}
-			buffer.Truncate(chunkSize)
-
-			ReleaseChunkBuffer(encryptedBuffer)
-			encryptedBuffer = buffer
+		encryptedBuffer, rewriteNeeded, err = decodeErasureCoding(encryptedBuffer)
+		if err != nil {
+			return err, false
 		}
-
 	}
 
 	if len(encryptionKey) > 0 {
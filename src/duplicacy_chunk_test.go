@@ -51,6 +51,56 @@ func TestErasureCoding(t *testing.T) {
 	return
 }
 
+func TestChunkConvertErasureCoding(t *testing.T) {
+	key := []byte("duplicacydefault")
+
+	config := CreateConfig()
+	config.HashKey = key
+	config.IDKey = key
+	config.MinimumChunkSize = 100
+	config.CompressionLevel = DEFAULT_COMPRESSION_LEVEL
+
+	plainData := make([]byte, 10000)
+	crypto_rand.Read(plainData)
+
+	chunk := CreateChunk(config, true)
+	chunk.Reset(true)
+	chunk.Write(plainData)
+	err := chunk.Encrypt(key, "", false)
+	if err != nil {
+		t.Fatalf("Failed to encrypt the data: %v", err)
+	}
+
+	// Chunks must be decodable regardless of the erasure coding parameters in the config
+	for _, shards := range [][3]int{{5, 2, 1}, {3, 1, 1}, {3, 1, 0}, {0, 0, 1}} {
+		converted, err := chunk.ConvertErasureCoding(shards[0], shards[1])
+		if err != nil {
+			t.Fatalf("Failed to convert the chunk to %d:%d: %v", shards[0], shards[1], err)
+		}
+		if converted != (shards[2] == 1) {
+			t.Errorf("Converting the chunk to %d:%d returned %t", shards[0], shards[1], converted)
+		}
+
+		dataShards, parityShards, valid := chunk.GetErasureCoding()
+		if !valid || dataShards != shards[0] || parityShards != shards[1] {
+			t.Errorf("The chunk is in the format %d:%d instead of %d:%d", dataShards, parityShards, shards[0], shards[1])
+		}
+		encryptedData := make([]byte, chunk.GetLength())
+		copy(encryptedData, chunk.GetBytes())
+
+		decrypted := CreateChunk(config, true)
+		decrypted.Reset(false)
+		decrypted.Write(encryptedData)
+		err, _ = decrypted.Decrypt(key, "")
+		if err != nil {
+			t.Fatalf("Failed to decrypt the chunk in the format %d:%d: %v", shards[0], shards[1], err)
+		}
+		if bytes.Compare(plainData, decrypted.GetBytes()) != 0 {
+			t.Errorf("The chunk in the format %d:%d has different content", shards[0], shards[1])
+		}
+	}
+}
+
 func TestChunkBasic(t *testing.T) {
 
 	key := []byte("duplicacydefault")
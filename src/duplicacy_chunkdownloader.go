@@ -114,9 +114,7 @@ func (downloader *ChunkDownloader) Prefetch(file *Entry) {
 
 				LOG_DEBUG("DOWNLOAD_PREFETCH", "Prefetching %s chunk %s", file.Path,
 					downloader.operator.config.GetChunkIDFromHash(task.chunkHash))
-				downloader.operator.DownloadAsync(task.chunkHash, i, false, func (chunk *Chunk, chunkIndex int) {
-					downloader.completionChannel <- ChunkDownloadCompletion { chunk: chunk, chunkIndex: chunkIndex }
-				})
+				downloader.operator.DownloadAsync(task.chunkHash, i, false, downloader.complete)
 				task.isDownloading = true
 				downloader.numberOfDownloadingChunks++
 				downloader.numberOfActiveChunks++
@@ -164,6 +162,26 @@ func (downloader *ChunkDownloader) GetLastDownloadedChunk() (chunk *Chunk, chunk
 	return task.chunk, task.chunkHash
 }
 
+// complete is called by the downloading goroutines when a chunk has been downloaded.  The chunk is dropped if the
+// running operation has been canceled, as nobody may be waiting for it any more.
+func (downloader *ChunkDownloader) complete(chunk *Chunk, chunkIndex int) {
+	select {
+	case downloader.completionChannel <- ChunkDownloadCompletion{chunk: chunk, chunkIndex: chunkIndex}:
+	case <-operationDone():
+	}
+}
+
+// receiveCompletion returns the next chunk downloaded, unless the running operation is canceled while waiting.
+func (downloader *ChunkDownloader) receiveCompletion() ChunkDownloadCompletion {
+	select {
+	case completion := <-downloader.completionChannel:
+		return completion
+	case <-operationDone():
+		checkCanceled()
+		return ChunkDownloadCompletion{}
+	}
+}
+
 // WaitForChunk waits until the specified chunk is ready
 func (downloader *ChunkDownloader) WaitForChunk(chunkIndex int) (chunk *Chunk) {
 
@@ -174,9 +192,7 @@ func (downloader *ChunkDownloader) WaitForChunk(chunkIndex int) (chunk *Chunk) {
 	if !downloader.taskList[chunkIndex].isDownloading {
 		LOG_DEBUG("DOWNLOAD_FETCH", "Fetching chunk %s",
 			downloader.operator.config.GetChunkIDFromHash(downloader.taskList[chunkIndex].chunkHash))
-		downloader.operator.DownloadAsync(downloader.taskList[chunkIndex].chunkHash, chunkIndex, false, func (chunk *Chunk, chunkIndex int) {
-			downloader.completionChannel <- ChunkDownloadCompletion { chunk: chunk, chunkIndex: chunkIndex }
-		})
+		downloader.operator.DownloadAsync(downloader.taskList[chunkIndex].chunkHash, chunkIndex, false, downloader.complete)
 		downloader.taskList[chunkIndex].isDownloading = true
 		downloader.numberOfDownloadingChunks++
 		downloader.numberOfActiveChunks++
@@ -194,9 +210,7 @@ func (downloader *ChunkDownloader) WaitForChunk(chunkIndex int) (chunk *Chunk) {
 
 		if !task.isDownloading {
 			LOG_DEBUG("DOWNLOAD_PREFETCH", "Prefetching chunk %s", downloader.operator.config.GetChunkIDFromHash(task.chunkHash))
-			downloader.operator.DownloadAsync(task.chunkHash, task.chunkIndex, false, func (chunk *Chunk, chunkIndex int) {
-				downloader.completionChannel <- ChunkDownloadCompletion { chunk: chunk, chunkIndex: chunkIndex }
-			})
+			downloader.operator.DownloadAsync(task.chunkHash, task.chunkIndex, false, downloader.complete)
 			task.isDownloading = true
 			downloader.numberOfDownloadingChunks++
 			downloader.numberOfActiveChunks++
@@ -205,7 +219,7 @@ func (downloader *ChunkDownloader) WaitForChunk(chunkIndex int) (chunk *Chunk) {
 
 	// Now wait until the chunk to be downloaded appears in the completed tasks
 	for _, found := downloader.completedTasks[chunkIndex]; !found; _, found = downloader.completedTasks[chunkIndex] {
-		completion := <-downloader.completionChannel
+		completion := downloader.receiveCompletion()
 		downloader.completedTasks[completion.chunkIndex] = true
 		downloader.taskList[completion.chunkIndex].chunk = completion.chunk
 		downloader.numberOfDownloadedChunks++
@@ -232,7 +246,7 @@ func (downloader *ChunkDownloader) WaitForCompletion() {
 
 		// Wait for a completion event first
 		if downloader.numberOfActiveChunks > 0 {
-			completion := <-downloader.completionChannel
+			completion := downloader.receiveCompletion()
 			downloader.operator.config.PutChunk(completion.chunk)
 			downloader.numberOfActiveChunks--
 			downloader.numberOfDownloadedChunks++
@@ -246,9 +260,7 @@ func (downloader *ChunkDownloader) WaitForCompletion() {
 				downloader.lastChunkIndex++
 				continue
 			}
-			downloader.operator.DownloadAsync(task.chunkHash, task.chunkIndex, false, func (chunk *Chunk, chunkIndex int) {
-				downloader.completionChannel <- ChunkDownloadCompletion { chunk: chunk, chunkIndex: chunkIndex }
-			})
+			downloader.operator.DownloadAsync(task.chunkHash, task.chunkIndex, false, downloader.complete)
 			task.isDownloading = true
 			downloader.numberOfDownloadingChunks++
 			downloader.numberOfActiveChunks++
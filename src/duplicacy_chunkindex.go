@@ -0,0 +1,553 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// MaxChunksInMemory is the number of chunks a ChunkIndex keeps in memory before it starts to spill them to disk.  It
+// can be changed by the environment variable DUPLICACY_MAX_CHUNKS_IN_MEMORY.
+var MaxChunksInMemory = 4 * 1024 * 1024
+
+const (
+	chunkKeySize        = 32               // Chunk ids are hex strings of 32-byte hashes
+	chunkRecordSize     = chunkKeySize + 8 // The key followed by the value as a big-endian int64
+	chunkBlockSize      = 1024             // Number of records per block when looking up a chunk on disk
+	chunkBlockCacheSize = 16               // Number of blocks kept in memory
+	chunkMaxRuns        = 16               // Runs are merged into one when there are more than this many
+	chunkIndexFileMode  = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+)
+
+type chunkKey [chunkKeySize]byte
+
+type chunkRecord struct {
+	key   chunkKey
+	value int64
+}
+
+type chunkEntry struct {
+	position int
+	value    int64
+}
+
+// ChunkIndex is a set of chunk ids, each with an int64 value such as the chunk size, for storages with too many
+// chunks to fit a map in memory.  Chunks are kept in memory as 32-byte keys until there are more than
+// MaxChunksInMemory of them, after which they are written to sorted runs on disk, to be merged into one sorted file
+// by Seal.
+//
+// Chunks are added first and then Seal is called, after which chunks can be looked up.  Each chunk is assigned a
+// position between 0 and Len()-1 so that callers can keep their own per-chunk state in a slice.  Chunks added after
+// Seal are kept in memory.  Looking up chunks in sorted order is much faster than in random order, since each block
+// of the sorted file is then read only once.
+type ChunkIndex struct {
+	limit int
+
+	memory map[chunkKey]int64
+	others map[string]int64 // Ids that are not in the standard format, always kept in memory
+
+	directory string   // The temporary directory for the runs, created on the first spill
+	runs      []string // Sorted files of unique records
+
+	sealed    bool
+	records   []chunkRecord // Sorted records if nothing was spilled to disk
+	file      *os.File      // The merged file if chunks were spilled to disk
+	count     int           // Number of records in 'records' or 'file'
+	blockKeys []chunkKey    // The first key of each block in 'file'
+	cache     map[int][]chunkRecord
+	cacheKeys []int
+
+	otherPositions map[string]chunkEntry
+	extra          map[string]chunkEntry // Chunks added after Seal
+}
+
+// CreateChunkIndex creates an empty chunk index.
+func CreateChunkIndex() *ChunkIndex {
+	limit := MaxChunksInMemory
+	if value, found := os.LookupEnv("DUPLICACY_MAX_CHUNKS_IN_MEMORY"); found && value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			limit = n
+		}
+	}
+
+	return &ChunkIndex{
+		limit:  limit,
+		memory: make(map[chunkKey]int64),
+		others: make(map[string]int64),
+		extra:  make(map[string]chunkEntry),
+	}
+}
+
+func getChunkKey(chunkID string) (key chunkKey, ok bool) {
+	if len(chunkID) != 2*chunkKeySize {
+		return key, false
+	}
+	_, err := hex.Decode(key[:], []byte(chunkID))
+	return key, err == nil
+}
+
+// Add adds a chunk with the given value.  If the chunk is already in the index the value is not changed unless the
+// chunk is still in memory.
+func (index *ChunkIndex) Add(chunkID string, value int64) {
+
+	if index.sealed {
+		if _, found := index.Find(chunkID); !found {
+			index.extra[chunkID] = chunkEntry{position: index.Len(), value: value}
+		}
+		return
+	}
+
+	key, ok := getChunkKey(chunkID)
+	if !ok {
+		index.others[chunkID] = value
+		return
+	}
+
+	index.memory[key] = value
+	if len(index.memory) >= index.limit {
+		err := index.spill()
+		if err != nil {
+			LOG_ERROR("CHUNK_INDEX", "Failed to write the chunk index to disk: %v", err)
+		}
+	}
+}
+
+// IsOnDisk returns true if the index has been spilled to disk.
+func (index *ChunkIndex) IsOnDisk() bool {
+	return len(index.runs) > 0 || index.file != nil
+}
+
+// spill writes the chunks in memory to a new sorted run.
+func (index *ChunkIndex) spill() error {
+
+	if index.directory == "" {
+		directory := preferencePath
+		if directory == "" {
+			directory = os.TempDir()
+		}
+		var err error
+		index.directory, err = ioutil.TempDir(directory, "chunk_index")
+		if err != nil {
+			return err
+		}
+		LOG_INFO("CHUNK_INDEX", "More than %d chunks; using %s to store the chunk index", index.limit, index.directory)
+	}
+
+	records := index.sortMemory()
+	runPath := path.Join(index.directory, fmt.Sprintf("run%d", len(index.runs)))
+	err := writeChunkRecords(runPath, records)
+	if err != nil {
+		return err
+	}
+	index.runs = append(index.runs, runPath)
+	index.memory = make(map[chunkKey]int64)
+
+	if len(index.runs) > chunkMaxRuns {
+		return index.mergeRuns(path.Join(index.directory, "merged"))
+	}
+	return nil
+}
+
+func (index *ChunkIndex) sortMemory() []chunkRecord {
+	records := make([]chunkRecord, 0, len(index.memory))
+	for key, value := range index.memory {
+		records = append(records, chunkRecord{key, value})
+	}
+	sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i].key[:], records[j].key[:]) < 0 })
+	return records
+}
+
+func writeChunkRecords(filePath string, records []chunkRecord) error {
+	file, err := os.OpenFile(filePath, chunkIndexFileMode, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	var buffer [chunkRecordSize]byte
+	for _, record := range records {
+		copy(buffer[:], record.key[:])
+		binary.BigEndian.PutUint64(buffer[chunkKeySize:], uint64(record.value))
+		if _, err = writer.Write(buffer[:]); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// chunkRunReader reads records from a sorted run one by one.
+type chunkRunReader struct {
+	file   *os.File
+	reader *bufio.Reader
+	record chunkRecord
+}
+
+func (run *chunkRunReader) next() (bool, error) {
+	var buffer [chunkRecordSize]byte
+	_, err := io.ReadFull(run.reader, buffer[:])
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	copy(run.record.key[:], buffer[:chunkKeySize])
+	run.record.value = int64(binary.BigEndian.Uint64(buffer[chunkKeySize:]))
+	return true, nil
+}
+
+type chunkRunHeap []*chunkRunReader
+
+func (h chunkRunHeap) Len() int { return len(h) }
+func (h chunkRunHeap) Less(i, j int) bool {
+	return bytes.Compare(h[i].record.key[:], h[j].record.key[:]) < 0
+}
+func (h chunkRunHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *chunkRunHeap) Push(x interface{}) { *h = append(*h, x.(*chunkRunReader)) }
+func (h *chunkRunHeap) Pop() interface{} {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
+
+// mergeRuns merges all runs into the file at 'mergedPath', dropping duplicate chunks, and makes it the only run.
+func (index *ChunkIndex) mergeRuns(mergedPath string) error {
+
+	runHeap := &chunkRunHeap{}
+	defer func() {
+		for _, run := range *runHeap {
+			run.file.Close()
+		}
+	}()
+
+	for _, runPath := range index.runs {
+		file, err := os.Open(runPath)
+		if err != nil {
+			return err
+		}
+		run := &chunkRunReader{file: file, reader: bufio.NewReader(file)}
+		ok, err := run.next()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if ok {
+			heap.Push(runHeap, run)
+		} else {
+			file.Close()
+		}
+	}
+
+	temporaryPath := mergedPath + ".tmp"
+	output, err := os.OpenFile(temporaryPath, chunkIndexFileMode, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(output)
+
+	var buffer [chunkRecordSize]byte
+	var lastKey chunkKey
+	count := 0
+	for runHeap.Len() > 0 {
+		run := (*runHeap)[0]
+		if count == 0 || run.record.key != lastKey {
+			lastKey = run.record.key
+			copy(buffer[:], run.record.key[:])
+			binary.BigEndian.PutUint64(buffer[chunkKeySize:], uint64(run.record.value))
+			if _, err = writer.Write(buffer[:]); err != nil {
+				output.Close()
+				return err
+			}
+			count++
+		}
+
+		ok, err := run.next()
+		if err != nil {
+			output.Close()
+			return err
+		}
+		if ok {
+			heap.Fix(runHeap, 0)
+		} else {
+			run.file.Close()
+			heap.Pop(runHeap)
+		}
+	}
+
+	if err = writer.Flush(); err != nil {
+		output.Close()
+		return err
+	}
+	if err = output.Close(); err != nil {
+		return err
+	}
+
+	for _, runPath := range index.runs {
+		os.Remove(runPath)
+	}
+	if err = os.Rename(temporaryPath, mergedPath); err != nil {
+		return err
+	}
+	index.runs = []string{mergedPath}
+	return nil
+}
+
+// Save writes all chunks added so far to the file at 'filePath' as one sorted run, so that they can be restored by
+// Load.  Chunk ids not in the standard format are not saved.  It must be called before Seal.
+func (index *ChunkIndex) Save(filePath string) error {
+
+	temporaryPath := filePath + ".tmp"
+	if len(index.runs) == 0 {
+		if err := writeChunkRecords(temporaryPath, index.sortMemory()); err != nil {
+			return err
+		}
+	} else {
+		if len(index.memory) > 0 {
+			if err := index.spill(); err != nil {
+				return err
+			}
+		}
+		if len(index.runs) > 1 {
+			if err := index.mergeRuns(path.Join(index.directory, "merged")); err != nil {
+				return err
+			}
+		}
+		if err := copyChunkRun(index.runs[0], temporaryPath); err != nil {
+			return err
+		}
+	}
+	return os.Rename(temporaryPath, filePath)
+}
+
+func copyChunkRun(from string, to string) error {
+	input, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.OpenFile(to, chunkIndexFileMode, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(output, input); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// Load adds the chunks saved by Save in the file at 'filePath'.
+func (index *ChunkIndex) Load(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	run := &chunkRunReader{file: file, reader: bufio.NewReader(file)}
+	for {
+		ok, err := run.next()
+		if err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+		index.Add(hex.EncodeToString(run.record.key[:]), run.record.value)
+	}
+}
+
+// Seal finishes adding chunks and prepares the index for lookups.
+func (index *ChunkIndex) Seal() error {
+
+	if index.sealed {
+		return nil
+	}
+	index.sealed = true
+
+	if len(index.runs) == 0 {
+		index.records = index.sortMemory()
+		index.count = len(index.records)
+	} else {
+		if len(index.memory) > 0 {
+			if err := index.spill(); err != nil {
+				return err
+			}
+		}
+		mergedPath := path.Join(index.directory, "sealed")
+		if err := index.mergeRuns(mergedPath); err != nil {
+			return err
+		}
+		file, err := os.Open(mergedPath)
+		if err != nil {
+			return err
+		}
+		index.file = file
+
+		stat, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		index.count = int(stat.Size() / chunkRecordSize)
+
+		// Read the first key of each block
+		var key chunkKey
+		for i := 0; i < index.count; i += chunkBlockSize {
+			if _, err = file.ReadAt(key[:], int64(i)*chunkRecordSize); err != nil {
+				return err
+			}
+			index.blockKeys = append(index.blockKeys, key)
+		}
+		index.cache = make(map[int][]chunkRecord)
+	}
+	index.memory = nil
+
+	otherIDs := make([]string, 0, len(index.others))
+	for chunkID := range index.others {
+		otherIDs = append(otherIDs, chunkID)
+	}
+	sort.Strings(otherIDs)
+	index.otherPositions = make(map[string]chunkEntry)
+	for i, chunkID := range otherIDs {
+		index.otherPositions[chunkID] = chunkEntry{position: index.count + i, value: index.others[chunkID]}
+	}
+	index.others = nil
+
+	return nil
+}
+
+// Len returns the number of unique chunks in a sealed index.
+func (index *ChunkIndex) Len() int {
+	return index.count + len(index.otherPositions) + len(index.extra)
+}
+
+// readBlock returns the records in the given block of the merged file.
+func (index *ChunkIndex) readBlock(block int) []chunkRecord {
+
+	if records, found := index.cache[block]; found {
+		return records
+	}
+
+	start := block * chunkBlockSize
+	end := start + chunkBlockSize
+	if end > index.count {
+		end = index.count
+	}
+
+	buffer := make([]byte, (end-start)*chunkRecordSize)
+	_, err := index.file.ReadAt(buffer, int64(start)*chunkRecordSize)
+	if err != nil {
+		LOG_ERROR("CHUNK_INDEX", "Failed to read the chunk index: %v", err)
+		return nil
+	}
+
+	records := make([]chunkRecord, end-start)
+	for i := range records {
+		record := buffer[i*chunkRecordSize : (i+1)*chunkRecordSize]
+		copy(records[i].key[:], record[:chunkKeySize])
+		records[i].value = int64(binary.BigEndian.Uint64(record[chunkKeySize:]))
+	}
+
+	if len(index.cacheKeys) >= chunkBlockCacheSize {
+		delete(index.cache, index.cacheKeys[0])
+		index.cacheKeys = index.cacheKeys[1:]
+	}
+	index.cache[block] = records
+	index.cacheKeys = append(index.cacheKeys, block)
+	return records
+}
+
+// Find looks up a chunk in a sealed index and returns its position and value.
+func (index *ChunkIndex) Find(chunkID string) (entry chunkEntry, found bool) {
+
+	if entry, found = index.extra[chunkID]; found {
+		return entry, true
+	}
+
+	key, ok := getChunkKey(chunkID)
+	if !ok {
+		entry, found = index.otherPositions[chunkID]
+		return entry, found
+	}
+
+	records := index.records
+	offset := 0
+	if index.file != nil {
+		block := sort.Search(len(index.blockKeys), func(i int) bool {
+			return bytes.Compare(index.blockKeys[i][:], key[:]) > 0
+		}) - 1
+		if block < 0 {
+			return entry, false
+		}
+		records = index.readBlock(block)
+		offset = block * chunkBlockSize
+	}
+
+	i := sort.Search(len(records), func(i int) bool { return bytes.Compare(records[i].key[:], key[:]) >= 0 })
+	if i < len(records) && records[i].key == key {
+		return chunkEntry{position: offset + i, value: records[i].value}, true
+	}
+	return entry, false
+}
+
+// ForEach calls 'visit' for every chunk in a sealed index in the order of their positions.
+func (index *ChunkIndex) ForEach(visit func(chunkID string, entry chunkEntry)) error {
+
+	if index.file != nil {
+		run := &chunkRunReader{reader: bufio.NewReader(io.NewSectionReader(index.file, 0, int64(index.count)*chunkRecordSize))}
+		for position := 0; ; position++ {
+			ok, err := run.next()
+			if err != nil {
+				return err
+			} else if !ok {
+				break
+			}
+			visit(hex.EncodeToString(run.record.key[:]), chunkEntry{position: position, value: run.record.value})
+		}
+	} else {
+		for position, record := range index.records {
+			visit(hex.EncodeToString(record.key[:]), chunkEntry{position: position, value: record.value})
+		}
+	}
+
+	for _, entries := range []map[string]chunkEntry{index.otherPositions, index.extra} {
+		chunkIDs := make([]string, 0, len(entries))
+		for chunkID := range entries {
+			chunkIDs = append(chunkIDs, chunkID)
+		}
+		sort.Slice(chunkIDs, func(i, j int) bool { return entries[chunkIDs[i]].position < entries[chunkIDs[j]].position })
+		for _, chunkID := range chunkIDs {
+			visit(chunkID, entries[chunkID])
+		}
+	}
+	return nil
+}
+
+// Close removes the files used by the index.
+func (index *ChunkIndex) Close() {
+	if index.file != nil {
+		index.file.Close()
+		index.file = nil
+	}
+	if index.directory != "" {
+		os.RemoveAll(index.directory)
+		index.directory = ""
+	}
+}
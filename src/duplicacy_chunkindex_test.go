@@ -0,0 +1,153 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+func generateRandomChunkIDs(count int) (chunkIDs []string) {
+	for i := 0; i < count; i++ {
+		id := make([]byte, 32)
+		rand.Read(id)
+		chunkIDs = append(chunkIDs, hex.EncodeToString(id))
+	}
+	return chunkIDs
+}
+
+func testChunkIndex(t *testing.T, limit int) {
+
+	maxChunksInMemory := MaxChunksInMemory
+	MaxChunksInMemory = limit
+	defer func() { MaxChunksInMemory = maxChunksInMemory }()
+
+	chunkIDs := generateRandomChunkIDs(5000)
+	missingIDs := generateRandomChunkIDs(100)
+
+	index := CreateChunkIndex()
+	defer index.Close()
+
+	// Add every chunk twice, and one chunk id not in the standard format
+	for round := 0; round < 2; round++ {
+		for i, chunkID := range chunkIDs {
+			index.Add(chunkID, int64(i))
+		}
+	}
+	index.Add("temporary.tmp", 7)
+
+	if index.IsOnDisk() != (limit < len(chunkIDs)) {
+		t.Errorf("Limit %d: the index is on disk: %t", limit, index.IsOnDisk())
+	}
+
+	err := index.Seal()
+	if err != nil {
+		t.Fatalf("Limit %d: failed to seal the index: %v", limit, err)
+	}
+
+	if index.Len() != len(chunkIDs)+1 {
+		t.Errorf("Limit %d: expecting %d chunks, got %d", limit, len(chunkIDs)+1, index.Len())
+	}
+
+	sortedIDs := append([]string{}, chunkIDs...)
+	sort.Strings(sortedIDs)
+	for i, chunkID := range chunkIDs {
+		entry, found := index.Find(chunkID)
+		if !found {
+			t.Errorf("Limit %d: chunk %s not found", limit, chunkID)
+		} else if entry.value != int64(i) {
+			t.Errorf("Limit %d: chunk %s has a value of %d instead of %d", limit, chunkID, entry.value, i)
+		} else if sortedIDs[entry.position] != chunkID {
+			t.Errorf("Limit %d: chunk %s is at the wrong position %d", limit, chunkID, entry.position)
+		}
+	}
+
+	for _, chunkID := range missingIDs {
+		if _, found := index.Find(chunkID); found {
+			t.Errorf("Limit %d: chunk %s should not be found", limit, chunkID)
+		}
+	}
+
+	if entry, found := index.Find("temporary.tmp"); !found || entry.value != 7 || entry.position != len(chunkIDs) {
+		t.Errorf("Limit %d: unexpected entry %v for temporary.tmp", limit, entry)
+	}
+
+	index.Add(missingIDs[0], 9)
+	if entry, found := index.Find(missingIDs[0]); !found || entry.value != 9 || entry.position != len(chunkIDs)+1 {
+		t.Errorf("Limit %d: unexpected entry %v for chunk added after sealing", limit, entry)
+	}
+
+	positions := 0
+	index.ForEach(func(chunkID string, entry chunkEntry) {
+		if entry.position != positions {
+			t.Errorf("Limit %d: chunk %s is visited at position %d instead of %d", limit, chunkID, positions, entry.position)
+		}
+		positions++
+	})
+	if positions != index.Len() {
+		t.Errorf("Limit %d: visited %d chunks instead of %d", limit, positions, index.Len())
+	}
+}
+
+func TestChunkIndex(t *testing.T) {
+
+	setTestingT(t)
+	SetDuplicacyPreferencePath("")
+
+	for _, limit := range []int{1 << 20, 100, 10} {
+		testChunkIndex(t, limit)
+	}
+}
+
+func TestChunkIndexSaveAndLoad(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "chunk_index_test")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	SetDuplicacyPreferencePath(testDir)
+
+	maxChunksInMemory := MaxChunksInMemory
+	MaxChunksInMemory = 100
+	defer func() { MaxChunksInMemory = maxChunksInMemory }()
+
+	chunkIDs := generateRandomChunkIDs(1000)
+
+	index := CreateChunkIndex()
+	for _, chunkID := range chunkIDs[:500] {
+		index.Add(chunkID, 1)
+	}
+	savedPath := path.Join(testDir, "saved")
+	err := index.Save(savedPath)
+	if err != nil {
+		t.Fatalf("Failed to save the index: %v", err)
+	}
+	index.Close()
+
+	index = CreateChunkIndex()
+	defer index.Close()
+	err = index.Load(savedPath)
+	if err != nil {
+		t.Fatalf("Failed to load the index: %v", err)
+	}
+	for _, chunkID := range chunkIDs[250:] {
+		index.Add(chunkID, 1)
+	}
+	index.Seal()
+
+	if index.Len() != len(chunkIDs) {
+		t.Errorf("Expecting %d chunks, got %d", len(chunkIDs), index.Len())
+	}
+	for _, chunkID := range chunkIDs {
+		if _, found := index.Find(chunkID); !found {
+			t.Errorf("Chunk %s not found", chunkID)
+		}
+	}
+}
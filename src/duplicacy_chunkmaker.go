@@ -135,26 +135,74 @@ func (maker *ChunkMaker) startNewChunk() (chunk *Chunk) {
 	return
 }
 
+// fill moves data from the buffer to the chunk.
+func (maker *ChunkMaker) fill(count int) {
+
+	if maker.bufferStart+count < maker.bufferCapacity {
+		maker.chunk.Write(maker.buffer[maker.bufferStart : maker.bufferStart+count])
+		maker.bufferStart += count
+		maker.bufferSize -= count
+	} else {
+		maker.chunk.Write(maker.buffer[maker.bufferStart:])
+		maker.chunk.Write(maker.buffer[:count-(maker.bufferCapacity-maker.bufferStart)])
+		maker.bufferStart = count - (maker.bufferCapacity - maker.bufferStart)
+		maker.bufferSize -= count
+	}
+}
+
+// ForceChunkBoundary ends the current chunk with whatever data has been added so far, so that the data passed to
+// the next AddData call starts a new chunk.  This has no effect with fixed-size chunking, where every file already
+// starts a new chunk.
+func (maker *ChunkMaker) ForceChunkBoundary(sendChunk func(*Chunk)) {
+
+	if maker.minimumChunkSize == maker.maximumChunkSize {
+		return
+	}
+
+	if maker.bufferSize > 0 {
+		maker.fill(maker.bufferSize)
+	}
+
+	if maker.chunk.GetLength() > 0 {
+		sendChunk(maker.chunk)
+		maker.startNewChunk()
+	}
+}
+
+// AddEntry appends the encoded metadata of a single entry to the current chunk.  Unlike AddData, chunk boundaries
+// are only placed between entries, and whether a chunk ends after an entry depends only on 'key' (normally the
+// entry path) and the length of the encoded entry.  As a result unchanged runs of entries are packed into the same
+// metadata chunks from one backup to the next, no matter what has changed before them.  Call ForceChunkBoundary
+// to send out the last chunk.
+func (maker *ChunkMaker) AddEntry(key string, data []byte, sendChunk func(*Chunk)) {
+
+	if maker.chunk.GetLength() > 0 && maker.chunk.GetLength()+len(data) > maker.maximumChunkSize {
+		sendChunk(maker.chunk)
+		maker.startNewChunk()
+	}
+
+	maker.chunk.Write(data)
+
+	chunkLength := maker.chunk.GetLength()
+	if chunkLength < maker.minimumChunkSize {
+		return
+	}
+
+	// The probability of ending the chunk is proportional to the entry length, so the average chunk size stays
+	// close to the average size passed to CreateMetaDataChunkMaker.
+	sum := maker.buzhashSum(0, []byte(key))
+	if sum&maker.hashMask < uint64(len(data)) || chunkLength >= maker.maximumChunkSize {
+		sendChunk(maker.chunk)
+		maker.startNewChunk()
+	}
+}
+
 func (maker *ChunkMaker) AddData(reader io.Reader, sendChunk func(*Chunk)) (int64, string) {
 
 	isEOF := false
 	fileSize := int64(0)
 	fileHasher := maker.config.NewFileHasher()
-
-	// Move data from the buffer to the chunk.
-	fill := func(count int) {
-
-		if maker.bufferStart+count < maker.bufferCapacity {
-			maker.chunk.Write(maker.buffer[maker.bufferStart : maker.bufferStart+count])
-			maker.bufferStart += count
-			maker.bufferSize -= count
-		} else {
-			maker.chunk.Write(maker.buffer[maker.bufferStart:])
-			maker.chunk.Write(maker.buffer[:count-(maker.bufferCapacity-maker.bufferStart)])
-			maker.bufferStart = count - (maker.bufferCapacity - maker.bufferStart)
-			maker.bufferSize -= count
-		}
-	}
+	fill := maker.fill
 
 	var err error
 
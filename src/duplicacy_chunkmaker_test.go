@@ -7,6 +7,7 @@ package duplicacy
 import (
 	"bytes"
 	crypto_rand "crypto/rand"
+	"fmt"
 	"math/rand"
 	"sort"
 	"testing"
@@ -113,3 +114,133 @@ func TestChunkMaker(t *testing.T) {
 	}
 
 }
+
+func TestChunkMakerForcedBoundary(t *testing.T) {
+
+	config := CreateConfig()
+
+	config.CompressionLevel = DEFAULT_COMPRESSION_LEVEL
+	config.AverageChunkSize = 32
+	config.MaximumChunkSize = 64
+	config.MinimumChunkSize = 16
+	config.ChunkSeed = []byte("duplicacy")
+
+	config.HashKey = DEFAULT_KEY
+	config.IDKey = DEFAULT_KEY
+
+	content := make([]byte, 1024)
+	_, err := crypto_rand.Read(content)
+	if err != nil {
+		t.Errorf("Error generating random content: %v", err)
+		return
+	}
+
+	// Split 'content' preceded by 'prefix', starting a new chunk right before 'content'
+	splitAfter := func(prefix []byte) (chunks []string) {
+		maker := CreateFileChunkMaker(config, false)
+		prefixLength := len(prefix)
+		chunkFunc := func(chunk *Chunk) {
+			if prefixLength > 0 {
+				prefixLength -= chunk.GetLength()
+				if prefixLength < 0 {
+					t.Errorf("A chunk contains data from both the prefix and the content")
+				}
+			} else {
+				chunks = append(chunks, chunk.GetHash())
+			}
+			config.PutChunk(chunk)
+		}
+
+		maker.AddData(bytes.NewBuffer(prefix), chunkFunc)
+		maker.ForceChunkBoundary(chunkFunc)
+		maker.AddData(bytes.NewBuffer(content), chunkFunc)
+		maker.AddData(nil, chunkFunc)
+		return chunks
+	}
+
+	var chunkArray1 []string
+	for _, prefixSize := range [...]int{0, 7, 100, 333} {
+		prefix := make([]byte, prefixSize)
+		crypto_rand.Read(prefix)
+
+		chunkArray2 := splitAfter(prefix)
+		if chunkArray1 == nil {
+			chunkArray1 = chunkArray2
+			continue
+		}
+
+		if len(chunkArray1) != len(chunkArray2) {
+			t.Errorf("[prefix %d] number of chunks is %d instead of %d", prefixSize, len(chunkArray2), len(chunkArray1))
+			continue
+		}
+
+		for i := range chunkArray1 {
+			if chunkArray1[i] != chunkArray2[i] {
+				t.Errorf("[prefix %d, chunk %d] chunk is different", prefixSize, i)
+			}
+		}
+	}
+}
+
+func TestChunkMakerEntryBoundary(t *testing.T) {
+
+	config := CreateConfig()
+
+	config.CompressionLevel = DEFAULT_COMPRESSION_LEVEL
+	config.AverageChunkSize = 1024
+	config.MaximumChunkSize = 1024
+	config.MinimumChunkSize = 1024
+	config.ChunkSeed = []byte("duplicacy")
+
+	config.HashKey = DEFAULT_KEY
+	config.IDKey = DEFAULT_KEY
+
+	var paths []string
+	for i := 0; i < 2000; i++ {
+		paths = append(paths, fmt.Sprintf("dir%d/file%d", i/100, i))
+	}
+
+	splitEntries := func(paths []string) (chunks map[string]bool, total int) {
+		chunks = make(map[string]bool)
+		maker := CreateMetaDataChunkMaker(config, 1024)
+		entryLength := 0
+		chunkFunc := func(chunk *Chunk) {
+			if chunk.GetLength()%entryLength != 0 {
+				t.Errorf("Chunk of length %d does not end at an entry boundary", chunk.GetLength())
+			}
+			chunks[chunk.GetHash()] = true
+			total++
+			config.PutChunk(chunk)
+		}
+
+		for _, path := range paths {
+			// Pad every entry to the same length to make it easy to check the chunk boundaries
+			data := []byte(fmt.Sprintf("%-32s", path))
+			entryLength = len(data)
+			maker.AddEntry(path, data, chunkFunc)
+		}
+		maker.ForceChunkBoundary(chunkFunc)
+		return chunks, total
+	}
+
+	chunks1, total1 := splitEntries(paths)
+
+	// Insert a new entry near the beginning; only the chunk containing the new entry should be different
+	newPaths := append([]string{paths[0], "dir0/new"}, paths[1:]...)
+	chunks2, _ := splitEntries(newPaths)
+
+	different := 0
+	for chunk := range chunks1 {
+		if !chunks2[chunk] {
+			different++
+		}
+	}
+
+	if total1 < 10 {
+		t.Errorf("Only %d chunks were created", total1)
+	}
+
+	if different > 2 {
+		t.Errorf("%d out of %d chunks are different after inserting one entry", different, total1)
+	}
+}
@@ -5,6 +5,8 @@
 package duplicacy
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"sync"
 	"sync/atomic"
@@ -19,6 +21,7 @@ const (
 	ChunkOperationFossilize = 3
 	ChunkOperationResurrect = 4
 	ChunkOperationFind = 5
+	ChunkOperationConvert = 6
 )
 
 // ChunkTask is used to pass parameters for different kinds of chunk operations.
@@ -44,8 +47,10 @@ type ChunkOperator struct {
 	threads  int                 // Number of threads
 	taskQueue chan ChunkTask     // Operating goroutines are waiting on this channel for input
 	stopChannel chan bool        // Used to stop all the goroutines
+	stopOnce sync.Once           // Makes sure that stopChannel is closed only once
 
 	numberOfActiveTasks int64    // The number of chunks that are being operated on
+	numberOfThreads int64        // The number of operating goroutines still running
 
 	fossils []string             // For fossilize operation, the paths of the fossils are stored in this slice
 	collectionLock *sync.Mutex   // The lock for accessing 'fossils'
@@ -59,6 +64,9 @@ type ChunkOperator struct {
 
 	rewriteChunks bool           // Whether to rewrite corrupted chunks when erasure coding is enabled
 
+	NumberOfConvertedChunks int64    // The number of chunks rewritten in a different erasure coding format
+	chunkFormats map[string]int64    // The number of downloaded chunks in each erasure coding format
+
 	UploadCompletionFunc func(chunk *Chunk, chunkIndex int, inCache bool, chunkSize int, uploadSize int)
 }
 
@@ -72,6 +80,7 @@ func CreateChunkOperator(config *Config, storage Storage, snapshotCache *FileSto
 		snapshotCache: snapshotCache,
 		showStatistics: showStatistics,
 		threads: threads,
+		numberOfThreads: int64(threads),
 
 		taskQueue:   make(chan ChunkTask, threads),
 		stopChannel: make(chan bool),
@@ -80,12 +89,14 @@ func CreateChunkOperator(config *Config, storage Storage, snapshotCache *FileSto
 		startTime: time.Now().Unix(),
 		allowFailures: allowFailures,
 		rewriteChunks: rewriteChunks,
+		chunkFormats: make(map[string]int64),
 	}
 
 	// Start the operator goroutines
 	for i := 0; i < operator.threads; i++ {
 		go func(threadIndex int) {
 			defer CatchLogException()
+			defer atomic.AddInt64(&operator.numberOfThreads, -1)
 			for {
 				select {
 				case task := <-operator.taskQueue:
@@ -100,27 +111,32 @@ func CreateChunkOperator(config *Config, storage Storage, snapshotCache *FileSto
 	return operator
 }
 
+// Stop waits for the queued tasks to complete and then stops all the goroutines.  It can be called more than once.
 func (operator *ChunkOperator) Stop() {
-	if atomic.LoadInt64(&operator.numberOfActiveTasks) < 0 {
-		return
-	}
+	operator.stopOnce.Do(func() {
+		// Tasks left by a canceled operation will never complete
+		for atomic.LoadInt64(&operator.numberOfActiveTasks) > 0 && !isOperationCanceled() {
+			time.Sleep(100 * time.Millisecond)
+		}
+		close(operator.stopChannel)
+	})
+}
 
-	for atomic.LoadInt64(&operator.numberOfActiveTasks) > 0 {
+// drain waits until the tasks queued when the operation was canceled have completed.  Only uploads are still run, and
+// there are at most twice as many of them as threads.
+func (operator *ChunkOperator) drain() {
+	for atomic.LoadInt64(&operator.numberOfActiveTasks) > 0 && atomic.LoadInt64(&operator.numberOfThreads) > 0 {
 		time.Sleep(100 * time.Millisecond)
 	}
-	for i := 0; i < operator.threads; i++ {
-		operator.stopChannel <- false
-	}
-
-	// Assign -1 to numberOfActiveTasks so Stop() can be called multiple times
-	atomic.AddInt64(&operator.numberOfActiveTasks, int64(-1))
 }
 
 func (operator *ChunkOperator) WaitForCompletion() {
 
 	for atomic.LoadInt64(&operator.numberOfActiveTasks) > 0 {
+		checkCanceled()
 		time.Sleep(100 * time.Millisecond)
 	}
+	checkCanceled()
 }
 
 func (operator *ChunkOperator) AddTask(operation int, chunkID string, chunkHash string, filePath string, chunkIndex int, chunk *Chunk, isMetadata bool, completionFunc func(*Chunk, int))  {
@@ -136,7 +152,15 @@ func (operator *ChunkOperator) AddTask(operation int, chunkID string, chunkHash
 		completionFunc: completionFunc,
 	}
 
-	operator.taskQueue <- task
+	if operation := getCurrentOperation(); operation != nil {
+		select {
+		case operator.taskQueue <- task:
+		case <-operation.ctx.Done():
+			operation.raiseCanceled()
+		}
+	} else {
+		operator.taskQueue <- task
+	}
 	atomic.AddInt64(&operator.numberOfActiveTasks, int64(1))
 
 	return
@@ -144,12 +168,20 @@ func (operator *ChunkOperator) AddTask(operation int, chunkID string, chunkHash
 
 func (operator *ChunkOperator) Download(chunkHash string, chunkIndex int, isMetadata bool) *Chunk {
 	chunkID := operator.config.GetChunkIDFromHash(chunkHash)
-	completionChannel := make(chan *Chunk)
+	completionChannel := make(chan *Chunk, 1)
 	completionFunc := func(chunk *Chunk, chunkIndex int) {
 		completionChannel <- chunk
 	}
 	operator.AddTask(ChunkOperationDownload, chunkID, chunkHash, "", chunkIndex, nil, isMetadata, completionFunc)
-	return <- completionChannel
+	if operation := getCurrentOperation(); operation != nil {
+		select {
+		case chunk := <-completionChannel:
+			return chunk
+		case <-operation.ctx.Done():
+			operation.raiseCanceled()
+		}
+	}
+	return <-completionChannel
 }
 
 func (operator *ChunkOperator) DownloadAsync(chunkHash string, chunkIndex int, isMetadata bool, completionFunc func(*Chunk, int)) {
@@ -175,11 +207,23 @@ func (operator *ChunkOperator) Resurrect(chunkID string, filePath string) {
 	operator.AddTask(ChunkOperationResurrect, chunkID, "", filePath, 0, nil, false, nil)
 }
 
+// Convert rewrites the chunk file at 'filePath' in the erasure coding format specified by the config.  The chunk
+// passed to 'completionFunc' is nil if the chunk can't be converted.
+func (operator *ChunkOperator) Convert(chunkID string, filePath string, chunkIndex int, completionFunc func(*Chunk, int)) {
+	operator.AddTask(ChunkOperationConvert, chunkID, "", filePath, chunkIndex, nil, false, completionFunc)
+}
+
 func (operator *ChunkOperator) Run(threadIndex int, task ChunkTask) {
 	defer func() {
 		atomic.AddInt64(&operator.numberOfActiveTasks, int64(-1))
 	}()
 
+	// Skip the remaining tasks of a canceled operation, except uploads which are allowed to complete so that an
+	// incomplete snapshot saved after the cancellation can include them
+	if task.operation != ChunkOperationUpload && isOperationCanceled() {
+		return
+	}
+
 	if task.operation == ChunkOperationDownload {
 		operator.DownloadChunk(threadIndex, task)
 		return
@@ -188,27 +232,39 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkTask) {
 		return
 	}
 
+	if operator.storage.IsAppendOnly() && (task.operation == ChunkOperationDelete ||
+		task.operation == ChunkOperationFossilize || task.operation == ChunkOperationResurrect ||
+		task.operation == ChunkOperationConvert) {
+		LOG_ERROR("CHUNK_APPEND_ONLY", "Chunks can't be deleted, renamed or rewritten by a client in the append-only mode")
+		return
+	}
+
+	if task.operation == ChunkOperationConvert {
+		operator.ConvertChunk(threadIndex, task)
+		return
+	}
+
 	// task.filePath may be empty.  If so, find the chunk first.
 	if task.operation == ChunkOperationDelete || task.operation == ChunkOperationFossilize {
 		if task.filePath == "" {
 			filePath, exist, _, err := operator.storage.FindChunk(threadIndex, task.chunkID, false)
 			if err != nil {
-				LOG_ERROR("CHUNK_FIND", "Failed to locate the path for the chunk %s: %v", task.chunkID, err)
+				LOG_ERROR("CHUNK_FIND", "Failed to locate the path for the chunk %s: %v", LogField("chunk_id", task.chunkID), err)
 				return
 			} else if !exist {
 				if task.operation == ChunkOperationDelete {
-					LOG_WARN("CHUNK_FIND", "Chunk %s does not exist in the storage", task.chunkID)
+					LOG_WARN("CHUNK_FIND", "Chunk %s does not exist in the storage", LogField("chunk_id", task.chunkID))
 					return
 				}
 
 				fossilPath, exist, _, _ := operator.storage.FindChunk(threadIndex, task.chunkID, true)
 				if exist {
-					LOG_WARN("CHUNK_FOSSILIZE", "Chunk %s is already a fossil", task.chunkID)
+					LOG_WARN("CHUNK_FOSSILIZE", "Chunk %s is already a fossil", LogField("chunk_id", task.chunkID))
 					operator.collectionLock.Lock()
 					operator.fossils = append(operator.fossils, fossilPath)
 					operator.collectionLock.Unlock()
 				} else {
-					LOG_ERROR("CHUNK_FIND", "Chunk %s does not exist in the storage", task.chunkID)
+					LOG_ERROR("CHUNK_FIND", "Chunk %s does not exist in the storage", LogField("chunk_id", task.chunkID))
 				}
 				return
 			}
@@ -219,11 +275,11 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkTask) {
 	if task.operation == ChunkOperationFind {
 		_, exist, _, err := operator.storage.FindChunk(threadIndex, task.chunkID, false)
 		if err != nil {
-			LOG_ERROR("CHUNK_FIND", "Failed to locate the path for the chunk %s: %v", task.chunkID, err)
+			LOG_ERROR("CHUNK_FIND", "Failed to locate the path for the chunk %s: %v", LogField("chunk_id", task.chunkID), err)
 		} else if !exist {
-			LOG_ERROR("CHUNK_FIND", "Chunk %s does not exist in the storage", task.chunkID)
+			LOG_ERROR("CHUNK_FIND", "Chunk %s does not exist in the storage", LogField("chunk_id", task.chunkID))
 		} else {
-			LOG_DEBUG("CHUNK_FIND", "Chunk %s exists in the storage", task.chunkID)
+			LOG_DEBUG("CHUNK_FIND", "Chunk %s exists in the storage", LogField("chunk_id", task.chunkID))
 		}
 	} else if task.operation == ChunkOperationDelete {
 		err := operator.storage.DeleteFile(threadIndex, task.filePath)
@@ -231,7 +287,7 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkTask) {
 			LOG_WARN("CHUNK_DELETE", "Failed to remove the file %s: %v", task.filePath, err)
 		} else {
 			if task.chunkID != "" {
-				LOG_INFO("CHUNK_DELETE", "The chunk %s has been permanently removed", task.chunkID)
+				LOG_INFO("CHUNK_DELETE", "The chunk %s has been permanently removed", LogField("chunk_id", task.chunkID))
 			} else {
 				LOG_INFO("CHUNK_DELETE", "Deleted file %s from the storage", task.filePath)
 			}
@@ -245,16 +301,16 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkTask) {
 			if _, exist, _, _ := operator.storage.FindChunk(threadIndex, task.chunkID, true); exist {
 				err := operator.storage.DeleteFile(threadIndex, task.filePath)
 				if err == nil {
-					LOG_TRACE("CHUNK_DELETE", "Deleted chunk file %s as the fossil already exists", task.chunkID)
+					LOG_TRACE("CHUNK_DELETE", "Deleted chunk file %s as the fossil already exists", LogField("chunk_id", task.chunkID))
 				}
 				operator.collectionLock.Lock()
 				operator.fossils = append(operator.fossils, fossilPath)
 				operator.collectionLock.Unlock()
 			} else {
-				LOG_ERROR("CHUNK_DELETE", "Failed to fossilize the chunk %s: %v", task.chunkID, err)
+				LOG_ERROR("CHUNK_DELETE", "Failed to fossilize the chunk %s: %v", LogField("chunk_id", task.chunkID), err)
 			}
 		} else {
-			LOG_TRACE("CHUNK_FOSSILIZE", "The chunk %s has been marked as a fossil", task.chunkID)
+			LOG_TRACE("CHUNK_FOSSILIZE", "The chunk %s has been marked as a fossil", LogField("chunk_id", task.chunkID))
 			operator.collectionLock.Lock()
 			operator.fossils = append(operator.fossils, fossilPath)
 			operator.collectionLock.Unlock()
@@ -262,12 +318,12 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkTask) {
 	} else if task.operation == ChunkOperationResurrect {
 		chunkPath, exist, _, err := operator.storage.FindChunk(threadIndex, task.chunkID, false)
 		if err != nil {
-			LOG_ERROR("CHUNK_FIND", "Failed to locate the path for the chunk %s: %v", task.chunkID, err)
+			LOG_ERROR("CHUNK_FIND", "Failed to locate the path for the chunk %s: %v", LogField("chunk_id", task.chunkID), err)
 		}
 
 		if exist {
 			operator.storage.DeleteFile(threadIndex, task.filePath)
-			LOG_INFO("FOSSIL_RESURRECT", "The chunk %s already exists", task.chunkID)
+			LOG_INFO("FOSSIL_RESURRECT", "The chunk %s already exists", LogField("chunk_id", task.chunkID))
 		} else {
 			err := operator.storage.MoveFile(threadIndex, task.filePath, chunkPath)
 			if err != nil {
@@ -304,18 +360,18 @@ func (operator *ChunkOperator) DownloadChunk(threadIndex int, task ChunkTask) {
 
 		cachedPath, exist, _, err = operator.snapshotCache.FindChunk(threadIndex, chunkID, false)
 		if err != nil {
-			LOG_WARN("DOWNLOAD_CACHE", "Failed to find the cache path for the chunk %s: %v", chunkID, err)
+			LOG_WARN("DOWNLOAD_CACHE", "Failed to find the cache path for the chunk %s: %v", LogField("chunk_id", chunkID), err)
 		} else if exist {
 			err = operator.snapshotCache.DownloadFile(0, cachedPath, chunk)
 			if err != nil {
-				LOG_WARN("DOWNLOAD_CACHE", "Failed to load the chunk %s from the snapshot cache: %v", chunkID, err)
+				LOG_WARN("DOWNLOAD_CACHE", "Failed to load the chunk %s from the snapshot cache: %v", LogField("chunk_id", chunkID), err)
 			} else {
 				actualChunkID := chunk.GetID()
 				if actualChunkID != chunkID {
 					LOG_WARN("DOWNLOAD_CACHE_CORRUPTED",
 						"The chunk %s load from the snapshot cache has a hash id of %s", chunkID, actualChunkID)
 				} else {
-					LOG_DEBUG("CHUNK_CACHE", "Chunk %s has been loaded from the snapshot cache", chunkID)
+					LOG_DEBUG("CHUNK_CACHE", "Chunk %s has been loaded from the snapshot cache", LogField("chunk_id", chunkID))
 
 					task.completionFunc(chunk, task.chunkIndex)
 					chunk = nil
@@ -354,7 +410,7 @@ func (operator *ChunkOperator) DownloadChunk(threadIndex int, task ChunkTask) {
 		chunkPath, exist, _, err = operator.storage.FindChunk(threadIndex, chunkID, false)
 		if err != nil {
 			completeFailedChunk()
-			LOG_WERROR(operator.allowFailures, "DOWNLOAD_CHUNK", "Failed to find the chunk %s: %v", chunkID, err)
+			LOG_WERROR(operator.allowFailures, "DOWNLOAD_CHUNK", "Failed to find the chunk %s: %v", LogField("chunk_id", chunkID), err)
 			return
 		}
 
@@ -365,7 +421,7 @@ func (operator *ChunkOperator) DownloadChunk(threadIndex int, task ChunkTask) {
 			fossilPath, exist, _, err = operator.storage.FindChunk(threadIndex, chunkID, true)
 			if err != nil {
 				completeFailedChunk()
-				LOG_WERROR(operator.allowFailures, "DOWNLOAD_CHUNK", "Failed to find the chunk %s: %v", chunkID, err)
+				LOG_WERROR(operator.allowFailures, "DOWNLOAD_CHUNK", "Failed to find the chunk %s: %v", LogField("chunk_id", chunkID), err)
 				return
 			}
 
@@ -383,22 +439,22 @@ func (operator *ChunkOperator) DownloadChunk(threadIndex int, task ChunkTask) {
 				}
 
 				if retry && downloadAttempt < MaxDownloadAttempts {
-					LOG_WARN("DOWNLOAD_RETRY", "Failed to find the chunk %s; retrying", chunkID)
+					LOG_WARN("DOWNLOAD_RETRY", "Failed to find the chunk %s; retrying", LogField("chunk_id", chunkID))
 					continue
 				}
 
 				// A chunk is not found.  This is a serious error and hopefully it will never happen.
 				completeFailedChunk()
 				if err != nil {
-					LOG_WERROR(operator.allowFailures, "DOWNLOAD_CHUNK", "Chunk %s can't be found: %v", chunkID, err)
+					LOG_WERROR(operator.allowFailures, "DOWNLOAD_CHUNK", "Chunk %s can't be found: %v", LogField("chunk_id", chunkID), err)
 				} else {
-					LOG_WERROR(operator.allowFailures, "DOWNLOAD_CHUNK", "Chunk %s can't be found", chunkID)
+					LOG_WERROR(operator.allowFailures, "DOWNLOAD_CHUNK", "Chunk %s can't be found", LogField("chunk_id", chunkID))
 				}
 				return
 			}
 
 			filePath = fossilPath
-			LOG_WARN("DOWNLOAD_FOSSIL", "Chunk %s is a fossil", chunkID)
+			LOG_WARN("DOWNLOAD_FOSSIL", "Chunk %s is a fossil", LogField("chunk_id", chunkID))
 		}
 
 		err = operator.storage.DownloadFile(threadIndex, filePath, chunk)
@@ -406,28 +462,30 @@ func (operator *ChunkOperator) DownloadChunk(threadIndex int, task ChunkTask) {
 			_, isHubic := operator.storage.(*HubicStorage)
 			// Retry on EOF or if it is a Hubic backend as it may return 404 even when the chunk exists
 			if (err == io.ErrUnexpectedEOF || isHubic) && downloadAttempt < MaxDownloadAttempts {
-				LOG_WARN("DOWNLOAD_RETRY", "Failed to download the chunk %s: %v; retrying", chunkID, err)
+				LOG_WARN("DOWNLOAD_RETRY", "Failed to download the chunk %s: %v; retrying", LogField("chunk_id", chunkID), err)
 				chunk.Reset(false)
 				chunk.isMetadata = task.isMetadata
 				continue
 			} else {
 				completeFailedChunk()
-				LOG_WERROR(operator.allowFailures, "DOWNLOAD_CHUNK", "Failed to download the chunk %s: %v", chunkID, err)
+				LOG_WERROR(operator.allowFailures, "DOWNLOAD_CHUNK", "Failed to download the chunk %s: %v", LogField("chunk_id", chunkID), err)
 				return
 			}
 		}
 
+		dataShards, parityShards, _ := chunk.GetErasureCoding()
+
 		rewriteNeeded := false
 		err, rewriteNeeded = chunk.Decrypt(operator.config.ChunkKey, task.chunkHash)
 		if err != nil {
 			if downloadAttempt < MaxDownloadAttempts {
-				LOG_WARN("DOWNLOAD_RETRY", "Failed to decrypt the chunk %s: %v; retrying", chunkID, err)
+				LOG_WARN("DOWNLOAD_RETRY", "Failed to decrypt the chunk %s: %v; retrying", LogField("chunk_id", chunkID), err)
 				chunk.Reset(false)
 				chunk.isMetadata = task.isMetadata
 				continue
 			} else {
 				completeFailedChunk()
-				LOG_WERROR(operator.allowFailures, "DOWNLOAD_DECRYPT", "Failed to decrypt the chunk %s: %v", chunkID, err)
+				LOG_WERROR(operator.allowFailures, "DOWNLOAD_DECRYPT", "Failed to decrypt the chunk %s: %v", LogField("chunk_id", chunkID), err)
 				return
 			}
 		}
@@ -435,26 +493,28 @@ func (operator *ChunkOperator) DownloadChunk(threadIndex int, task ChunkTask) {
 		actualChunkID := chunk.GetID()
 		if actualChunkID != chunkID {
 			if downloadAttempt < MaxDownloadAttempts {
-				LOG_WARN("DOWNLOAD_RETRY", "The chunk %s has a hash id of %s; retrying", chunkID, actualChunkID)
+				LOG_WARN("DOWNLOAD_RETRY", "The chunk %s has a hash id of %s; retrying", LogField("chunk_id", chunkID), actualChunkID)
 				chunk.Reset(false)
 				chunk.isMetadata = task.isMetadata
 				continue
 			} else {
 				completeFailedChunk()
-				LOG_WERROR(operator.allowFailures, "DOWNLOAD_CORRUPTED", "The chunk %s has a hash id of %s", chunkID, actualChunkID)
+				LOG_WERROR(operator.allowFailures, "DOWNLOAD_CORRUPTED", "The chunk %s has a hash id of %s", LogField("chunk_id", chunkID), actualChunkID)
 				return
 			}
 		}
 
+		operator.recordChunkFormat(dataShards, parityShards)
+
 		if rewriteNeeded && operator.rewriteChunks {
 
 			if filePath != fossilPath {
 				fossilPath = filePath + ".fsl"
 				err := operator.storage.MoveFile(threadIndex, chunkPath, fossilPath)
 				if err != nil {
-					LOG_WARN("CHUNK_REWRITE", "Failed to fossilize the chunk %s: %v", task.chunkID, err)
+					LOG_WARN("CHUNK_REWRITE", "Failed to fossilize the chunk %s: %v", LogField("chunk_id", task.chunkID), err)
 				} else {
-					LOG_TRACE("CHUNK_REWRITE", "The existing chunk %s has been marked as a fossil for rewrite", task.chunkID)
+					LOG_TRACE("CHUNK_REWRITE", "The existing chunk %s has been marked as a fossil for rewrite", LogField("chunk_id", task.chunkID))
 					operator.collectionLock.Lock()
 					operator.fossils = append(operator.fossils, fossilPath)
 					operator.collectionLock.Unlock()
@@ -470,9 +530,10 @@ func (operator *ChunkOperator) DownloadChunk(threadIndex int, task ChunkTask) {
 				// Re-upload the chunk
 				err = operator.storage.UploadFile(threadIndex, chunkPath, newChunk.GetBytes())
 				if err != nil {
-					LOG_WARN("CHUNK_REWRITE", "Failed to re-upload the chunk %s: %v", chunkID, err)
+					LOG_WARN("CHUNK_REWRITE", "Failed to re-upload the chunk %s: %v", LogField("chunk_id", chunkID), err)
 				} else {
-					LOG_INFO("CHUNK_REWRITE", "The chunk %s has been re-uploaded", chunkID)
+					LOG_INFO("CHUNK_REWRITE", "The chunk %s has been re-uploaded", LogField("chunk_id", chunkID))
+					operator.recordChunkChecksum(chunkID, newChunk.GetBytes())
 				}
 			}
 			operator.config.PutChunk(newChunk)
@@ -485,29 +546,32 @@ func (operator *ChunkOperator) DownloadChunk(threadIndex int, task ChunkTask) {
 		// Save a copy to the local snapshot cache
 		err := operator.snapshotCache.UploadFile(threadIndex, cachedPath, chunk.GetBytes())
 		if err != nil {
-			LOG_WARN("DOWNLOAD_CACHE", "Failed to add the chunk %s to the snapshot cache: %v", chunkID, err)
+			LOG_WARN("DOWNLOAD_CACHE", "Failed to add the chunk %s to the snapshot cache: %v", LogField("chunk_id", chunkID), err)
 		}
 	}
 
 	downloadedChunkSize := atomic.AddInt64(&operator.downloadedChunkSize, int64(chunk.GetLength()))
 
-	if (operator.showStatistics || IsTracing()) && operator.totalChunkSize > 0 {
-
+	var speed, remainingTime int64
+	if operator.totalChunkSize > 0 {
 		now := time.Now().Unix()
 		if now <= operator.startTime {
 			now = operator.startTime + 1
 		}
-		speed := downloadedChunkSize / (now - operator.startTime)
-		remainingTime := int64(0)
+		speed = downloadedChunkSize / (now - operator.startTime)
 		if speed > 0 {
 			remainingTime = (operator.totalChunkSize-downloadedChunkSize)/speed + 1
 		}
+		reportProgress("Downloading chunks", downloadedChunkSize, operator.totalChunkSize, speed, remainingTime)
+	}
+
+	if (operator.showStatistics || IsTracing()) && operator.totalChunkSize > 0 {
 		percentage := float32(downloadedChunkSize * 1000 / operator.totalChunkSize)
 		LOG_INFO("DOWNLOAD_PROGRESS", "Downloaded chunk %d size %d, %sB/s %s %.1f%%",
 			task.chunkIndex+1, chunk.GetLength(),
 			PrettySize(speed), PrettyTime(remainingTime), percentage/10)
 	} else {
-		LOG_DEBUG("CHUNK_DOWNLOAD", "Chunk %s has been downloaded", chunkID)
+		LOG_DEBUG("CHUNK_DOWNLOAD", "Chunk %s has been downloaded", LogField("chunk_id", chunkID))
 	}
 
 	task.completionFunc(chunk, task.chunkIndex)
@@ -531,26 +595,26 @@ func (operator *ChunkOperator) UploadChunk(threadIndex int, task ChunkTask) bool
 		// Save a copy to the local snapshot.
 		chunkPath, exist, _, err := operator.snapshotCache.FindChunk(threadIndex, chunkID, false)
 		if err != nil {
-			LOG_WARN("UPLOAD_CACHE", "Failed to find the cache path for the chunk %s: %v", chunkID, err)
+			LOG_WARN("UPLOAD_CACHE", "Failed to find the cache path for the chunk %s: %v", LogField("chunk_id", chunkID), err)
 		} else if exist {
-			LOG_DEBUG("CHUNK_CACHE", "Chunk %s already exists in the snapshot cache", chunkID)
+			LOG_DEBUG("CHUNK_CACHE", "Chunk %s already exists in the snapshot cache", LogField("chunk_id", chunkID))
 		} else if err = operator.snapshotCache.UploadFile(threadIndex, chunkPath, chunk.GetBytes()); err != nil {
-			LOG_WARN("UPLOAD_CACHE", "Failed to save the chunk %s to the snapshot cache: %v", chunkID, err)
+			LOG_WARN("UPLOAD_CACHE", "Failed to save the chunk %s to the snapshot cache: %v", LogField("chunk_id", chunkID), err)
 		} else {
-			LOG_DEBUG("CHUNK_CACHE", "Chunk %s has been saved to the snapshot cache", chunkID)
+			LOG_DEBUG("CHUNK_CACHE", "Chunk %s has been saved to the snapshot cache", LogField("chunk_id", chunkID))
 		}
 	}
 
 	// This returns the path the chunk file should be at.
 	chunkPath, exist, _, err := operator.storage.FindChunk(threadIndex, chunkID, false)
 	if err != nil {
-		LOG_ERROR("UPLOAD_CHUNK", "Failed to find the path for the chunk %s: %v", chunkID, err)
+		LOG_ERROR("UPLOAD_CHUNK", "Failed to find the path for the chunk %s: %v", LogField("chunk_id", chunkID), err)
 		return false
 	}
 
 	if exist {
 		// Chunk deduplication by name in effect here.
-		LOG_DEBUG("CHUNK_DUPLICATE", "Chunk %s already exists", chunkID)
+		LOG_DEBUG("CHUNK_DUPLICATE", "Chunk %s already exists", LogField("chunk_id", chunkID))
 
 		operator.UploadCompletionFunc(chunk, task.chunkIndex, false, chunkSize, 0)
 		return false
@@ -559,21 +623,128 @@ func (operator *ChunkOperator) UploadChunk(threadIndex int, task ChunkTask) bool
 	// Encrypt the chunk only after we know that it must be uploaded.
 	err = chunk.Encrypt(operator.config.ChunkKey, chunk.GetHash(), task.isMetadata)
 	if err != nil {
-		LOG_ERROR("UPLOAD_CHUNK", "Failed to encrypt the chunk %s: %v", chunkID, err)
+		LOG_ERROR("UPLOAD_CHUNK", "Failed to encrypt the chunk %s: %v", LogField("chunk_id", chunkID), err)
 		return false
 	}
 
 	if !operator.config.dryRun {
 		err = operator.storage.UploadFile(threadIndex, chunkPath, chunk.GetBytes())
 		if err != nil {
-			LOG_ERROR("UPLOAD_CHUNK", "Failed to upload the chunk %s: %v", chunkID, err)
+			LOG_ERROR("UPLOAD_CHUNK", "Failed to upload the chunk %s: %v", LogField("chunk_id", chunkID), err)
 			return false
 		}
-		LOG_DEBUG("CHUNK_UPLOAD", "Chunk %s has been uploaded", chunkID)
+		LOG_DEBUG("CHUNK_UPLOAD", "Chunk %s has been uploaded", LogField("chunk_id", chunkID))
+		operator.recordChunkChecksum(chunkID, chunk.GetBytes())
 	} else {
-		LOG_DEBUG("CHUNK_UPLOAD", "Uploading was skipped for chunk %s", chunkID)
+		LOG_DEBUG("CHUNK_UPLOAD", "Uploading was skipped for chunk %s", LogField("chunk_id", chunkID))
 	}
 
 	operator.UploadCompletionFunc(chunk, task.chunkIndex, false, chunkSize, chunk.GetLength())
 	return true
-}
\ No newline at end of file
+}
+// ConvertChunk downloads a chunk file and uploads it again in the erasure coding format specified by the config.  The
+// chunk isn't decrypted.  The new content replaces the old one in a single upload to the same path, so the chunk is
+// always readable in either format even if the conversion is interrupted.  Since some storages keep the existing file
+// on such an upload without reporting an error, the chunk is downloaded again to make sure it has been replaced.
+func (operator *ChunkOperator) ConvertChunk(threadIndex int, task ChunkTask) {
+
+	chunk := operator.config.GetChunk()
+	chunk.Reset(false)
+	defer operator.config.PutChunk(chunk)
+
+	completeFailedChunk := func() {
+		atomic.AddInt64(&operator.NumberOfFailedChunks, 1)
+		task.completionFunc(nil, task.chunkIndex)
+	}
+
+	// A locked chunk can't be overwritten until the lock expires
+	if lockStorage, ok := operator.storage.(ObjectLockStorage); ok && lockStorage.IsObjectLockEnabled() {
+		expiry, err := lockStorage.GetObjectLockExpiry(threadIndex, task.filePath)
+		if err != nil {
+			LOG_WARN("CONVERT_LOCK", "Failed to get the lock of the chunk %s: %v", LogField("chunk_id", task.chunkID), err)
+			completeFailedChunk()
+			return
+		} else if time.Now().Before(expiry) {
+			LOG_WARN("CONVERT_LOCK", "Chunk %s is locked until %s and can't be converted", LogField("chunk_id", task.chunkID),
+				expiry.Format("2006-01-02 15:04:05"))
+			completeFailedChunk()
+			return
+		}
+	}
+
+	err := operator.storage.DownloadFile(threadIndex, task.filePath, chunk)
+	if err != nil {
+		LOG_WARN("CONVERT_DOWNLOAD", "Failed to download the chunk %s: %v", LogField("chunk_id", task.chunkID), err)
+		completeFailedChunk()
+		return
+	}
+
+	converted, err := chunk.ConvertErasureCoding(operator.config.DataShards, operator.config.ParityShards)
+	if err != nil {
+		LOG_WARN("CONVERT_CHUNK", "Failed to convert the chunk %s: %v", LogField("chunk_id", task.chunkID), err)
+		completeFailedChunk()
+		return
+	}
+
+	if !converted {
+		LOG_DEBUG("CONVERT_SKIP", "Chunk %s is already in the requested format", LogField("chunk_id", task.chunkID))
+		task.completionFunc(chunk, task.chunkIndex)
+		return
+	}
+
+	if !operator.config.dryRun {
+		err = operator.storage.UploadFile(threadIndex, task.filePath, chunk.GetBytes())
+		if err != nil {
+			LOG_WARN("CONVERT_UPLOAD", "Failed to upload the converted chunk %s: %v", LogField("chunk_id", task.chunkID), err)
+			completeFailedChunk()
+			return
+		}
+		if !operator.isFileReplaced(threadIndex, task.filePath, chunk.GetBytes()) {
+			LOG_WARN("CONVERT_VERIFY", "Chunk %s in the storage has not been replaced by the converted one; the storage "+
+				"may not support overwriting files", LogField("chunk_id", task.chunkID))
+			completeFailedChunk()
+			return
+		}
+		operator.recordChunkChecksum(task.chunkID, chunk.GetBytes())
+		LOG_DEBUG("CONVERT_CHUNK", "Chunk %s has been converted", LogField("chunk_id", task.chunkID))
+	} else {
+		LOG_DEBUG("CONVERT_CHUNK", "Uploading was skipped for the converted chunk %s", LogField("chunk_id", task.chunkID))
+	}
+
+	atomic.AddInt64(&operator.NumberOfConvertedChunks, 1)
+	task.completionFunc(chunk, task.chunkIndex)
+}
+
+// isFileReplaced returns true if the file at 'filePath' in the storage has the content 'content' just uploaded.
+func (operator *ChunkOperator) isFileReplaced(threadIndex int, filePath string, content []byte) bool {
+	uploaded := operator.config.GetChunk()
+	uploaded.Reset(false)
+	defer operator.config.PutChunk(uploaded)
+
+	err := operator.storage.DownloadFile(threadIndex, filePath, uploaded)
+	if err != nil {
+		LOG_WARN("CONVERT_VERIFY", "Failed to download the file %s: %v", filePath, err)
+		return false
+	}
+	return bytes.Equal(uploaded.GetBytes(), content)
+}
+
+// recordChunkFormat counts a chunk downloaded from the storage by its erasure coding format.
+func (operator *ChunkOperator) recordChunkFormat(dataShards int, parityShards int) {
+	operator.collectionLock.Lock()
+	operator.chunkFormats[fmt.Sprintf("%d:%d", dataShards, parityShards)]++
+	operator.collectionLock.Unlock()
+}
+
+// GetChunkFormats returns the number of chunks downloaded so far in each erasure coding format, keyed by
+// 'data:parity' shards where '0:0' means no erasure coding.
+func (operator *ChunkOperator) GetChunkFormats() map[string]int64 {
+	operator.collectionLock.Lock()
+	defer operator.collectionLock.Unlock()
+
+	formats := make(map[string]int64)
+	for format, count := range operator.chunkFormats {
+		formats[format] = count
+	}
+	return formats
+}
@@ -5,9 +5,11 @@
 package duplicacy
 
 import (
+	"context"
 	"os"
 	"path"
 	"runtime/debug"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -116,3 +118,29 @@ func TestChunkOperator(t *testing.T) {
 	}
 
 }
+
+func TestChunkOperatorStop(t *testing.T) {
+
+	setTestingT(t)
+
+	// A task left by a canceled operation never completes, but Stop must not wait for it or close the channel twice
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	setCurrentOperation(&apiOperation{command: "backup", ctx: ctx, cancel: cancel})
+	defer setCurrentOperation(nil)
+
+	chunkOperator := CreateChunkOperator(nil, nil, nil, false, false, 2, false)
+	atomic.AddInt64(&chunkOperator.numberOfActiveTasks, 1)
+
+	chunkOperator.Stop()
+	chunkOperator.Stop()
+
+	if tasks := atomic.LoadInt64(&chunkOperator.numberOfActiveTasks); tasks != 1 {
+		t.Errorf("The number of active tasks is %d after Stop", tasks)
+	}
+
+	chunkOperator.drain()
+	if threads := atomic.LoadInt64(&chunkOperator.numberOfThreads); threads != 0 {
+		t.Errorf("%d goroutines are still running after drain", threads)
+	}
+}
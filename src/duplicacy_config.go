@@ -88,6 +88,10 @@ type Config struct {
 	DataShards int `json:'data-shards'`
 	ParityShards int `json:'parity-shards'`
 
+	// Files at least this large always start a new chunk, and smaller files are packed together only with
+	// files from the same directory.  0 means files are packed into one continuous chunk stream.
+	FileBoundarySize int `json:"file-boundary-size,omitempty"`
+
 	// for RSA encryption
 	rsaPrivateKey *rsa.PrivateKey
 	rsaPublicKey *rsa.PublicKey
@@ -95,6 +99,9 @@ type Config struct {
 	chunkPool      chan *Chunk
 	numberOfChunks int32
 	dryRun         bool
+
+	// The number of iterations used to derive the key of the config file when it was downloaded; 0 if unencrypted
+	iterations int
 }
 
 // Create an alias to avoid recursive calls on Config.MarshalJSON
@@ -197,6 +204,10 @@ func (config *Config) Print() {
 		LOG_TRACE("CONFIG_INFO", "Metadata chunks are encrypted")
 	}
 
+	if config.FileBoundarySize > 0 {
+		LOG_TRACE("CONFIG_INFO", "File boundary size: %d", config.FileBoundarySize)
+	}
+
 	if config.DataShards != 0 && config.ParityShards != 0 {
 		LOG_TRACE("CONFIG_INFO", "Data shards: %d, parity shards: %d", config.DataShards, config.ParityShards)
 	}
@@ -428,12 +439,14 @@ func DownloadConfig(storage Storage, password string) (config *Config, isEncrypt
 	}
 
 	var masterKey []byte
+	keyIterations := 0
 
 	if len(password) > 0 {
 
 		if string(configFile.GetBytes()[:len(ENCRYPTION_BANNER)]) == ENCRYPTION_BANNER {
 			// This is the old config format with a static salt and a fixed number of iterations
 			masterKey = GenerateKeyFromPassword(password, DEFAULT_KEY, CONFIG_DEFAULT_ITERATIONS)
+			keyIterations = CONFIG_DEFAULT_ITERATIONS
 			LOG_TRACE("CONFIG_FORMAT", "Using a static salt and %d iterations for key derivation", CONFIG_DEFAULT_ITERATIONS)
 		} else if string(configFile.GetBytes()[:len(CONFIG_BANNER)]) == CONFIG_BANNER {
 			// This is the new config format with a random salt and a configurable number of iterations
@@ -444,6 +457,7 @@ func DownloadConfig(storage Storage, password string) (config *Config, isEncrypt
 			iterations := binary.LittleEndian.Uint32(saltStart[CONFIG_SALT_LENGTH : CONFIG_SALT_LENGTH+4])
 			LOG_TRACE("CONFIG_ITERATIONS", "Using %d iterations for key derivation", iterations)
 			masterKey = GenerateKeyFromPassword(password, saltStart[:CONFIG_SALT_LENGTH], int(iterations))
+			keyIterations = int(iterations)
 
 			// Copy to a temporary buffer to replace the banner and remove the salt and the number of riterations
 			var encrypted bytes.Buffer
@@ -472,6 +486,7 @@ func DownloadConfig(storage Storage, password string) (config *Config, isEncrypt
 	if err != nil {
 		return nil, false, fmt.Errorf("Failed to parse the config file: %v", err)
 	}
+	config.iterations = keyIterations
 
 	storage.SetNestingLevels(config)
 
@@ -561,7 +576,8 @@ func UploadConfig(storage Storage, config *Config, password string, iterations i
 // it simply creates a file named 'config' that stores various parameters as well as a set of keys if encryption
 // is enabled.
 func ConfigStorage(storage Storage, iterations int, compressionLevel int, averageChunkSize int, maximumChunkSize int,
-	minimumChunkSize int, password string, copyFrom *Config, bitCopy bool, keyFile string, dataShards int, parityShards int) bool {
+	minimumChunkSize int, password string, copyFrom *Config, bitCopy bool, keyFile string, dataShards int, parityShards int,
+	fileBoundarySize int) bool {
 
 	exist, _, _, err := storage.GetFileInfo(0, "config")
 	if err != nil {
@@ -586,6 +602,7 @@ func ConfigStorage(storage Storage, iterations int, compressionLevel int, averag
 
 	config.DataShards = dataShards
 	config.ParityShards = parityShards
+	config.FileBoundarySize = fileBoundarySize
 
 	return UploadConfig(storage, config, password, iterations)
 }
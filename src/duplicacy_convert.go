@@ -0,0 +1,395 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The file in the snapshot cache where the conversion of chunks to a different erasure coding format records its
+// progress.  The first line is the target format and each following line is the id of a chunk already converted.
+const convertProgressFile = "convert_progress"
+
+// How often the progress of the conversion is reported
+const convertProgressInterval = 10
+
+// getErasureCodingFormat returns the key used for an erasure coding format by ChunkOperator.GetChunkFormats.
+func getErasureCodingFormat(dataShards int, parityShards int) string {
+	if dataShards == 0 || parityShards == 0 {
+		return "0:0"
+	}
+	return fmt.Sprintf("%d:%d", dataShards, parityShards)
+}
+
+// describeErasureCodingFormat turns a format returned by ChunkOperator.GetChunkFormats into a readable description.
+func describeErasureCodingFormat(format string) string {
+	var dataShards, parityShards int
+	if _, err := fmt.Sscanf(format, "%d:%d", &dataShards, &parityShards); err != nil || dataShards == 0 {
+		return "without erasure coding"
+	}
+	return fmt.Sprintf("with erasure coding of %d data and %d parity shards", dataShards, parityShards)
+}
+
+// ConvertErasureCoding rewrites all chunks in the storage with 'dataShards' data shards and 'parityShards' parity
+// shards, or without erasure coding if either is 0, and updates the config file accordingly.  Chunks are converted
+// in place without being decrypted, using 'threads' threads.  A chunk is always readable, in either the old or the
+// new format, so the conversion can be interrupted at any time; a later run with the same parameters only converts
+// the chunks not yet converted.  'password' and 'iterations' are used to encrypt the new config file; if 'iterations'
+// is 0, the new config file uses the same number of iterations as the current one.
+//
+// Older clients take the shard layout from the config rather than from the chunk.  When converting from one erasure
+// coding setting to another, the new config is uploaded before any chunk is converted, so these clients can't read
+// the chunks not yet converted until the conversion has completed.
+func (manager *SnapshotManager) ConvertErasureCoding(dataShards int, parityShards int, password string, iterations int,
+	threads int) bool {
+
+	if manager.storage.IsAppendOnly() {
+		LOG_ERROR("CONVERT_APPEND_ONLY", "Chunks can't be converted in the append-only mode")
+		return false
+	}
+
+	// Uploading a file to an existing path on Google Drive creates a second file with the same name
+	if _, isGCD := manager.storage.(*GCDStorage); isGCD {
+		LOG_ERROR("CONVERT_UNSUPPORTED", "Chunks can't be converted on Google Drive, which doesn't replace files")
+		return false
+	}
+
+	if dataShards == 0 || parityShards == 0 {
+		dataShards, parityShards = 0, 0
+	}
+	if iterations == 0 {
+		iterations = manager.config.iterations
+		if iterations == 0 {
+			iterations = CONFIG_DEFAULT_ITERATIONS
+		}
+	}
+	format := getErasureCodingFormat(dataShards, parityShards)
+	configChanged := getErasureCodingFormat(manager.config.DataShards, manager.config.ParityShards) != format
+
+	LOG_INFO("CONVERT_START", "Converting chunks to be stored %s", describeErasureCodingFormat(format))
+
+	// Older clients derive the shard size from the config rather than from the chunk, so they can read erasure coded
+	// chunks only if the config enables erasure coding.  Hence the config is updated first when enabling erasure
+	// coding, and last when disabling it.
+	if configChanged && dataShards != 0 && manager.config.DataShards != 0 {
+		LOG_WARN("CONVERT_COMPATIBILITY", "Older clients can't read the chunks not yet converted until the conversion "+
+			"has completed")
+	}
+	manager.config.DataShards, manager.config.ParityShards = dataShards, parityShards
+	if configChanged && dataShards != 0 {
+		if !manager.uploadConvertedConfig(password, iterations) {
+			return false
+		}
+	}
+
+	progress, err := manager.openConvertProgress(format)
+	if err != nil {
+		LOG_ERROR("CONVERT_PROGRESS", "Failed to load the conversion progress: %v", err)
+		return false
+	}
+	defer progress.close()
+
+	LOG_INFO("CONVERT_LIST", "Listing all chunks")
+	var chunks []string
+	skippedChunks := 0
+	if !manager.listAllFiles(manager.storage, chunkDir, func(chunk string, size int64) {
+		if len(chunk) == 0 || chunk[len(chunk)-1] == '/' || strings.HasSuffix(chunk, ".tmp") ||
+			strings.HasSuffix(chunk, ".fsl") {
+			return
+		}
+		if _, found := progress.converted.Find(strings.Replace(chunk, "/", "", -1)); found {
+			skippedChunks++
+			return
+		}
+		chunks = append(chunks, chunk)
+	}) {
+		return false
+	}
+	sort.Strings(chunks)
+
+	if skippedChunks > 0 {
+		LOG_INFO("CONVERT_RESUME", "Skipped %d chunks converted by a previous run", skippedChunks)
+	}
+	LOG_INFO("CONVERT_CHUNKS", "%d chunks to be converted", len(chunks))
+
+	manager.CreateChunkOperator(false, false, threads, true)
+	defer func() {
+		manager.chunkOperator.Stop()
+		manager.chunkOperator = nil
+	}()
+
+	startTime := time.Now()
+	lastReportTime := startTime
+	var doneChunks int64
+	for i, chunk := range chunks {
+		chunkID := strings.Replace(chunk, "/", "", -1)
+		manager.chunkOperator.Convert(chunkID, chunkDir+chunk, i, func(converted *Chunk, chunkIndex int) {
+			done := atomic.AddInt64(&doneChunks, 1)
+			if converted != nil {
+				progress.record(chunkID)
+			}
+
+			progress.lock.Lock()
+			defer progress.lock.Unlock()
+			now := time.Now()
+			if now.Sub(lastReportTime) < convertProgressInterval*time.Second {
+				return
+			}
+			lastReportTime = now
+			elapsedTime := now.Sub(startTime).Seconds()
+			remainingTime := int64(float64(int64(len(chunks))-done) / float64(done) * elapsedTime)
+			LOG_INFO("CONVERT_PROGRESS", "Processed %d/%d chunks %.1f%%, ETA %s", done, len(chunks),
+				float64(done)/float64(len(chunks))*100.0, PrettyTime(remainingTime))
+		})
+	}
+	manager.chunkOperator.WaitForCompletion()
+
+	convertedChunks := atomic.LoadInt64(&manager.chunkOperator.NumberOfConvertedChunks)
+	failedChunks := atomic.LoadInt64(&manager.chunkOperator.NumberOfFailedChunks)
+	LOG_INFO("CONVERT_END", "%d chunks converted, %d chunks already in the requested format, %d chunks failed",
+		convertedChunks, int64(len(chunks))-convertedChunks-failedChunks, failedChunks)
+
+	if failedChunks > 0 {
+		LOG_ERROR("CONVERT_FAIL", "%d chunks couldn't be converted; run the command again to retry them", failedChunks)
+		return false
+	}
+
+	if configChanged && dataShards == 0 {
+		if !manager.uploadConvertedConfig(password, iterations) {
+			return false
+		}
+	}
+
+	if !manager.config.dryRun {
+		progress.remove()
+	}
+
+	LOG_INFO("CONVERT_DONE", "All chunks have been converted to be stored %s; chunks uploaded by backups still "+
+		"running with the previous config may need another run", describeErasureCodingFormat(format))
+	return true
+}
+
+// uploadConvertedConfig replaces the config file in the storage with one containing the new erasure coding
+// parameters.  The old config file is overwritten in a single upload rather than deleted first, so the storage
+// always has a valid config file.  The config file is downloaded again to make sure it has been replaced.
+func (manager *SnapshotManager) uploadConvertedConfig(password string, iterations int) bool {
+	if manager.config.dryRun {
+		LOG_INFO("CONVERT_CONFIG", "The config file would be updated")
+		return true
+	}
+
+	if !UploadConfig(manager.storage, manager.config, password, iterations) {
+		return false
+	}
+
+	config, _, err := DownloadConfig(manager.storage, password)
+	if err != nil {
+		LOG_ERROR("CONVERT_CONFIG", "Failed to download the updated config file: %v", err)
+		return false
+	} else if config == nil || config.DataShards != manager.config.DataShards ||
+		config.ParityShards != manager.config.ParityShards {
+		LOG_ERROR("CONVERT_CONFIG", "The config file in the storage has not been replaced; the storage may not "+
+			"support overwriting files")
+		return false
+	}
+	LOG_INFO("CONVERT_CONFIG", "The config file has been updated")
+	return true
+}
+
+// convertProgress keeps track of the chunks converted to a given format.
+type convertProgress struct {
+	converted *ChunkIndex
+	file      *os.File
+	writer    *bufio.Writer
+	filePath  string
+	lock      sync.Mutex
+}
+
+// openConvertProgress loads the chunks converted by a previous run to the same format.  The progress of a run that
+// converted to a different format is discarded.
+func (manager *SnapshotManager) openConvertProgress(format string) (progress *convertProgress, err error) {
+
+	progress = &convertProgress{
+		converted: CreateChunkIndex(),
+	}
+
+	directory := os.TempDir()
+	if manager.snapshotCache != nil {
+		directory = manager.snapshotCache.storageDir
+	}
+	progress.filePath = path.Join(directory, convertProgressFile)
+
+	if file, err := os.Open(progress.filePath); err == nil {
+		scanner := bufio.NewScanner(file)
+		if scanner.Scan() && scanner.Text() == format {
+			for scanner.Scan() {
+				progress.converted.Add(scanner.Text(), 0)
+			}
+		} else {
+			LOG_INFO("CONVERT_PROGRESS", "Discarding the progress of a conversion to a different format")
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			progress.converted.Close()
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		progress.converted.Close()
+		return nil, err
+	}
+
+	err = progress.converted.Seal()
+	if err != nil {
+		progress.converted.Close()
+		return nil, err
+	}
+
+	if manager.config.dryRun {
+		return progress, nil
+	}
+
+	// Rewrite the file so that a partial line at the end left by an interrupted run is removed
+	progress.file, err = os.OpenFile(progress.filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		progress.converted.Close()
+		return nil, err
+	}
+	progress.writer = bufio.NewWriter(progress.file)
+	fmt.Fprintf(progress.writer, "%s\n", format)
+	err = progress.converted.ForEach(func(chunkID string, entry chunkEntry) {
+		fmt.Fprintf(progress.writer, "%s\n", chunkID)
+	})
+	if err == nil {
+		err = progress.writer.Flush()
+	}
+	if err != nil {
+		progress.close()
+		return nil, err
+	}
+	return progress, nil
+}
+
+// record adds a chunk that is now in the target format.  Chunks already recorded are lost if the process is killed
+// before they are flushed, in which case they are just downloaded again and skipped by the next run.
+func (progress *convertProgress) record(chunkID string) {
+	if progress.writer == nil {
+		return
+	}
+
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+
+	_, err := fmt.Fprintf(progress.writer, "%s\n", chunkID)
+	if err != nil {
+		LOG_WARN("CONVERT_PROGRESS", "Failed to record the progress of the conversion: %v", err)
+	}
+}
+
+func (progress *convertProgress) close() {
+	if progress.writer != nil {
+		err := progress.writer.Flush()
+		if err != nil {
+			LOG_WARN("CONVERT_PROGRESS", "Failed to save the progress of the conversion: %v", err)
+		}
+		progress.writer = nil
+	}
+	if progress.file != nil {
+		progress.file.Close()
+		progress.file = nil
+	}
+	if progress.converted != nil {
+		progress.converted.Close()
+		progress.converted = nil
+	}
+}
+
+// remove deletes the progress file once all chunks have been converted.
+func (progress *convertProgress) remove() {
+	progress.close()
+	err := os.Remove(progress.filePath)
+	if err != nil && !os.IsNotExist(err) {
+		LOG_WARN("CONVERT_PROGRESS", "Failed to remove the conversion progress file %s: %v", progress.filePath, err)
+	}
+}
+
+// reportChunkFormats logs the erasure coding formats of the chunks downloaded by the chunk operator.  Chunks can be in
+// different formats if a conversion by ConvertErasureCoding hasn't completed.  Only chunks downloaded by 'check
+// -chunks' or 'check -files' are counted; reportConvertProgress reports an unfinished conversion without downloading
+// any chunks.
+func (manager *SnapshotManager) reportChunkFormats() {
+
+	formats := manager.chunkOperator.GetChunkFormats()
+	if len(formats) == 0 {
+		return
+	}
+
+	var keys []string
+	for format := range formats {
+		keys = append(keys, format)
+	}
+	sort.Strings(keys)
+
+	configFormat := getErasureCodingFormat(manager.config.DataShards, manager.config.ParityShards)
+	for _, format := range keys {
+		LOG_INFO("SNAPSHOT_FORMAT", "%d downloaded chunks are stored %s", formats[format],
+			describeErasureCodingFormat(format))
+	}
+
+	if len(keys) > 1 || keys[0] != configFormat {
+		LOG_WARN("SNAPSHOT_FORMAT", "Some chunks are not stored %s as specified by the config; run the convert "+
+			"command to convert them", describeErasureCodingFormat(configFormat))
+	}
+}
+
+// getConvertProgress returns the target format of a conversion started from this client that hasn't completed, and the
+// number of chunks it has converted so far.  'format' is empty if there is no such conversion.
+func (manager *SnapshotManager) getConvertProgress() (format string, numberOfConvertedChunks int, err error) {
+
+	if manager.snapshotCache == nil {
+		return "", 0, nil
+	}
+
+	file, err := os.Open(path.Join(manager.snapshotCache.storageDir, convertProgressFile))
+	if os.IsNotExist(err) {
+		return "", 0, nil
+	} else if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if scanner.Scan() {
+		format = scanner.Text()
+	}
+	for scanner.Scan() {
+		numberOfConvertedChunks++
+	}
+	return format, numberOfConvertedChunks, scanner.Err()
+}
+
+// reportConvertProgress warns about a conversion started from this client that hasn't completed, in which case the
+// chunks in the storage are in different erasure coding formats.
+func (manager *SnapshotManager) reportConvertProgress() {
+
+	format, numberOfConvertedChunks, err := manager.getConvertProgress()
+	if err != nil {
+		LOG_WARN("SNAPSHOT_FORMAT", "Failed to read the conversion progress: %v", err)
+		return
+	} else if format == "" {
+		return
+	}
+
+	LOG_WARN("SNAPSHOT_FORMAT", "The conversion of chunks to be stored %s hasn't completed (%d chunks converted so "+
+		"far); run the convert command again to finish it", describeErasureCodingFormat(format), numberOfConvertedChunks)
+}
@@ -0,0 +1,195 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestConvertErasureCoding(t *testing.T) {
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir+"/repository1/dir1", 0700)
+	os.MkdirAll(testDir+"/repository1/.duplicacy", 0700)
+	os.MkdirAll(testDir+"/repository2/.duplicacy", 0700)
+
+	files := []string{"file1", "dir1/file2", "dir1/file3"}
+	for i, f := range files {
+		createRandomFileSeeded(testDir+"/repository1/"+f, 300000+i*1000, int64(i+1))
+	}
+
+	threads := 2
+	storage, err := loadStorage(testDir+"/storage", threads)
+	if err != nil {
+		t.Errorf("Failed to create storage: %v", err)
+		return
+	}
+	cleanStorage(storage)
+
+	password := "duplicacy"
+	if !ConfigStorage(storage, 4096, 100, 64*1024, 256*1024, 16*1024, password, nil, false, "", 0, 0, 0) {
+		t.Errorf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository1/.duplicacy")
+	backupManager := CreateBackupManager("host1", storage, testDir, password, nil)
+	backupManager.SetupSnapshotCache("default")
+	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, true, threads, "first", false, false, 0, false, 1024, 1024)
+
+	snapshotManager := backupManager.SnapshotManager
+
+	// Convert in both directions and between different numbers of shards, keeping the iterations of the config
+	for _, format := range [][2]int{{5, 2}, {3, 1}, {0, 0}} {
+		if !snapshotManager.ConvertErasureCoding(format[0], format[1], password, 0, threads) {
+			t.Fatalf("Failed to convert the storage to %d:%d", format[0], format[1])
+		}
+
+		config, _, err := DownloadConfig(storage, password)
+		if err != nil {
+			t.Fatalf("Failed to download the config: %v", err)
+		}
+		if config.DataShards != format[0] || config.ParityShards != format[1] {
+			t.Errorf("The config has %d:%d shards instead of %d:%d", config.DataShards, config.ParityShards,
+				format[0], format[1])
+		}
+		if config.iterations != 4096 {
+			t.Errorf("The config is encrypted with %d iterations instead of 4096", config.iterations)
+		}
+
+		snapshotManager.listAllFiles(storage, chunkDir, func(chunk string, size int64) {
+			if chunk == "" || chunk[len(chunk)-1] == '/' {
+				return
+			}
+			downloaded := backupManager.config.GetChunk()
+			downloaded.Reset(false)
+			err := storage.DownloadFile(0, chunkDir+chunk, downloaded)
+			if err != nil {
+				t.Errorf("Failed to download the chunk %s: %v", chunk, err)
+				return
+			}
+			dataShards, parityShards, valid := downloaded.GetErasureCoding()
+			if !valid || dataShards != format[0] || parityShards != format[1] {
+				t.Errorf("Chunk %s is in the format %d:%d instead of %d:%d", chunk, dataShards, parityShards,
+					format[0], format[1])
+			}
+			backupManager.config.PutChunk(downloaded)
+		})
+
+		if !snapshotManager.CheckSnapshots( /*snapshotID*/ "host1" /*revisions*/, []int{1} /*tag*/, "",
+			/*showStatistics*/ false /*showTabular*/, false /*checkFiles*/, false /*checkChunks*/, true,
+			/*searchFossils*/ false /*resurrect*/, false /*rewrite*/, false, threads /*allowFailures*/, false /*verifyBudget*/, nil /*ledgerInStorage*/, false) {
+			t.Errorf("The storage converted to %d:%d failed the check", format[0], format[1])
+		}
+
+		if _, err := os.Stat(path.Join(snapshotManager.snapshotCache.storageDir, convertProgressFile)); err == nil {
+			t.Errorf("The conversion progress file hasn't been removed")
+		}
+	}
+
+	// An unfinished conversion is found without downloading any chunks
+	ioutil.WriteFile(path.Join(snapshotManager.snapshotCache.storageDir, convertProgressFile), []byte("5:2\nchunk1\nchunk2\n"), 0600)
+	format, numberOfConvertedChunks, err := snapshotManager.getConvertProgress()
+	if err != nil || format != "5:2" || numberOfConvertedChunks != 2 {
+		t.Errorf("The unfinished conversion was reported as %s with %d chunks: %v", format, numberOfConvertedChunks, err)
+	}
+	os.Remove(path.Join(snapshotManager.snapshotCache.storageDir, convertProgressFile))
+
+	SetDuplicacyPreferencePath(testDir + "/repository2/.duplicacy")
+	failedFiles := backupManager.Restore(testDir+"/repository2", 1, &RestoreOptions{
+		Threads:   threads,
+		Overwrite: true,
+	})
+	assertRestoreFailures(t, failedFiles, 0)
+
+	for _, f := range files {
+		hash1 := getFileHash(testDir + "/repository1/" + f)
+		hash2 := getFileHash(testDir + "/repository2/" + f)
+		if hash1 != hash2 {
+			t.Errorf("File %s has different hashes: %s vs %s", f, hash1, hash2)
+		}
+	}
+}
+
+// keepChunksStorage is a file storage that, like some cloud storages, keeps an existing chunk when another one is
+// uploaded to the same path, without returning an error.
+type keepChunksStorage struct {
+	*FileStorage
+}
+
+func (storage *keepChunksStorage) UploadFile(threadIndex int, filePath string, content []byte) (err error) {
+	if strings.HasPrefix(filePath, chunkDir) {
+		if exist, _, _, _ := storage.GetFileInfo(threadIndex, filePath); exist {
+			return nil
+		}
+	}
+	return storage.FileStorage.UploadFile(threadIndex, filePath, content)
+}
+
+func TestConvertErasureCodingWithoutOverwrite(t *testing.T) {
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir+"/repository1/.duplicacy", 0700)
+	createRandomFileSeeded(testDir+"/repository1/file1", 300000, 1)
+
+	fileStorage, err := CreateFileStorage(testDir+"/storage", false, 1)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	storage := &keepChunksStorage{FileStorage: fileStorage}
+
+	if !ConfigStorage(storage, 4096, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository1/.duplicacy")
+	backupManager := CreateBackupManager("host1", storage, testDir, "", nil)
+	backupManager.SetupSnapshotCache("default")
+	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, true, 1, "first", false, false, 0, false, 1024, 1024)
+
+	// The conversion fails because no chunk has been replaced; none of them is recorded as converted
+	var logs bytes.Buffer
+	testingT = nil
+	logOutput = &logs
+	defer func() {
+		logOutput = nil
+	}()
+
+	converted := true
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(Exception); !ok {
+					panic(r)
+				}
+				converted = false
+			}
+		}()
+		converted = backupManager.SnapshotManager.ConvertErasureCoding(5, 2, "", 0, 1)
+	}()
+	setTestingT(t)
+
+	if converted {
+		t.Errorf("The conversion succeeded although no chunk was replaced")
+	}
+	if !strings.Contains(logs.String(), "CONVERT_VERIFY") || !strings.Contains(logs.String(), "CONVERT_FAIL") {
+		t.Errorf("The chunks not replaced were not reported:\n%s", logs.String())
+	}
+
+	_, numberOfConvertedChunks, err := backupManager.SnapshotManager.getConvertProgress()
+	if err != nil || numberOfConvertedChunks != 0 {
+		t.Errorf("%d chunks were recorded as converted: %v", numberOfConvertedChunks, err)
+	}
+}
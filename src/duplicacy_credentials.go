@@ -0,0 +1,137 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// The output of credential commands that have been run, so that each command is run at most once per process even
+// if the same credential is looked up several times.
+var credentialCommandOutputs = make(map[string]string)
+var credentialCommandLock sync.Mutex
+
+// getCredentialFromEnvironment looks up the environment variable 'name' with the suffix 'suffix', trying also the name
+// with characters not allowed in environment variable names replaced by '_'.
+func getCredentialFromEnvironment(name string, suffix string) string {
+	for _, candidate := range getCredentialEnvironmentNames(name) {
+		candidate += suffix
+		LOG_DEBUG("PASSWORD_ENV_VAR", "Reading the environment variable %s", candidate)
+		if value, found := os.LookupEnv(candidate); found && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func getCredentialEnvironmentNames(name string) []string {
+	names := []string{name}
+	re := regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	if plainName := re.ReplaceAllString(name, "_"); plainName != name {
+		names = append(names, plainName)
+	}
+	return names
+}
+
+// readCredentialFile returns the content of the file at 'filePath' without the trailing line break.
+func readCredentialFile(filePath string) string {
+	LOG_DEBUG("PASSWORD_FILE", "Reading the credential file %s", filePath)
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		LOG_ERROR("PASSWORD_FILE", "Failed to read the credential file %s: %v", filePath, err)
+		return ""
+	}
+	return strings.TrimRight(string(content), "\r\n")
+}
+
+// runCredentialCommand runs 'command' with the shell and returns its standard output without the trailing line break.
+// Standard input and standard error are those of this process so the command can prompt the user if needed.
+func runCredentialCommand(command string) string {
+
+	credentialCommandLock.Lock()
+	defer credentialCommandLock.Unlock()
+
+	if output, found := credentialCommandOutputs[command]; found {
+		return output
+	}
+
+	LOG_DEBUG("PASSWORD_COMMAND", "Running the credential command %s", command)
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		LOG_ERROR("PASSWORD_COMMAND", "Failed to run the credential command %s: %v", command, err)
+		return ""
+	}
+
+	output := strings.TrimRight(stdout.String(), "\r\n")
+	if output == "" {
+		LOG_ERROR("PASSWORD_COMMAND", "The credential command %s returned an empty output", command)
+		return ""
+	}
+
+	credentialCommandOutputs[command] = output
+	return output
+}
+
+// getCredentialFromSystemd reads the credential 'name' passed by systemd with LoadCredential= or
+// LoadCredentialEncrypted=, which is a file in the directory given by $CREDENTIALS_DIRECTORY.
+func getCredentialFromSystemd(name string) string {
+	directory := os.Getenv("CREDENTIALS_DIRECTORY")
+	if directory == "" {
+		return ""
+	}
+
+	filePath := filepath.Join(directory, name)
+	if _, err := os.Stat(filePath); err != nil {
+		LOG_DEBUG("PASSWORD_SYSTEMD", "No systemd credential %s found", name)
+		return ""
+	}
+	return readCredentialFile(filePath)
+}
+
+// getCredentialFromPreference looks up a credential in the preference keys.  The key 'name' + "_file" names a file
+// containing the credential, the key 'name' + "_command" a command printing it, and the key 'name' the credential
+// itself.
+func getCredentialFromPreference(preference Preference, name string) string {
+	if len(preference.Keys) == 0 {
+		return ""
+	}
+
+	if filePath := preference.Keys[name+"_file"]; filePath != "" {
+		LOG_DEBUG("PASSWORD_PREFERENCE", "Reading %s from the file specified in preferences", name)
+		return readCredentialFile(filePath)
+	}
+
+	if command := preference.Keys[name+"_command"]; command != "" {
+		LOG_DEBUG("PASSWORD_PREFERENCE", "Reading %s from the command specified in preferences", name)
+		return runCredentialCommand(command)
+	}
+
+	if value := preference.Keys[name]; value != "" {
+		LOG_DEBUG("PASSWORD_PREFERENCE", "Reading %s from preferences", name)
+		return value
+	}
+
+	return ""
+}
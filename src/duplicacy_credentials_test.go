@@ -0,0 +1,82 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+)
+
+func TestGetPasswordFromCredentialSources(t *testing.T) {
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "credentials")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	passwordFile := path.Join(testDir, "password")
+	ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600)
+	os.MkdirAll(path.Join(testDir, "systemd"), 0700)
+	ioutil.WriteFile(path.Join(testDir, "systemd", "offsite_password"), []byte("from-systemd\n"), 0600)
+
+	for _, name := range []string{"DUPLICACY_OFFSITE_PASSWORD", "DUPLICACY_OFFSITE_PASSWORD_FILE",
+		"DUPLICACY_OFFSITE_PASSWORD_COMMAND", "CREDENTIALS_DIRECTORY"} {
+		value, found := os.LookupEnv(name)
+		os.Unsetenv(name)
+		if found {
+			defer os.Setenv(name, value)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	preference := Preference{
+		Name: "offsite",
+		Keys: map[string]string{
+			"password": "from-preference",
+		},
+	}
+
+	check := func(expected string) {
+		if password := GetPasswordFromPreference(preference, "password"); password != expected {
+			t.Errorf("The password is '%s' instead of '%s'", password, expected)
+		}
+	}
+
+	// Sources are removed one by one, from the highest priority to the lowest
+	os.Setenv("DUPLICACY_OFFSITE_PASSWORD", "from-env")
+	os.Setenv("DUPLICACY_OFFSITE_PASSWORD_FILE", passwordFile)
+	if runtime.GOOS != "windows" {
+		os.Setenv("DUPLICACY_OFFSITE_PASSWORD_COMMAND", "echo from-command")
+	}
+	os.Setenv("CREDENTIALS_DIRECTORY", path.Join(testDir, "systemd"))
+	check("from-env")
+
+	os.Unsetenv("DUPLICACY_OFFSITE_PASSWORD")
+	check("from-file")
+
+	os.Unsetenv("DUPLICACY_OFFSITE_PASSWORD_FILE")
+	if runtime.GOOS != "windows" {
+		check("from-command")
+		os.Unsetenv("DUPLICACY_OFFSITE_PASSWORD_COMMAND")
+	}
+
+	check("from-systemd")
+
+	os.Unsetenv("CREDENTIALS_DIRECTORY")
+	check("from-preference")
+
+	preference.Keys["offsite_password_file"] = passwordFile
+	check("from-file")
+	delete(preference.Keys, "offsite_password_file")
+
+	if runtime.GOOS != "windows" {
+		preference.Keys["password_command"] = "printf 'from-preference-command\\n'"
+		check("from-preference-command")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,6 +27,10 @@ import (
 const (
 	entryHardLinkRootChunkMarker   = -9
 	entryHardLinkTargetChunkMarker = -10
+
+	// The internal attribute storing the change time and the inode number of a file as two 64-bit little-endian
+	// integers.  Like file flags it is never restored as an extended attribute.
+	inodeInfoKey = "\x00I"
 )
 
 // This is the hidden directory in the repository for storing various files.
@@ -570,6 +575,33 @@ func (entry *Entry) IsSameAs(other *Entry) bool {
 	return entry.Size == other.Size && entry.Time <= other.Time+1 && entry.Time >= other.Time-1
 }
 
+// IsSameInode returns false only if both entries have recorded the change time and the inode number and either of
+// them is different.
+func (entry *Entry) IsSameInode(other *Entry) bool {
+	if entry.Attributes == nil || other.Attributes == nil {
+		return true
+	}
+	info, found := (*entry.Attributes)[inodeInfoKey]
+	otherInfo, otherFound := (*other.Attributes)[inodeInfoKey]
+	return !found || !otherFound || bytes.Equal(info, otherInfo)
+}
+
+// ReadInodeInfo records the change time and the inode number of the file, if available, as an internal attribute.
+func (entry *Entry) ReadInodeInfo(fileInfo os.FileInfo) {
+	inode, ctime := getInodeInfo(fileInfo)
+	if inode == 0 {
+		return
+	}
+
+	v := make([]byte, 16)
+	binary.LittleEndian.PutUint64(v[0:], uint64(ctime))
+	binary.LittleEndian.PutUint64(v[8:], inode)
+	if entry.Attributes == nil {
+		entry.Attributes = &map[string][]byte{}
+	}
+	(*entry.Attributes)[inodeInfoKey] = v
+}
+
 func (entry *Entry) IsSameAsFileInfo(other os.FileInfo) bool {
 	time := other.ModTime().Unix()
 	return entry.Size == other.Size() && entry.Time <= time+1 && entry.Time >= time-1
@@ -779,6 +811,8 @@ type EntryListerOptions struct {
 	IncludeFileFlags   bool
 	IncludeSpecials    bool
 	OneFileSystem      bool
+	IncludeInodeInfo   bool        // record the change time and the inode number of each file
+	InodeIndex         *InodeIndex // if not nil, directories that haven't changed since the last backup are not listed
 }
 
 type EntryLister interface {
@@ -814,19 +848,45 @@ func NewLocalDirectoryLister(top string, options *EntryListerOptions) *LocalDire
 	}
 }
 
+// listedFile is a file or subdirectory read by ReadDir.  'entry' is nil if the file has been skipped or excluded.
+type listedFile struct {
+	path         string
+	fileInfo     os.FileInfo
+	entry        *Entry
+	skipped      bool // true if the file couldn't be read and should be reported as skipped
+	linkKey      listEntryLinkKey
+	isHardLinked bool
+}
+
+// DirectoryContent contains what ReadDir has read from a directory.  It must be passed to EmitDir to resolve
+// hard links and send out the entries.
+type DirectoryContent struct {
+	path  string
+	files []listedFile
+	err   error
+}
+
 // ListDir returns a list of entries representing file and subdirectories under the directory 'path'.
 // Entry paths are normalized as relative to 'top'.
 func (dl *LocalDirectoryLister) ListDir(path string, listingChannel chan *Entry) (directoryList []*Entry, skippedFiles []string, err error) {
+	return dl.EmitDir(dl.ReadDir(path), listingChannel)
+}
+
+// ReadDir reads the directory 'path' and the attributes of all files under it.  It doesn't modify the lister so
+// multiple directories can be read concurrently, but their content must be passed to EmitDir one by one in the
+// listing order.
+func (dl *LocalDirectoryLister) ReadDir(path string) (content *DirectoryContent) {
 	LOG_DEBUG("LIST_ENTRIES", "Listing %s", path)
 
+	content = &DirectoryContent{path: path}
+
 	options := dl.options
 	fullPath := joinPath(dl.top, path)
 
-	files := make([]os.FileInfo, 0, 1024)
-
-	files, err = ioutil.ReadDir(fullPath)
+	files, err := ioutil.ReadDir(fullPath)
 	if err != nil {
-		return directoryList, nil, err
+		content.err = err
+		return content
 	}
 
 	patterns := options.Patterns
@@ -836,7 +896,7 @@ func (dl *LocalDirectoryLister) ListDir(path string, listingChannel chan *Entry)
 		ii := sort.Search(len(files), func(ii int) bool { return strings.Compare(files[ii].Name(), options.NoBackupFile) >= 0 })
 		if ii < len(files) && files[ii].Name() == options.NoBackupFile {
 			LOG_DEBUG("LIST_NOBACKUP", "%s is excluded due to nobackup file", path)
-			return directoryList, skippedFiles, nil
+			return content
 		}
 	}
 
@@ -852,6 +912,8 @@ func (dl *LocalDirectoryLister) ListDir(path string, listingChannel chan *Entry)
 
 	sort.Sort(FileInfoCompare(files))
 
+	content.files = make([]listedFile, 0, len(files))
+
 	for _, f := range files {
 		if f.Name() == DUPLICACY_DIRECTORY {
 			continue
@@ -868,32 +930,19 @@ func (dl *LocalDirectoryLister) ListDir(path string, listingChannel chan *Entry)
 			continue
 		}
 
-		entry := CreateEntryFromFileInfo(f, path)
+		content.files = append(content.files, listedFile{path: path, fileInfo: f})
+		file := &content.files[len(content.files)-1]
 
-		linkKey, isHardLinked := getHardLinkKey(f)
-		if isHardLinked {
-			if linkIndex, seen := dl.linkTable[linkKey]; seen {
-				if linkIndex == -1 {
-					LOG_DEBUG("LIST_EXCLUDE", "%s was excluded or skipped (hard link)", entry.Path)
-					continue
-				}
+		entry := CreateEntryFromFileInfo(f, path)
 
-				entry.Size = 0
-				if entry.IsFile() {
-					entry.Link = strconv.FormatInt(int64(linkIndex), 16)
-				} else {
-					entry.EndChunk = entryHardLinkTargetChunkMarker
-					entry.EndOffset = linkIndex
-				}
-				listingChannel <- entry
-				continue
+		// Every hard linked file is treated as the root here; EmitDir will turn it into a child if another link
+		// to the same file has been seen
+		file.linkKey, file.isHardLinked = getHardLinkKey(f)
+		if file.isHardLinked {
+			if entry.IsFile() {
+				entry.Link = "/"
 			} else {
-				if entry.IsFile() {
-					entry.Link = "/"
-				} else {
-					entry.EndChunk = entryHardLinkRootChunkMarker
-				}
-				dl.linkTable[linkKey] = -1
+				entry.EndChunk = entryHardLinkRootChunkMarker
 			}
 		}
 
@@ -904,7 +953,7 @@ func (dl *LocalDirectoryLister) ListDir(path string, listingChannel chan *Entry)
 			isRegular, entry.Link, err = Readlink(fullPath)
 			if err != nil {
 				LOG_WARN("LIST_LINK", "Failed to read the symlink %s: %v", entry.Path, err)
-				skippedFiles = append(skippedFiles, entry.Path)
+				file.skipped = true
 				continue
 			}
 
@@ -914,7 +963,7 @@ func (dl *LocalDirectoryLister) ListDir(path string, listingChannel chan *Entry)
 				stat, err := os.Stat(fullPath)
 				if err != nil {
 					LOG_WARN("LIST_LINK", "Failed to read the symlink: %v", err)
-					skippedFiles = append(skippedFiles, entry.Path)
+					file.skipped = true
 					continue
 				}
 
@@ -932,7 +981,7 @@ func (dl *LocalDirectoryLister) ListDir(path string, listingChannel chan *Entry)
 		} else if options.IncludeSpecials && entry.IsSpecial() {
 			if err := entry.ReadSpecial(fullPath, f); err != nil {
 				LOG_WARN("LIST_DEV", "Failed to save device node %s: %v", entry.Path, err)
-				skippedFiles = append(skippedFiles, entry.Path)
+				file.skipped = true
 				continue
 			}
 		}
@@ -955,25 +1004,92 @@ func (dl *LocalDirectoryLister) ListDir(path string, listingChannel chan *Entry)
 			continue
 		}
 
-		if isHardLinked {
-			dl.linkTable[linkKey] = dl.linkIndex
+		if options.IncludeInodeInfo && entry.IsFile() {
+			entry.ReadInodeInfo(f)
+		}
+
+		file.entry = entry
+	}
+
+	return content
+}
+
+// EmitDir resolves hard links among the entries read by ReadDir, sends out all files and then all subdirectories
+// to 'listingChannel', and returns the subdirectories in the reverse order so they can be pushed onto a stack.
+func (dl *LocalDirectoryLister) EmitDir(content *DirectoryContent, listingChannel chan *Entry) (directoryList []*Entry, skippedFiles []string, err error) {
+
+	if content.err != nil {
+		return directoryList, nil, content.err
+	}
+
+	directoryFileInfo := make(map[*Entry]os.FileInfo)
+
+	for i := range content.files {
+		file := &content.files[i]
+
+		if file.isHardLinked {
+			if linkIndex, seen := dl.linkTable[file.linkKey]; seen {
+				if linkIndex == -1 {
+					LOG_DEBUG("LIST_EXCLUDE", "%s was excluded or skipped (hard link)", file.path)
+					continue
+				}
+
+				entry := CreateEntryFromFileInfo(file.fileInfo, file.path)
+				entry.Size = 0
+				if entry.IsFile() {
+					entry.Link = strconv.FormatInt(int64(linkIndex), 16)
+				} else {
+					entry.EndChunk = entryHardLinkTargetChunkMarker
+					entry.EndOffset = linkIndex
+				}
+				sendEntry(listingChannel, entry)
+				continue
+			}
+			dl.linkTable[file.linkKey] = -1
+		}
+
+		if file.entry == nil {
+			if file.skipped {
+				skippedFiles = append(skippedFiles, file.path)
+			}
+			continue
+		}
+
+		if file.isHardLinked {
+			dl.linkTable[file.linkKey] = dl.linkIndex
 			dl.linkIndex++
 		}
 
-		if entry.IsDir() {
-			directoryList = append(directoryList, entry)
+		if file.entry.IsDir() {
+			directoryList = append(directoryList, file.entry)
+			directoryFileInfo[file.entry] = file.fileInfo
 		} else {
-			listingChannel <- entry
+			sendEntry(listingChannel, file.entry)
 		}
 	}
 
 	// For top level directory we need to sort again because symlinks may have been changed
-	if path == "" {
+	if content.path == "" {
 		sort.Sort(ByName(directoryList))
 	}
 
+	index := dl.options.InodeIndex
+	listedDirectories := directoryList[:0]
 	for _, entry := range directoryList {
-		listingChannel <- entry
+		// A directory that hasn't changed is still sent out but not returned for listing
+		if index == nil || !index.Visit(entry.Path, directoryFileInfo[entry]) {
+			listedDirectories = append(listedDirectories, entry)
+		}
+		sendEntry(listingChannel, entry)
+	}
+	directoryList = listedDirectories
+
+	if index != nil {
+		pinned := false
+		for i := range content.files {
+			pinned = pinned || content.files[i].isHardLinked
+		}
+		index.Record(content.path, pinned)
 	}
 
 	for i, j := 0, len(directoryList)-1; i < j; i, j = i+1, j-1 {
@@ -7,6 +7,7 @@ package duplicacy
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -232,6 +233,68 @@ func TestEntryOrder(t *testing.T) {
 
 }
 
+// TestEntryParallelListing checks that listing with multiple threads produces the same entries in the same order
+// as listing with a single thread, including hard links
+func TestEntryParallelListing(t *testing.T) {
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "parallel")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			dir := filepath.Join(testDir, fmt.Sprintf("dir%d", i), fmt.Sprintf("sub%d", j))
+			os.MkdirAll(dir, 0700)
+			for k := 0; k < 4; k++ {
+				os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", k)), []byte(dir), 0600)
+			}
+			// Each file0 is linked from the top directory and from the next directory
+			if runtime.GOOS != "windows" {
+				os.Link(filepath.Join(dir, "file0"), filepath.Join(testDir, fmt.Sprintf("link%d-%d", i, j)))
+				os.Link(filepath.Join(dir, "file0"), filepath.Join(testDir, fmt.Sprintf("dir%d", (i+1)%8), fmt.Sprintf("link%d", j)))
+			}
+		}
+	}
+
+	listEntries := func(threads int) (entries []*Entry) {
+		snapshot := CreateEmptySnapshot("parallel")
+		listingChannel := make(chan *Entry)
+		go snapshot.ListLocalFiles(testDir, listingChannel, nil, nil, &ListFilesOptions{
+			FiltersFile:    filepath.Join(testDir, "nonexistent_filters"),
+			ListingThreads: threads,
+		})
+		for entry := range listingChannel {
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	entries1 := listEntries(1)
+	for _, threads := range []int{2, 4, 16} {
+		entries2 := listEntries(threads)
+		if len(entries1) != len(entries2) {
+			t.Errorf("[threads %d] %d entries instead of %d", threads, len(entries2), len(entries1))
+			continue
+		}
+		for i := range entries1 {
+			if entries1[i].Path != entries2[i].Path || entries1[i].Link != entries2[i].Link ||
+				entries1[i].EndChunk != entries2[i].EndChunk || entries1[i].EndOffset != entries2[i].EndOffset {
+				t.Errorf("[threads %d] entry %d is %s (link %s) instead of %s (link %s)", threads, i,
+					entries2[i].Path, entries2[i].Link, entries1[i].Path, entries1[i].Link)
+			}
+		}
+		for i := 1; i < len(entries2); i++ {
+			if entries2[i-1].Compare(entries2[i]) >= 0 {
+				t.Errorf("[threads %d] %s is listed before %s", threads, entries2[i-1].Path, entries2[i].Path)
+			}
+		}
+	}
+
+	if !t.Failed() {
+		os.RemoveAll(testDir)
+	}
+}
+
 // TestEntryExcludeByAttribute tests the excludeByAttribute parameter to the ListEntries function
 func TestEntryExcludeByAttribute(t *testing.T) {
 
@@ -23,6 +23,10 @@ type FileStorage struct {
 	isCacheNeeded   bool // Network storages require caching
 	storageDir      string
 	numberOfThreads int
+
+	objectLockRetention time.Duration // How long chunks and snapshot files are immutable after being uploaded
+
+	rejectDeletions bool // Refuse to delete, rename or overwrite files as an append-only server would
 }
 
 // CreateFileStorage creates a file storage.
@@ -91,7 +95,13 @@ func (storage *FileStorage) ListFiles(threadIndex int, dir string) (files []stri
 
 // DeleteFile deletes the file or directory at 'filePath'.
 func (storage *FileStorage) DeleteFile(threadIndex int, filePath string) (err error) {
+	if storage.rejectDeletions {
+		return storage.errorAppendOnly("delete", filePath)
+	}
 	err = os.Remove(path.Join(storage.storageDir, filePath))
+	if os.IsPermission(err) && storage.releaseExpiredLock(filePath) {
+		err = os.Remove(path.Join(storage.storageDir, filePath))
+	}
 	if err == nil || os.IsNotExist(err) {
 		return nil
 	} else {
@@ -101,7 +111,34 @@ func (storage *FileStorage) DeleteFile(threadIndex int, filePath string) (err er
 
 // MoveFile renames the file.
 func (storage *FileStorage) MoveFile(threadIndex int, from string, to string) (err error) {
-	return os.Rename(path.Join(storage.storageDir, from), path.Join(storage.storageDir, to))
+	if storage.rejectDeletions {
+		return storage.errorAppendOnly("rename", from)
+	}
+	err = os.Rename(path.Join(storage.storageDir, from), path.Join(storage.storageDir, to))
+	if os.IsPermission(err) && storage.releaseExpiredLock(from) {
+		err = os.Rename(path.Join(storage.storageDir, from), path.Join(storage.storageDir, to))
+	}
+	return err
+}
+
+// errorAppendOnly returns the error for an operation refused by an append-only storage, which is a permission error
+// like the one a server would return.
+func (storage *FileStorage) errorAppendOnly(operation string, filePath string) error {
+	return &os.PathError{Op: operation, Path: filePath, Err: syscall.EPERM}
+}
+
+// releaseExpiredLock clears the immutable flag of a file whose retention date has passed, and returns true if the
+// file is no longer locked.
+func (storage *FileStorage) releaseExpiredLock(filePath string) bool {
+	if !isFileLockSupported {
+		return false
+	}
+	expiry, err := getFileLockExpiry(path.Join(storage.storageDir, filePath), true)
+	if err != nil {
+		LOG_WARN("FILE_LOCK", "Failed to get the retention date of %s: %v", filePath, err)
+		return false
+	}
+	return expiry.IsZero()
 }
 
 // CreateDirectory creates a new directory.
@@ -151,74 +188,191 @@ func (storage *FileStorage) UploadFile(threadIndex int, filePath string, content
 
 	fullPath := path.Join(storage.storageDir, filePath)
 
-	if len(strings.Split(filePath, "/")) > 2 {
-		dir := path.Dir(fullPath)
-		// Use Lstat() instead of Stat() since 1) Stat() doesn't work for deduplicated disks on Windows and 2) there isn't
-		// really a need to follow the link if filePath is a link.
-		stat, err := os.Lstat(dir)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return err
-			}
-			err = os.MkdirAll(dir, 0744)
-			if err != nil {
-				return err
+	err = storage.makeParentDirectory(filePath)
+	if err != nil {
+		return err
+	}
+
+	if storage.rejectDeletions {
+		if _, err := os.Lstat(fullPath); err == nil {
+			return storage.errorAppendOnly("overwrite", filePath)
+		}
+	}
+
+	temporaryFile, err := storage.writeTemporaryFile(fullPath, content)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(temporaryFile, fullPath)
+	if err != nil {
+
+		if _, e := os.Stat(fullPath); e == nil {
+			// In the append-only mode the temporary file is left for prune to remove
+			if !storage.IsAppendOnly() && !storage.rejectDeletions {
+				os.Remove(temporaryFile)
 			}
+			return nil
 		} else {
-			if !stat.IsDir() && stat.Mode() & os.ModeSymlink == 0 {
-				return fmt.Errorf("The path %s is not a directory or symlink", dir)
-			}
+			return err
 		}
 	}
 
+	if storage.objectLockRetention > 0 && isObjectLockRequired(filePath) {
+		return lockFile(fullPath, time.Now().Add(storage.objectLockRetention))
+	}
+
+	return nil
+}
+
+// UploadFileIfNotExist writes the file to a temporary file first and then links it to 'filePath', which fails if the
+// file already exists, so the file appears complete or not at all.  Like UploadFile it never replaces a file, so it works
+// the same way in the append-only mode.  On file systems without hard links the file is written in place with O_EXCL.
+func (storage *FileStorage) UploadFileIfNotExist(threadIndex int, filePath string, content []byte) (exist bool, err error) {
+
+	fullPath := path.Join(storage.storageDir, filePath)
+
+	err = storage.makeParentDirectory(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	temporaryFile, err := storage.writeTemporaryFile(fullPath, content)
+	if temporaryFile != "" {
+		// The temporary file is either partial or another link to the published file, so it can always be removed
+		defer os.Remove(temporaryFile)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Link(temporaryFile, fullPath)
+	if os.IsExist(err) {
+		return true, nil
+	} else if err != nil {
+		exist, err = storage.writeFileIfNotExist(fullPath, content)
+		if exist || err != nil {
+			return exist, err
+		}
+	}
+
+	if storage.objectLockRetention > 0 && isObjectLockRequired(filePath) {
+		return false, lockFile(fullPath, time.Now().Add(storage.objectLockRetention))
+	}
+	return false, nil
+}
+
+// writeTemporaryFile writes 'content' to a new temporary file next to 'fullPath' and returns its path, which is also
+// returned if the write failed after the file was created.
+func (storage *FileStorage) writeTemporaryFile(fullPath string, content []byte) (temporaryFile string, err error) {
+
 	letters := "abcdefghijklmnopqrstuvwxyz"
 	suffix := make([]byte, 8)
 	for i := range suffix {
 		suffix[i] = letters[rand.Intn(len(letters))]
 	}
 
-	temporaryFile := fullPath + "." + string(suffix) + ".tmp"
+	temporaryFile = fullPath + "." + string(suffix) + ".tmp"
 
 	file, err := os.OpenFile(temporaryFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	reader := CreateRateLimitedReader(content, storage.UploadRateLimit/storage.numberOfThreads)
-	_, err = io.Copy(file, reader)
-	if err != nil {
-		file.Close()
-		return err
+	err = storage.writeAndSync(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
 	}
+	return temporaryFile, err
+}
 
-	if err = file.Sync(); err != nil {
-		pathErr, ok := err.(*os.PathError)
-		isNotSupported := ok && pathErr.Op == "sync" && pathErr.Err == syscall.ENOTSUP
-		if !isNotSupported {
-			_ = file.Close()
-			return err
+// writeFileIfNotExist writes 'content' directly to 'fullPath' with O_EXCL, so that nothing is written if the file
+// already exists.  A partial file left by a failed write is removed unless no file can be deleted.
+func (storage *FileStorage) writeFileIfNotExist(fullPath string, content []byte) (exist bool, err error) {
+
+	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	err = storage.writeAndSync(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if !storage.IsAppendOnly() && !storage.rejectDeletions {
+			os.Remove(fullPath)
 		}
+		return false, err
 	}
+	return false, nil
+}
 
-	err = file.Close()
+// writeAndSync writes 'content' to 'file' at the upload rate limit and flushes it to the disk.
+func (storage *FileStorage) writeAndSync(file *os.File, content []byte) error {
+
+	reader := CreateRateLimitedReader(content, storage.UploadRateLimit/storage.numberOfThreads)
+	_, err := io.Copy(file, reader)
 	if err != nil {
 		return err
 	}
 
-	err = os.Rename(temporaryFile, fullPath)
-	if err != nil {
+	err = file.Sync()
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Op == "sync" && pathErr.Err == syscall.ENOTSUP {
+		return nil
+	}
+	return err
+}
 
-		if _, e := os.Stat(fullPath); e == nil {
-			os.Remove(temporaryFile)
-			return nil
-		} else {
+// makeParentDirectory creates the directory that will contain 'filePath' if it doesn't exist.
+func (storage *FileStorage) makeParentDirectory(filePath string) error {
+
+	if len(strings.Split(filePath, "/")) <= 2 {
+		return nil
+	}
+
+	dir := path.Dir(path.Join(storage.storageDir, filePath))
+	// Use Lstat() instead of Stat() since 1) Stat() doesn't work for deduplicated disks on Windows and 2) there isn't
+	// really a need to follow the link if filePath is a link.
+	stat, err := os.Lstat(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
 			return err
 		}
+		return os.MkdirAll(dir, 0744)
+	}
+	if !stat.IsDir() && stat.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("The path %s is not a directory or symlink", dir)
 	}
+	return nil
+}
 
+// SetObjectLock makes chunks and snapshot files uploaded afterwards immutable for 'retention', by setting the
+// immutable file flag and recording the retention date in an extended attribute.  Unlike S3 Object Lock, this only
+// protects against clients without CAP_LINUX_IMMUTABLE, so both modes behave the same.
+func (storage *FileStorage) SetObjectLock(mode string, retention time.Duration) (err error) {
+	if mode != "governance" && mode != "compliance" {
+		return fmt.Errorf("invalid object lock mode '%s'", mode)
+	}
+	if !isFileLockSupported {
+		return fmt.Errorf("locking files is not supported on this platform")
+	}
+	storage.objectLockRetention = retention
 	return nil
 }
 
+// IsObjectLockEnabled returns true if object lock has been configured for the storage.
+func (storage *FileStorage) IsObjectLockEnabled() bool {
+	return storage.objectLockRetention > 0
+}
+
+// GetObjectLockExpiry returns the retention date of the file at 'filePath' if it is immutable.
+func (storage *FileStorage) GetObjectLockExpiry(threadIndex int, filePath string) (expiry time.Time, err error) {
+	return getFileLockExpiry(path.Join(storage.storageDir, filePath), false)
+}
+
 // If a local snapshot cache is needed for the storage to avoid downloading/uploading chunks too often when
 // managing snapshots.
 func (storage *FileStorage) IsCacheNeeded() bool { return storage.isCacheNeeded }
@@ -0,0 +1,85 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
+)
+
+// The retention date of a locked file is stored in this extended attribute, since the immutable flag itself
+// never expires
+const fileLockExpiryAttribute = "user.duplicacy.retain_until"
+
+const isFileLockSupported = true
+
+// lockFile makes the file immutable (as 'chattr +i' does) until 'expiry'.  This requires CAP_LINUX_IMMUTABLE.
+func lockFile(fullPath string, expiry time.Time) error {
+	err := xattr.Set(fullPath, fileLockExpiryAttribute, []byte(strconv.FormatInt(expiry.Unix(), 10)))
+	if err != nil {
+		return err
+	}
+
+	fd, err := openForChFlagsTryNoAtime(fullPath)
+	if err != nil {
+		return err
+	}
+	defer closeRetry(fd)
+
+	flags, err := ioctlGetUint32Retry(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	return ioctlSetUint32Retry(fd, unix.FS_IOC_SETFLAGS, flags|linux_FS_IMMUTABLE_FL)
+}
+
+// getFileLockExpiry returns the retention date of an immutable file, or the zero time if the file is not immutable.
+// If 'release' is true and the retention date has passed, the immutable flag is cleared.
+func getFileLockExpiry(fullPath string, release bool) (expiry time.Time, err error) {
+	fd, err := openForChFlagsTryNoAtime(fullPath)
+	if err == unix.ENOENT {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	defer closeRetry(fd)
+
+	flags, err := ioctlGetUint32Retry(fd, unix.FS_IOC_GETFLAGS)
+	if err == unix.ENOTTY {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	if flags&linux_FS_IMMUTABLE_FL == 0 {
+		return time.Time{}, nil
+	}
+
+	value, err := xattr.Get(fullPath, fileLockExpiryAttribute)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("the file is immutable but its retention date can't be read: %v", err)
+	}
+	seconds, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid retention date '%s'", value)
+	}
+
+	expiry = time.Unix(seconds, 0)
+	if expiry.After(time.Now()) {
+		return expiry, nil
+	}
+
+	if release {
+		err = ioctlSetUint32Retry(fd, unix.FS_IOC_SETFLAGS, flags&^linux_FS_IMMUTABLE_FL)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Time{}, nil
+}
@@ -0,0 +1,23 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+//go:build !linux
+// +build !linux
+
+package duplicacy
+
+import (
+	"fmt"
+	"time"
+)
+
+const isFileLockSupported = false
+
+func lockFile(fullPath string, expiry time.Time) error {
+	return fmt.Errorf("locking files is only supported on Linux")
+}
+
+func getFileLockExpiry(fullPath string, release bool) (expiry time.Time, err error) {
+	return time.Time{}, nil
+}
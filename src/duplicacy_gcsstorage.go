@@ -6,7 +6,9 @@ package duplicacy
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -194,6 +196,42 @@ func (storage *GCSStorage) ListFiles(threadIndex int, dir string) ([]string, []i
 	return files, sizes, nil
 }
 
+// ListFilesWithChecksums returns all files under 'dir' with their sizes and CRC32C checksums.
+func (storage *GCSStorage) ListFilesWithChecksums(threadIndex int, dir string) (files []string, sizes []int64, checksums []string, err error) {
+	for len(dir) > 0 && dir[len(dir)-1] == '/' {
+		dir = dir[:len(dir)-1]
+	}
+
+	query := gcs.Query{
+		Prefix: storage.storageDir + dir + "/",
+	}
+	prefixLength := len(query.Prefix)
+
+	iter := storage.bucket.Objects(context.Background(), &query)
+	for {
+		attributes, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if len(attributes.Prefix) == 0 {
+			files = append(files, attributes.Name[prefixLength:])
+			sizes = append(sizes, attributes.Size)
+			checksums = append(checksums, fmt.Sprintf("crc32c:%08x", attributes.CRC32C))
+		}
+	}
+
+	return files, sizes, checksums, nil
+}
+
+// ComputeChecksum returns the CRC32C of the content, which GCS computes for every object.
+func (storage *GCSStorage) ComputeChecksum(content []byte) string {
+	return fmt.Sprintf("crc32c:%08x", crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli)))
+}
+
 // DeleteFile deletes the file or directory at 'filePath'.
 func (storage *GCSStorage) DeleteFile(threadIndex int, filePath string) (err error) {
 	err = storage.bucket.Object(storage.storageDir + filePath).Delete(context.Background())
@@ -272,6 +310,35 @@ func (storage *GCSStorage) UploadFile(threadIndex int, filePath string, content
 	return err
 }
 
+// UploadFileIfNotExist uploads the file with the precondition that no generation of the object exists, which makes
+// GCS reject the upload with 412 if the file already exists.  A retry of an upload that succeeded also gets 412, so
+// SnapshotManager compares the existing file with its own before taking it as uploaded by another client.
+func (storage *GCSStorage) UploadFileIfNotExist(threadIndex int, filePath string, content []byte) (exist bool, err error) {
+
+	backoff := 1
+	for {
+		object := storage.bucket.Object(storage.storageDir + filePath).If(gcs.Conditions{DoesNotExist: true})
+		writeCloser := object.NewWriter(context.Background())
+		reader := CreateRateLimitedReader(content, storage.UploadRateLimit/storage.numberOfThreads)
+		_, err = io.Copy(writeCloser, reader)
+		// The result of the upload, including a failed precondition, is only known when the writer is closed
+		if closeErr := writeCloser.Close(); err == nil {
+			err = closeErr
+		}
+
+		var apiError *googleapi.Error
+		if errors.As(err, &apiError) && apiError.Code == 412 {
+			return true, nil
+		}
+
+		if retry, e := storage.shouldRetry(&backoff, err); e == nil && !retry {
+			return false, nil
+		} else if !retry {
+			return false, e
+		}
+	}
+}
+
 // If a local snapshot cache is needed for the storage to avoid downloading/uploading chunks too often when
 // managing snapshots.
 func (storage *GCSStorage) IsCacheNeeded() bool { return true }
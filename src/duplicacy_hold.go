@@ -0,0 +1,196 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SnapshotHold records that a revision has been pinned and must not be deleted by any prune operation, no matter
+// which retention policy is used or which client runs it.  Holds are stored under 'snapshots/<id>/holds/<revision>'.
+type SnapshotHold struct {
+	Reason    string `json:"reason"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func getHoldDirectory(snapshotID string) string {
+	return fmt.Sprintf("snapshots/%s/holds/", snapshotID)
+}
+
+func getHoldPath(snapshotID string, revision int) string {
+	return fmt.Sprintf("snapshots/%s/holds/%d", snapshotID, revision)
+}
+
+// getHoldDerivationKey returns the key used to encrypt a hold file, derived from its path like snapshot files.
+func getHoldDerivationKey(holdPath string) string {
+	if len(holdPath) > 64 {
+		return holdPath[len(holdPath)-64:]
+	}
+	return holdPath
+}
+
+// String returns a one-line description of the hold.
+func (hold *SnapshotHold) String() string {
+	createdAt := time.Unix(hold.CreatedAt, 0).Format("2006-01-02 15:04")
+	if hold.Reason == "" {
+		return fmt.Sprintf("pinned by %s at %s", hold.CreatedBy, createdAt)
+	}
+	return fmt.Sprintf("pinned by %s at %s: %s", hold.CreatedBy, createdAt, hold.Reason)
+}
+
+// ListHolds returns the holds placed on revisions of the given snapshot id.  Holds are always read from the storage
+// rather than the snapshot cache, because they can be removed or replaced from any other client.
+func (manager *SnapshotManager) ListHolds(snapshotID string) (holds map[int]*SnapshotHold, err error) {
+
+	holdDir := getHoldDirectory(snapshotID)
+
+	files, _, err := manager.storage.ListFiles(0, holdDir)
+	if err != nil {
+		exist, _, _, statErr := manager.storage.GetFileInfo(0, holdDir)
+		if statErr == nil && !exist {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, file := range files {
+		if len(file) == 0 || file[len(file)-1] == '/' {
+			continue
+		}
+		revision, err := strconv.Atoi(file)
+		if err != nil {
+			continue
+		}
+
+		hold, err := manager.downloadHold(getHoldPath(snapshotID, revision))
+		if err != nil {
+			return nil, err
+		}
+
+		if holds == nil {
+			holds = make(map[int]*SnapshotHold)
+		}
+		holds[revision] = hold
+	}
+
+	return holds, nil
+}
+
+func (manager *SnapshotManager) downloadHold(holdPath string) (*SnapshotHold, error) {
+
+	manager.fileChunk.Reset(false)
+	err := manager.storage.DownloadFile(0, holdPath, manager.fileChunk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the hold file %s: %v", holdPath, err)
+	}
+
+	err, _ = manager.fileChunk.Decrypt(manager.config.FileKey, getHoldDerivationKey(holdPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the hold file %s: %v", holdPath, err)
+	}
+
+	hold := &SnapshotHold{}
+	err = json.Unmarshal(manager.fileChunk.GetBytes(), hold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the hold file %s: %v", holdPath, err)
+	}
+
+	return hold, nil
+}
+
+// PinSnapshot places a hold with the given reason on each of the specified revisions.  An existing hold is
+// replaced.
+func (manager *SnapshotManager) PinSnapshot(snapshotID string, revisions []int, reason string) bool {
+
+	LOG_DEBUG("PIN_PARAMETERS", "id: %s, revisions: %v, reason: %s", snapshotID, revisions, reason)
+
+	existingRevisions, err := manager.ListSnapshotRevisions(snapshotID)
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_LIST", "Failed to list all revisions for snapshot %s: %v", snapshotID, err)
+		return false
+	}
+
+	for _, revision := range revisions {
+		index := sort.SearchInts(existingRevisions, revision)
+		if index >= len(existingRevisions) || existingRevisions[index] != revision {
+			LOG_ERROR("SNAPSHOT_PIN", "Snapshot %s at revision %d does not exist", snapshotID, revision)
+			return false
+		}
+	}
+
+	err = manager.storage.CreateDirectory(0, getHoldDirectory(snapshotID))
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_PIN", "Failed to create the hold directory for snapshot %s: %v", snapshotID, err)
+		return false
+	}
+
+	for _, revision := range revisions {
+		hold := &SnapshotHold{
+			Reason:    reason,
+			CreatedBy: hostname,
+			CreatedAt: time.Now().Unix(),
+		}
+
+		description, err := json.Marshal(hold)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_PIN", "Failed to create a json file for the hold: %v", err)
+			return false
+		}
+
+		holdPath := getHoldPath(snapshotID, revision)
+		manager.fileChunk.Reset(false)
+		manager.fileChunk.Write(description)
+		err = manager.fileChunk.Encrypt(manager.config.FileKey, getHoldDerivationKey(holdPath), true)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_PIN", "Failed to encrypt the hold file %s: %v", holdPath, err)
+			return false
+		}
+
+		err = manager.storage.UploadFile(0, holdPath, manager.fileChunk.GetBytes())
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_PIN", "Failed to upload the hold file %s: %v", holdPath, err)
+			return false
+		}
+
+		LOG_INFO("SNAPSHOT_PIN", "Snapshot %s at revision %d has been pinned", snapshotID, revision)
+	}
+
+	return true
+}
+
+// UnpinSnapshot removes the holds on the specified revisions.
+func (manager *SnapshotManager) UnpinSnapshot(snapshotID string, revisions []int) bool {
+
+	LOG_DEBUG("UNPIN_PARAMETERS", "id: %s, revisions: %v", snapshotID, revisions)
+
+	holds, err := manager.ListHolds(snapshotID)
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_HOLD", "Failed to list the holds for snapshot %s: %v", snapshotID, err)
+		return false
+	}
+
+	for _, revision := range revisions {
+		if _, found := holds[revision]; !found {
+			LOG_WARN("SNAPSHOT_UNPIN", "Snapshot %s at revision %d is not pinned", snapshotID, revision)
+			continue
+		}
+
+		err = manager.storage.DeleteFile(0, getHoldPath(snapshotID, revision))
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_UNPIN", "Failed to remove the hold on snapshot %s at revision %d: %v",
+				snapshotID, revision, err)
+			return false
+		}
+
+		LOG_INFO("SNAPSHOT_UNPIN", "Snapshot %s at revision %d has been unpinned", snapshotID, revision)
+	}
+
+	return true
+}
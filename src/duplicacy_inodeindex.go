@@ -0,0 +1,414 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// The change journal is a text file under the snapshot cache directory written by the watch command.  It starts
+// with a 'session' line identifying the watching process, followed by a 'dirty' line for each directory in which
+// a change has been observed.  An 'overflow' line means some changes may have been missed.
+const (
+	changeJournalFile         = "journal"
+	consumedChangeJournalFile = "journal.consumed"
+	inodeIndexFile            = "inode_index"
+)
+
+// InodeRecord is what the inode index remembers about a directory listed by the last backup.
+type InodeRecord struct {
+	Inode  uint64
+	Size   int64
+	MTime  int64 // in nanoseconds
+	CTime  int64 // in nanoseconds
+	Pinned bool  // the directory or one below it contains hard linked files so it must always be listed
+}
+
+// InodeIndex allows a quick mode backup to skip directories that haven't changed since the last backup.  Directory
+// timestamps alone can't reveal modifications of files inside, so a subtree is only skipped when a change journal
+// kept by the watch command covers the entire period since the last backup, no change has been recorded under the
+// subtree, and the directory still has the same inode and timestamps.  Files in skipped directories are copied
+// from the last snapshot.
+type InodeIndex struct {
+	Revision    int    // the revision created by the backup that saved this index
+	Session     string // the watch session whose journal was consumed by that backup
+	Fingerprint string // a hash of the filters and listing options
+	Directories map[string]*InodeRecord
+
+	cachePath string
+
+	previous         *InodeIndex
+	dirtyDirectories map[string]bool // directories with changes and all their ancestors; nil if nothing can be skipped
+	visited          map[string]*InodeRecord
+	skipped          map[string]bool
+	skippedLock      sync.Mutex
+}
+
+// LoadInodeIndex consumes the change journal under 'cachePath' and loads the index saved by the last backup.  It
+// returns nil if there is no change journal from a running watch session, in which case there is no point in
+// maintaining the index.  'revision' is the revision of the last backup, or 0 if no directories should be
+// skipped.
+func LoadInodeIndex(cachePath string, revision int) *InodeIndex {
+
+	sessions, dirtyPaths, overflow, err := consumeChangeJournal(cachePath)
+	if err != nil {
+		LOG_WARN("INDEX_JOURNAL", "Failed to read the change journal: %v", err)
+		os.Remove(path.Join(cachePath, consumedChangeJournalFile))
+		return nil
+	}
+
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	session := sessions[len(sessions)-1]
+	if !isWatchSessionRunning(session) {
+		LOG_INFO("INDEX_JOURNAL", "The watch session that wrote the change journal is no longer running")
+		return nil
+	}
+
+	index := &InodeIndex{
+		Session:     session,
+		Directories: make(map[string]*InodeRecord),
+		cachePath:   cachePath,
+		visited:     make(map[string]*InodeRecord),
+		skipped:     make(map[string]bool),
+	}
+
+	previous := &InodeIndex{}
+	indexFile, err := os.Open(path.Join(cachePath, inodeIndexFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LOG_WARN("INDEX_LOAD", "Failed to open the inode index: %v", err)
+		}
+		return index
+	}
+	defer indexFile.Close()
+
+	err = msgpack.NewDecoder(bufio.NewReader(indexFile)).Decode(previous)
+	if err != nil {
+		LOG_WARN("INDEX_LOAD", "Failed to load the inode index: %v", err)
+		return index
+	}
+
+	if overflow {
+		LOG_INFO("INDEX_JOURNAL", "The change journal is incomplete; all directories will be listed")
+		return index
+	}
+
+	if previous.Revision != revision {
+		LOG_DEBUG("INDEX_LOAD", "The inode index was created for revision %d instead of %d", previous.Revision, revision)
+		return index
+	}
+
+	for _, s := range sessions {
+		if s != previous.Session {
+			LOG_INFO("INDEX_JOURNAL", "The change journal doesn't cover the entire period since the last backup")
+			return index
+		}
+	}
+
+	index.previous = previous
+	index.dirtyDirectories = make(map[string]bool)
+	for _, dirtyPath := range dirtyPaths {
+		for {
+			if index.dirtyDirectories[dirtyPath] {
+				break
+			}
+			index.dirtyDirectories[dirtyPath] = true
+			if dirtyPath == "" {
+				break
+			}
+			dirtyPath = getParentDirectory(dirtyPath)
+		}
+	}
+	LOG_DEBUG("INDEX_JOURNAL", "%d directories have been changed since the last backup", len(dirtyPaths))
+
+	return index
+}
+
+// getParentDirectory returns the parent of the directory 'dir'; both end with a '/' unless it is the top directory.
+func getParentDirectory(dir string) string {
+	dir = strings.TrimSuffix(dir, "/")
+	i := strings.LastIndex(dir, "/")
+	if i == -1 {
+		return ""
+	}
+	return dir[:i+1]
+}
+
+// consumeChangeJournal moves the current change journal into the consumed journal, which is deleted only after the
+// backup has completed, and parses the consumed journal.
+func consumeChangeJournal(cachePath string) (sessions []string, dirtyPaths []string, overflow bool, err error) {
+
+	journalPath := path.Join(cachePath, changeJournalFile)
+	consumedPath := path.Join(cachePath, consumedChangeJournalFile)
+
+	if _, err = os.Stat(journalPath); err == nil {
+
+		// The watch command may be still writing to the journal after it has been renamed, so the journal must be
+		// locked before it is read
+		incomingPath := journalPath + ".incoming"
+		err = os.Rename(journalPath, incomingPath)
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		var data []byte
+		data, err = readChangeJournal(incomingPath)
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		consumed, err := os.OpenFile(consumedPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		_, err = consumed.Write(data)
+		consumed.Close()
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		os.Remove(incomingPath)
+	} else if !os.IsNotExist(err) {
+		return nil, nil, false, err
+	}
+
+	data, err := ioutil.ReadFile(consumedPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, nil, false, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "session ") {
+			sessions = append(sessions, strings.TrimPrefix(line, "session "))
+		} else if strings.HasPrefix(line, "dirty ") {
+			dirtyPath, err := strconv.Unquote(strings.TrimPrefix(line, "dirty "))
+			if err != nil {
+				return nil, nil, false, fmt.Errorf("invalid journal line '%s'", line)
+			}
+			dirtyPaths = append(dirtyPaths, dirtyPath)
+		} else if line == "overflow" {
+			overflow = true
+		} else if line != "" {
+			return nil, nil, false, fmt.Errorf("invalid journal line '%s'", line)
+		}
+	}
+
+	return sessions, dirtyPaths, overflow, nil
+}
+
+// appendChangeJournal adds the dirty directories to the change journal under 'cachePath', starting a new journal
+// if the last one has been consumed by a backup.
+func appendChangeJournal(cachePath string, session string, dirtyPaths []string, overflow bool) error {
+
+	err := os.MkdirAll(cachePath, 0700)
+	if err != nil {
+		return err
+	}
+
+	journalPath := path.Join(cachePath, changeJournalFile)
+
+	for {
+		journal, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+
+		// If the journal has been renamed by a backup between the open and the lock, start over with a new one
+		renamed, err := lockChangeJournal(journal, journalPath)
+		if err != nil || renamed {
+			journal.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var lines strings.Builder
+		if stat, err := journal.Stat(); err == nil && stat.Size() == 0 {
+			lines.WriteString("session " + session + "\n")
+		}
+		for _, dirtyPath := range dirtyPaths {
+			lines.WriteString("dirty " + strconv.Quote(dirtyPath) + "\n")
+		}
+		if overflow {
+			lines.WriteString("overflow\n")
+		}
+
+		_, err = journal.WriteString(lines.String())
+		journal.Close()
+		return err
+	}
+}
+
+// SetFingerprint records the filters and listing options in use.  Nothing will be skipped if they are different
+// from those used by the last backup.
+func (index *InodeIndex) SetFingerprint(patterns []string, options *EntryListerOptions) {
+	hasher := sha256.New()
+	for _, pattern := range patterns {
+		hasher.Write([]byte(pattern + "\n"))
+	}
+	hasher.Write([]byte(fmt.Sprintf("%s:%t:%t:%t:%t:%t:%t", options.NoBackupFile, options.ExcludeByAttribute,
+		options.ExcludeXattrs, options.NormalizeXattr, options.IncludeFileFlags, options.IncludeSpecials,
+		options.OneFileSystem)))
+	index.Fingerprint = hex.EncodeToString(hasher.Sum(nil))
+
+	if index.previous != nil && index.previous.Fingerprint != index.Fingerprint {
+		LOG_INFO("INDEX_OPTIONS", "Filters or listing options have changed since the last backup; all directories will be listed")
+		index.previous = nil
+		index.dirtyDirectories = nil
+	}
+}
+
+// Visit is called when the directory 'dir' is found in its parent.  It returns true if the directory hasn't
+// changed since the last backup, in which case it doesn't need to be listed.
+func (index *InodeIndex) Visit(dir string, fileInfo os.FileInfo) (unchanged bool) {
+
+	inode, ctime := getInodeInfo(fileInfo)
+	record := &InodeRecord{
+		Inode: inode,
+		Size:  fileInfo.Size(),
+		MTime: fileInfo.ModTime().UnixNano(),
+		CTime: ctime,
+	}
+
+	if index.dirtyDirectories != nil && !index.dirtyDirectories[dir] && fileInfo.IsDir() {
+		if previous := index.previous.Directories[dir]; previous != nil && !previous.Pinned && inode != 0 &&
+			*previous == *record {
+			index.skippedLock.Lock()
+			index.skipped[dir] = true
+			index.skippedLock.Unlock()
+			index.Directories[dir] = record
+			return true
+		}
+	}
+
+	index.visited[dir] = record
+	return false
+}
+
+// Record is called when the directory 'dir' has been listed successfully.  If 'dir' is pinned, so are all its
+// ancestors, which have been listed before it; skipping any of them would skip 'dir' too.
+func (index *InodeIndex) Record(dir string, pinned bool) {
+	if record, found := index.visited[dir]; found {
+		delete(index.visited, dir)
+		record.Pinned = pinned
+		index.Directories[dir] = record
+	}
+
+	for parent := dir; pinned && parent != ""; {
+		parent = getParentDirectory(parent)
+		if record := index.Directories[parent]; record != nil {
+			record.Pinned = true
+		}
+	}
+}
+
+// Forget removes the directory containing 'file' and all its ancestors from the index, so they will be listed by
+// the next backup.  This is needed if 'file' couldn't be backed up.
+func (index *InodeIndex) Forget(file string) {
+	dir := file
+	if !strings.HasSuffix(dir, "/") {
+		dir = getParentDirectory(dir)
+	}
+	for {
+		delete(index.Directories, dir)
+		if dir == "" {
+			break
+		}
+		dir = getParentDirectory(dir)
+	}
+}
+
+// IsInSkippedDirectory returns true if 'file' is under a directory that was not listed.
+func (index *InodeIndex) IsInSkippedDirectory(file string) bool {
+	index.skippedLock.Lock()
+	defer index.skippedLock.Unlock()
+
+	if len(index.skipped) == 0 {
+		return false
+	}
+
+	dir := getParentDirectory(file)
+	for {
+		if index.skipped[dir] {
+			return true
+		}
+		if dir == "" {
+			return false
+		}
+		dir = getParentDirectory(dir)
+	}
+}
+
+// NumberOfSkippedDirectories returns how many directories were not listed.
+func (index *InodeIndex) NumberOfSkippedDirectories() int {
+	index.skippedLock.Lock()
+	defer index.skippedLock.Unlock()
+	return len(index.skipped)
+}
+
+// Save saves the index for the backup that just created 'revision' and deletes the consumed change journal.
+func (index *InodeIndex) Save(revision int) {
+
+	// Directories under skipped ones were not visited so their records must be carried over
+	if index.previous != nil {
+		for dir, record := range index.previous.Directories {
+			if _, found := index.Directories[dir]; !found && index.IsInSkippedDirectory(dir) {
+				index.Directories[dir] = record
+			}
+		}
+	}
+
+	index.Revision = revision
+
+	indexPath := path.Join(index.cachePath, inodeIndexFile)
+	temporaryPath := indexPath + ".tmp"
+
+	indexFile, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		LOG_WARN("INDEX_SAVE", "Failed to create the inode index: %v", err)
+		return
+	}
+
+	writer := bufio.NewWriter(indexFile)
+	err = msgpack.NewEncoder(writer).Encode(index)
+	if err == nil {
+		err = writer.Flush()
+	}
+	indexFile.Close()
+	if err != nil {
+		LOG_WARN("INDEX_SAVE", "Failed to save the inode index: %v", err)
+		os.Remove(temporaryPath)
+		return
+	}
+
+	err = os.Rename(temporaryPath, indexPath)
+	if err != nil {
+		LOG_WARN("INDEX_SAVE", "Failed to rename the inode index: %v", err)
+		return
+	}
+
+	err = os.Remove(path.Join(index.cachePath, consumedChangeJournalFile))
+	if err != nil && !os.IsNotExist(err) {
+		LOG_WARN("INDEX_JOURNAL", "Failed to remove the consumed change journal: %v", err)
+	}
+}
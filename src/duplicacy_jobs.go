@@ -0,0 +1,614 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// JobFile describes the repositories managed by the daemon and the jobs to run on them.  An example:
+//
+//	max_jobs = 2
+//	state_file = "/var/lib/dupluxy/jobs.state"
+//
+//	[[repository]]
+//	name = "home"
+//	path = "/home/alice"
+//	storage = "default"
+//
+//	  [[repository.job]]
+//	  command = "backup"
+//	  schedule = "every 1h"
+//	  options = ["-threads", "4"]
+//
+//	  [[repository.job]]
+//	  command = "prune"
+//	  schedule = "daily 03:30"
+//	  keep = ["0:360", "30:180", "7:30", "1:7"]
+//
+//	  [[repository.job]]
+//	  command = "copy"
+//	  to = "offsite"
+//	  schedule = "weekly sun 04:00"
+//
+// Storages are referred to by the names they have in the preferences of each repository.
+type JobFile struct {
+	MaxJobs      int              `toml:"max_jobs"`
+	StateFile    string           `toml:"state_file"`
+	Repositories []*JobRepository `toml:"repository"`
+}
+
+// JobRepository is a repository with the jobs to run on it.  'Storage' is the default storage of its jobs.
+type JobRepository struct {
+	Name    string `toml:"name"`
+	Path    string `toml:"path"`
+	Storage string `toml:"storage"`
+	Jobs    []*Job `toml:"job"`
+
+	preferences []Preference
+}
+
+// Job is a command to run on a repository on a schedule.  'Keep' lists the -keep options of a prune job and 'To' is
+// the destination storage of a copy job.  'Options' are passed to the command as is.
+type Job struct {
+	Name     string   `toml:"name"`
+	Command  string   `toml:"command"`
+	Storage  string   `toml:"storage"`
+	To       string   `toml:"to"`
+	Schedule string   `toml:"schedule"`
+	Keep     []string `toml:"keep"`
+	Options  []string `toml:"options"`
+
+	Repository *JobRepository `toml:"-"`
+
+	schedule *jobSchedule
+	locks    []jobStorageLock
+}
+
+// A job takes a shared lock on each storage it reads from or adds to, and an exclusive lock on the storage it prunes.
+// This way backups and copies to the same storage can run together but never at the same time as a prune.
+type jobStorageLock struct {
+	storageURL string
+	exclusive  bool
+}
+
+// LoadJobFile reads the job file at 'filePath' and validates every job in it, including the storages they refer to.
+func LoadJobFile(filePath string) (jobFile *JobFile, err error) {
+
+	jobFile = &JobFile{}
+	metadata, err := toml.DecodeFile(filePath, jobFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the job file %s: %v", filePath, err)
+	}
+
+	if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown key '%s' in the job file %s", undecoded[0], filePath)
+	}
+
+	if jobFile.MaxJobs <= 0 {
+		jobFile.MaxJobs = 1
+	}
+
+	if jobFile.StateFile == "" {
+		jobFile.StateFile = strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".state"
+	}
+
+	names := make(map[string]bool)
+	for _, repository := range jobFile.Repositories {
+		if repository.Path == "" {
+			return nil, fmt.Errorf("a repository in the job file %s has no path", filePath)
+		}
+		if repository.Name == "" {
+			repository.Name = filepath.Base(repository.Path)
+		}
+
+		repository.preferences, err = readRepositoryPreferences(repository.Path)
+		if err != nil {
+			return nil, fmt.Errorf("repository %s: %v", repository.Name, err)
+		}
+
+		for _, job := range repository.Jobs {
+			job.Repository = repository
+			err = job.validate()
+			if err != nil {
+				return nil, fmt.Errorf("repository %s: %v", repository.Name, err)
+			}
+			if names[job.Name] {
+				return nil, fmt.Errorf("there are multiple jobs named %s", job.Name)
+			}
+			names[job.Name] = true
+		}
+	}
+
+	return jobFile, nil
+}
+
+// GetJobs returns all jobs in the order they appear in the job file.
+func (jobFile *JobFile) GetJobs() (jobs []*Job) {
+	for _, repository := range jobFile.Repositories {
+		jobs = append(jobs, repository.Jobs...)
+	}
+	return jobs
+}
+
+// readRepositoryPreferences reads the preferences of the repository at 'repository' without changing the preferences
+// loaded by LoadPreferences.
+func readRepositoryPreferences(repository string) (preferences []Preference, err error) {
+
+	directory := path.Join(repository, DUPLICACY_DIRECTORY)
+	stat, err := os.Stat(directory)
+	if err != nil {
+		return nil, fmt.Errorf("the repository has not been initialized: %v", err)
+	}
+
+	// The .duplicacy file contains the path to the actual preference directory
+	if !stat.IsDir() {
+		content, err := os.ReadFile(directory)
+		if err != nil {
+			return nil, err
+		}
+		directory = strings.TrimSpace(string(content))
+	}
+
+	description, err := os.ReadFile(path.Join(directory, "preferences"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(description, &preferences)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the preference file: %v", err)
+	}
+	if len(preferences) == 0 {
+		return nil, fmt.Errorf("no storage is configured")
+	}
+	return preferences, nil
+}
+
+func (repository *JobRepository) findStorageURL(storageName string) string {
+	for _, preference := range repository.preferences {
+		if preference.Name == storageName {
+			return preference.StorageURL
+		}
+	}
+	return ""
+}
+
+// validate fills in the defaults of the job and checks the command, the storages and the schedule.
+func (job *Job) validate() (err error) {
+
+	repository := job.Repository
+	if job.Storage == "" {
+		job.Storage = repository.Storage
+	}
+	if job.Storage == "" {
+		job.Storage = repository.preferences[0].Name
+	}
+
+	storageURL := repository.findStorageURL(job.Storage)
+	if storageURL == "" {
+		return fmt.Errorf("no storage named '%s' is found", job.Storage)
+	}
+
+	switch job.Command {
+	case "backup", "check":
+		job.locks = []jobStorageLock{{storageURL: storageURL}}
+	case "prune":
+		if len(job.Keep) == 0 {
+			return fmt.Errorf("the prune job on %s has no retention policy", job.Storage)
+		}
+		job.locks = []jobStorageLock{{storageURL: storageURL, exclusive: true}}
+	case "copy":
+		if job.To == "" {
+			return fmt.Errorf("the copy job from %s has no destination storage", job.Storage)
+		}
+		toURL := repository.findStorageURL(job.To)
+		if toURL == "" {
+			return fmt.Errorf("no storage named '%s' is found", job.To)
+		}
+		job.locks = []jobStorageLock{{storageURL: storageURL}, {storageURL: toURL}}
+	default:
+		return fmt.Errorf("unsupported command '%s'; only backup, prune, check and copy can be scheduled", job.Command)
+	}
+
+	if job.Name == "" {
+		job.Name = repository.Name + "/" + job.Command + "/" + job.Storage
+		if job.Command == "copy" {
+			job.Name += "-" + job.To
+		}
+	}
+
+	job.schedule, err = parseJobSchedule(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("job %s: %v", job.Name, err)
+	}
+	return nil
+}
+
+// GetArguments returns the command line arguments that run the job.
+func (job *Job) GetArguments() []string {
+	arguments := []string{job.Command}
+	if job.Command == "copy" {
+		arguments = append(arguments, "-from", job.Storage, "-to", job.To)
+	} else {
+		arguments = append(arguments, "-storage", job.Storage)
+	}
+	for _, keep := range job.Keep {
+		arguments = append(arguments, "-keep", keep)
+	}
+	return append(arguments, job.Options...)
+}
+
+// jobSchedule is either an interval ("every 6h") or a time of day, optionally on a given weekday ("daily 02:30" or
+// "weekly sun 02:30").  Times are in the local time zone.
+type jobSchedule struct {
+	interval time.Duration
+	weekday  time.Weekday
+	weekly   bool
+	hour     int
+	minute   int
+}
+
+var jobWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseJobSchedule(text string) (schedule *jobSchedule, err error) {
+
+	fields := strings.Fields(strings.ToLower(text))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no schedule is specified")
+	}
+
+	schedule = &jobSchedule{}
+	clock := ""
+	switch {
+	case fields[0] == "every" && len(fields) == 2:
+		schedule.interval, err = time.ParseDuration(fields[1])
+		if err != nil || schedule.interval < time.Minute {
+			return nil, fmt.Errorf("invalid interval '%s' in the schedule '%s'", fields[1], text)
+		}
+		return schedule, nil
+	case fields[0] == "daily" && len(fields) == 2:
+		clock = fields[1]
+	case fields[0] == "weekly" && len(fields) == 3:
+		weekday, found := jobWeekdays[fields[1]]
+		if !found {
+			return nil, fmt.Errorf("invalid weekday '%s' in the schedule '%s'", fields[1], text)
+		}
+		schedule.weekly = true
+		schedule.weekday = weekday
+		clock = fields[2]
+	default:
+		return nil, fmt.Errorf("invalid schedule '%s'", text)
+	}
+
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time '%s' in the schedule '%s'", clock, text)
+	}
+	schedule.hour = t.Hour()
+	schedule.minute = t.Minute()
+	return schedule, nil
+}
+
+// next returns when the job should run after it last started at 'last'.  A job that has never run is due immediately
+// if it runs at an interval, or at the next scheduled time otherwise.
+func (schedule *jobSchedule) next(last time.Time, now time.Time) time.Time {
+
+	if schedule.interval > 0 {
+		if last.IsZero() {
+			return now
+		}
+		return last.Add(schedule.interval)
+	}
+
+	if last.IsZero() {
+		last = now
+	}
+
+	candidate := time.Date(last.Year(), last.Month(), last.Day(), schedule.hour, schedule.minute, 0, 0, last.Location())
+	for !candidate.After(last) || (schedule.weekly && candidate.Weekday() != schedule.weekday) {
+		candidate = candidate.AddDate(0, 0, 1)
+	}
+	return candidate
+}
+
+// jobState is what is saved in the state file for each job, so that schedules continue where they left off after the
+// daemon restarts.
+type jobState struct {
+	LastStart  int64  `json:"last_start"`
+	LastEnd    int64  `json:"last_end"`
+	LastResult string `json:"last_result"`
+}
+
+// JobRunner runs a job and returns an error if it fails.
+type JobRunner func(job *Job) error
+
+// JobScheduler runs the jobs in a job file when they are due, running at most MaxJobs jobs at a time and never
+// running a prune at the same time as another job on the same storage.
+type JobScheduler struct {
+	jobFile *JobFile
+	runner  JobRunner
+
+	states      map[string]*jobState
+	running     map[string]bool
+	storageUses map[string]int  // the number of jobs holding a shared lock on each storage
+	pruning     map[string]bool // storages locked exclusively by a running prune job
+	lock        sync.Mutex
+	waitGroup   sync.WaitGroup
+	done        chan bool
+	stop        chan bool
+}
+
+// CreateJobScheduler creates a scheduler for the jobs in 'jobFile' and restores their states from the state file.
+func CreateJobScheduler(jobFile *JobFile, runner JobRunner) (scheduler *JobScheduler, err error) {
+
+	scheduler = &JobScheduler{
+		jobFile:     jobFile,
+		runner:      runner,
+		states:      make(map[string]*jobState),
+		running:     make(map[string]bool),
+		storageUses: make(map[string]int),
+		pruning:     make(map[string]bool),
+		done:        make(chan bool, 16),
+		stop:        make(chan bool, 1),
+	}
+
+	description, err := os.ReadFile(jobFile.StateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read the state file %s: %v", jobFile.StateFile, err)
+	} else if err == nil {
+		err = json.Unmarshal(description, &scheduler.states)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the state file %s: %v", jobFile.StateFile, err)
+		}
+	}
+
+	for _, job := range jobFile.GetJobs() {
+		if _, found := scheduler.states[job.Name]; !found {
+			scheduler.states[job.Name] = &jobState{}
+		}
+	}
+	return scheduler, nil
+}
+
+// GetNextRun returns when 'job' will be due.  A job that was interrupted by a restart of the daemon is due immediately.
+func (scheduler *JobScheduler) GetNextRun(job *Job, now time.Time) time.Time {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	return scheduler.getNextRun(job, now)
+}
+
+func (scheduler *JobScheduler) getNextRun(job *Job, now time.Time) time.Time {
+	state := scheduler.states[job.Name]
+	if state.LastStart > state.LastEnd {
+		return now
+	}
+	var last time.Time
+	if state.LastStart > 0 {
+		last = time.Unix(state.LastStart, 0)
+	}
+	return job.schedule.next(last, now)
+}
+
+// Run starts the jobs that are due every few seconds until Stop is called, and then waits for the running jobs to
+// complete.
+func (scheduler *JobScheduler) Run() {
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for _, job := range scheduler.jobFile.GetJobs() {
+		LOG_INFO("JOB_SCHEDULE", "Job %s will run at %s", job.Name,
+			scheduler.GetNextRun(job, time.Now()).Format("2006-01-02 15:04"))
+	}
+
+	for {
+		scheduler.startDueJobs(time.Now())
+		select {
+		case <-scheduler.stop:
+			LOG_INFO("JOB_STOP", "Waiting for running jobs to complete")
+			scheduler.waitGroup.Wait()
+			return
+		case <-scheduler.done:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop makes Run return once the running jobs have completed.  No new jobs are started after Stop is called.
+func (scheduler *JobScheduler) Stop() {
+	select {
+	case scheduler.stop <- true:
+	default:
+	}
+}
+
+// startDueJobs starts the jobs that are due at 'now', those that have been due the longest first, as long as the
+// limit on concurrent jobs and the storage locks allow.
+func (scheduler *JobScheduler) startDueJobs(now time.Time) {
+
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	var dueJobs []*Job
+	dueTimes := make(map[string]time.Time)
+	for _, job := range scheduler.jobFile.GetJobs() {
+		if scheduler.running[job.Name] {
+			continue
+		}
+		dueTime := scheduler.getNextRun(job, now)
+		if !dueTime.After(now) {
+			dueJobs = append(dueJobs, job)
+			dueTimes[job.Name] = dueTime
+		}
+	}
+	sort.SliceStable(dueJobs, func(i, j int) bool { return dueTimes[dueJobs[i].Name].Before(dueTimes[dueJobs[j].Name]) })
+
+	// Storages wanted by a prune job that couldn't start; jobs after it must not take these storages
+	waited := make(map[string]bool)
+
+	for _, job := range dueJobs {
+		if len(scheduler.running) >= scheduler.jobFile.MaxJobs {
+			break
+		}
+		if !scheduler.acquireLocks(job, waited) {
+			LOG_DEBUG("JOB_WAIT", "Job %s is waiting for another job on the same storage", job.Name)
+			continue
+		}
+
+		scheduler.running[job.Name] = true
+		state := scheduler.states[job.Name]
+		state.LastStart = now.Unix()
+		scheduler.saveStates()
+
+		scheduler.waitGroup.Add(1)
+		go scheduler.runJob(job)
+	}
+}
+
+// acquireLocks takes the storage locks of 'job' if none of them conflict with running jobs.  Otherwise it records the
+// storages a prune job is waiting for in 'waited', so that it isn't starved by other jobs starting first.
+func (scheduler *JobScheduler) acquireLocks(job *Job, waited map[string]bool) bool {
+
+	available := true
+	for _, lock := range job.locks {
+		if scheduler.pruning[lock.storageURL] || waited[lock.storageURL] {
+			available = false
+		} else if lock.exclusive && scheduler.storageUses[lock.storageURL] > 0 {
+			available = false
+		}
+	}
+
+	if !available {
+		for _, lock := range job.locks {
+			if lock.exclusive {
+				waited[lock.storageURL] = true
+			}
+		}
+		return false
+	}
+
+	for _, lock := range job.locks {
+		if lock.exclusive {
+			scheduler.pruning[lock.storageURL] = true
+		} else {
+			scheduler.storageUses[lock.storageURL]++
+		}
+	}
+	return true
+}
+
+func (scheduler *JobScheduler) releaseLocks(job *Job) {
+	for _, lock := range job.locks {
+		if lock.exclusive {
+			delete(scheduler.pruning, lock.storageURL)
+		} else {
+			scheduler.storageUses[lock.storageURL]--
+		}
+	}
+}
+
+func (scheduler *JobScheduler) runJob(job *Job) {
+
+	defer scheduler.waitGroup.Done()
+
+	LOG_INFO("JOB_START", "Starting job %s", job.Name)
+	startTime := time.Now()
+	err := scheduler.runner(job)
+
+	result := "success"
+	if err != nil {
+		result = err.Error()
+		LOG_WARN("JOB_FAIL", "Job %s failed after %s: %v", job.Name, time.Since(startTime).Round(time.Second), err)
+	} else {
+		LOG_INFO("JOB_END", "Job %s completed in %s", job.Name, time.Since(startTime).Round(time.Second))
+	}
+
+	scheduler.lock.Lock()
+	state := scheduler.states[job.Name]
+	state.LastEnd = time.Now().Unix()
+	if state.LastEnd < state.LastStart {
+		state.LastEnd = state.LastStart
+	}
+	state.LastResult = result
+	scheduler.releaseLocks(job)
+	delete(scheduler.running, job.Name)
+	scheduler.saveStates()
+	scheduler.lock.Unlock()
+
+	select {
+	case scheduler.done <- true:
+	default:
+	}
+}
+
+// saveStates writes the job states to the state file.  Must be called with the lock held.
+func (scheduler *JobScheduler) saveStates() {
+
+	description, err := json.MarshalIndent(scheduler.states, "", "    ")
+	if err != nil {
+		LOG_WARN("JOB_STATE", "Failed to encode the job states: %v", err)
+		return
+	}
+
+	temporaryPath := scheduler.jobFile.StateFile + ".tmp"
+	err = os.WriteFile(temporaryPath, description, 0600)
+	if err == nil {
+		err = os.Rename(temporaryPath, scheduler.jobFile.StateFile)
+	}
+	if err != nil {
+		LOG_WARN("JOB_STATE", "Failed to save the job states to %s: %v", scheduler.jobFile.StateFile, err)
+	}
+}
+
+// CreateJobProcessRunner returns a JobRunner that runs each job as a child process of 'executable' in the repository
+// directory, with 'globalOptions' before the command.  The output of the child process is logged line by line.
+func CreateJobProcessRunner(executable string, globalOptions []string) JobRunner {
+	return func(job *Job) error {
+
+		arguments := append(append([]string{}, globalOptions...), job.GetArguments()...)
+		LOG_DEBUG("JOB_COMMAND", "Running %s %s in %s", executable, strings.Join(arguments, " "), job.Repository.Path)
+
+		reader, writer := io.Pipe()
+		cmd := exec.Command(executable, arguments...)
+		cmd.Dir = job.Repository.Path
+		cmd.Stdout = writer
+		cmd.Stderr = writer
+
+		scanned := make(chan bool)
+		go func() {
+			scanner := bufio.NewScanner(reader)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); line != "" {
+					logJobOutput(job.Name, line)
+				}
+			}
+			io.Copy(io.Discard, reader)
+			scanned <- true
+		}()
+
+		err := cmd.Run()
+		writer.Close()
+		<-scanned
+		return err
+	}
+}
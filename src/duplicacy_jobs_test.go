@@ -0,0 +1,219 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJobSchedule(t *testing.T) {
+
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.Local) // a Wednesday
+
+	testCases := []struct {
+		schedule string
+		last     time.Time
+		next     time.Time
+	}{
+		{"every 6h", time.Time{}, now},
+		{"every 6h", now.Add(-time.Hour), now.Add(5 * time.Hour)},
+		{"daily 02:30", time.Time{}, time.Date(2024, 5, 16, 2, 30, 0, 0, time.Local)},
+		{"daily 14:00", time.Time{}, time.Date(2024, 5, 15, 14, 0, 0, 0, time.Local)},
+		{"daily 02:30", time.Date(2024, 5, 13, 2, 30, 0, 0, time.Local), time.Date(2024, 5, 14, 2, 30, 0, 0, time.Local)},
+		{"weekly sun 04:00", time.Time{}, time.Date(2024, 5, 19, 4, 0, 0, 0, time.Local)},
+		{"Weekly Wed 12:00", now, time.Date(2024, 5, 22, 12, 0, 0, 0, time.Local)},
+	}
+
+	for _, testCase := range testCases {
+		schedule, err := parseJobSchedule(testCase.schedule)
+		if err != nil {
+			t.Errorf("Failed to parse the schedule '%s': %v", testCase.schedule, err)
+			continue
+		}
+		if next := schedule.next(testCase.last, now); !next.Equal(testCase.next) {
+			t.Errorf("The next run of '%s' after %s is %s instead of %s", testCase.schedule, testCase.last, next,
+				testCase.next)
+		}
+	}
+
+	for _, invalid := range []string{"", "every", "every 10s", "daily 25:00", "weekly 02:00", "weekly xyz 02:00", "hourly"} {
+		if _, err := parseJobSchedule(invalid); err == nil {
+			t.Errorf("The invalid schedule '%s' was accepted", invalid)
+		}
+	}
+}
+
+func TestJobScheduler(t *testing.T) {
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "jobs")
+	os.RemoveAll(testDir)
+	os.MkdirAll(path.Join(testDir, "repository1", DUPLICACY_DIRECTORY), 0700)
+	os.MkdirAll(path.Join(testDir, "repository2", DUPLICACY_DIRECTORY), 0700)
+	defer os.RemoveAll(testDir)
+
+	os.WriteFile(path.Join(testDir, "repository1", DUPLICACY_DIRECTORY, "preferences"),
+		[]byte(`[{"name": "default", "storage": "/storage/nas"}, {"name": "offsite", "storage": "s3://offsite"}]`), 0600)
+	os.WriteFile(path.Join(testDir, "repository2", DUPLICACY_DIRECTORY, "preferences"),
+		[]byte(`[{"name": "nas", "storage": "/storage/nas"}]`), 0600)
+
+	jobFilePath := path.Join(testDir, "jobs.toml")
+	os.WriteFile(jobFilePath, []byte(strings.Replace(`
+max_jobs = 3
+
+[[repository]]
+path = "TESTDIR/repository1"
+
+  [[repository.job]]
+  command = "backup"
+  schedule = "every 1h"
+
+  [[repository.job]]
+  command = "prune"
+  schedule = "every 24h"
+  keep = ["0:360", "7:30"]
+
+  [[repository.job]]
+  command = "copy"
+  to = "offsite"
+  schedule = "daily 04:00"
+
+[[repository]]
+name = "other"
+path = "TESTDIR/repository2"
+
+  [[repository.job]]
+  command = "backup"
+  schedule = "every 2h"
+  options = ["-threads", "4"]
+`, "TESTDIR", testDir, -1)), 0600)
+
+	jobFile, err := LoadJobFile(jobFilePath)
+	if err != nil {
+		t.Fatalf("Failed to load the job file: %v", err)
+	}
+
+	jobs := jobFile.GetJobs()
+	names := []string{"repository1/backup/default", "repository1/prune/default", "repository1/copy/default-offsite",
+		"other/backup/nas"}
+	if len(jobs) != len(names) {
+		t.Fatalf("The job file has %d jobs", len(jobs))
+	}
+	for i, job := range jobs {
+		if job.Name != names[i] {
+			t.Errorf("Job %d is named %s instead of %s", i, job.Name, names[i])
+		}
+	}
+	if arguments := strings.Join(jobs[1].GetArguments(), " "); arguments != "prune -storage default -keep 0:360 -keep 7:30" {
+		t.Errorf("The prune job has the arguments '%s'", arguments)
+	}
+	if arguments := strings.Join(jobs[3].GetArguments(), " "); arguments != "backup -storage nas -threads 4" {
+		t.Errorf("The backup job has the arguments '%s'", arguments)
+	}
+
+	// Jobs are blocked until the test releases them
+	var lock sync.Mutex
+	started := make(map[string]bool)
+	release := make(chan bool)
+	scheduler, err := CreateJobScheduler(jobFile, func(job *Job) error {
+		lock.Lock()
+		started[job.Name] = true
+		lock.Unlock()
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the scheduler: %v", err)
+	}
+
+	isStarted := func(name string) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return started[name]
+	}
+	getRunning := func() int {
+		scheduler.lock.Lock()
+		defer scheduler.lock.Unlock()
+		return len(scheduler.running)
+	}
+	waitForJobs := func(count int) {
+		for i := 0; i < 100 && getRunning() != count; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if getRunning() != count {
+			t.Fatalf("The number of running jobs is not %d", count)
+		}
+	}
+
+	// The prune has to wait for the first backup, and the second backup due at the same time can't start before it
+	now := time.Now()
+	scheduler.startDueJobs(now)
+	waitForJobs(1)
+	time.Sleep(10 * time.Millisecond)
+	if !isStarted("repository1/backup/default") || isStarted("repository1/prune/default") || isStarted("other/backup/nas") {
+		t.Errorf("The started jobs are %v", started)
+	}
+
+	release <- true
+	waitForJobs(0)
+
+	scheduler.startDueJobs(now)
+	waitForJobs(1)
+	time.Sleep(10 * time.Millisecond)
+	scheduler.startDueJobs(now)
+	if !isStarted("repository1/prune/default") || getRunning() != 1 {
+		t.Errorf("The prune job isn't running alone: %v", started)
+	}
+	release <- true
+	waitForJobs(0)
+
+	// Backups to the same storage run together
+	scheduler.startDueJobs(now.Add(time.Hour))
+	waitForJobs(2)
+	time.Sleep(10 * time.Millisecond)
+	if !isStarted("other/backup/nas") {
+		t.Errorf("The second backup job didn't start")
+	}
+	release <- true
+	release <- true
+	waitForJobs(0)
+
+	// The states survive a restart
+	scheduler, err = CreateJobScheduler(jobFile, nil)
+	if err != nil {
+		t.Fatalf("Failed to recreate the scheduler: %v", err)
+	}
+	if next := scheduler.GetNextRun(jobs[1], now); next.Before(now.Add(23 * time.Hour)) {
+		t.Errorf("The prune job will run again at %s", next)
+	}
+	if state := scheduler.states[jobs[0].Name]; state.LastResult != "success" || state.LastStart == 0 {
+		t.Errorf("The state of the backup job is %+v", state)
+	}
+
+	// A job interrupted by a restart is due immediately
+	scheduler.states[jobs[0].Name].LastStart = scheduler.states[jobs[0].Name].LastEnd + 1
+	if next := scheduler.GetNextRun(jobs[0], now); !next.Equal(now) {
+		t.Errorf("The interrupted backup job will run at %s", next)
+	}
+
+	// Invalid job files are rejected
+	os.WriteFile(jobFilePath, []byte(strings.Replace(`
+[[repository]]
+path = "TESTDIR/repository1"
+
+  [[repository.job]]
+  command = "backup"
+  storage = "missing"
+  schedule = "every 1h"
+`, "TESTDIR", testDir, -1)), 0600)
+	if _, err = LoadJobFile(jobFilePath); err == nil {
+		t.Errorf("A job on a missing storage was accepted")
+	}
+}
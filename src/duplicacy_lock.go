@@ -0,0 +1,448 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a remote lease is honored by other clients if the process holding it dies without removing it.  A lease
+// held by a process on the same host is recognized as stale as soon as the process is gone.  The lease is renewed
+// every quarter of this duration while it is held.
+var RemoteLockLeaseDuration = 24 * time.Hour
+
+const remoteLockDirectory = "locks/"
+
+// LockInfo is the content of a lock file, identifying the process holding the lock.
+type LockInfo struct {
+	Host       string `json:"host"`
+	PID        int    `json:"pid"`
+	Command    string `json:"command"`
+	Exclusive  bool   `json:"exclusive,omitempty"`
+	StartTime  int64  `json:"start_time"`
+	ExpiryTime int64  `json:"expiry_time,omitempty"`
+}
+
+func newLockInfo(command string, exclusive bool) *LockInfo {
+	return &LockInfo{
+		Host:      hostname,
+		PID:       os.Getpid(),
+		Command:   command,
+		Exclusive: exclusive,
+		StartTime: time.Now().Unix(),
+	}
+}
+
+// String returns a description of the process holding the lock.
+func (info *LockInfo) String() string {
+	return fmt.Sprintf("%s (pid %d on %s) since %s", info.Command, info.PID, info.Host,
+		time.Unix(info.StartTime, 0).Format("2006-01-02 15:04:05"))
+}
+
+// IsStale returns true if the process holding the lock is known to be gone: it ran on this host and no process with
+// its pid exists any more, or the lease has expired.
+func (info *LockInfo) IsStale() bool {
+	if info.ExpiryTime > 0 && info.ExpiryTime < time.Now().Unix() {
+		return true
+	}
+	return info.Host == hostname && info.PID != os.Getpid() && !isProcessRunning(info.PID)
+}
+
+// LockError is returned when a lock can't be acquired because another process holds it.
+type LockError struct {
+	Holder *LockInfo
+}
+
+func (err *LockError) Error() string {
+	return fmt.Sprintf("locked by %s", err.Holder)
+}
+
+// Locks held by this process, which are released by ReleaseLocks if the process exits on an error.
+var heldLocks []interface{ Release() }
+var heldLocksLock sync.Mutex
+
+func addHeldLock(lock interface{ Release() }) {
+	heldLocksLock.Lock()
+	defer heldLocksLock.Unlock()
+	heldLocks = append(heldLocks, lock)
+}
+
+func removeHeldLock(lock interface{ Release() }) {
+	heldLocksLock.Lock()
+	defer heldLocksLock.Unlock()
+	for i, heldLock := range heldLocks {
+		if heldLock == lock {
+			heldLocks = append(heldLocks[:i], heldLocks[i+1:]...)
+			return
+		}
+	}
+}
+
+// ReleaseLocks releases all local locks and remote leases still held.  It is called before the process exits.
+func ReleaseLocks() {
+	heldLocksLock.Lock()
+	locks := append([]interface{ Release() }{}, heldLocks...)
+	heldLocksLock.Unlock()
+
+	for i := len(locks) - 1; i >= 0; i-- {
+		locks[i].Release()
+	}
+}
+
+// LocalLock is an advisory lock on a storage of the repository, held by a file under the 'locks' directory in the
+// preference directory that records the host and the pid of its owner.
+type LocalLock struct {
+	path string
+	once sync.Once
+}
+
+// AcquireLocalLock locks the storage 'storageName' of the repository for 'command'.  Only one process at a time can
+// hold the lock; a lock left behind by a process that no longer exists is removed.
+func AcquireLocalLock(storageName string, command string) (*LocalLock, error) {
+
+	lockDirectory := path.Join(GetDuplicacyPreferencePath(), "locks")
+	err := os.MkdirAll(lockDirectory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	lockPath := path.Join(lockDirectory, storageName)
+	description, err := json.Marshal(newLockInfo(command, false))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = file.Write(description)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, err
+			}
+			lock := &LocalLock{path: lockPath}
+			addHeldLock(lock)
+			LOG_DEBUG("LOCK_ACQUIRE", "Acquired the lock %s", lockPath)
+			return lock, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		holder, holderDescription, err := readLocalLock(lockPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !holder.IsStale() {
+			return nil, &LockError{Holder: holder}
+		}
+
+		LOG_WARN("LOCK_STALE", "Removing the stale lock held by %s", holder)
+		err = removeStaleLocalLock(lockPath, holderDescription)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// The number of stale locks this process has tried to remove, used to give each one a unique name.
+var numberOfStaleLocks int64
+
+// removeStaleLocalLock removes the lock file at 'lockPath' that was found to be stale with the content 'description'.
+// Another process may have removed the same stale lock and created its own since then, so the file is renamed to a
+// name of its own before it is checked: a file that turns out to be different is linked back, which fails rather than
+// replacing a lock created in the meantime.  On file systems without hard links it is written back to a file created
+// exclusively instead.
+func removeStaleLocalLock(lockPath string, description []byte) error {
+
+	stalePath := fmt.Sprintf("%s.%d.%d.stale", lockPath, os.Getpid(), atomic.AddInt64(&numberOfStaleLocks, 1))
+	err := os.Rename(lockPath, stalePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer os.Remove(stalePath)
+
+	renamed, err := os.ReadFile(stalePath)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(renamed, description) {
+		return nil
+	}
+
+	err = os.Link(stalePath, lockPath)
+	if err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = file.Write(renamed)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+	return nil
+}
+
+// readLocalLock reads the lock file at 'lockPath' and returns its holder along with its content.  A lock file that
+// can't be parsed, most likely because its owner died while writing it, is considered stale after a minute.
+func readLocalLock(lockPath string) (*LockInfo, []byte, error) {
+	description, err := os.ReadFile(lockPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	holder := &LockInfo{}
+	err = json.Unmarshal(description, holder)
+	if err != nil {
+		stat, statErr := os.Stat(lockPath)
+		if statErr != nil {
+			return nil, nil, statErr
+		}
+		holder = &LockInfo{Command: "unknown", StartTime: stat.ModTime().Unix(),
+			ExpiryTime: stat.ModTime().Add(time.Minute).Unix()}
+	}
+	return holder, description, nil
+}
+
+// Release removes the lock file.  It can be called more than once.
+func (lock *LocalLock) Release() {
+	lock.once.Do(func() {
+		removeHeldLock(lock)
+		err := os.Remove(lock.path)
+		if err != nil && !os.IsNotExist(err) {
+			LOG_WARN("LOCK_RELEASE", "Failed to remove the lock %s: %v", lock.path, err)
+			return
+		}
+		LOG_DEBUG("LOCK_RELEASE", "Released the lock %s", lock.path)
+	})
+}
+
+// RemoteLock is a lease file under 'locks/' in the storage.  Clients holding shared leases, such as backups, can work
+// at the same time, but an exclusive lease, taken by 'prune -exclusive', can't be held together with any other lease.
+// This is best-effort only: it relies on all clients using remote locks, and on listing files reflecting recent
+// uploads.
+type RemoteLock struct {
+	manager     *SnapshotManager
+	threadIndex int // The storage thread reserved for the lease
+	filePath    string
+	info        *LockInfo
+	once        sync.Once
+
+	stopRenewal chan bool // Closed to stop renewing the lease
+	renewalDone chan bool // Closed when the lease is no longer being renewed
+}
+
+func getRemoteLockPath(info *LockInfo) string {
+	return fmt.Sprintf("%s%s_%d", remoteLockDirectory, strings.Replace(info.Host, "/", "_", -1), info.PID)
+}
+
+// AcquireRemoteLock uploads a lease for 'command' to the storage after making sure that no conflicting lease is held
+// by another client.  The storage is checked again after the upload so that of two clients starting at the same time,
+// at least one gives up.  Leases can't be taken in the append-only mode, in which they could never be removed.
+// 'threadIndex' must be a storage thread not used by the operation itself, since the lease is renewed in the
+// background while the operation is running.
+func (manager *SnapshotManager) AcquireRemoteLock(command string, exclusive bool,
+	threadIndex int) (*RemoteLock, error) {
+
+	if manager.storage.IsAppendOnly() {
+		return nil, fmt.Errorf("leases can't be taken on a storage in the append-only mode")
+	}
+
+	info := newLockInfo(command, exclusive)
+	info.ExpiryTime = time.Now().Add(RemoteLockLeaseDuration).Unix()
+	lock := &RemoteLock{manager: manager, threadIndex: threadIndex, filePath: getRemoteLockPath(info), info: info}
+
+	holder, err := manager.findConflictingLease(threadIndex, lock.filePath, exclusive)
+	if err != nil {
+		return nil, err
+	} else if holder != nil {
+		return nil, &LockError{Holder: holder}
+	}
+
+	err = manager.uploadLease(threadIndex, lock.filePath, info)
+	if err != nil {
+		return nil, err
+	}
+
+	holder, err = manager.findConflictingLease(threadIndex, lock.filePath, exclusive)
+	if err != nil || holder != nil {
+		lock.Release()
+		if err != nil {
+			return nil, err
+		}
+		return nil, &LockError{Holder: holder}
+	}
+
+	lock.stopRenewal = make(chan bool)
+	lock.renewalDone = make(chan bool)
+	go lock.renew()
+
+	addHeldLock(lock)
+	LOG_DEBUG("LOCK_ACQUIRE", "Acquired the lease %s", lock.filePath)
+	return lock, nil
+}
+
+// renew uploads the lease again with a new expiry time every quarter of the lease duration, so that other clients
+// don't take it as expired while a long backup or prune is still running.
+func (lock *RemoteLock) renew() {
+	defer close(lock.renewalDone)
+
+	ticker := time.NewTicker(RemoteLockLeaseDuration / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.stopRenewal:
+			return
+		case <-ticker.C:
+			info := *lock.info
+			info.ExpiryTime = time.Now().Add(RemoteLockLeaseDuration).Unix()
+			err := lock.manager.uploadLease(lock.threadIndex, lock.filePath, &info)
+			if err != nil {
+				LOG_WARN("LOCK_RENEW", "Failed to renew the lease %s: %v", lock.filePath, err)
+				continue
+			}
+			LOG_DEBUG("LOCK_RENEW", "Renewed the lease %s", lock.filePath)
+		}
+	}
+}
+
+// findConflictingLease returns the holder of a live lease other than 'ownPath' that conflicts with a lease of the
+// given kind.  Stale leases found on the way are removed.
+func (manager *SnapshotManager) findConflictingLease(threadIndex int, ownPath string,
+	exclusive bool) (*LockInfo, error) {
+
+	files, _, err := manager.storage.ListFiles(threadIndex, remoteLockDirectory)
+	if err != nil {
+		exist, _, _, statErr := manager.storage.GetFileInfo(threadIndex, remoteLockDirectory)
+		if statErr == nil && !exist {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list the lease files: %v", err)
+	}
+
+	for _, file := range files {
+		if len(file) == 0 || file[len(file)-1] == '/' || remoteLockDirectory+file == ownPath {
+			continue
+		}
+
+		leasePath := remoteLockDirectory + file
+		holder, err := manager.downloadLease(threadIndex, leasePath)
+		if err != nil {
+			// The lease may have been released since the files were listed
+			if exist, _, _, statErr := manager.storage.GetFileInfo(threadIndex, leasePath); statErr == nil && !exist {
+				continue
+			}
+			return nil, err
+		}
+
+		if holder.IsStale() {
+			LOG_WARN("LOCK_STALE", "Removing the stale lease held by %s", holder)
+			err = manager.storage.DeleteFile(threadIndex, leasePath)
+			if err != nil {
+				LOG_WARN("LOCK_STALE", "Failed to remove the lease file %s: %v", leasePath, err)
+			}
+			continue
+		}
+
+		if exclusive || holder.Exclusive {
+			return holder, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (manager *SnapshotManager) uploadLease(threadIndex int, leasePath string, info *LockInfo) error {
+
+	description, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	err = manager.storage.CreateDirectory(threadIndex, remoteLockDirectory)
+	if err != nil {
+		return fmt.Errorf("failed to create the lock directory: %v", err)
+	}
+
+	// Leases are renewed in the background, so the file chunk of the manager can't be used
+	chunk := manager.config.GetChunk()
+	defer manager.config.PutChunk(chunk)
+
+	chunk.Reset(false)
+	chunk.Write(description)
+	err = chunk.Encrypt(manager.config.FileKey, getHoldDerivationKey(leasePath), true)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt the lease file %s: %v", leasePath, err)
+	}
+
+	err = manager.storage.UploadFile(threadIndex, leasePath, chunk.GetBytes())
+	if err != nil {
+		return fmt.Errorf("failed to upload the lease file %s: %v", leasePath, err)
+	}
+	return nil
+}
+
+func (manager *SnapshotManager) downloadLease(threadIndex int, leasePath string) (*LockInfo, error) {
+
+	manager.fileChunk.Reset(false)
+	err := manager.storage.DownloadFile(threadIndex, leasePath, manager.fileChunk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the lease file %s: %v", leasePath, err)
+	}
+
+	err, _ = manager.fileChunk.Decrypt(manager.config.FileKey, getHoldDerivationKey(leasePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the lease file %s: %v", leasePath, err)
+	}
+
+	holder := &LockInfo{}
+	err = json.Unmarshal(manager.fileChunk.GetBytes(), holder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the lease file %s: %v", leasePath, err)
+	}
+	return holder, nil
+}
+
+// Release stops renewing the lease and removes the lease file from the storage.  It can be called more than once.
+func (lock *RemoteLock) Release() {
+	lock.once.Do(func() {
+		removeHeldLock(lock)
+		if lock.stopRenewal != nil {
+			close(lock.stopRenewal)
+			<-lock.renewalDone
+		}
+		err := lock.manager.storage.DeleteFile(lock.threadIndex, lock.filePath)
+		if err != nil {
+			LOG_WARN("LOCK_RELEASE", "Failed to remove the lease file %s: %v", lock.filePath, err)
+			return
+		}
+		LOG_DEBUG("LOCK_RELEASE", "Released the lease %s", lock.filePath)
+	})
+}
@@ -0,0 +1,239 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// getExitedPID returns the pid of a process that has already exited.
+func getExitedPID(t *testing.T) int {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	err := cmd.Run()
+	if err != nil {
+		t.Fatalf("Failed to run %s: %v", os.Args[0], err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestLocalLock(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "lock_test")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir+"/.duplicacy", 0700)
+	defer os.RemoveAll(testDir)
+	SetDuplicacyPreferencePath(testDir + "/.duplicacy")
+
+	lock, err := AcquireLocalLock("default", "backup")
+	if err != nil {
+		t.Fatalf("Failed to acquire the lock: %v", err)
+	}
+
+	var lockError *LockError
+	_, err = AcquireLocalLock("default", "backup")
+	if !errors.As(err, &lockError) || lockError.Holder.PID != os.Getpid() || lockError.Holder.Command != "backup" {
+		t.Errorf("The lock held by this process was acquired again: %v", err)
+	}
+
+	otherLock, err := AcquireLocalLock("offsite", "backup")
+	if err != nil {
+		t.Errorf("The lock on another storage can't be acquired: %v", err)
+	} else {
+		otherLock.Release()
+	}
+
+	lock.Release()
+	lock.Release()
+	lock, err = AcquireLocalLock("default", "prune")
+	if err != nil {
+		t.Fatalf("Failed to acquire the released lock: %v", err)
+	}
+	lock.Release()
+
+	// A lock left by a process that has exited is removed
+	description, _ := json.Marshal(&LockInfo{Host: hostname, PID: getExitedPID(t), Command: "backup",
+		StartTime: time.Now().Unix()})
+	os.WriteFile(testDir+"/.duplicacy/locks/default", description, 0600)
+	lock, err = AcquireLocalLock("default", "backup")
+	if err != nil {
+		t.Fatalf("The stale lock was not removed: %v", err)
+	}
+
+	// ReleaseLocks releases the locks still held
+	ReleaseLocks()
+	if _, err := os.Stat(testDir + "/.duplicacy/locks/default"); !os.IsNotExist(err) {
+		t.Errorf("The lock was not released by ReleaseLocks")
+	}
+}
+
+func TestConcurrentStaleLock(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "lock_test")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir+"/.duplicacy/locks", 0700)
+	defer os.RemoveAll(testDir)
+	SetDuplicacyPreferencePath(testDir + "/.duplicacy")
+
+	// Of two processes finding the same stale lock, only one can take it over
+	exitedPID := getExitedPID(t)
+	for i := 0; i < 50; i++ {
+		description, _ := json.Marshal(&LockInfo{Host: hostname, PID: exitedPID, Command: "backup",
+			StartTime: time.Now().Unix()})
+		os.WriteFile(testDir+"/.duplicacy/locks/default", description, 0600)
+
+		start := make(chan bool)
+		locks := make(chan *LocalLock, 8)
+		var acquirers sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			acquirers.Add(1)
+			go func() {
+				defer acquirers.Done()
+				<-start
+				lock, err := AcquireLocalLock("default", "backup")
+				var lockError *LockError
+				if err == nil {
+					locks <- lock
+				} else if !errors.As(err, &lockError) {
+					t.Errorf("Failed to acquire the lock: %v", err)
+				}
+			}()
+		}
+		close(start)
+		acquirers.Wait()
+		close(locks)
+
+		if len(locks) != 1 {
+			t.Fatalf("The stale lock was taken over by %d acquirers", len(locks))
+		}
+		for lock := range locks {
+			lock.Release()
+		}
+	}
+
+	// A process that finds the lock stale only after another one has taken it over leaves the new lock in place
+	lockPath := testDir + "/.duplicacy/locks/default"
+	description, _ := json.Marshal(&LockInfo{Host: hostname, PID: exitedPID, Command: "backup",
+		StartTime: time.Now().Unix()})
+	os.WriteFile(lockPath, description, 0600)
+	_, staleDescription, err := readLocalLock(lockPath)
+	if err != nil {
+		t.Fatalf("Failed to read the lock: %v", err)
+	}
+	lock, err := AcquireLocalLock("default", "backup")
+	if err != nil {
+		t.Fatalf("The stale lock was not removed: %v", err)
+	}
+	err = removeStaleLocalLock(lockPath, staleDescription)
+	if err != nil {
+		t.Errorf("Failed to remove the stale lock: %v", err)
+	}
+	var lockError *LockError
+	_, err = AcquireLocalLock("default", "backup")
+	if !errors.As(err, &lockError) {
+		t.Errorf("The lock taken over from the stale one was removed: %v", err)
+	}
+	lock.Release()
+
+	files, _ := os.ReadDir(testDir + "/.duplicacy/locks")
+	if len(files) != 0 {
+		t.Errorf("%d files left in the lock directory", len(files))
+	}
+}
+
+func TestRemoteLock(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "lock_test")
+	snapshotManager := createTestSnapshotManager(testDir)
+	defer os.RemoveAll(testDir)
+
+	lock, err := snapshotManager.AcquireRemoteLock("backup", false, 1)
+	if err != nil {
+		t.Fatalf("Failed to acquire a shared lease: %v", err)
+	}
+
+	// A backup on another host doesn't conflict with this one, but an exclusive prune does
+	backupLease := &LockInfo{Host: "otherhost", PID: 100, Command: "backup", StartTime: time.Now().Unix(),
+		ExpiryTime: time.Now().Add(time.Hour).Unix()}
+	err = snapshotManager.uploadLease(0, getRemoteLockPath(backupLease), backupLease)
+	if err != nil {
+		t.Fatalf("Failed to upload the lease: %v", err)
+	}
+
+	var lockError *LockError
+	_, err = snapshotManager.AcquireRemoteLock("prune", true, 1)
+	if !errors.As(err, &lockError) {
+		t.Errorf("An exclusive lease was acquired during backups: %v", err)
+	}
+
+	lock.Release()
+	snapshotManager.storage.DeleteFile(0, getRemoteLockPath(backupLease))
+
+	// The lease is renewed while it is held
+	savedDuration := RemoteLockLeaseDuration
+	RemoteLockLeaseDuration = 2 * time.Second
+	lock, err = snapshotManager.AcquireRemoteLock("backup", false, 1)
+	if err != nil {
+		t.Fatalf("Failed to acquire a shared lease: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	lease, err := snapshotManager.downloadLease(0, lock.filePath)
+	if err != nil {
+		t.Errorf("Failed to download the lease: %v", err)
+	} else if lease.ExpiryTime <= lock.info.ExpiryTime {
+		t.Errorf("The lease expiring at %d was not renewed", lease.ExpiryTime)
+	}
+	lock.Release()
+	RemoteLockLeaseDuration = savedDuration
+
+	pruneLease := &LockInfo{Host: "otherhost", PID: 200, Command: "prune", Exclusive: true,
+		StartTime: time.Now().Unix(), ExpiryTime: time.Now().Add(time.Hour).Unix()}
+	err = snapshotManager.uploadLease(0, getRemoteLockPath(pruneLease), pruneLease)
+	if err != nil {
+		t.Fatalf("Failed to upload the lease: %v", err)
+	}
+
+	_, err = snapshotManager.AcquireRemoteLock("backup", false, 1)
+	if !errors.As(err, &lockError) || lockError.Holder.Command != "prune" || lockError.Holder.Host != "otherhost" {
+		t.Errorf("A shared lease was acquired during an exclusive prune: %v", err)
+	}
+
+	// Expired leases and leases of exited processes on this host are removed
+	pruneLease.ExpiryTime = time.Now().Add(-time.Minute).Unix()
+	snapshotManager.uploadLease(0, getRemoteLockPath(pruneLease), pruneLease)
+	deadLease := &LockInfo{Host: hostname, PID: getExitedPID(t), Command: "backup", StartTime: time.Now().Unix(),
+		ExpiryTime: time.Now().Add(time.Hour).Unix()}
+	snapshotManager.uploadLease(0, getRemoteLockPath(deadLease), deadLease)
+
+	lock, err = snapshotManager.AcquireRemoteLock("prune", true, 1)
+	if err != nil {
+		t.Fatalf("Failed to acquire the exclusive lease: %v", err)
+	}
+	lock.Release()
+
+	files, _, _ := snapshotManager.storage.ListFiles(0, remoteLockDirectory)
+	if len(files) != 0 {
+		t.Errorf("Leases left in the storage: %v", files)
+	}
+
+	// Leases that can't be removed are never taken
+	snapshotManager.storage.SetAppendOnly(true)
+	_, err = snapshotManager.AcquireRemoteLock("backup", false, 1)
+	if err == nil {
+		t.Errorf("A lease was taken in the append-only mode")
+	}
+}
@@ -5,6 +5,8 @@
 package duplicacy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"log"
@@ -128,6 +130,7 @@ type Exception struct {
 	Level   int
 	LogID   string
 	Message string
+	Err     error // The cause of the exception, if any
 }
 
 var logMutex sync.Mutex
@@ -136,6 +139,10 @@ func logf(level int, logID string, format string, v ...interface{}) {
 
 	message := fmt.Sprintf(format, v...)
 
+	if level > WARN || !suppressedLogs[logID] {
+		recordReportMessage(level, logID, message)
+	}
+
 	if LogFunction != nil {
 		LogFunction(level, logID, message)
 		return
@@ -167,12 +174,7 @@ func logf(level int, logID string, format string, v ...interface{}) {
 				}
 			}
 
-			if printLogHeader {
-				fmt.Printf("%s %s %s %s\n",
-					now.Format("2006-01-02 15:04:05.000"), getLevelName(level), logID, message)
-			} else {
-				fmt.Printf("%s\n", message)
-			}
+			writeLog(now, level, logID, message, v)
 		}
 	}
 
@@ -214,6 +216,9 @@ func init() {
 const (
 	duplicacyExitCode = 100
 	otherExitCode     = 101
+
+	// The exit code when a backup or a restore has stopped cleanly after SIGINT or SIGTERM
+	InterruptedExitCode = 102
 )
 
 // This is the function to be called before exiting when an error occurs.
@@ -221,18 +226,37 @@ var RunAtError func() = func() {}
 
 func CatchLogException() {
 	if r := recover(); r != nil {
+		if catchOperationException(r) {
+			return
+		}
 		switch e := r.(type) {
 		case Exception:
 			if printStackTrace {
 				debug.PrintStack()
 			}
 			RunAtError()
+			ReleaseLocks()
+			FinishRunReport(duplicacyExitCode)
 			os.Exit(duplicacyExitCode)
 		default:
 			fmt.Fprintf(os.Stderr, "%v\n", e)
 			debug.PrintStack()
 			RunAtError()
+			ReleaseLocks()
+			FinishRunReport(otherExitCode)
 			os.Exit(otherExitCode)
 		}
 	}
 }
+
+// GetExitCode returns the exit code for an error returned by the API: InterruptedExitCode if the operation was
+// canceled, the one CatchLogException would use for an exception, or the one for unexpected errors.
+func GetExitCode(err error) int {
+	var exception Exception
+	if errors.Is(err, context.Canceled) {
+		return InterruptedExitCode
+	} else if errors.As(err, &exception) {
+		return duplicacyExitCode
+	}
+	return otherExitCode
+}
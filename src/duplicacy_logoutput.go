@@ -0,0 +1,288 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+var logFormat = LOG_FORMAT_TEXT
+
+// The destination of logs when they aren't sent to journald; nil means the standard output.
+var logOutput io.Writer
+
+// The connection to journald, if logs are sent there.
+var journalConnection *net.UnixConn
+
+// Fields such as the storage name and the snapshot id that are added to every structured log.
+var logContext = make(map[string]interface{})
+
+// SetLogFormat selects how logs are printed: 'text' for the default format, or 'json' for one JSON object per line
+// with the time, level, log id, message and all fields.
+func SetLogFormat(format string) error {
+	if format != LOG_FORMAT_TEXT && format != LOG_FORMAT_JSON {
+		return fmt.Errorf("invalid log format '%s'", format)
+	}
+	logFormat = format
+	return nil
+}
+
+// SetLogContext sets a field added to every structured log from now on.  A nil or empty value removes the field.
+func SetLogContext(name string, value interface{}) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if value == nil || value == "" {
+		delete(logContext, name)
+	} else {
+		logContext[name] = value
+	}
+}
+
+// logField is an argument of a log message that is also added to the structured log as a field.  It is formatted in
+// the message exactly like its value.
+type logField struct {
+	name  string
+	value interface{}
+}
+
+func (field logField) Format(state fmt.State, verb rune) {
+	fmt.Fprintf(state, fmt.FormatString(state, verb), field.value)
+}
+
+// LogField wraps an argument of LOG_INFO and others so that it is recorded in structured logs as the field 'name', e.g.
+// LOG_WARN("SKIP_FILE", "File %s cannot be opened", LogField("path", file)).
+func LogField(name string, value interface{}) interface{} {
+	return logField{name: name, value: value}
+}
+
+// getLogFields returns the context fields and the fields among the arguments of a log message.
+func getLogFields(v []interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for name, value := range logContext {
+		fields[name] = value
+	}
+	for _, argument := range v {
+		if field, ok := argument.(logField); ok {
+			fields[field.name] = field.value
+		}
+	}
+	return fields
+}
+
+// writeLog prints a log to the configured destination in the configured format.  Must be called with logMutex held.
+func writeLog(now time.Time, level int, logID string, message string, v []interface{}) {
+
+	if journalConnection != nil {
+		err := sendToJournal(level, logID, message, getLogFields(v))
+		if err == nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Failed to send the log to journald: %v\n", err)
+	}
+
+	output := logOutput
+	if output == nil {
+		output = os.Stdout
+	}
+
+	if logFormat == LOG_FORMAT_JSON {
+		record := getLogFields(v)
+		record["time"] = now.Format(time.RFC3339Nano)
+		record["level"] = getLevelName(level)
+		record["log_id"] = logID
+		record["message"] = message
+		line, err := json.Marshal(record)
+		if err != nil {
+			line, _ = json.Marshal(map[string]string{"time": now.Format(time.RFC3339Nano),
+				"level": getLevelName(level), "log_id": logID, "message": message})
+		}
+		output.Write(append(line, '\n'))
+	} else if printLogHeader || logOutput != nil {
+		fmt.Fprintf(output, "%s %s %s %s\n", now.Format("2006-01-02 15:04:05.000"), getLevelName(level), logID, message)
+	} else {
+		fmt.Fprintf(output, "%s\n", message)
+	}
+}
+
+// logJobOutput logs a line printed by the child process running the job 'jobName'.  When both the daemon and its
+// children use the JSON log format, a line that is already a log record is written as it is, with the field 'job'
+// added, instead of being encoded again as the message of another record.
+func logJobOutput(jobName string, line string) {
+
+	if logFormat == LOG_FORMAT_JSON && journalConnection == nil && strings.HasPrefix(line, "{") {
+		record := make(map[string]interface{})
+		if json.Unmarshal([]byte(line), &record) == nil && record["log_id"] != nil {
+			record["job"] = jobName
+			if description, err := json.Marshal(record); err == nil {
+				output := logOutput
+				if output == nil {
+					output = os.Stdout
+				}
+				logMutex.Lock()
+				output.Write(append(description, '\n'))
+				logMutex.Unlock()
+				return
+			}
+		}
+	}
+
+	LOG_INFO("JOB_OUTPUT", "%s: %s", LogField("job", jobName), line)
+}
+
+// rotatingLogFile is a log file that is renamed to <path>.1 when it reaches 'maximumSize', keeping at most
+// 'maximumFiles' old files as <path>.1 to <path>.<maximumFiles>.
+type rotatingLogFile struct {
+	path         string
+	file         *os.File
+	size         int64
+	maximumSize  int64
+	maximumFiles int
+}
+
+// SetLogFile sends logs to the file at 'filePath', rotating it when it grows larger than 'maximumSize' bytes.  A
+// 'maximumSize' of 0 disables rotation.
+func SetLogFile(filePath string, maximumSize int64, maximumFiles int) error {
+	logFile := &rotatingLogFile{
+		path:         filePath,
+		maximumSize:  maximumSize,
+		maximumFiles: maximumFiles,
+	}
+	err := logFile.open()
+	if err != nil {
+		return err
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	logOutput = logFile
+	return nil
+}
+
+func (logFile *rotatingLogFile) open() error {
+	file, err := os.OpenFile(logFile.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	logFile.file = file
+	logFile.size = stat.Size()
+	return nil
+}
+
+func (logFile *rotatingLogFile) Write(p []byte) (n int, err error) {
+
+	if logFile.maximumSize > 0 && logFile.size > 0 && logFile.size+int64(len(p)) > logFile.maximumSize {
+		logFile.rotate()
+	}
+
+	n, err = logFile.file.Write(p)
+	logFile.size += int64(n)
+	return n, err
+}
+
+func (logFile *rotatingLogFile) rotate() {
+	logFile.file.Close()
+
+	if logFile.maximumFiles < 1 {
+		os.Remove(logFile.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", logFile.path, logFile.maximumFiles))
+		for i := logFile.maximumFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", logFile.path, i), fmt.Sprintf("%s.%d", logFile.path, i+1))
+		}
+		os.Rename(logFile.path, logFile.path+".1")
+	}
+
+	err := logFile.open()
+	if err != nil {
+		// Keep logging somewhere rather than losing everything
+		fmt.Fprintf(os.Stderr, "Failed to reopen the log file %s: %v\n", logFile.path, err)
+		logFile.file = os.Stderr
+		logFile.maximumSize = 0
+	}
+}
+
+// EnableJournal sends logs to journald using its native protocol, so that the log id and all fields can be queried,
+// e.g. with 'journalctl DUPLICACY_LOG_ID=RESTORE_HARDLINK'.
+func EnableJournal() error {
+	address := &net.UnixAddr{Name: "/run/systemd/journal/socket", Net: "unixgram"}
+	connection, err := net.DialUnix("unixgram", nil, address)
+	if err != nil {
+		return err
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	journalConnection = connection
+	return nil
+}
+
+// The syslog priorities of the log levels.
+func getJournalPriority(level int) int {
+	switch {
+	case level <= TRACE:
+		return 7
+	case level == INFO:
+		return 6
+	case level == WARN:
+		return 4
+	case level == ERROR:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// sendToJournal sends a log as a datagram of KEY=VALUE lines.  Values with line breaks are sent as the key, a line
+// break, the length as a 64-bit little endian integer, and the value.
+func sendToJournal(level int, logID string, message string, fields map[string]interface{}) error {
+
+	var datagram bytes.Buffer
+	addField := func(name string, value string) {
+		name = strings.ToUpper(name)
+		if !strings.Contains(value, "\n") {
+			fmt.Fprintf(&datagram, "%s=%s\n", name, value)
+			return
+		}
+		datagram.WriteString(name + "\n")
+		binary.Write(&datagram, binary.LittleEndian, uint64(len(value)))
+		datagram.WriteString(value + "\n")
+	}
+
+	addField("MESSAGE", message)
+	addField("PRIORITY", fmt.Sprintf("%d", getJournalPriority(level)))
+	addField("SYSLOG_IDENTIFIER", "dupluxy")
+	addField("DUPLICACY_LOG_ID", logID)
+
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		addField("DUPLICACY_"+name, fmt.Sprintf("%v", fields[name]))
+	}
+
+	_, err := journalConnection.Write(datagram.Bytes())
+	return err
+}
@@ -0,0 +1,193 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogFormat(t *testing.T) {
+
+	var buffer bytes.Buffer
+	logOutput = &buffer
+	defer func() {
+		logOutput = nil
+		logFormat = LOG_FORMAT_TEXT
+		logContext = make(map[string]interface{})
+	}()
+
+	SetLogFormat(LOG_FORMAT_JSON)
+	SetLogContext("storage", "offsite")
+	SetLogContext("snapshot_id", "host1")
+
+	now := time.Now()
+	v := []interface{}{LogField("chunk_id", "abcd"), LogField("revision", 3)}
+	message := fmt.Sprintf("Chunk %s referenced by revision %d is missing", v...)
+	logMutex.Lock()
+	writeLog(now, WARN, "SNAPSHOT_VALIDATE", message, v)
+	logMutex.Unlock()
+
+	var record map[string]interface{}
+	err := json.Unmarshal(buffer.Bytes(), &record)
+	if err != nil {
+		t.Fatalf("Failed to parse the log '%s': %v", buffer.String(), err)
+	}
+
+	expected := map[string]interface{}{
+		"level":       "WARN",
+		"log_id":      "SNAPSHOT_VALIDATE",
+		"message":     "Chunk abcd referenced by revision 3 is missing",
+		"storage":     "offsite",
+		"snapshot_id": "host1",
+		"chunk_id":    "abcd",
+		"revision":    float64(3),
+		"time":        now.Format(time.RFC3339Nano),
+	}
+	for name, value := range expected {
+		if record[name] != value {
+			t.Errorf("The field %s of the log is %v instead of %v", name, record[name], value)
+		}
+	}
+
+	if SetLogFormat("xml") == nil {
+		t.Errorf("An invalid log format was accepted")
+	}
+}
+
+func TestJSONJobOutput(t *testing.T) {
+
+	var buffer bytes.Buffer
+	logOutput = &buffer
+	level, savedT := loggingLevel, testingT
+	testingT = nil
+	defer func() {
+		logOutput = nil
+		logFormat = LOG_FORMAT_TEXT
+		SetLoggingLevel(level)
+		testingT = savedT
+	}()
+
+	SetLogFormat(LOG_FORMAT_JSON)
+	SetLoggingLevel(INFO)
+
+	// A log record printed by a child running with the JSON log format is passed through
+	logJobOutput("nightly", `{"level":"INFO","log_id":"BACKUP_END","message":"Backup completed","revision":5}`)
+	// Any other output is wrapped in a record
+	logJobOutput("nightly", "Storage set to /backups")
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines were logged instead of 2: %s", len(lines), buffer.String())
+	}
+
+	var record map[string]interface{}
+	err := json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil {
+		t.Fatalf("Failed to parse the log '%s': %v", lines[0], err)
+	}
+	if record["log_id"] != "BACKUP_END" || record["message"] != "Backup completed" || record["job"] != "nightly" ||
+		record["revision"] != float64(5) {
+		t.Errorf("The log of the child was not passed through: %s", lines[0])
+	}
+
+	record = nil
+	err = json.Unmarshal([]byte(lines[1]), &record)
+	if err != nil {
+		t.Fatalf("Failed to parse the log '%s': %v", lines[1], err)
+	}
+	if record["log_id"] != "JOB_OUTPUT" || record["message"] != "nightly: Storage set to /backups" ||
+		record["job"] != "nightly" {
+		t.Errorf("The output of the child was not wrapped: %s", lines[1])
+	}
+}
+
+func TestRotatingLogFile(t *testing.T) {
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "logs")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	logPath := path.Join(testDir, "dupluxy.log")
+	logFile := &rotatingLogFile{path: logPath, maximumSize: 100, maximumFiles: 2}
+	err := logFile.open()
+	if err != nil {
+		t.Fatalf("Failed to open the log file: %v", err)
+	}
+
+	line := strings.Repeat("x", 39) + "\n"
+	for i := 0; i < 10; i++ {
+		logFile.Write([]byte(line))
+	}
+	logFile.file.Close()
+
+	for _, suffix := range []string{"", ".1", ".2"} {
+		stat, err := os.Stat(logPath + suffix)
+		if err != nil {
+			t.Errorf("The log file %s doesn't exist: %v", logPath+suffix, err)
+		} else if stat.Size() > 100 {
+			t.Errorf("The log file %s has a size of %d", logPath+suffix, stat.Size())
+		}
+	}
+	if _, err := os.Stat(logPath + ".3"); err == nil {
+		t.Errorf("More rotated log files than configured are kept")
+	}
+}
+
+func TestJournalLog(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("journald is not available on Windows")
+	}
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "journal")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	address := &net.UnixAddr{Name: path.Join(testDir, "socket"), Net: "unixgram"}
+	server, err := net.ListenUnixgram("unixgram", address)
+	if err != nil {
+		t.Skipf("Unix datagram sockets are not available: %v", err)
+	}
+	defer server.Close()
+
+	journalConnection, err = net.DialUnix("unixgram", nil, address)
+	if err != nil {
+		t.Fatalf("Failed to connect to the socket: %v", err)
+	}
+	defer func() {
+		journalConnection.Close()
+		journalConnection = nil
+	}()
+
+	err = sendToJournal(ERROR, "RESTORE_HARDLINK", "line 1\nline 2", map[string]interface{}{"path": "a/b"})
+	if err != nil {
+		t.Fatalf("Failed to send the log: %v", err)
+	}
+
+	datagram := make([]byte, 4096)
+	n, err := server.Read(datagram)
+	if err != nil {
+		t.Fatalf("Failed to receive the log: %v", err)
+	}
+	received := string(datagram[:n])
+
+	for _, field := range []string{"PRIORITY=3\n", "DUPLICACY_LOG_ID=RESTORE_HARDLINK\n", "DUPLICACY_PATH=a/b\n",
+		"MESSAGE\n\x0d\x00\x00\x00\x00\x00\x00\x00line 1\nline 2\n"} {
+		if !strings.Contains(received, field) {
+			t.Errorf("The journal entry doesn't contain %q: %q", field, received)
+		}
+	}
+}
@@ -58,6 +58,11 @@ type Preference struct {
 	IncludeSpecials    bool              `json:"include_specials"`
 	FileFlagsMask      flagsMask         `json:"file_flags_mask"`
 	OneFileSystem      bool              `json:"one_file_system"`
+	CompareChangeTime  bool              `json:"compare_ctime"`
+	ObjectLockDays     int               `json:"object_lock_days"`
+	ObjectLockMode     string            `json:"object_lock_mode"`
+	AppendOnly         bool              `json:"append_only"`
+	RemoteLock         bool              `json:"remote_lock"`
 }
 
 var preferencePath string
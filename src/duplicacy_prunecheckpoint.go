@@ -0,0 +1,471 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The files in the snapshot cache (.duplicacy/cache/storage/) where an exhaustive prune saves its progress: the
+// checkpoint itself, the chunks referenced by the snapshots processed so far, and the files listed so far.
+const (
+	pruneCheckpointFile = "prune_checkpoint"
+	pruneReferencedFile = "prune_referenced"
+	pruneListingFile    = "prune_listing"
+)
+
+// How often the checkpoint is saved and the progress is reported.
+const pruneCheckpointInterval = 5 * 60
+const pruneProgressInterval = 10
+
+// A checkpoint older than this is never used, since the storage may have changed too much in the meantime.
+const pruneCheckpointMaxAge = 7 * secondsInDay
+
+// PruneCheckpoint records how far an exhaustive prune has gone, so that a run that is interrupted can be resumed
+// without listing the chunk directory or downloading the chunks of every snapshot again.  A checkpoint is only used
+// if the same revisions are to be deleted and no other prune operation has run in between.
+//
+// The referenced chunks are kept in a ChunkIndex and the listed files in a local file, so the memory used doesn't
+// grow with the number of chunks in the storage.
+type PruneCheckpoint struct {
+	// The snapshots to be deleted, in the form of 'id:revision'
+	Flagged []string `json:"flagged"`
+
+	// The fossil collections in the storage, which change whenever a prune operation completes
+	Collections []string `json:"collections"`
+
+	// The snapshots whose chunks have been added to the referenced chunks
+	ProcessedSnapshots []string `json:"processed_snapshots"`
+
+	// The state of listing the chunk directory.  Only the first 'ListingSize' bytes of the listing file are valid.
+	ListingCompleted    bool     `json:"listing_completed"`
+	PendingDirectories  []string `json:"pending_directories"`
+	ListingSize         int64    `json:"listing_size"`
+	NumberOfListedFiles int      `json:"listed_files"`
+
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+
+	directory     string
+	referenced    *ChunkIndex
+	listing       *os.File
+	listingWriter *bufio.Writer
+
+	lock      sync.Mutex
+	modified  bool
+	transient bool // Never saved, as in a dry run
+}
+
+func getSnapshotKey(snapshot *Snapshot) string {
+	return fmt.Sprintf("%s:%d", snapshot.ID, snapshot.Revision)
+}
+
+// getFlaggedSnapshots returns the keys of the snapshots to be deleted in a fixed order.
+func getFlaggedSnapshots(allSnapshots map[string][]*Snapshot) (flagged []string) {
+	flagged = []string{}
+	for _, snapshots := range allSnapshots {
+		for _, snapshot := range snapshots {
+			if snapshot.Flag {
+				flagged = append(flagged, getSnapshotKey(snapshot))
+			}
+		}
+	}
+	sort.Strings(flagged)
+	return flagged
+}
+
+func isSameStringList(list1 []string, list2 []string) bool {
+	if len(list1) != len(list2) {
+		return false
+	}
+	for i := range list1 {
+		if list1[i] != list2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// openPruneCheckpoint returns the checkpoint saved by a previous run for the same set of snapshots to be deleted, or
+// a new one if there is none.  A transient checkpoint is created in a temporary directory and never saved.
+func (manager *SnapshotManager) openPruneCheckpoint(allSnapshots map[string][]*Snapshot, transient bool) (*PruneCheckpoint, error) {
+
+	flagged := getFlaggedSnapshots(allSnapshots)
+	collections, _, err := manager.storage.ListFiles(0, "fossils")
+	if err != nil {
+		LOG_WARN("PRUNE_CHECKPOINT", "Failed to list fossil collections: %v", err)
+	}
+	sort.Strings(collections)
+	now := time.Now().Unix()
+	checkpoint := &PruneCheckpoint{
+		Flagged:     flagged,
+		Collections: collections,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		referenced:  CreateChunkIndex(),
+		transient:   transient || manager.snapshotCache == nil,
+	}
+
+	if checkpoint.transient {
+		directory := GetDuplicacyPreferencePath()
+		if directory == "" {
+			directory = os.TempDir()
+		}
+		checkpoint.directory, err = ioutil.TempDir(directory, "prune")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		checkpoint.directory = manager.snapshotCache.storageDir
+		if saved := checkpoint.loadSaved(); saved != nil {
+			checkpoint = saved
+		} else {
+			// The files of an unusable checkpoint will be overwritten, so the checkpoint must not be used later
+			os.Remove(path.Join(checkpoint.directory, pruneCheckpointFile))
+		}
+	}
+
+	listingFlags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if checkpoint.ListingSize > 0 {
+		listingFlags = os.O_RDWR
+	}
+	checkpoint.listing, err = os.OpenFile(path.Join(checkpoint.directory, pruneListingFile), listingFlags, 0600)
+	if err != nil {
+		checkpoint.referenced.Close()
+		return nil, err
+	}
+	if checkpoint.ListingSize > 0 {
+		// Discard files listed after the checkpoint was saved
+		if err = checkpoint.listing.Truncate(checkpoint.ListingSize); err == nil {
+			_, err = checkpoint.listing.Seek(checkpoint.ListingSize, io.SeekStart)
+		}
+		if err != nil {
+			checkpoint.close()
+			return nil, err
+		}
+	}
+	checkpoint.listingWriter = bufio.NewWriter(checkpoint.listing)
+
+	return checkpoint, nil
+}
+
+// loadSaved loads the checkpoint saved in the same directory and returns it if it can be used in place of this one.
+func (checkpoint *PruneCheckpoint) loadSaved() *PruneCheckpoint {
+
+	description, err := ioutil.ReadFile(path.Join(checkpoint.directory, pruneCheckpointFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LOG_WARN("PRUNE_CHECKPOINT", "Failed to load the prune checkpoint: %v", err)
+		}
+		return nil
+	}
+
+	saved := &PruneCheckpoint{}
+	err = json.Unmarshal(description, saved)
+	if err != nil {
+		LOG_WARN("PRUNE_CHECKPOINT", "Failed to parse the prune checkpoint: %v", err)
+		return nil
+	}
+
+	if saved.CreatedAt+pruneCheckpointMaxAge < checkpoint.CreatedAt {
+		LOG_INFO("PRUNE_CHECKPOINT", "Ignoring the prune checkpoint created at %s",
+			time.Unix(saved.CreatedAt, 0).Format("2006-01-02 15:04:05"))
+		return nil
+	}
+	if !isSameStringList(saved.Flagged, checkpoint.Flagged) {
+		LOG_INFO("PRUNE_CHECKPOINT", "Ignoring the prune checkpoint created for a different set of snapshots")
+		return nil
+	}
+	if !isSameStringList(saved.Collections, checkpoint.Collections) {
+		LOG_INFO("PRUNE_CHECKPOINT", "Ignoring the prune checkpoint as fossil collections have changed since then")
+		return nil
+	}
+
+	saved.directory = checkpoint.directory
+	saved.referenced = checkpoint.referenced
+	if len(saved.ProcessedSnapshots) > 0 {
+		err = saved.referenced.Load(path.Join(saved.directory, pruneReferencedFile))
+		if err != nil {
+			LOG_WARN("PRUNE_CHECKPOINT", "Failed to load the referenced chunks from the prune checkpoint: %v", err)
+			saved.referenced.Close()
+			checkpoint.referenced = CreateChunkIndex()
+			return nil
+		}
+	}
+
+	LOG_INFO("PRUNE_CHECKPOINT", "Resuming from the prune checkpoint saved at %s: %d snapshots processed, %d files listed",
+		time.Unix(saved.UpdatedAt, 0).Format("2006-01-02 15:04:05"), len(saved.ProcessedSnapshots), saved.NumberOfListedFiles)
+	return saved
+}
+
+// save writes the checkpoint to the snapshot cache if it has been modified since the last save.
+func (checkpoint *PruneCheckpoint) save() {
+	checkpoint.lock.Lock()
+	defer checkpoint.lock.Unlock()
+
+	if !checkpoint.modified || checkpoint.transient {
+		return
+	}
+
+	err := checkpoint.listingWriter.Flush()
+	if err == nil {
+		checkpoint.ListingSize, err = checkpoint.listing.Seek(0, io.SeekCurrent)
+	}
+	if err != nil {
+		LOG_WARN("PRUNE_CHECKPOINT", "Failed to save the list of chunk files: %v", err)
+		return
+	}
+
+	if !checkpoint.referenced.sealed {
+		err = checkpoint.referenced.Save(path.Join(checkpoint.directory, pruneReferencedFile))
+		if err != nil {
+			LOG_WARN("PRUNE_CHECKPOINT", "Failed to save the referenced chunks: %v", err)
+			return
+		}
+	}
+
+	checkpoint.UpdatedAt = time.Now().Unix()
+	description, err := json.Marshal(checkpoint)
+	if err != nil {
+		LOG_WARN("PRUNE_CHECKPOINT", "Failed to create a json file for the prune checkpoint: %v", err)
+		return
+	}
+
+	checkpointPath := path.Join(checkpoint.directory, pruneCheckpointFile)
+	err = ioutil.WriteFile(checkpointPath+".tmp", description, 0600)
+	if err == nil {
+		err = os.Rename(checkpointPath+".tmp", checkpointPath)
+	}
+	if err != nil {
+		LOG_WARN("PRUNE_CHECKPOINT", "Failed to save the prune checkpoint: %v", err)
+		return
+	}
+	checkpoint.modified = false
+	LOG_DEBUG("PRUNE_CHECKPOINT", "Saved the prune checkpoint: %d snapshots processed, %d files listed",
+		len(checkpoint.ProcessedSnapshots), checkpoint.NumberOfListedFiles)
+}
+
+// close releases the files used by the checkpoint without removing it.
+func (checkpoint *PruneCheckpoint) close() {
+	checkpoint.referenced.Close()
+	if checkpoint.listing != nil {
+		checkpoint.listing.Close()
+		checkpoint.listing = nil
+	}
+	if checkpoint.transient {
+		os.RemoveAll(checkpoint.directory)
+	}
+}
+
+// remove deletes the checkpoint once the prune operation no longer needs it.
+func (checkpoint *PruneCheckpoint) remove() {
+	checkpoint.close()
+	if checkpoint.transient {
+		return
+	}
+	for _, file := range []string{pruneCheckpointFile, pruneReferencedFile, pruneListingFile} {
+		err := os.Remove(path.Join(checkpoint.directory, file))
+		if err != nil && !os.IsNotExist(err) {
+			LOG_WARN("PRUNE_CHECKPOINT", "Failed to remove the prune checkpoint file %s: %v", file, err)
+		}
+	}
+}
+
+// pruneProgress reports the progress of one phase of the prune operation at a limited rate.
+type pruneProgress struct {
+	phase      string
+	total      int
+	startTime  time.Time
+	lastReport time.Time
+}
+
+func newPruneProgress(phase string, total int) *pruneProgress {
+	now := time.Now()
+	return &pruneProgress{phase: phase, total: total, startTime: now, lastReport: now}
+}
+
+// report logs the number of items done and the estimated remaining time.  If 'total' is 0 the remaining time is
+// unknown.
+func (progress *pruneProgress) report(done int, final bool) {
+	checkCanceled()
+
+	now := time.Now()
+	if !final && now.Sub(progress.lastReport) < pruneProgressInterval*time.Second {
+		return
+	}
+	progress.lastReport = now
+
+	elapsedTime := now.Sub(progress.startTime).Seconds()
+	remainingTime := int64(-1)
+	if progress.total > 0 && done > 0 {
+		remainingTime = int64(float64(progress.total-done) / float64(done) * elapsedTime)
+	}
+	reportProgress(progress.phase, int64(done), int64(progress.total), 0, remainingTime)
+
+	if progress.total == 0 {
+		LOG_INFO("PRUNE_PROGRESS", "%s: %d found, elapsed time %s", progress.phase, done, PrettyTime(int64(elapsedTime)))
+		return
+	}
+
+	percentage := float64(done) / float64(progress.total) * 100.0
+	LOG_INFO("PRUNE_PROGRESS", "%s: %d/%d %.1f%%, ETA %s", progress.phase, done, progress.total, percentage,
+		PrettyTime(remainingTime))
+}
+
+// loadSnapshotChunks downloads the chunk lists of the given snapshots using 'threads' goroutines and passes them
+// to 'visit' one snapshot at a time in the calling goroutine.
+func (manager *SnapshotManager) loadSnapshotChunks(snapshots []*Snapshot, threads int, visit func(*Snapshot, []string)) {
+
+	if threads < 1 {
+		threads = 1
+	}
+
+	type snapshotChunks struct {
+		snapshot *Snapshot
+		chunks   []string
+	}
+
+	snapshotChannel := make(chan *Snapshot, len(snapshots))
+	resultChannel := make(chan snapshotChunks, threads)
+
+	for _, snapshot := range snapshots {
+		snapshotChannel <- snapshot
+	}
+	close(snapshotChannel)
+
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer CatchLogException()
+			defer wg.Done()
+			for snapshot := range snapshotChannel {
+				resultChannel <- snapshotChunks{snapshot, manager.GetSnapshotChunks(snapshot, false)}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultChannel)
+	}()
+
+	progress := newPruneProgress("Loading snapshot chunks", len(snapshots))
+	done := 0
+	for result := range resultChannel {
+		visit(result.snapshot, result.chunks)
+		done++
+		progress.report(done, done == len(snapshots))
+	}
+
+	// A goroutine that has failed leaves some snapshots out
+	checkCanceled()
+}
+
+// addSnapshotChunks adds the chunks of a processed snapshot to the referenced chunks.
+func (checkpoint *PruneCheckpoint) addSnapshotChunks(snapshot *Snapshot, chunks []string) {
+	checkpoint.lock.Lock()
+	defer checkpoint.lock.Unlock()
+	for _, chunk := range chunks {
+		checkpoint.referenced.Add(chunk, 0)
+	}
+	checkpoint.ProcessedSnapshots = append(checkpoint.ProcessedSnapshots, getSnapshotKey(snapshot))
+	checkpoint.modified = true
+}
+
+// listChunks lists all files under the chunk directory into the listing file of the checkpoint, saving the
+// directories that remain to be listed so that an interrupted listing can continue where it stopped.  Listed paths
+// are relative to the chunk directory.
+func (manager *SnapshotManager) listChunks(checkpoint *PruneCheckpoint) bool {
+
+	if checkpoint.ListingCompleted {
+		return true
+	}
+
+	checkpoint.lock.Lock()
+	if len(checkpoint.PendingDirectories) == 0 && checkpoint.NumberOfListedFiles == 0 {
+		checkpoint.PendingDirectories = []string{chunkDir}
+	}
+	checkpoint.lock.Unlock()
+
+	lastSaveTime := time.Now().Unix()
+	progress := newPruneProgress("Listing chunks", 0)
+	for {
+		checkpoint.lock.Lock()
+		if len(checkpoint.PendingDirectories) == 0 {
+			checkpoint.ListingCompleted = true
+			checkpoint.modified = true
+			checkpoint.lock.Unlock()
+			break
+		}
+		dir := checkpoint.PendingDirectories[len(checkpoint.PendingDirectories)-1]
+		checkpoint.lock.Unlock()
+
+		LOG_TRACE("LIST_FILES", "Listing %s", dir)
+
+		files, _, err := manager.storage.ListFiles(0, dir)
+		if err != nil {
+			LOG_ERROR("LIST_FILES", "Failed to list the directory %s: %v", dir, err)
+			return false
+		}
+
+		// The directory is only removed from the pending list after its content has been recorded
+		checkpoint.lock.Lock()
+		checkpoint.PendingDirectories = checkpoint.PendingDirectories[:len(checkpoint.PendingDirectories)-1]
+		for _, file := range files {
+			if len(file) > 0 && file[len(file)-1] == '/' {
+				checkpoint.PendingDirectories = append(checkpoint.PendingDirectories, dir+file)
+			} else if len(file) > 0 {
+				checkpoint.listingWriter.WriteString((dir + file)[len(chunkDir):] + "\n")
+				checkpoint.NumberOfListedFiles++
+			}
+		}
+		checkpoint.modified = true
+		numberOfFiles := checkpoint.NumberOfListedFiles
+		checkpoint.lock.Unlock()
+
+		progress.report(numberOfFiles, false)
+		if now := time.Now().Unix(); now > lastSaveTime+pruneCheckpointInterval {
+			lastSaveTime = now
+			checkpoint.save()
+		}
+	}
+
+	progress.report(checkpoint.NumberOfListedFiles, true)
+	checkpoint.save()
+	return true
+}
+
+// forEachListedFile calls 'visit' with each file in the listing file.
+func (checkpoint *PruneCheckpoint) forEachListedFile(visit func(file string)) error {
+
+	checkpoint.lock.Lock()
+	err := checkpoint.listingWriter.Flush()
+	checkpoint.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	listing, err := os.Open(path.Join(checkpoint.directory, pruneListingFile))
+	if err != nil {
+		return err
+	}
+	defer listing.Close()
+
+	scanner := bufio.NewScanner(listing)
+	for scanner.Scan() {
+		visit(scanner.Text())
+	}
+	return scanner.Err()
+}
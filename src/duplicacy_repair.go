@@ -0,0 +1,328 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RepairSnapshots rewrites the given revisions of the snapshot of this backup manager so that they no longer reference
+// missing chunks.  Files referencing missing chunks are re-sourced from the directory 'top' if it is not empty and the
+// files there still have the same content; otherwise they are removed from the snapshot.  Repaired revisions are
+// uploaded again with 'tag' as the tag.  If 'revisions' is empty, all revisions are repaired.  Returns the paths of the
+// files that have been lost for each repaired revision, or nil on failure, along with the revisions that need to be
+// repaired but can't be.
+func (manager *BackupManager) RepairSnapshots(top string, revisions []int, tag string,
+	threads int) (lostFiles map[int][]string, unrepairedRevisions []int) {
+
+	if manager.storage.IsAppendOnly() {
+		LOG_ERROR("REPAIR_APPEND_ONLY", "Snapshots can't be repaired in the append-only mode")
+		return nil, nil
+	}
+
+	var err error
+	if len(revisions) == 0 {
+		revisions, err = manager.SnapshotManager.ListSnapshotRevisions(manager.snapshotID)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to list all revisions for snapshot %s: %v", manager.snapshotID, err)
+			return nil, nil
+		}
+	}
+
+	existingChunks := CreateChunkIndex()
+	defer existingChunks.Close()
+
+	fossils := 0
+	LOG_INFO("REPAIR_LIST", "Listing all chunks")
+	if !manager.SnapshotManager.listAllFiles(manager.storage, chunkDir, func(chunk string, size int64) {
+		if len(chunk) == 0 || chunk[len(chunk)-1] == '/' || strings.HasSuffix(chunk, ".tmp") {
+			return
+		}
+		if strings.HasSuffix(chunk, ".fsl") {
+			fossils++
+			chunk = strings.TrimSuffix(chunk, ".fsl")
+		}
+		existingChunks.Add(strings.Replace(chunk, "/", "", -1), size)
+	}) {
+		return nil, nil
+	}
+
+	err = existingChunks.Seal()
+	if err != nil {
+		LOG_ERROR("CHUNK_INDEX", "Failed to build the index of all chunks: %v", err)
+		return nil, nil
+	}
+
+	if fossils > 0 {
+		LOG_WARN("REPAIR_FOSSIL", "Fossils are treated as existing chunks; run 'check -fossils -resurrect' to turn "+
+			"them back into chunks")
+	}
+
+	manager.SnapshotManager.CreateChunkOperator(false, false, threads, false)
+	defer func() {
+		manager.SnapshotManager.chunkOperator.Stop()
+		manager.SnapshotManager.chunkOperator = nil
+	}()
+
+	lostFiles = make(map[int][]string)
+	for _, revision := range revisions {
+		lost, repaired, ok := manager.repairSnapshot(top, revision, tag, existingChunks)
+		if !ok {
+			unrepairedRevisions = append(unrepairedRevisions, revision)
+		} else if repaired {
+			lostFiles[revision] = lost
+		}
+	}
+
+	return lostFiles, unrepairedRevisions
+}
+
+// repairSnapshot repairs one revision.  'repaired' is false if the revision doesn't need to be repaired, and 'ok' is
+// false if it needs to be but can't be.
+func (manager *BackupManager) repairSnapshot(top string, revision int, tag string,
+	existingChunks *ChunkIndex) (lostFiles []string, repaired bool, ok bool) {
+
+	chunkOperator := manager.SnapshotManager.chunkOperator
+	snapshot := manager.SnapshotManager.DownloadSnapshot(manager.snapshotID, revision)
+
+	// The metadata chunks can't be recovered
+	for _, sequence := range [][]string{snapshot.FileSequence, snapshot.ChunkSequence, snapshot.LengthSequence} {
+		for _, chunkHash := range sequence {
+			chunkID := manager.config.GetChunkIDFromHash(chunkHash)
+			if _, found := existingChunks.Find(chunkID); !found {
+				LOG_WARN("REPAIR_METADATA", "Metadata chunk %s referenced by snapshot %s at revision %d is missing; "+
+					"the revision can't be repaired and can only be deleted", chunkID, manager.snapshotID, revision)
+				return nil, true, false
+			}
+		}
+	}
+
+	if snapshot.Version == 0 {
+		LOG_WARN("REPAIR_VERSION", "Snapshot %s at revision %d is encoded in an old version format that can't be repaired",
+			manager.snapshotID, revision)
+		return nil, true, false
+	}
+
+	if !manager.SnapshotManager.DownloadSnapshotSequences(snapshot) {
+		return nil, true, false
+	}
+
+	missingChunks := make(map[int]bool)
+	for i, chunkHash := range snapshot.ChunkHashes {
+		if _, found := existingChunks.Find(manager.config.GetChunkIDFromHash(chunkHash)); !found {
+			missingChunks[i] = true
+		}
+	}
+
+	if len(missingChunks) == 0 {
+		LOG_INFO("REPAIR_SKIP", "All chunks referenced by snapshot %s at revision %d exist", manager.snapshotID, revision)
+		return nil, false, true
+	}
+
+	LOG_INFO("REPAIR_START", "Repairing snapshot %s at revision %d with %d missing chunks", manager.snapshotID, revision,
+		len(missingChunks))
+
+	// Keep all entries in memory; the on-disk file of an entry list is shared with incomplete backups
+	entryList, err := CreateEntryList(manager.snapshotID, manager.cachePath, -1)
+	if err != nil {
+		LOG_ERROR("REPAIR_LIST", "Failed to create the entry list: %v", err)
+		return nil, true, false
+	}
+
+	for i, chunkHash := range snapshot.ChunkHashes {
+		entryList.AddPreservedChunk(chunkHash, snapshot.ChunkLengths[i])
+	}
+
+	// Hard links refer to their roots by the order of the roots, which changes if a root is removed
+	var hardLinkRoots []*Entry
+	var newHardLinkIDs []int
+	numberOfHardLinkRoots := 0
+
+	resourcedFiles := 0
+	isFailed := false
+
+	snapshot.ListRemoteFiles(manager.config, chunkOperator, func(entry *Entry) bool {
+
+		if entry.IsHardLinkChild() {
+			i, err := entry.GetHardLinkId()
+			if err != nil || i >= len(newHardLinkIDs) {
+				LOG_ERROR("REPAIR_LINK", "Invalid hard link entry %s: %v", entry.Path, err)
+				isFailed = true
+				return false
+			}
+
+			if newHardLinkIDs[i] < 0 {
+				LOG_INFO("REPAIR_LOST", "Lost %s", entry.Path)
+				lostFiles = append(lostFiles, entry.Path)
+				snapshot.NumberOfFiles--
+				snapshot.FileSize -= entry.Size
+				return true
+			}
+
+			if entry.IsFile() {
+				root := hardLinkRoots[i]
+				entry.Link = strconv.FormatInt(int64(newHardLinkIDs[i]), 16)
+				if entry.Size > 0 {
+					entry.StartChunk, entry.StartOffset = root.StartChunk, root.StartOffset
+					entry.EndChunk, entry.EndOffset = root.EndChunk, root.EndOffset
+				}
+			} else {
+				entry.EndOffset = newHardLinkIDs[i]
+			}
+		} else if entry.IsFile() && entry.Size > 0 {
+			isMissing := false
+			for i := entry.StartChunk; i <= entry.EndChunk; i++ {
+				if missingChunks[i] {
+					isMissing = true
+					break
+				}
+			}
+
+			if isMissing {
+				if !manager.resourceFile(top, entry, entryList, existingChunks) {
+					LOG_INFO("REPAIR_LOST", "Lost %s", entry.Path)
+					lostFiles = append(lostFiles, entry.Path)
+					snapshot.NumberOfFiles--
+					snapshot.FileSize -= entry.Size
+					if entry.IsHardLinkRoot() {
+						hardLinkRoots = append(hardLinkRoots, nil)
+						newHardLinkIDs = append(newHardLinkIDs, -1)
+					}
+					return true
+				}
+				resourcedFiles++
+			}
+		}
+
+		if entry.IsHardLinkRoot() {
+			hardLinkRoots = append(hardLinkRoots, entry)
+			newHardLinkIDs = append(newHardLinkIDs, numberOfHardLinkRoots)
+			numberOfHardLinkRoots++
+		}
+
+		err := entryList.AddEntry(entry)
+		if err != nil {
+			LOG_ERROR("REPAIR_LIST", "Failed to add %s to the entry list: %v", entry.Path, err)
+			isFailed = true
+			return false
+		}
+		return true
+	})
+
+	chunkOperator.WaitForCompletion()
+
+	if isFailed {
+		return nil, true, false
+	}
+
+	snapshot.ChunkHashes = append(entryList.PreservedChunkHashes, entryList.UploadedChunkHashes...)
+	snapshot.ChunkLengths = append(entryList.PreservedChunkLengths, entryList.UploadedChunkLengths...)
+
+	if snapshot.Tag != "" && snapshot.Tag != tag {
+		LOG_INFO("REPAIR_TAG", "The tag of snapshot %s at revision %d is changed from '%s' to '%s'", manager.snapshotID,
+			revision, snapshot.Tag, tag)
+	}
+	snapshot.Tag = tag
+
+	if manager.config.dryRun {
+		LOG_INFO("REPAIR_DRYRUN", "Snapshot %s at revision %d would be repaired; %d files re-sourced, %d files lost",
+			manager.snapshotID, revision, resourcedFiles, len(lostFiles))
+		return lostFiles, true, true
+	}
+
+	// The repaired snapshot replaces the revision it was loaded from
+	manager.UploadSnapshot(chunkOperator, top, snapshot, entryList, make(map[string]bool), 1024*1024, true)
+
+	LOG_INFO("REPAIR_END", "Snapshot %s at revision %d has been repaired; %d files re-sourced, %d files lost",
+		manager.snapshotID, revision, resourcedFiles, len(lostFiles))
+	return lostFiles, true, true
+}
+
+// resourceFile uploads the file under 'top' again in new chunks if its content is the same as the one recorded in
+// 'entry', in which case the chunks of 'entry' are updated to point to the new chunks.
+func (manager *BackupManager) resourceFile(top string, entry *Entry, entryList *EntryList, existingChunks *ChunkIndex) bool {
+
+	if top == "" || entry.Hash == "" || strings.HasPrefix(entry.Hash, "#") {
+		return false
+	}
+
+	fullPath := joinPath(top, entry.Path)
+	stat, err := os.Stat(fullPath)
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() != entry.Size {
+		return false
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		LOG_WARN("REPAIR_OPEN", "Failed to open %s: %v", fullPath, err)
+		return false
+	}
+	defer file.Close()
+
+	// Compute the hash first so that nothing is uploaded if the content has changed
+	hasher := manager.config.NewFileHasher()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		LOG_WARN("REPAIR_READ", "Failed to read %s: %v", fullPath, err)
+		return false
+	}
+	if !strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), entry.Hash) {
+		LOG_INFO("REPAIR_CHANGED", "%s has been changed and can't be used to repair the snapshot", entry.Path)
+		return false
+	}
+
+	if manager.config.dryRun {
+		LOG_INFO("REPAIR_RESOURCED", "%s would be re-sourced from %s", entry.Path, fullPath)
+		return true
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		LOG_WARN("REPAIR_READ", "Failed to read %s: %v", fullPath, err)
+		return false
+	}
+
+	chunkOperator := manager.SnapshotManager.chunkOperator
+	chunkOperator.UploadCompletionFunc = func(chunk *Chunk, chunkIndex int, inCache bool, chunkSize int, uploadSize int) {
+		manager.config.PutChunk(chunk)
+	}
+
+	uploadedChunkIndex := len(entryList.UploadedChunkHashes)
+	startChunk := len(entryList.PreservedChunkHashes) + uploadedChunkIndex
+	var chunkHashes []string
+	var chunkLengths []int
+	chunkMaker := CreateFileChunkMaker(manager.config, false)
+	uploadChunkFunc := func(chunk *Chunk) {
+		chunkHashes = append(chunkHashes, chunk.GetHash())
+		chunkLengths = append(chunkLengths, chunk.GetLength())
+		chunkOperator.Upload(chunk, startChunk+len(chunkHashes)-1, false)
+	}
+
+	fileSize, fileHash := chunkMaker.AddData(file, uploadChunkFunc)
+	chunkMaker.AddData(nil, uploadChunkFunc)
+
+	if fileSize != entry.Size || !strings.EqualFold(fileHash, entry.Hash) {
+		// The chunks already uploaded are left for prune to remove
+		LOG_WARN("REPAIR_CHANGED", "%s was changed while being uploaded", entry.Path)
+		return false
+	}
+
+	for i := range chunkHashes {
+		entryList.AddUploadedChunk(uploadedChunkIndex+i, chunkHashes[i], chunkLengths[i])
+		existingChunks.Add(manager.config.GetChunkIDFromHash(chunkHashes[i]), int64(chunkLengths[i]))
+	}
+
+	entry.StartChunk = startChunk
+	entry.StartOffset = 0
+	entry.EndChunk = startChunk + len(chunkHashes) - 1
+	entry.EndOffset = chunkLengths[len(chunkLengths)-1]
+
+	LOG_INFO("REPAIR_RESOURCED", "Re-sourced %s from %s", entry.Path, fullPath)
+	return true
+}
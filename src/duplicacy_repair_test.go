@@ -0,0 +1,144 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRepairSnapshots(t *testing.T) {
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not tested on Windows")
+	}
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir+"/repository1/dir1", 0700)
+	os.MkdirAll(testDir+"/repository1/.duplicacy", 0700)
+	os.MkdirAll(testDir+"/repository2/.duplicacy", 0700)
+
+	// Files are large enough to be split into several chunks
+	files := []string{"file1", "dir1/file2", "dir1/file3"}
+	for i, f := range files {
+		createRandomFileSeeded(testDir+"/repository1/"+f, 300000+i*1000, int64(i+1))
+	}
+	os.Link(testDir+"/repository1/file1", testDir+"/repository1/link1")
+	os.Link(testDir+"/repository1/dir1/file3", testDir+"/repository1/dir1/link3")
+
+	threads := 1
+	storage, err := loadStorage(testDir+"/storage", threads)
+	if err != nil {
+		t.Errorf("Failed to create storage: %v", err)
+		return
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0, 0) {
+		t.Errorf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository1/.duplicacy")
+	backupManager := CreateBackupManager("host1", storage, testDir, "", nil)
+	backupManager.SetupSnapshotCache("default")
+	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, true, threads, "first", false, false, 0, false, 1024, 1024)
+
+	// Remove a chunk of file1 and one of file3; either may be shared with other files
+	snapshotManager := backupManager.SnapshotManager
+	snapshot := snapshotManager.DownloadSnapshot("host1", 1)
+	snapshotManager.DownloadSnapshotSequences(snapshot)
+	snapshotManager.CreateChunkOperator(false, false, threads, false)
+	var chunksToDelete []string
+	snapshot.ListRemoteFiles(backupManager.config, snapshotManager.chunkOperator, func(entry *Entry) bool {
+		if entry.Path == "file1" {
+			chunksToDelete = append(chunksToDelete, snapshot.ChunkHashes[entry.EndChunk])
+		} else if entry.Path == "dir1/file3" {
+			chunksToDelete = append(chunksToDelete, snapshot.ChunkHashes[entry.StartChunk])
+		}
+		return true
+	})
+	snapshotManager.chunkOperator.Stop()
+	snapshotManager.chunkOperator = nil
+
+	if len(chunksToDelete) != 2 {
+		t.Fatalf("Expected 2 chunks to delete but found %d", len(chunksToDelete))
+	}
+	for _, chunkHash := range chunksToDelete {
+		chunkPath, exist, _, err := storage.FindChunk(0, backupManager.config.GetChunkIDFromHash(chunkHash), false)
+		if err != nil || !exist {
+			t.Fatalf("Failed to find the chunk to delete: %v", err)
+		}
+		storage.DeleteFile(0, chunkPath)
+	}
+
+	// file1 can't be re-sourced because it has been changed; file2 and file3 can
+	modifyFile(testDir+"/repository1/file1", 0.1)
+
+	lostFiles, unrepairedRevisions := backupManager.RepairSnapshots(testDir+"/repository1", nil, "repaired", threads)
+	if len(unrepairedRevisions) != 0 {
+		t.Errorf("Revisions %v couldn't be repaired", unrepairedRevisions)
+	}
+	sort.Strings(lostFiles[1])
+	if strings.Join(lostFiles[1], ",") != "file1,link1" {
+		t.Errorf("Lost files are %v instead of [file1 link1]", lostFiles[1])
+	}
+
+	snapshot = snapshotManager.DownloadSnapshot("host1", 1)
+	if snapshot.Tag != "repaired" {
+		t.Errorf("The repaired revision has the tag '%s'", snapshot.Tag)
+	}
+	if snapshot.NumberOfFiles != 3 {
+		t.Errorf("The repaired revision has %d files instead of 3", snapshot.NumberOfFiles)
+	}
+
+	// A second repair should find nothing to do
+	lostFiles, unrepairedRevisions = backupManager.RepairSnapshots(testDir+"/repository1", nil, "repaired", threads)
+	if len(lostFiles) != 0 || len(unrepairedRevisions) != 0 {
+		t.Errorf("Revisions %v were repaired again and revisions %v couldn't be repaired", lostFiles,
+			unrepairedRevisions)
+	}
+
+	if !snapshotManager.CheckSnapshots( /*snapshotID*/ "host1" /*revisions*/, []int{1} /*tag*/, "",
+		/*showStatistics*/ false /*showTabular*/, false /*checkFiles*/, true /*checkChunks*/, false,
+		/*searchFossils*/ false /*resurrect*/, false /*rewrite*/, false, 1 /*allowFailures*/, false /*verifyBudget*/, nil /*ledgerInStorage*/, false) {
+		t.Errorf("The repaired revision failed the check")
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository2/.duplicacy")
+	failedFiles := backupManager.Restore(testDir+"/repository2", 1, &RestoreOptions{
+		Threads:   threads,
+		Overwrite: true,
+	})
+	assertRestoreFailures(t, failedFiles, 0)
+
+	checkExistence(t, testDir+"/repository2/file1", false, false)
+	checkExistence(t, testDir+"/repository2/link1", false, false)
+	for _, f := range []string{"dir1/file2", "dir1/file3", "dir1/link3"} {
+		hash1 := getFileHash(testDir + "/repository1/" + f)
+		hash2 := getFileHash(testDir + "/repository2/" + f)
+		if hash1 != hash2 {
+			t.Errorf("File %s has different hashes: %s vs %s", f, hash1, hash2)
+		}
+	}
+
+	// A revision with a missing metadata chunk can't be repaired, which is reported instead of being ignored
+	chunkPath, exist, _, err := storage.FindChunk(0, backupManager.config.GetChunkIDFromHash(snapshot.FileSequence[0]),
+		false)
+	if err != nil || !exist {
+		t.Fatalf("Failed to find the metadata chunk: %v", err)
+	}
+	storage.DeleteFile(0, chunkPath)
+	lostFiles, unrepairedRevisions = backupManager.RepairSnapshots(testDir+"/repository1", nil, "repaired", threads)
+	if len(lostFiles) != 0 || len(unrepairedRevisions) != 1 || unrepairedRevisions[0] != 1 {
+		t.Errorf("Revisions %v were repaired and revisions %v couldn't be repaired", lostFiles, unrepairedRevisions)
+	}
+}
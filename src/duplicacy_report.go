@@ -0,0 +1,329 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// At most this many warnings and errors are included in a report; the rest are only counted.
+const maximumReportMessages = 100
+
+// RunReport summarizes the result of a command: what it ran on, the statistics of a backup, and the warnings and
+// errors logged.  It is passed to scripts and posted to the webhook configured for the storage.
+type RunReport struct {
+	Command    string `json:"command"`
+	Storage    string `json:"storage,omitempty"`
+	StorageURL string `json:"storage_url,omitempty"`
+	SnapshotID string `json:"snapshot_id,omitempty"`
+	Revision   int    `json:"revision,omitempty"`
+	StartTime  int64  `json:"start_time"`
+	EndTime    int64  `json:"end_time,omitempty"`
+	ExitCode   int    `json:"exit_code"`
+
+	Backup *BackupReport `json:"backup,omitempty"`
+	Check  *CheckReport  `json:"check,omitempty"`
+
+	NumberOfWarnings int             `json:"number_of_warnings"`
+	NumberOfErrors   int             `json:"number_of_errors"`
+	Messages         []ReportMessage `json:"messages"`
+
+	webhookURL       string
+	metricsDirectory string
+	finished         bool
+}
+
+// BackupReport contains the statistics of a backup, the same numbers shown by 'backup -stats'.
+type BackupReport struct {
+	Files                      int64 `json:"files"`
+	FileBytes                  int64 `json:"file_bytes"`
+	NewFiles                   int64 `json:"new_files"`
+	NewFileBytes               int64 `json:"new_file_bytes"`
+	SkippedDirectories         int   `json:"skipped_directories"`
+	SkippedFiles               int   `json:"skipped_files"`
+	FileChunks                 int64 `json:"file_chunks"`
+	FileChunkBytes             int64 `json:"file_chunk_bytes"`
+	NewFileChunks              int64 `json:"new_file_chunks"`
+	NewFileChunkBytes          int64 `json:"new_file_chunk_bytes"`
+	UploadedFileChunkBytes     int64 `json:"uploaded_file_chunk_bytes"`
+	MetadataChunks             int64 `json:"metadata_chunks"`
+	MetadataChunkBytes         int64 `json:"metadata_chunk_bytes"`
+	NewMetadataChunks          int64 `json:"new_metadata_chunks"`
+	NewMetadataChunkBytes      int64 `json:"new_metadata_chunk_bytes"`
+	UploadedMetadataChunkBytes int64 `json:"uploaded_metadata_chunk_bytes"`
+}
+
+// CheckReport contains the size of the storage found by a check.  The statistics of each snapshot id are only
+// available if the check is run with -stats or -tabular.
+type CheckReport struct {
+	Revisions  int                        `json:"revisions"`
+	Chunks     int64                      `json:"chunks"`
+	ChunkBytes int64                      `json:"chunk_bytes"`
+	Snapshots  map[string]*SnapshotReport `json:"snapshots,omitempty"`
+}
+
+// SnapshotReport contains the statistics of all revisions of a snapshot id, as shown by 'check -stats'.
+type SnapshotReport struct {
+	Revisions          int   `json:"revisions"`
+	LatestRevision     int   `json:"latest_revision"`
+	LatestRevisionTime int64 `json:"latest_revision_time"`
+	Files              int64 `json:"files"`
+	FileBytes          int64 `json:"file_bytes"`
+	Chunks             int64 `json:"chunks"`
+	ChunkBytes         int64 `json:"chunk_bytes"`
+	UniqueChunks       int64 `json:"unique_chunks"`
+	UniqueChunkBytes   int64 `json:"unique_chunk_bytes"`
+}
+
+// ReportMessage is a warning or an error logged while the command was running.
+type ReportMessage struct {
+	Time    int64  `json:"time"`
+	Level   string `json:"level"`
+	LogID   string `json:"log_id"`
+	Message string `json:"message"`
+}
+
+var runReport *RunReport
+var runReportLock sync.Mutex
+
+// reportFunction, if set, is called by FinishRunReport with the finished report, before it is posted to the webhook.
+var reportFunction func(report *RunReport)
+
+// StartRunReport starts collecting the report of 'command'.  Metrics are written to the directory given by the
+// environment variable DUPLICACY_METRICS_DIR, unless the storage has its own directory.
+func StartRunReport(command string) {
+	runReportLock.Lock()
+	defer runReportLock.Unlock()
+	runReport = &RunReport{
+		Command:          command,
+		StartTime:        time.Now().Unix(),
+		Messages:         []ReportMessage{},
+		metricsDirectory: os.Getenv("DUPLICACY_METRICS_DIR"),
+	}
+}
+
+// SetRunReportPreference records the storage and the snapshot id the command runs on.  The webhook URL is read from
+// the preference key 'report_webhook', or from the file or command given by 'report_webhook_file' or
+// 'report_webhook_command'.  The preference key 'metrics_dir' sets the directory to write metrics to.
+func SetRunReportPreference(preference Preference) {
+	webhookURL := getCredentialFromPreference(preference, "report_webhook")
+
+	runReportLock.Lock()
+	defer runReportLock.Unlock()
+	if runReport == nil {
+		return
+	}
+	runReport.Storage = preference.Name
+	runReport.StorageURL = preference.StorageURL
+	runReport.SnapshotID = preference.SnapshotID
+	runReport.webhookURL = webhookURL
+	if directory := preference.Keys["metrics_dir"]; directory != "" {
+		runReport.metricsDirectory = directory
+	}
+}
+
+// setRunReportBackup records the revision created by a backup and its statistics.
+func setRunReportBackup(revision int, backup *BackupReport) {
+	runReportLock.Lock()
+	defer runReportLock.Unlock()
+	if runReport == nil {
+		return
+	}
+	runReport.Revision = revision
+	runReport.Backup = backup
+}
+
+// setRunReportCheck records the number of revisions and the total size of chunks found by a check.
+func setRunReportCheck(revisions int, chunks int64, chunkBytes int64) {
+	runReportLock.Lock()
+	defer runReportLock.Unlock()
+	if runReport == nil {
+		return
+	}
+	runReport.Check = &CheckReport{
+		Revisions:  revisions,
+		Chunks:     chunks,
+		ChunkBytes: chunkBytes,
+	}
+}
+
+// setRunReportSnapshot records the statistics of the snapshot id 'snapshotID' whose revisions are 'snapshotList'.
+func setRunReportSnapshot(snapshotID string, snapshotList []*Snapshot, chunks int64, chunkBytes int64,
+	uniqueChunks int64, uniqueChunkBytes int64) {
+
+	snapshotReport := &SnapshotReport{
+		Revisions:        len(snapshotList),
+		Chunks:           chunks,
+		ChunkBytes:       chunkBytes,
+		UniqueChunks:     uniqueChunks,
+		UniqueChunkBytes: uniqueChunkBytes,
+	}
+	for _, snapshot := range snapshotList {
+		if snapshot.Revision > snapshotReport.LatestRevision {
+			snapshotReport.LatestRevision = snapshot.Revision
+			snapshotReport.LatestRevisionTime = snapshot.StartTime
+			snapshotReport.Files = snapshot.NumberOfFiles
+			snapshotReport.FileBytes = snapshot.FileSize
+		}
+	}
+
+	runReportLock.Lock()
+	defer runReportLock.Unlock()
+	if runReport == nil || runReport.Check == nil {
+		return
+	}
+	if runReport.Check.Snapshots == nil {
+		runReport.Check.Snapshots = make(map[string]*SnapshotReport)
+	}
+	runReport.Check.Snapshots[snapshotID] = snapshotReport
+}
+
+// recordReportMessage is called by logf for every log message.  Only warnings and errors go to the report.
+func recordReportMessage(level int, logID string, message string) {
+	if level < WARN {
+		return
+	}
+
+	runReportLock.Lock()
+	defer runReportLock.Unlock()
+	if runReport == nil || runReport.finished {
+		return
+	}
+
+	if level == WARN {
+		runReport.NumberOfWarnings++
+	} else {
+		runReport.NumberOfErrors++
+	}
+	if len(runReport.Messages) < maximumReportMessages {
+		runReport.Messages = append(runReport.Messages, ReportMessage{
+			Time:    time.Now().Unix(),
+			Level:   getLevelName(level),
+			LogID:   logID,
+			Message: message,
+		})
+	}
+}
+
+// GetRunReport returns a copy of the current report as if the command completed now with 'exitCode', or nil if no
+// report has been started.
+func GetRunReport(exitCode int) *RunReport {
+	runReportLock.Lock()
+	defer runReportLock.Unlock()
+	if runReport == nil {
+		return nil
+	}
+
+	report := *runReport
+	report.Messages = append([]ReportMessage{}, runReport.Messages...)
+	if !report.finished {
+		report.EndTime = time.Now().Unix()
+		report.ExitCode = exitCode
+	}
+	return &report
+}
+
+// FinishRunReport completes the report with 'exitCode', passes it to reportFunction, posts it to the webhook and writes
+// its metrics.  Only the first call has any effect.
+func FinishRunReport(exitCode int) {
+
+	runReportLock.Lock()
+	if runReport == nil || runReport.finished {
+		runReportLock.Unlock()
+		return
+	}
+	runReport.EndTime = time.Now().Unix()
+	runReport.ExitCode = exitCode
+	runReport.finished = true
+	report := *runReport
+	runReportLock.Unlock()
+
+	if reportFunction != nil {
+		reportFunction(&report)
+	}
+
+	if report.webhookURL != "" {
+		err := report.Post(report.webhookURL)
+		if err != nil {
+			LOG_WARN("REPORT_WEBHOOK", "Failed to post the report to the webhook: %v", err)
+		} else {
+			LOG_DEBUG("REPORT_WEBHOOK", "Posted the report to the webhook")
+		}
+	}
+
+	if report.metricsDirectory != "" && report.Storage != "" {
+		err := WriteMetrics(&report, report.metricsDirectory)
+		if err != nil {
+			LOG_WARN("REPORT_METRICS", "Failed to write the metrics to %s: %v", report.metricsDirectory, err)
+		}
+	}
+}
+
+// Post sends the report as JSON to 'url'.
+func (report *RunReport) Post(url string) error {
+
+	description, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Post(url, "application/json", bytes.NewReader(description))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("the webhook returned %s", response.Status)
+	}
+	return nil
+}
+
+// WriteFile saves the report as JSON to a temporary file and returns its path.  The caller should remove the file when
+// done with it.
+func (report *RunReport) WriteFile() (filePath string, err error) {
+
+	description, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp("", "dupluxy-report-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = file.Write(description)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// GetEnvironment returns the main fields of the report as environment variables for scripts.  'filePath' is the path
+// of the report written by WriteFile.
+func (report *RunReport) GetEnvironment(filePath string) []string {
+	return []string{
+		"DUPLICACY_REPORT=" + filePath,
+		"DUPLICACY_REPORT_COMMAND=" + report.Command,
+		"DUPLICACY_REPORT_STORAGE=" + report.Storage,
+		"DUPLICACY_REPORT_SNAPSHOT_ID=" + report.SnapshotID,
+		"DUPLICACY_REPORT_REVISION=" + strconv.Itoa(report.Revision),
+		"DUPLICACY_REPORT_EXIT_CODE=" + strconv.Itoa(report.ExitCode),
+		"DUPLICACY_REPORT_WARNINGS=" + strconv.Itoa(report.NumberOfWarnings),
+		"DUPLICACY_REPORT_ERRORS=" + strconv.Itoa(report.NumberOfErrors),
+		"DUPLICACY_REPORT_DURATION=" + strconv.FormatInt(report.EndTime-report.StartTime, 10),
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunReport(t *testing.T) {
+	setTestingT(t)
+
+	var posted []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("The report was posted as %s", r.Header.Get("Content-Type"))
+		}
+		posted, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	defer func() {
+		runReport = nil
+	}()
+
+	StartRunReport("backup")
+	SetRunReportPreference(Preference{
+		Name:       "offsite",
+		SnapshotID: "host1",
+		StorageURL: "s3://offsite",
+		Keys:       map[string]string{"report_webhook": server.URL},
+	})
+
+	LOG_WARN("SKIP_FILE", "File a cannot be opened")
+	LOG_WARN("SKIP_FILE", "File b cannot be opened")
+	LOG_INFO("BACKUP_END", "Backup completed")
+	setRunReportBackup(3, &BackupReport{Files: 10, NewFiles: 2, UploadedFileChunkBytes: 4096})
+
+	// Scripts see the report as it is before the command completes
+	report := GetRunReport(0)
+	filePath, err := report.WriteFile()
+	if err != nil {
+		t.Fatalf("Failed to write the report: %v", err)
+	}
+	defer os.Remove(filePath)
+
+	environment := strings.Join(report.GetEnvironment(filePath), "\n")
+	for _, variable := range []string{"DUPLICACY_REPORT=" + filePath, "DUPLICACY_REPORT_STORAGE=offsite",
+		"DUPLICACY_REPORT_REVISION=3", "DUPLICACY_REPORT_WARNINGS=2", "DUPLICACY_REPORT_EXIT_CODE=0"} {
+		if !strings.Contains(environment, variable+"\n") {
+			t.Errorf("The environment variable %s is missing", variable)
+		}
+	}
+
+	var finished *RunReport
+	reportFunction = func(report *RunReport) {
+		finished = report
+	}
+	defer func() {
+		reportFunction = nil
+	}()
+
+	FinishRunReport(duplicacyExitCode)
+	FinishRunReport(0)
+	if finished == nil || finished.ExitCode != duplicacyExitCode {
+		t.Errorf("The finished report is %+v", finished)
+	}
+
+	var received RunReport
+	err = json.Unmarshal(posted, &received)
+	if err != nil {
+		t.Fatalf("Failed to parse the posted report '%s': %v", posted, err)
+	}
+	if received.Command != "backup" || received.SnapshotID != "host1" || received.Revision != 3 ||
+		received.ExitCode != duplicacyExitCode || received.Backup == nil || received.Backup.NewFiles != 2 {
+		t.Errorf("The posted report is %+v", received)
+	}
+	if len(received.Messages) != 2 || received.Messages[0].LogID != "SKIP_FILE" || received.Messages[0].Level != "WARN" {
+		t.Errorf("The posted report has the messages %+v", received.Messages)
+	}
+
+	// Logs after the command has completed aren't added
+	LOG_WARN("REPORT_TEST", "Late warning")
+	if report := GetRunReport(0); report.NumberOfWarnings != 2 {
+		t.Errorf("The report has %d warnings", report.NumberOfWarnings)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Calendar buckets in the order they are reported.  The 'last' bucket holds one snapshot each.
+var calendarBuckets = []string{"last", "hourly", "daily", "weekly", "monthly", "yearly"}
+
+var calendarRuleRegex = regexp.MustCompile(`^(last|hourly|daily|weekly|monthly|yearly):([0-9]+|all)$`)
+var withinRuleRegex = regexp.MustCompile(`^within:(?:([0-9]+)y)?(?:([0-9]+)m)?(?:([0-9]+)w)?(?:([0-9]+)d)?(?:([0-9]+)h)?$`)
+var tagRuleRegex = regexp.MustCompile(`^tag:(.+)$`)
+
+// calendarRetention is a grandfather-father-son retention policy.  For each bucket, the most recent snapshot in
+// each of the latest 'count' hours, days, weeks (starting on Mondays), months, or years that have snapshots is
+// kept, where the calendar boundaries are determined in the time zone 'location'.  Snapshots created within the
+// specified period or with one of the specified tags are always kept.  Any other snapshots are to be deleted.
+type calendarRetention struct {
+	counts map[string]int // number of snapshots to keep for each bucket; -1 means all
+
+	withinYears, withinMonths, withinDays, withinHours int
+	within                                             string
+
+	tags map[string]bool
+
+	location *time.Location
+}
+
+// isCalendarRetention returns true if 'retention' is a rule of a calendar retention policy rather than in the
+// 'interval:age' form.
+func isCalendarRetention(retention string) bool {
+	return calendarRuleRegex.MatchString(retention) || strings.HasPrefix(retention, "within:") ||
+		strings.HasPrefix(retention, "tag:")
+}
+
+// parseCalendarRetention parses rules such as 'daily:14', 'weekly:8', 'monthly:24', 'yearly:all', 'last:3',
+// 'within:1m15d', and 'tag:important'.  The rules are evaluated in 'location', or in the local time zone if it is nil.
+func parseCalendarRetention(retentions []string, location *time.Location) (*calendarRetention, error) {
+
+	if location == nil {
+		location = time.Local
+	}
+
+	policy := &calendarRetention{
+		counts:   make(map[string]int),
+		tags:     make(map[string]bool),
+		location: location,
+	}
+
+	for _, retention := range retentions {
+		retention = strings.TrimSpace(retention)
+
+		if matched := calendarRuleRegex.FindStringSubmatch(retention); matched != nil {
+			if _, found := policy.counts[matched[1]]; found {
+				return nil, fmt.Errorf("the %s rule is specified more than once", matched[1])
+			}
+			count := -1
+			if matched[2] != "all" {
+				count, _ = strconv.Atoi(matched[2])
+			}
+			policy.counts[matched[1]] = count
+		} else if matched := withinRuleRegex.FindStringSubmatch(retention); matched != nil && retention != "within:" {
+			if policy.within != "" {
+				return nil, fmt.Errorf("the within rule is specified more than once")
+			}
+			values := make([]int, 5)
+			for i := range values {
+				values[i], _ = strconv.Atoi(matched[i+1])
+			}
+			policy.withinYears, policy.withinMonths = values[0], values[1]
+			policy.withinDays, policy.withinHours = values[2]*7+values[3], values[4]
+			policy.within = strings.TrimPrefix(retention, "within:")
+		} else if matched := tagRuleRegex.FindStringSubmatch(retention); matched != nil {
+			policy.tags[matched[1]] = true
+		} else {
+			return nil, fmt.Errorf("invalid retention rule '%s'", retention)
+		}
+	}
+
+	return policy, nil
+}
+
+// describe returns a list of human readable descriptions of the rules.
+func (policy *calendarRetention) describe() (descriptions []string) {
+	for _, bucket := range calendarBuckets {
+		count, found := policy.counts[bucket]
+		if !found {
+			continue
+		}
+		if count < 0 {
+			descriptions = append(descriptions, fmt.Sprintf("Keep all %s snapshots", bucket))
+		} else if bucket == "last" {
+			descriptions = append(descriptions, fmt.Sprintf("Keep the last %d snapshots", count))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("Keep the last %d %s snapshots", count, bucket))
+		}
+	}
+
+	if policy.within != "" {
+		descriptions = append(descriptions, fmt.Sprintf("Keep all snapshots created within %s", policy.within))
+	}
+
+	var tags []string
+	for tag := range policy.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		descriptions = append(descriptions, fmt.Sprintf("Keep all snapshots with the tag '%s'", tag))
+	}
+	return descriptions
+}
+
+// getBucketKey returns the calendar period that 'startTime' falls in for the given bucket.
+func getBucketKey(bucket string, startTime int64, revision int, location *time.Location) string {
+	t := time.Unix(startTime, 0).In(location)
+	switch bucket {
+	case "hourly":
+		return t.Format("2006-01-02 15")
+	case "daily":
+		return t.Format("2006-01-02")
+	case "weekly":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case "monthly":
+		return t.Format("2006-01")
+	case "yearly":
+		return t.Format("2006")
+	default:
+		return strconv.Itoa(revision)
+	}
+}
+
+// apply returns the reasons for keeping each snapshot, where 'snapshots' must be sorted by revision.  A snapshot
+// with no reasons should be deleted.
+func (policy *calendarRetention) apply(snapshots []*Snapshot, now time.Time) (reasons [][]string) {
+
+	reasons = make([][]string, len(snapshots))
+
+	// Go through the snapshots from the newest to the oldest
+	for _, bucket := range calendarBuckets {
+		count, found := policy.counts[bucket]
+		if !found {
+			continue
+		}
+
+		kept := 0
+		lastKey := ""
+		for i := len(snapshots) - 1; i >= 0 && (count < 0 || kept < count); i-- {
+			key := getBucketKey(bucket, snapshots[i].StartTime, snapshots[i].Revision, policy.location)
+			if kept > 0 && key == lastKey {
+				continue
+			}
+			kept++
+			lastKey = key
+			if count < 0 {
+				reasons[i] = append(reasons[i], fmt.Sprintf("%s (%s)", bucket, key))
+			} else {
+				reasons[i] = append(reasons[i], fmt.Sprintf("%s %d/%d (%s)", bucket, kept, count, key))
+			}
+		}
+	}
+
+	if policy.within != "" {
+		threshold := now.In(policy.location).AddDate(-policy.withinYears, -policy.withinMonths, -policy.withinDays).
+			Add(-time.Duration(policy.withinHours) * time.Hour).Unix()
+		for i, snapshot := range snapshots {
+			if snapshot.StartTime >= threshold {
+				reasons[i] = append(reasons[i], "within "+policy.within)
+			}
+		}
+	}
+
+	for i, snapshot := range snapshots {
+		if policy.tags[snapshot.Tag] {
+			reasons[i] = append(reasons[i], "tag "+snapshot.Tag)
+		}
+	}
+
+	return reasons
+}
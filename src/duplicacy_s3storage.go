@@ -10,8 +10,14 @@
 package duplicacy
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -27,6 +33,11 @@ type S3Storage struct {
 	bucket          string
 	storageDir      string
 	numberOfThreads int
+
+	objectLockMode      string        // S3 Object Lock mode (GOVERNANCE or COMPLIANCE)
+	objectLockRetention time.Duration // How long chunks and snapshot files are locked after being uploaded
+	objectLockEnabled   bool          // If Object Lock is enabled on the bucket
+	objectLockOnce      sync.Once
 }
 
 // CreateS3Storage creates a amazon s3 storage object.
@@ -130,6 +141,47 @@ func (storage *S3Storage) ListFiles(threadIndex int, dir string) (files []string
 
 }
 
+// ListFilesWithChecksums returns all files under 'dir' with their sizes and checksums.  The ETag of an object is the
+// MD5 of its content only if it was uploaded in a single part and not encrypted with SSE-KMS or SSE-C; ETags that
+// are not in the form of an MD5 are ignored.
+func (storage *S3Storage) ListFilesWithChecksums(threadIndex int, dir string) (files []string, sizes []int64, checksums []string, err error) {
+	if len(dir) > 0 && dir[len(dir)-1] != '/' {
+		dir += "/"
+	}
+
+	dir = storage.storageDir + dir
+	input := s3.ListObjectsV2Input{
+		Bucket:  aws.String(storage.bucket),
+		Prefix:  aws.String(dir),
+		MaxKeys: aws.Int64(1000),
+	}
+
+	err = storage.client.ListObjectsV2Pages(&input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			files = append(files, (*object.Key)[len(dir):])
+			sizes = append(sizes, *object.Size)
+
+			checksum := ""
+			etag := strings.ToLower(strings.Trim(aws.StringValue(object.ETag), "\""))
+			if len(etag) == 32 && !strings.Contains(etag, "-") {
+				checksum = "md5:" + etag
+			}
+			checksums = append(checksums, checksum)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return files, sizes, checksums, nil
+}
+
+// ComputeChecksum returns the MD5 of the content, which is what the ETag of an object uploaded by UploadFile is.
+func (storage *S3Storage) ComputeChecksum(content []byte) string {
+	digest := md5.Sum(content)
+	return "md5:" + hex.EncodeToString(digest[:])
+}
+
 // DeleteFile deletes the file or directory at 'filePath'.
 func (storage *S3Storage) DeleteFile(threadIndex int, filePath string) (err error) {
 	input := &s3.DeleteObjectInput{
@@ -209,6 +261,31 @@ func (storage *S3Storage) DownloadFile(threadIndex int, filePath string, chunk *
 
 // UploadFile writes 'content' to the file at 'filePath'.
 func (storage *S3Storage) UploadFile(threadIndex int, filePath string, content []byte) (err error) {
+	return storage.putObject(filePath, content, false)
+}
+
+// UploadFileIfNotExist uploads the file with the 'If-None-Match: *' header, which makes S3 reject the upload if the
+// object already exists.  S3 compatible services that don't support conditional writes are checked before the upload
+// instead.  As with GCS, a retry of an upload that succeeded finds the object existing.
+func (storage *S3Storage) UploadFileIfNotExist(threadIndex int, filePath string, content []byte) (exist bool, err error) {
+	err = storage.putObject(filePath, content, true)
+	if e, ok := err.(awserr.RequestFailure); ok {
+		switch {
+		case e.StatusCode() == 412 || e.StatusCode() == 409:
+			// 409 means another conditional upload of the same object is in progress
+			return true, nil
+		case e.StatusCode() == 501 || e.Code() == "NotImplemented":
+			exist, _, _, err = storage.GetFileInfo(threadIndex, filePath)
+			if err != nil || exist {
+				return exist, err
+			}
+			return false, storage.putObject(filePath, content, false)
+		}
+	}
+	return false, err
+}
+
+func (storage *S3Storage) putObject(filePath string, content []byte, ifNotExist bool) (err error) {
 
 	attempts := 0
 
@@ -221,7 +298,19 @@ func (storage *S3Storage) UploadFile(threadIndex int, filePath string, content [
 			ContentType: aws.String("application/duplicacy"),
 		}
 
-		_, err = storage.client.PutObject(input)
+		if storage.objectLockRetention > 0 && isObjectLockRequired(filePath) {
+			// Object Lock requires the Content-MD5 header
+			digest := md5.Sum(content)
+			input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(digest[:]))
+			input.ObjectLockMode = aws.String(storage.objectLockMode)
+			input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(storage.objectLockRetention))
+		}
+
+		request, _ := storage.client.PutObjectRequest(input)
+		if ifNotExist {
+			request.HTTPRequest.Header.Set("If-None-Match", "*")
+		}
+		err = request.Send()
 		if err == nil || attempts >= 3 || !strings.Contains(err.Error(), "XAmzContentSHA256Mismatch") {
 			return err
 		}
@@ -231,6 +320,62 @@ func (storage *S3Storage) UploadFile(threadIndex int, filePath string, content [
 	}
 }
 
+// SetObjectLock makes chunks and snapshot files uploaded afterwards locked for 'retention' with S3 Object Lock, which
+// must have been enabled when the bucket was created.
+func (storage *S3Storage) SetObjectLock(mode string, retention time.Duration) (err error) {
+	mode = strings.ToUpper(mode)
+	if mode != s3.ObjectLockModeGovernance && mode != s3.ObjectLockModeCompliance {
+		return fmt.Errorf("invalid object lock mode '%s'", mode)
+	}
+
+	if !storage.IsObjectLockEnabled() {
+		return fmt.Errorf("Object Lock is not enabled on the bucket %s", storage.bucket)
+	}
+
+	storage.objectLockMode = mode
+	storage.objectLockRetention = retention
+	return nil
+}
+
+// IsObjectLockEnabled returns true if Object Lock is enabled on the bucket.
+func (storage *S3Storage) IsObjectLockEnabled() bool {
+	storage.objectLockOnce.Do(func() {
+		input := &s3.GetObjectLockConfigurationInput{
+			Bucket: aws.String(storage.bucket),
+		}
+		output, err := storage.client.GetObjectLockConfiguration(input)
+		if err != nil {
+			LOG_DEBUG("S3_LOCK", "Failed to get the object lock configuration: %v", err)
+			return
+		}
+		storage.objectLockEnabled = output.ObjectLockConfiguration != nil &&
+			aws.StringValue(output.ObjectLockConfiguration.ObjectLockEnabled) == s3.ObjectLockEnabledEnabled
+	})
+	return storage.objectLockEnabled
+}
+
+// GetObjectLockExpiry returns the retention date of the current version of the file at 'filePath'.
+func (storage *S3Storage) GetObjectLockExpiry(threadIndex int, filePath string) (expiry time.Time, err error) {
+	input := &s3.GetObjectRetentionInput{
+		Bucket: aws.String(storage.bucket),
+		Key:    aws.String(storage.storageDir + filePath),
+	}
+
+	output, err := storage.client.GetObjectRetention(input)
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == "NoSuchObjectLockConfiguration" {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	if output.Retention == nil || output.Retention.RetainUntilDate == nil ||
+		!output.Retention.RetainUntilDate.After(time.Now()) {
+		return time.Time{}, nil
+	}
+	return *output.Retention.RetainUntilDate, nil
+}
+
 // If a local snapshot cache is needed for the storage to avoid downloading/uploading chunks too often when
 // managing snapshots.
 func (storage *S3Storage) IsCacheNeeded() bool { return true }
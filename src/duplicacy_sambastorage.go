@@ -223,7 +223,10 @@ func (storage *SambaStorage) UploadFile(threadIndex int, filePath string, conten
 	if err != nil {
 
 		if _, e := storage.share.Stat(fullPath); e == nil {
-			storage.share.Remove(temporaryFile)
+			// In the append-only mode the temporary file is left for prune to remove
+			if !storage.IsAppendOnly() {
+				storage.share.Remove(temporaryFile)
+			}
 			return nil
 		} else {
 			return err
@@ -0,0 +1,309 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gilbertchen/gopass"
+)
+
+// The encrypted secrets store is kept under this name next to the preferences file.
+const secretsFile = "secrets"
+
+// The credential name of the passphrase that seals the secrets store.  It is looked up in the environment variables
+// DUPLICACY_SECRETS_PASSPHRASE, DUPLICACY_SECRETS_PASSPHRASE_FILE (which is how a key file is specified) and
+// DUPLICACY_SECRETS_PASSPHRASE_COMMAND, and as the systemd credential 'secrets_passphrase'.
+const secretsPassphraseName = "secrets_passphrase"
+
+// SecretStore holds passwords and tokens that would otherwise be stored in plaintext in the preference keys.  It is
+// saved encrypted with a key derived from a passphrase, in the same format as an encrypted config file.  Secrets
+// are named like preference keys, e.g. 'password' or 'offsite_s3_secret'.
+type SecretStore struct {
+	Secrets map[string]*Secret `json:"secrets"`
+
+	passphrase string
+}
+
+// Secret is a value in the secrets store.
+type Secret struct {
+	Value      string `json:"value"`
+	ModifiedAt int64  `json:"modified_at"`
+}
+
+// The secrets store loaded by GetPasswordFromPreference or GetPassword, which is only unlocked once per process.
+var loadedSecretStore *SecretStore
+var secretStoreLoaded bool
+var secretStoreLock sync.Mutex
+
+func getSecretStorePath() string {
+	if preferencePath == "" {
+		return ""
+	}
+	return path.Join(preferencePath, secretsFile)
+}
+
+// SecretStoreExists returns true if the repository has a secrets store.
+func SecretStoreExists() bool {
+	filePath := getSecretStorePath()
+	if filePath == "" {
+		return false
+	}
+	_, err := os.Stat(filePath)
+	return err == nil
+}
+
+// GetSecretsPassphrase returns the passphrase of the secrets store from the credential sources, or prompts for it
+// with 'prompt' if it isn't found there and the process is not running in the background.
+func GetSecretsPassphrase(prompt string) string {
+	name := "DUPLICACY_SECRETS_PASSPHRASE"
+	if passphrase := getCredentialFromEnvironment(name, ""); passphrase != "" {
+		return passphrase
+	}
+	if filePath := getCredentialFromEnvironment(name, "_FILE"); filePath != "" {
+		return readCredentialFile(filePath)
+	}
+	if command := getCredentialFromEnvironment(name, "_COMMAND"); command != "" {
+		return runCredentialCommand(command)
+	}
+	if passphrase := getCredentialFromSystemd(secretsPassphraseName); passphrase != "" {
+		return passphrase
+	}
+
+	if RunInBackground || prompt == "" {
+		return ""
+	}
+
+	fmt.Printf("%s", prompt)
+	passphrase, err := gopass.GetPasswdMasked()
+	if err != nil {
+		LOG_ERROR("SECRETS_PASSPHRASE", "Failed to read the passphrase: %v", err)
+		return ""
+	}
+	return string(passphrase)
+}
+
+// OpenSecretStore decrypts the secrets store of the repository with 'passphrase'.  An empty store is returned if the
+// repository doesn't have one yet.
+func OpenSecretStore(passphrase string) (store *SecretStore, err error) {
+
+	store = &SecretStore{
+		Secrets:    make(map[string]*Secret),
+		passphrase: passphrase,
+	}
+
+	filePath := getSecretStorePath()
+	if filePath == "" {
+		return nil, fmt.Errorf("the preference path has not been set")
+	}
+
+	encrypted, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+
+	if len(encrypted) < len(CONFIG_BANNER)+CONFIG_SALT_LENGTH+4 || string(encrypted[:len(CONFIG_BANNER)]) != CONFIG_BANNER {
+		return nil, fmt.Errorf("the secrets file %s has an invalid banner", filePath)
+	}
+
+	// The format is CONFIG_BANNER + salt + #iterations + encrypted content, the same as an encrypted config file
+	salt := encrypted[len(CONFIG_BANNER) : len(CONFIG_BANNER)+CONFIG_SALT_LENGTH]
+	iterations := binary.LittleEndian.Uint32(encrypted[len(CONFIG_BANNER)+CONFIG_SALT_LENGTH:])
+	masterKey := GenerateKeyFromPassword(passphrase, salt, int(iterations))
+
+	chunk := CreateChunk(CreateConfig(), true)
+	chunk.Write([]byte(ENCRYPTION_BANNER))
+	chunk.Write(encrypted[len(CONFIG_BANNER)+CONFIG_SALT_LENGTH+4:])
+	err, _ = chunk.Decrypt(masterKey, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the secrets file %s; the passphrase may be incorrect", filePath)
+	}
+
+	err = json.Unmarshal(chunk.GetBytes(), store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the secrets file %s: %v", filePath, err)
+	}
+	if store.Secrets == nil {
+		store.Secrets = make(map[string]*Secret)
+	}
+	return store, nil
+}
+
+// SetPassphrase changes the passphrase used to encrypt the store when it is saved next time.
+func (store *SecretStore) SetPassphrase(passphrase string) {
+	store.passphrase = passphrase
+}
+
+// Save encrypts the store and writes it next to the preferences file.  The file is replaced atomically so an
+// interrupted save never leaves a corrupted store.
+func (store *SecretStore) Save() error {
+
+	if len(store.passphrase) < 8 {
+		return fmt.Errorf("the passphrase must be at least 8 characters")
+	}
+
+	filePath := getSecretStorePath()
+	if filePath == "" {
+		return fmt.Errorf("the preference path has not been set")
+	}
+
+	description, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, CONFIG_SALT_LENGTH)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	masterKey := GenerateKeyFromPassword(store.passphrase, salt, CONFIG_DEFAULT_ITERATIONS)
+
+	chunk := CreateChunk(CreateConfig(), true)
+	chunk.Write(description)
+	err = chunk.Encrypt(masterKey, "", true)
+	if err != nil {
+		return err
+	}
+
+	var encrypted bytes.Buffer
+	encrypted.Write([]byte(CONFIG_BANNER))
+	encrypted.Write(salt)
+	binary.Write(&encrypted, binary.LittleEndian, uint32(CONFIG_DEFAULT_ITERATIONS))
+	encrypted.Write(chunk.GetBytes()[len(ENCRYPTION_BANNER):])
+
+	temporaryPath := filePath + ".tmp"
+	err = os.WriteFile(temporaryPath, encrypted.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, filePath)
+}
+
+// Get returns the value of the secret 'name'.
+func (store *SecretStore) Get(name string) (value string, found bool) {
+	secret, found := store.Secrets[name]
+	if !found {
+		return "", false
+	}
+	return secret.Value, true
+}
+
+// Set adds the secret 'name' or replaces its value.
+func (store *SecretStore) Set(name string, value string) {
+	store.Secrets[name] = &Secret{Value: value, ModifiedAt: time.Now().Unix()}
+}
+
+// Remove deletes the secret 'name' and returns false if it doesn't exist.
+func (store *SecretStore) Remove(name string) bool {
+	if _, found := store.Secrets[name]; !found {
+		return false
+	}
+	delete(store.Secrets, name)
+	return true
+}
+
+// List returns the names of all secrets in sorted order.
+func (store *SecretStore) List() (names []string) {
+	for name := range store.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getUnlockedSecretStore returns the secrets store of the repository, unlocking it on the first call.  Unless
+// 'interactive' is true, the store is only unlocked with a passphrase from the credential sources and never by
+// prompting for it, and a later interactive call can still unlock it.  Returns nil if there is no store or it can't
+// be unlocked.
+func getUnlockedSecretStore(interactive bool) *SecretStore {
+
+	secretStoreLock.Lock()
+	defer secretStoreLock.Unlock()
+
+	if secretStoreLoaded {
+		return loadedSecretStore
+	}
+
+	if !SecretStoreExists() {
+		return nil
+	}
+
+	prompt := ""
+	if interactive {
+		prompt = "Enter the passphrase of the secrets store:"
+	}
+	passphrase := GetSecretsPassphrase(prompt)
+	if passphrase == "" {
+		if interactive {
+			secretStoreLoaded = true
+			LOG_WARN("SECRETS_LOCKED", "The secrets store can't be unlocked without a passphrase")
+		}
+		return nil
+	}
+	secretStoreLoaded = true
+
+	store, err := OpenSecretStore(passphrase)
+	if err != nil {
+		LOG_ERROR("SECRETS_OPEN", "Failed to open the secrets store: %v", err)
+		return nil
+	}
+	loadedSecretStore = store
+	return store
+}
+
+// getSecret looks up the secret 'name' in the secrets store of the repository, if there is one.  The passphrase of
+// the store is only prompted for if 'interactive' is true.
+func getSecret(name string, interactive bool) string {
+	store := getUnlockedSecretStore(interactive)
+	if store == nil {
+		return ""
+	}
+
+	value, found := store.Get(name)
+	if found {
+		LOG_DEBUG("PASSWORD_SECRETS", "Reading %s from the secrets store", name)
+	}
+	return value
+}
+
+// saveSecret stores the secret 'name' in the secrets store of the repository.  Returns false if the repository
+// doesn't have a secrets store, in which case the secret should be saved elsewhere.  The store is never unlocked by
+// prompting for its passphrase here; if it is still locked the secret is not saved at all.
+func saveSecret(name string, value string) bool {
+	if !SecretStoreExists() {
+		return false
+	}
+
+	store := getUnlockedSecretStore(false)
+	if store == nil {
+		LOG_DEBUG("PASSWORD_SECRETS", "Not saving %s since the secrets store is locked", name)
+		return true
+	}
+
+	secretStoreLock.Lock()
+	defer secretStoreLock.Unlock()
+
+	store.Set(name, value)
+	err := store.Save()
+	if err != nil {
+		LOG_WARN("SECRETS_SAVE", "Failed to save %s to the secrets store: %v", name, err)
+		return false
+	}
+	LOG_DEBUG("PASSWORD_SECRETS", "Saved %s to the secrets store", name)
+	return true
+}
@@ -0,0 +1,112 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSecretStore(t *testing.T) {
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "secrets")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	SetDuplicacyPreferencePath(testDir)
+
+	passphrase := "secrets passphrase"
+	value, found := os.LookupEnv("DUPLICACY_SECRETS_PASSPHRASE")
+	os.Setenv("DUPLICACY_SECRETS_PASSPHRASE", passphrase)
+	defer func() {
+		if found {
+			os.Setenv("DUPLICACY_SECRETS_PASSPHRASE", value)
+		} else {
+			os.Unsetenv("DUPLICACY_SECRETS_PASSPHRASE")
+		}
+		secretStoreLoaded = false
+		loadedSecretStore = nil
+		os.RemoveAll(testDir)
+	}()
+
+	store, err := OpenSecretStore(passphrase)
+	if err != nil {
+		t.Fatalf("Failed to create the secrets store: %v", err)
+	}
+	store.Set("password", "storage password")
+	store.Set("offsite_s3_secret", "s3 secret")
+	err = store.Save()
+	if err != nil {
+		t.Fatalf("Failed to save the secrets store: %v", err)
+	}
+
+	content, err := os.ReadFile(path.Join(testDir, secretsFile))
+	if err != nil {
+		t.Fatalf("Failed to read the secrets file: %v", err)
+	}
+	if bytes.Contains(content, []byte("storage password")) {
+		t.Errorf("The secrets file contains a plaintext value")
+	}
+
+	_, err = OpenSecretStore("wrong passphrase")
+	if err == nil {
+		t.Errorf("The secrets store was opened with a wrong passphrase")
+	}
+
+	store, err = OpenSecretStore(passphrase)
+	if err != nil {
+		t.Fatalf("Failed to open the secrets store: %v", err)
+	}
+	if names := store.List(); len(names) != 2 || names[0] != "offsite_s3_secret" || names[1] != "password" {
+		t.Errorf("The secrets store has secrets %v", names)
+	}
+
+	// Secrets are used transparently by the password lookup, and saved passwords go to the store
+	secretStoreLoaded = false
+	if password := GetPasswordFromPreference(Preference{Name: "default"}, "password"); password != "storage password" {
+		t.Errorf("The password from the secrets store is '%s'", password)
+	}
+	if secret := GetPasswordFromPreference(Preference{Name: "offsite"}, "s3_secret"); secret != "s3 secret" {
+		t.Errorf("The s3 secret from the secrets store is '%s'", secret)
+	}
+
+	SavePassword(Preference{Name: "offsite"}, "password", "offsite password")
+	store, err = OpenSecretStore(passphrase)
+	if err != nil {
+		t.Fatalf("Failed to open the secrets store: %v", err)
+	}
+	if password, _ := store.Get("offsite_password"); password != "offsite password" {
+		t.Errorf("The saved password in the secrets store is '%s'", password)
+	}
+
+	// Without a passphrase from the credential sources, the password lookup and saving passwords skip the store
+	// instead of prompting for the passphrase
+	os.Unsetenv("DUPLICACY_SECRETS_PASSPHRASE")
+	secretStoreLoaded = false
+	loadedSecretStore = nil
+	if password := GetPasswordFromPreference(Preference{Name: "default"}, "password"); password != "" {
+		t.Errorf("The password was read from the locked secrets store")
+	}
+	SavePassword(Preference{Name: "default"}, "ssh_password", "ssh password")
+	if secretStoreLoaded {
+		t.Errorf("The secrets store was unlocked without a passphrase")
+	}
+	os.Setenv("DUPLICACY_SECRETS_PASSPHRASE", passphrase)
+
+	// Changing the passphrase
+	store.SetPassphrase("new passphrase")
+	err = store.Save()
+	if err != nil {
+		t.Fatalf("Failed to save the secrets store: %v", err)
+	}
+	if _, err = OpenSecretStore(passphrase); err == nil {
+		t.Errorf("The secrets store was opened with the old passphrase")
+	}
+	if _, err = OpenSecretStore("new passphrase"); err != nil {
+		t.Errorf("Failed to open the secrets store with the new passphrase: %v", err)
+	}
+}
@@ -327,7 +327,10 @@ func (storage *SFTPStorage) UploadFile(threadIndex int, filePath string, content
 		err = storage.getSFTPClient().Rename(temporaryFile, fullPath)
 		if err != nil {
 			if _, err = storage.getSFTPClient().Stat(fullPath); err == nil {
-				storage.getSFTPClient().Remove(temporaryFile)
+				// In the append-only mode the temporary file is left for prune to remove
+				if !storage.IsAppendOnly() {
+					storage.getSFTPClient().Remove(temporaryFile)
+				}
 				return nil
 			} else {
 				return fmt.Errorf("Uploaded file but failed to store it at %s: %v", fullPath, err)
@@ -90,6 +90,9 @@ type ListFilesOptions struct {
 	IncludeFileFlags   bool
 	IncludeSpecials    bool
 	OneFileSystem      bool
+	IncludeInodeInfo   bool
+	ListingThreads     int         // number of directories to read concurrently
+	InodeIndex         *InodeIndex // if not nil, used to skip directories that haven't changed
 }
 
 func NewListFilesOptions(p *Preference) *ListFilesOptions {
@@ -123,29 +126,77 @@ func (snapshot *Snapshot) ListLocalFiles(top string,
 		IncludeFileFlags:   options.IncludeFileFlags,
 		IncludeSpecials:    options.IncludeSpecials,
 		OneFileSystem:      options.OneFileSystem,
+		IncludeInodeInfo:   options.IncludeInodeInfo,
+		InodeIndex:         options.InodeIndex,
 	})
 
-	directories := make([]*Entry, 0, 256)
-	directories = append(directories, CreateEntry("", 0, 0, 0))
+	if options.InodeIndex != nil {
+		options.InodeIndex.SetFingerprint(patterns, lister.options)
+	}
+
+	threads := options.ListingThreads
+	if threads < 1 {
+		threads = 1
+	}
+
+	// With more than one thread, directories near the top of the stack are read ahead by up to 'threads'
+	// goroutines, while the listing order and the hard link resolution are still handled by this goroutine.
+	// The number of directories read ahead is bounded to keep the memory usage in check.
+	type pendingDirectory struct {
+		entry   *Entry
+		content chan *DirectoryContent
+	}
+
+	semaphore := make(chan bool, threads)
+	readAhead := func(directory *pendingDirectory) {
+		if directory.content != nil {
+			return
+		}
+		directory.content = make(chan *DirectoryContent, 1)
+		go func() {
+			defer CatchLogException()
+			semaphore <- true
+			content := lister.ReadDir(directory.entry.Path)
+			<-semaphore
+			directory.content <- content
+		}()
+	}
+
+	directories := make([]*pendingDirectory, 0, 256)
+	directories = append(directories, &pendingDirectory{entry: CreateEntry("", 0, 0, 0)})
 
 	for len(directories) > 0 {
 
 		directory := directories[len(directories)-1]
 		directories = directories[:len(directories)-1]
-		subdirectories, skipped, err := lister.ListDir(directory.Path, listingChannel)
+
+		var content *DirectoryContent
+		if threads > 1 {
+			readAhead(directory)
+			for i := len(directories) - 1; i >= 0 && i >= len(directories)-2*threads; i-- {
+				readAhead(directories[i])
+			}
+			content = <-directory.content
+		} else {
+			content = lister.ReadDir(directory.entry.Path)
+		}
+
+		subdirectories, skipped, err := lister.EmitDir(content, listingChannel)
 		if err != nil {
-			if directory.Path == "" {
+			if directory.entry.Path == "" {
 				LOG_ERROR("LIST_FAILURE", "Failed to list the repository root: %v", err)
 				return
 			}
-			LOG_WARN("LIST_FAILURE", "Failed to list subdirectory %s: %v", directory.Path, err)
+			LOG_WARN("LIST_FAILURE", "Failed to list subdirectory %s: %v", directory.entry.Path, err)
 			if skippedDirectories != nil {
-				*skippedDirectories = append(*skippedDirectories, directory.Path)
+				*skippedDirectories = append(*skippedDirectories, directory.entry.Path)
 			}
 			continue
 		}
 
-		directories = append(directories, subdirectories...)
+		for _, subdirectory := range subdirectories {
+			directories = append(directories, &pendingDirectory{entry: subdirectory})
+		}
 
 		if skippedFiles != nil {
 			*skippedFiles = append(*skippedFiles, skipped...)
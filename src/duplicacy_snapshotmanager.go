@@ -6,6 +6,7 @@ package duplicacy
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -192,6 +193,13 @@ type SnapshotManager struct {
 	snapshotCache *FileStorage
 
 	chunkOperator *ChunkOperator
+
+	// Unreferenced chunks that couldn't be removed by prune because they are still locked
+	numberOfLockedChunks int
+	lastLockExpiry       time.Time
+
+	// Whether check compares checksums reported by the storage with those recorded at upload time
+	remoteChecksums bool
 }
 
 // CreateSnapshotManager creates a snapshot manager
@@ -206,6 +214,11 @@ func CreateSnapshotManager(config *Config, storage Storage) *SnapshotManager {
 	return manager
 }
 
+// SetRemoteChecksums enables comparing checksums reported by the storage with those recorded at upload time in check.
+func (manager *SnapshotManager) SetRemoteChecksums(enabled bool) {
+	manager.remoteChecksums = enabled
+}
+
 // DownloadSnapshot downloads the specified snapshot.
 func (manager *SnapshotManager) DownloadSnapshot(snapshotID string, revision int) *Snapshot {
 
@@ -548,6 +561,17 @@ func (manager *SnapshotManager) downloadLatestSnapshot(snapshotID string) (remot
 
 // ListAllFiles return all files and subdirectories in the subtree of the 'top' directory in the specified 'storage'.
 func (manager *SnapshotManager) ListAllFiles(storage Storage, top string) (allFiles []string, allSizes []int64) {
+	if !manager.listAllFiles(storage, top, func(file string, size int64) {
+		allFiles = append(allFiles, file)
+		allSizes = append(allSizes, size)
+	}) {
+		return nil, nil
+	}
+	return allFiles, allSizes
+}
+
+// listAllFiles is like ListAllFiles but passes each file or directory to 'visit' instead of returning all of them.
+func (manager *SnapshotManager) listAllFiles(storage Storage, top string, visit func(file string, size int64)) bool {
 
 	directories := make([]string, 0, 1024)
 
@@ -563,25 +587,23 @@ func (manager *SnapshotManager) ListAllFiles(storage Storage, top string) (allFi
 		files, sizes, err := storage.ListFiles(0, dir)
 		if err != nil {
 			LOG_ERROR("LIST_FILES", "Failed to list the directory %s: %v", dir, err)
-			return nil, nil
+			return false
 		}
 
 		if len(dir) > len(top) {
-			allFiles = append(allFiles, dir[len(top):])
-			allSizes = append(allSizes, 0)
+			visit(dir[len(top):], 0)
 		}
 
 		for i, file := range files {
 			if len(file) > 0 && file[len(file)-1] == '/' {
 				directories = append(directories, dir+file)
 			} else {
-				allFiles = append(allFiles, (dir + file)[len(top):])
-				allSizes = append(allSizes, sizes[i])
+				visit((dir + file)[len(top):], sizes[i])
 			}
 		}
 	}
 
-	return allFiles, allSizes
+	return true
 }
 
 // GetSnapshotChunks returns all chunks referenced by a given snapshot. If
@@ -706,6 +728,12 @@ func (manager *SnapshotManager) ListSnapshots(snapshotID string, revisionsToList
 			}
 		}
 
+		holds, err := manager.ListHolds(snapshotID)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_HOLD", "Failed to list the holds for snapshot %s: %v", snapshotID, err)
+			return 0
+		}
+
 		for _, revision := range revisions {
 
 			snapshot := manager.DownloadSnapshot(snapshotID, revision)
@@ -723,6 +751,9 @@ func (manager *SnapshotManager) ListSnapshots(snapshotID string, revisionsToList
 			}
 			LOG_INFO("SNAPSHOT_INFO", "Snapshot %s revision %d created at %s %s%s",
 				snapshotID, revision, creationTime, tagWithSpace, options)
+			if hold, found := holds[revision]; found {
+				LOG_INFO("SNAPSHOT_HOLD", "Snapshot %s revision %d is %s", snapshotID, revision, hold)
+			}
 
 			if showFiles {
 				// We need to fill in ChunkHashes and ChunkLengths to verify that each entry is valid
@@ -780,7 +811,13 @@ func (manager *SnapshotManager) ListSnapshots(snapshotID string, revisionsToList
 
 // CheckSnapshots checks if there is any problem with a snapshot.
 func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToCheck []int, tag string, showStatistics bool, showTabular bool,
-	checkFiles bool, checkChunks, searchFossils bool, resurrect bool, rewriteChunks bool, threads int, allowFailures bool) bool {
+	checkFiles bool, checkChunks, searchFossils bool, resurrect bool, rewriteChunks bool, threads int, allowFailures bool,
+	verifyBudget *VerifyBudget, ledgerInStorage bool) bool {
+
+	if manager.storage.IsAppendOnly() && (resurrect || rewriteChunks) {
+		LOG_ERROR("CHECK_APPEND_ONLY", "Fossils can't be resurrected and chunks can't be rewritten in the append-only mode")
+		return false
+	}
 
 	manager.CreateChunkOperator(resurrect, rewriteChunks, threads, allowFailures)
 	defer func() {
@@ -794,7 +831,14 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 	snapshotMap := make(map[string][]*Snapshot)
 	var err error
 
-	// Stores the chunk file size for each chunk
+	// Stores the chunk file size for each chunk in the storage
+	chunkSizeIndex := CreateChunkIndex()
+	defer chunkSizeIndex.Close()
+
+	// The following are only needed for statistics and only contain referenced chunks.
+	showingStatistics := showStatistics || showTabular
+
+	// Stores the chunk file size for each referenced chunk
 	chunkSizeMap := make(map[string]int64)
 
 	// Indicate whether or not a chunk is shared by multiple snapshots
@@ -805,27 +849,46 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 
 	emptyChunks := 0
 
-	LOG_INFO("SNAPSHOT_CHECK", "Listing all chunks")
-	allChunks, allSizes := manager.ListAllFiles(manager.storage, chunkDir)
-
-	for i, chunk := range allChunks {
+	addChunk := func(chunk string, size int64) {
 		if len(chunk) == 0 || chunk[len(chunk)-1] == '/' {
-			continue
+			return
 		}
 
 		if strings.HasSuffix(chunk, ".fsl") {
-			continue
+			return
 		}
 
 		chunk = strings.Replace(chunk, "/", "", -1)
-		chunkSizeMap[chunk] = allSizes[i]
+		chunkSizeIndex.Add(chunk, size)
 
-		if allSizes[i] == 0 && !strings.HasSuffix(chunk, ".tmp") {
+		if size == 0 && !strings.HasSuffix(chunk, ".tmp") {
 			LOG_WARN("SNAPSHOT_CHECK", "Chunk %s has a size of 0", chunk)
 			emptyChunks++
 		}
 	}
 
+	// Chunks whose checksums reported by the storage differ from those recorded at upload time
+	checksumMismatches := 0
+
+	if manager.remoteChecksums {
+		var ok bool
+		checksumMismatches, ok = manager.checkRemoteChecksums(addChunk)
+		if !ok {
+			return false
+		}
+	} else {
+		LOG_INFO("SNAPSHOT_CHECK", "Listing all chunks")
+		if !manager.listAllFiles(manager.storage, chunkDir, addChunk) {
+			return false
+		}
+	}
+
+	err = chunkSizeIndex.Seal()
+	if err != nil {
+		LOG_ERROR("CHUNK_INDEX", "Failed to build the index of all chunks: %v", err)
+		return false
+	}
+
 	if snapshotID == "" || showStatistics || showTabular {
 		snapshotIDs, err := manager.ListSnapshotIDs()
 		if err != nil {
@@ -870,13 +933,18 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 	LOG_INFO("SNAPSHOT_CHECK", "%d snapshots and %d revisions", len(snapshotMap), totalRevisions)
 
 	var totalChunkSize int64
-	for _, size := range chunkSizeMap {
-		totalChunkSize += size
+	err = chunkSizeIndex.ForEach(func(chunk string, entry chunkEntry) {
+		totalChunkSize += entry.value
+	})
+	if err != nil {
+		LOG_ERROR("CHUNK_INDEX", "Failed to read the index of all chunks: %v", err)
+		return false
 	}
-	LOG_INFO("SNAPSHOT_CHECK", "Total chunk size is %s in %d chunks", PrettyNumber(totalChunkSize), len(chunkSizeMap))
+	LOG_INFO("SNAPSHOT_CHECK", "Total chunk size is %s in %d chunks", PrettyNumber(totalChunkSize), chunkSizeIndex.Len())
+	setRunReportCheck(totalRevisions, int64(chunkSizeIndex.Len()), totalChunkSize)
 
 	var allChunkHashes *map[string]bool
-	if checkChunks && !checkFiles {
+	if checkChunks || checkFiles {
 		m := make(map[string]bool)
 		allChunkHashes = &m
 	}
@@ -885,20 +953,26 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 
 		for _, snapshot := range snapshotMap[snapshotID] {
 
+			chunks := make(map[string]bool)
+			manager.GetSnapshotChunkHashes(snapshot, allChunkHashes, chunks)
+
 			if checkFiles {
-				manager.DownloadSnapshotSequences(snapshot)
-				manager.VerifySnapshot(snapshot)
+				// Files will be verified later, one snapshot at a time, after chunks to verify have been selected
 				manager.ClearSnapshotSequences(snapshot)
 				continue
 			}
 
-			chunks := make(map[string]bool)
-			manager.GetSnapshotChunkHashes(snapshot, allChunkHashes, chunks)
+			// Look up chunks in sorted order which is much faster when the index is on disk
+			sortedChunks := make([]string, 0, len(chunks))
+			for chunkID := range chunks {
+				sortedChunks = append(sortedChunks, chunkID)
+			}
+			sort.Strings(sortedChunks)
 
 			missingChunks := 0
-			for chunkID := range chunks {
+			for _, chunkID := range sortedChunks {
 
-				_, found := chunkSizeMap[chunkID]
+				entry, found := chunkSizeIndex.Find(chunkID)
 
 				if !found {
 
@@ -919,7 +993,8 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 						missingChunks += 1
 						LOG_WARN("SNAPSHOT_VALIDATE",
 							"Chunk %s referenced by snapshot %s at revision %d does not exist",
-							chunkID, snapshotID, snapshot.Revision)
+							LogField("chunk_id", chunkID), LogField("snapshot_id", snapshotID),
+							LogField("revision", snapshot.Revision))
 						continue
 					}
 
@@ -942,12 +1017,20 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 						manager.resurrectChunk(chunkPath, chunkID)
 					} else {
 						LOG_WARN("SNAPSHOT_FOSSIL", "Chunk %s referenced by snapshot %s at revision %d "+
-							"has been marked as a fossil", chunkID, snapshotID, snapshot.Revision)
+							"has been marked as a fossil", LogField("chunk_id", chunkID), LogField("snapshot_id", snapshotID),
+							LogField("revision", snapshot.Revision))
 					}
 
-					chunkSizeMap[chunkID] = size
+					chunkSizeIndex.Add(chunkID, size)
+					entry.value = size
 				}
 
+				if !showingStatistics {
+					continue
+				}
+
+				chunkSizeMap[chunkID] = entry.value
+
 				if unique, found := chunkUniqueMap[chunkID]; !found {
 					chunkUniqueMap[chunkID] = true
 				} else {
@@ -986,85 +1069,61 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 		return false
 	}
 
+	if checksumMismatches > 0 {
+		LOG_ERROR("SNAPSHOT_CHECK", "%d chunks have checksums different from those recorded at upload time", checksumMismatches)
+		return false
+	}
+
+	if (showTabular || showStatistics) && manager.config.FileBoundarySize > 0 {
+		LOG_INFO("SNAPSHOT_CHECK", "Chunks are split at files of %s bytes or larger and at directory changes",
+			PrettyNumber(int64(manager.config.FileBoundarySize)))
+	}
+
 	if showTabular {
 		manager.ShowStatisticsTabular(snapshotMap, chunkSizeMap, chunkUniqueMap, chunkSnapshotMap)
 	} else if showStatistics {
 		manager.ShowStatistics(snapshotMap, chunkSizeMap, chunkUniqueMap, chunkSnapshotMap)
 	}
 
-	// Don't verify chunks with -files
-	if !checkChunks || checkFiles {
+	manager.reportConvertProgress()
+
+	if !checkChunks && !checkFiles {
 		return true
 	}
 
-	// This contains chunks that have been verifed in previous checks and is loaded from
-	// .duplicacy/cache/storage/verified_chunks.  Note that it contains the chunk ids not chunk
-	// hashes.
-	verifiedChunks := make(map[string]int64)
-	var verifiedChunksLock sync.Mutex
-	verifiedChunksFile := "verified_chunks"
+	// Chunks that have been verified in previous checks are recorded in the verification ledger and are only verified
+	// again if the verification budget allows.
+	verification := manager.loadChunkVerification(*allChunkHashes, chunkSizeIndex, verifyBudget, ledgerInStorage)
+	defer verification.save()
+	RunAtError = verification.save
+	defer func() {
+		RunAtError = func() {}
+	}()
 
-	manager.fileChunk.Reset(false)
-	err = manager.snapshotCache.DownloadFile(0, verifiedChunksFile, manager.fileChunk)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			LOG_WARN("SNAPSHOT_VERIFY", "Failed to load the file containing verified chunks: %v", err)
-		}
-	} else {
-		err = json.Unmarshal(manager.fileChunk.GetBytes(), &verifiedChunks)
-		if err != nil {
-			LOG_WARN("SNAPSHOT_VERIFY", "Failed to parse the file containing verified chunks: %v", err)
-		}
-	}
-	numberOfVerifiedChunks := len(verifiedChunks)
+	verification.start()
 
-	saveVerifiedChunks := func() {
-		verifiedChunksLock.Lock()
-		defer verifiedChunksLock.Unlock()
-		if len(verifiedChunks) > numberOfVerifiedChunks {
-			var description []byte
-			description, err = json.Marshal(verifiedChunks)
-			if err != nil {
-				LOG_WARN("SNAPSHOT_VERIFY", "Failed to create a json file for the set of verified chunks: %v", err)
-			} else {
-				err = manager.snapshotCache.UploadFile(0, verifiedChunksFile, description)
-				if err != nil {
-					LOG_WARN("SNAPSHOT_VERIFY", "Failed to save the verified chunks file: %v", err)
-				} else {
-					LOG_INFO("SNAPSHOT_VERIFY", "Added %d chunks to the list of verified chunks", len(verifiedChunks) - numberOfVerifiedChunks)
-					numberOfVerifiedChunks = len(verifiedChunks)
-				}
+	// Verify whole files with -files, which downloads and verifies the chunks they consist of
+	if checkFiles {
+		for snapshotID = range snapshotMap {
+			for _, snapshot := range snapshotMap[snapshotID] {
+				manager.DownloadSnapshotSequences(snapshot)
+				manager.VerifySnapshot(snapshot, verification)
+				manager.ClearSnapshotSequences(snapshot)
 			}
 		}
+		manager.reportChunkFormats()
+		return true
 	}
-	defer saveVerifiedChunks()
-	RunAtError = saveVerifiedChunks
 
-	LOG_INFO("SNAPSHOT_VERIFY", "Verifying %d chunks", len(*allChunkHashes))
+	chunkHashes := verification.chunkHashes
+	LOG_INFO("SNAPSHOT_VERIFY", "Verifying %d chunks", len(chunkHashes))
 
 	startTime := time.Now()
-	var chunkHashes []string
-
-	skippedChunks := 0
-	for chunkHash := range *allChunkHashes {
-		if len(verifiedChunks) > 0 {
-			chunkID := manager.config.GetChunkIDFromHash(chunkHash)
-			if _, found := verifiedChunks[chunkID]; found {
-				skippedChunks++
-				continue
-			}
-		}
-		chunkHashes = append(chunkHashes, chunkHash)
-	}
-
-	if skippedChunks > 0 {
-		LOG_INFO("SNAPSHOT_VERIFY", "Skipped %d chunks that have already been verified before", skippedChunks)
-	}
 
 	var totalDownloadedChunkSize int64
 	var totalDownloadedChunks int64
 	totalChunks := int64(len(chunkHashes))
-	lastSaveTime := time.Now().Unix()
+	numberOfChunksToVerify := len(chunkHashes)
 
 	chunkChannel := make(chan int, threads)
 	var wg sync.WaitGroup
@@ -1073,11 +1132,11 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 	for i := 0; i < threads; i++ {
 		go func() {
 			defer CatchLogException()
+			defer wg.Done()
 
 			for {
 				chunkIndex, ok := <-chunkChannel
 				if !ok {
-					wg.Done()
 					return
 				}
 
@@ -1088,16 +1147,7 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 
 				if !chunk.isBroken {
 					chunkID := manager.config.GetChunkIDFromHash(chunkHashes[chunkIndex])
-					verifiedChunksLock.Lock()
-					now := time.Now().Unix()
-					verifiedChunks[chunkID] = now
-					if now > lastSaveTime + 5 * 60 {
-						lastSaveTime = now
-						verifiedChunksLock.Unlock()
-						saveVerifiedChunks()
-					} else {
-						verifiedChunksLock.Unlock()
-					}
+					verification.record(chunkHashes[chunkIndex])
 
 					downloadedChunkSize := atomic.AddInt64(&totalDownloadedChunkSize, int64(chunk.GetLength()))
 					downloadedChunks := atomic.AddInt64(&totalDownloadedChunks, 1)
@@ -1106,6 +1156,7 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 					speed := int64(float64(downloadedChunkSize) / elapsedTime)
 					remainingTime := int64(float64(totalChunks - downloadedChunks) / float64(downloadedChunks) * elapsedTime)
 					percentage := float64(downloadedChunks) / float64(totalChunks) * 100.0
+					reportProgress("Verifying chunks", downloadedChunks, totalChunks, speed, remainingTime)
 					LOG_INFO("VERIFY_PROGRESS", "Verified chunk %s (%d/%d), %sB/s %s %.1f%%",
 							chunkID, downloadedChunks, totalChunks, PrettySize(speed), PrettyTime(remainingTime), percentage)
 				}
@@ -1116,17 +1167,27 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 	}
 
 	for chunkIndex := range chunkHashes {
-		chunkChannel <- chunkIndex
+		if chunkIndex >= verification.numberOfNewChunks && !verification.withinBudget() {
+			LOG_INFO("SNAPSHOT_VERIFY", "Stopped verifying previously verified chunks as the budget of %s has been used up",
+				verification.budget)
+			numberOfChunksToVerify = chunkIndex
+			break
+		}
+		select {
+		case chunkChannel <- chunkIndex:
+		case <-operationDone():
+		}
 	}
 
 	close(chunkChannel)
 	wg.Wait()
 	manager.chunkOperator.WaitForCompletion()
+	manager.reportChunkFormats()
 
 	if manager.chunkOperator.NumberOfFailedChunks > 0 {
-		LOG_ERROR("SNAPSHOT_VERIFY", "%d out of %d chunks are corrupted", manager.chunkOperator.NumberOfFailedChunks, len(*allChunkHashes))
+		LOG_ERROR("SNAPSHOT_VERIFY", "%d out of %d chunks are corrupted", manager.chunkOperator.NumberOfFailedChunks, numberOfChunksToVerify)
 	} else {
-		LOG_INFO("SNAPSHOT_VERIFY", "All %d chunks have been successfully verified", len(*allChunkHashes))
+		LOG_INFO("SNAPSHOT_VERIFY", "All %d chunks have been successfully verified", numberOfChunksToVerify)
 	}
 	return true
 }
@@ -1167,16 +1228,20 @@ func (manager *SnapshotManager) ShowStatistics(snapshotMap map[string][]*Snapsho
 
 		var totalChunkSize int64
 		var uniqueChunkSize int64
+		var uniqueChunkCount int64
 		for chunkID := range snapshotChunks {
 			chunkSize := chunkSizeMap[chunkID]
 			totalChunkSize += chunkSize
 
 			if chunkSnapshotMap[chunkID] != -1 {
 				uniqueChunkSize += chunkSize
+				uniqueChunkCount += 1
 			}
 		}
 		LOG_INFO("SNAPSHOT_CHECK", "Snapshot %s all revisions: %s total chunk bytes, %s unique chunk bytes",
 			snapshotID, PrettyNumber(totalChunkSize), PrettyNumber(uniqueChunkSize))
+		setRunReportSnapshot(snapshotID, snapshotList, int64(len(snapshotChunks)), totalChunkSize, uniqueChunkCount,
+			uniqueChunkSize)
 	}
 }
 
@@ -1260,6 +1325,7 @@ func (manager *SnapshotManager) ShowStatisticsTabular(snapshotMap map[string][]*
 		fmt.Fprintln(tableWriter, fmt.Sprintf(
 			"%s \tall \t \t \t \t%d \t%s \t%d \t%s \t \t \t",
 			snapshotID, totalChunkCount, PrettyNumber(totalChunkSize), uniqueChunkCount, PrettyNumber(uniqueChunkSize)))
+		setRunReportSnapshot(snapshotID, snapshotList, totalChunkCount, totalChunkSize, uniqueChunkCount, uniqueChunkSize)
 	}
 	tableWriter.Flush()
 	LOG_INFO("SNAPSHOT_CHECK", tableBuffer.String())
@@ -1322,8 +1388,9 @@ func (manager *SnapshotManager) PrintSnapshot(snapshot *Snapshot) bool {
 }
 
 // VerifySnapshot verifies that every file in the snapshot has the correct hash.  It does this by downloading chunks
-// and computing the whole file hash for each file.
-func (manager *SnapshotManager) VerifySnapshot(snapshot *Snapshot) bool {
+// and computing the whole file hash for each file.  If 'verification' is not nil, files consisting only of chunks
+// that don't need to be verified are skipped, and chunks of files with the correct hash are added to its ledger.
+func (manager *SnapshotManager) VerifySnapshot(snapshot *Snapshot, verification *chunkVerification) bool {
 
 	err := manager.CheckSnapshot(snapshot)
 
@@ -1344,14 +1411,28 @@ func (manager *SnapshotManager) VerifySnapshot(snapshot *Snapshot) bool {
 
 	sort.Sort(ByChunk(files))
 	corruptedFiles := 0
+	skippedFiles := 0
 	var lastChunk *Chunk
 	for _, file := range files {
+		if verification != nil && !manager.fileNeedsVerification(snapshot, file, verification) {
+			skippedFiles++
+			continue
+		}
 		if !manager.RetrieveFile(snapshot, file, &lastChunk, func([]byte) {}) {
 			corruptedFiles++
+		} else if verification != nil {
+			for i := file.StartChunk; i <= file.EndChunk; i++ {
+				verification.record(snapshot.ChunkHashes[i])
+			}
 		}
 		LOG_TRACE("SNAPSHOT_VERIFY", "%s", file.Path)
 	}
 
+	if skippedFiles > 0 {
+		LOG_INFO("SNAPSHOT_VERIFY", "Skipped %d files in snapshot %s at revision %d whose chunks have already been verified",
+			skippedFiles, snapshot.ID, snapshot.Revision)
+	}
+
 	if lastChunk != nil {
 		manager.config.PutChunk(lastChunk)
 	}
@@ -1367,6 +1448,16 @@ func (manager *SnapshotManager) VerifySnapshot(snapshot *Snapshot) bool {
 	}
 }
 
+// fileNeedsVerification returns true if any chunk of the file still needs to be verified.
+func (manager *SnapshotManager) fileNeedsVerification(snapshot *Snapshot, file *Entry, verification *chunkVerification) bool {
+	for i := file.StartChunk; i <= file.EndChunk; i++ {
+		if verification.needsVerification(snapshot.ChunkHashes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
 // RetrieveFile retrieves the file in the specified snapshot.
 func (manager *SnapshotManager) RetrieveFile(snapshot *Snapshot, file *Entry, lastChunk **Chunk, output func([]byte)) bool {
 
@@ -1798,6 +1889,30 @@ func (manager *SnapshotManager) ShowHistory(top string, snapshotID string, revis
 
 // fossilizeChunk turns the chunk into a fossil.
 func (manager *SnapshotManager) fossilizeChunk(chunkID string, filePath string, exclusive bool) bool {
+
+	// A locked chunk can't be turned into a fossil until the retention period expires
+	if lockStorage, ok := manager.storage.(ObjectLockStorage); ok && lockStorage.IsObjectLockEnabled() {
+		if filePath == "" {
+			filePath, _, _, _ = manager.storage.FindChunk(0, chunkID, false)
+		}
+		if filePath != "" {
+			expiry, err := lockStorage.GetObjectLockExpiry(0, filePath)
+			if err != nil {
+				LOG_WARN("CHUNK_LOCK", "Failed to get the retention date of the chunk %s: %v", chunkID, err)
+				return false
+			}
+			if !expiry.IsZero() {
+				LOG_INFO("CHUNK_LOCKED", "Chunk %s is locked for another %s (until %s)", chunkID,
+					PrettyTime(int64(time.Until(expiry).Seconds())), expiry.Format("2006-01-02 15:04:05"))
+				manager.numberOfLockedChunks++
+				if expiry.After(manager.lastLockExpiry) {
+					manager.lastLockExpiry = expiry
+				}
+				return false
+			}
+		}
+	}
+
 	if exclusive {
 		manager.chunkOperator.Delete(chunkID, filePath)
 	} else {
@@ -1848,8 +1963,10 @@ func (manager *SnapshotManager) resurrectChunk(fossilPath string, chunkID string
 // Note that a snapshot being created when step 2 is in progress may reference a fossil.  To avoid this
 // problem, never remove the lastest revision (unless exclusive is true), and only cache chunks referenced
 // by the lastest revision.
+//
+// Calendar retention rules are evaluated in 'location', or in the local time zone if it is nil.
 func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string, revisionsToBeDeleted []int,
-	tags []string, retentions []string,
+	tags []string, retentions []string, location *time.Location,
 	exhaustive bool, exclusive bool, ignoredIDs []string,
 	dryRun bool, deleteOnly bool, collectOnly bool, threads int) bool {
 
@@ -1863,12 +1980,21 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 		LOG_WARN("DELETE_OPTIONS", "Tags or retention policy will be ignored if at least one revision is specified")
 	}
 
+	if manager.storage.IsAppendOnly() {
+		LOG_ERROR("PRUNE_APPEND_ONLY", "This client is in the append-only mode; please run the prune command "+
+			"from a host that is allowed to delete files in the storage")
+		return false
+	}
+
 	manager.CreateChunkOperator(false, false, threads, false)
 	defer func() {
 		manager.chunkOperator.Stop()
 		manager.chunkOperator = nil
 	}()
 
+	manager.numberOfLockedChunks = 0
+	manager.lastLockExpiry = time.Time{}
+
 	prefPath := GetDuplicacyPreferencePath()
 	logDir := path.Join(prefPath, "logs")
 	err := os.MkdirAll(logDir, 0700)
@@ -1906,8 +2032,30 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 	}
 	var retentionPolicies []RetentionPolicy
 
+	// Alternatively, a calendar retention policy can be specified by rules like 'daily:14' or 'monthly:24'
+	var calendarPolicy *calendarRetention
+	if len(revisionsToBeDeleted) == 0 && len(retentions) > 0 && isCalendarRetention(strings.TrimSpace(retentions[0])) {
+		for _, retention := range retentions {
+			if !isCalendarRetention(strings.TrimSpace(retention)) {
+				LOG_ERROR("RETENTION_INVALID", "Retention policy %s can't be used together with calendar rules", retention)
+				return false
+			}
+		}
+
+		calendarPolicy, err = parseCalendarRetention(retentions, location)
+		if err != nil {
+			LOG_ERROR("RETENTION_INVALID", "Invalid retention policy: %v", err)
+			return false
+		}
+
+		for _, description := range calendarPolicy.describe() {
+			LOG_INFO("RETENTION_POLICY", "%s", description)
+		}
+		LOG_INFO("RETENTION_POLICY", "Calendar boundaries are determined in the %s time zone", calendarPolicy.location)
+	}
+
 	// Parse the retention policy if needed.
-	if len(revisionsToBeDeleted) == 0 && len(retentions) > 0 {
+	if len(revisionsToBeDeleted) == 0 && len(retentions) > 0 && calendarPolicy == nil {
 
 		retentionRegex := regexp.MustCompile(`^([0-9]+):([0-9]+)$`)
 
@@ -1986,6 +2134,36 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 		}
 	}
 
+	// Pinned revisions are never deleted, and chunks referenced by them are never removed
+	allHolds := make(map[string]map[int]*SnapshotHold)
+	for id := range allSnapshots {
+		holds, err := manager.ListHolds(id)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_HOLD", "Failed to list the holds for snapshot %s: %v", id, err)
+			return false
+		}
+		if len(holds) > 0 {
+			allHolds[id] = holds
+		}
+	}
+
+	var heldChunks map[string]bool
+	getHeldChunks := func() map[string]bool {
+		if heldChunks == nil {
+			heldChunks = make(map[string]bool)
+			for id, snapshots := range allSnapshots {
+				for _, snapshot := range snapshots {
+					if _, found := allHolds[id][snapshot.Revision]; found {
+						for _, chunk := range manager.GetSnapshotChunks(snapshot, false) {
+							heldChunks[chunk] = true
+						}
+					}
+				}
+			}
+		}
+		return heldChunks
+	}
+
 	collectionRegex := regexp.MustCompile(`^([0-9]+)$`)
 
 	collectionDir := "fossils"
@@ -2084,6 +2262,13 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 				}
 			}
 
+			// A revision may have been pinned after these fossils were collected
+			if len(allHolds) > 0 {
+				for chunk := range getHeldChunks() {
+					newChunks[chunk] = true
+				}
+			}
+
 			for _, fossil := range collection.Fossils {
 
 				chunk := fossil[len(chunkDir):]
@@ -2170,6 +2355,42 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 			}
 
 			continue
+		} else if calendarPolicy != nil {
+
+			if len(snapshots) <= 1 {
+				continue
+			}
+
+			var candidates []*Snapshot
+			for _, snapshot := range snapshots {
+				if len(tagMap) > 0 {
+					if _, found := tagMap[snapshot.Tag]; !found {
+						continue
+					}
+				}
+				candidates = append(candidates, snapshot)
+			}
+
+			reasons := calendarPolicy.apply(candidates, time.Now())
+			for i, snapshot := range candidates {
+				if !exclusive && snapshot == snapshots[len(snapshots)-1] {
+					reasons[i] = append(reasons[i], "latest revision")
+				}
+
+				if len(reasons[i]) == 0 {
+					LOG_DEBUG("SNAPSHOT_DELETE", "Snapshot %s at revision %d to be deleted - not kept by any rule",
+						snapshot.ID, snapshot.Revision)
+					snapshot.Flag = true
+					toBeDeleted++
+				} else if dryRun {
+					LOG_INFO("SNAPSHOT_KEEP", "Snapshot %s at revision %d would be kept by: %s",
+						snapshot.ID, snapshot.Revision, strings.Join(reasons[i], ", "))
+				} else {
+					LOG_DEBUG("SNAPSHOT_KEEP", "Snapshot %s at revision %d is kept by: %s",
+						snapshot.ID, snapshot.Revision, strings.Join(reasons[i], ", "))
+				}
+			}
+
 		} else if len(retentionPolicies) > 0 {
 
 			if len(snapshots) <= 1 {
@@ -2232,6 +2453,41 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 		}
 	}
 
+	for id, holds := range allHolds {
+		for _, snapshot := range allSnapshots[id] {
+			if hold, found := holds[snapshot.Revision]; found && snapshot.Flag {
+				LOG_INFO("SNAPSHOT_HOLD", "Snapshot %s at revision %d will not be deleted as it is %s",
+					snapshot.ID, snapshot.Revision, hold)
+				snapshot.Flag = false
+				toBeDeleted--
+			}
+		}
+	}
+
+	// Snapshots still locked can't be deleted, so chunks referenced by them must not be removed either
+	if lockStorage, ok := manager.storage.(ObjectLockStorage); ok && lockStorage.IsObjectLockEnabled() {
+		for _, snapshots := range allSnapshots {
+			for _, snapshot := range snapshots {
+				if !snapshot.Flag {
+					continue
+				}
+				snapshotPath := fmt.Sprintf("snapshots/%s/%d", snapshot.ID, snapshot.Revision)
+				expiry, err := lockStorage.GetObjectLockExpiry(0, snapshotPath)
+				if err != nil {
+					LOG_ERROR("SNAPSHOT_LOCK", "Failed to get the retention date of the snapshot %s at revision %d: %v",
+						snapshot.ID, snapshot.Revision, err)
+					return false
+				}
+				if !expiry.IsZero() {
+					LOG_INFO("SNAPSHOT_LOCKED", "Snapshot %s at revision %d is locked until %s and can't be deleted yet",
+						snapshot.ID, snapshot.Revision, expiry.Format("2006-01-02 15:04:05"))
+					snapshot.Flag = false
+					toBeDeleted--
+				}
+			}
+		}
+	}
+
 	if toBeDeleted == 0 && !exhaustive {
 		LOG_INFO("SNAPSHOT_NONE", "No snapshot to delete")
 		return false
@@ -2241,9 +2497,9 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 
 	var success bool
 	if exhaustive {
-		success = manager.pruneSnapshotsExhaustive(referencedFossils, allSnapshots, collection, logFile, dryRun, exclusive)
+		success = manager.pruneSnapshotsExhaustive(referencedFossils, allSnapshots, collection, logFile, dryRun, exclusive, threads)
 	} else {
-		success = manager.pruneSnapshotsNonExhaustive(allSnapshots, collection, logFile, dryRun, exclusive)
+		success = manager.pruneSnapshotsNonExhaustive(allSnapshots, collection, logFile, dryRun, exclusive, threads)
 	}
 	if !success {
 		return false
@@ -2254,6 +2510,36 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 		collection.AddFossil(fossil)
 	}
 
+	if manager.numberOfLockedChunks > 0 {
+		LOG_INFO("CHUNK_LOCKED", "%d unreferenced chunks are locked until as late as %s; run prune with -exhaustive "+
+			"after that to remove them", manager.numberOfLockedChunks, manager.lastLockExpiry.Format("2006-01-02 15:04:05"))
+	}
+
+	// Check again for revisions pinned while the chunks were being collected.  Their chunks may have been turned
+	// into fossils, but these fossils will be resurrected when the fossil collection is processed.
+	for id, snapshots := range allSnapshots {
+		flagged := false
+		for _, snapshot := range snapshots {
+			flagged = flagged || snapshot.Flag
+		}
+		if !flagged || dryRun {
+			continue
+		}
+
+		holds, err := manager.ListHolds(id)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_HOLD", "Failed to list the holds for snapshot %s: %v", id, err)
+			return false
+		}
+		for _, snapshot := range snapshots {
+			if _, found := holds[snapshot.Revision]; found && snapshot.Flag {
+				LOG_WARN("SNAPSHOT_HOLD", "Snapshot %s at revision %d was pinned during pruning and will not be deleted",
+					snapshot.ID, snapshot.Revision)
+				snapshot.Flag = false
+			}
+		}
+	}
+
 	// Save the deleted revision in the fossil collection
 	for _, snapshots := range allSnapshots {
 		for _, snapshot := range snapshots {
@@ -2337,8 +2623,11 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 
 // pruneSnapshots in non-exhaustive mode, only chunks that exist in the
 // snapshots to be deleted but not other are identified as unreferenced chunks.
-func (manager *SnapshotManager) pruneSnapshotsNonExhaustive(allSnapshots map[string][]*Snapshot, collection *FossilCollection, logFile io.Writer, dryRun, exclusive bool) bool {
-	targetChunks := make(map[string]bool)
+func (manager *SnapshotManager) pruneSnapshotsNonExhaustive(allSnapshots map[string][]*Snapshot, collection *FossilCollection, logFile io.Writer, dryRun, exclusive bool, threads int) bool {
+	targetChunks := CreateChunkIndex()
+	defer targetChunks.Close()
+
+	var flaggedSnapshots, keptSnapshots []*Snapshot
 
 	// Now build all chunks referened by snapshot not deleted
 	for _, snapshots := range allSnapshots {
@@ -2355,63 +2644,102 @@ func (manager *SnapshotManager) pruneSnapshotsNonExhaustive(allSnapshots map[str
 
 		for _, snapshot := range snapshots {
 			if !snapshot.Flag {
+				keptSnapshots = append(keptSnapshots, snapshot)
 				continue
 			}
 
 			LOG_INFO("SNAPSHOT_DELETE", "Deleting snapshot %s at revision %d", snapshot.ID, snapshot.Revision)
-			chunks := manager.GetSnapshotChunks(snapshot, false)
-
-			for _, chunk := range chunks {
-				// The initial value is 'false'.  When a referenced chunk is found it will change the value to 'true'.
-				targetChunks[chunk] = false
-			}
+			flaggedSnapshots = append(flaggedSnapshots, snapshot)
 		}
 	}
 
-	for _, snapshots := range allSnapshots {
-		for _, snapshot := range snapshots {
-			if snapshot.Flag {
-				continue
-			}
+	manager.loadSnapshotChunks(flaggedSnapshots, threads, func(snapshot *Snapshot, chunks []string) {
+		for _, chunk := range chunks {
+			targetChunks.Add(chunk, 0)
+		}
+	})
 
-			chunks := manager.GetSnapshotChunks(snapshot, false)
+	err := targetChunks.Seal()
+	if err != nil {
+		LOG_ERROR("CHUNK_INDEX", "Failed to build the index of chunks to be removed: %v", err)
+		return false
+	}
 
-			for _, chunk := range chunks {
-				if _, found := targetChunks[chunk]; found {
-					targetChunks[chunk] = true
-				}
+	// Whether each target chunk is still referenced by a snapshot not to be deleted
+	referenced := make([]bool, targetChunks.Len())
+	manager.loadSnapshotChunks(keptSnapshots, threads, func(snapshot *Snapshot, chunks []string) {
+		sort.Strings(chunks)
+		for _, chunk := range chunks {
+			if entry, found := targetChunks.Find(chunk); found {
+				referenced[entry.position] = true
 			}
 		}
-	}
+	})
 
-	for chunk, value := range targetChunks {
-		if value {
-			continue
+	err = targetChunks.ForEach(func(chunk string, entry chunkEntry) {
+		if referenced[entry.position] {
+			return
 		}
 
 		if dryRun {
 			LOG_INFO("CHUNK_UNREFERENCED", "Found unreferenced chunk %s", chunk)
-			continue
+			return
 		}
 
-		manager.fossilizeChunk(chunk, "", exclusive)
+		if !manager.fossilizeChunk(chunk, "", exclusive) {
+			return
+		}
 		if exclusive {
 			fmt.Fprintf(logFile, "Deleted chunk %s (exclusive mode)\n", chunk)
 		} else {
 			fmt.Fprintf(logFile, "Marked fossil %s\n", chunk)
 		}
-
-		targetChunks[chunk] = true
+	})
+	if err != nil {
+		LOG_ERROR("CHUNK_INDEX", "Failed to read the index of chunks to be removed: %v", err)
+		return false
 	}
 
 	return true
 }
 
+// getListedFileKey returns the key of a listed file in a chunk index, which must be a hex string of 32 bytes.
+func getListedFileKey(file string) string {
+	hash := sha256.Sum256([]byte(file))
+	return hex.EncodeToString(hash[:])
+}
+
 // pruneSnapshotsExhaustive in exhaustive, we scan the entire chunk tree to
 // find dangling chunks and temporaries.
-func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[string]bool, allSnapshots map[string][]*Snapshot, collection *FossilCollection, logFile io.Writer, dryRun, exclusive bool) bool {
+//
+// Listing the chunk directory and loading the chunks of every snapshot can take a long time on a large storage, so
+// the progress of both is saved to a checkpoint in the snapshot cache, from which an interrupted run will resume.
+func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[string]bool, allSnapshots map[string][]*Snapshot, collection *FossilCollection, logFile io.Writer, dryRun, exclusive bool, threads int) bool {
 	chunkRegex := regexp.MustCompile(`^[0-9a-f]+$`)
-	referencedChunks := make(map[string]bool)
+
+	checkpoint, err := manager.openPruneCheckpoint(allSnapshots, dryRun)
+	if err != nil {
+		LOG_ERROR("PRUNE_CHECKPOINT", "Failed to create the prune checkpoint: %v", err)
+		return false
+	}
+	completed := false
+	RunAtError = checkpoint.save
+	defer func() {
+		RunAtError = func() {}
+		if completed {
+			checkpoint.remove()
+		} else {
+			checkpoint.save()
+			checkpoint.close()
+		}
+	}()
+
+	processedSnapshots := make(map[string]bool)
+	for _, key := range checkpoint.ProcessedSnapshots {
+		processedSnapshots[key] = true
+	}
+
+	var snapshotsToLoad []*Snapshot
 
 	// Now build all chunks referened by snapshot not deleted
 	for _, snapshots := range allSnapshots {
@@ -2430,26 +2758,67 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 				LOG_INFO("SNAPSHOT_DELETE", "Deleting snapshot %s at revision %d", snapshot.ID, snapshot.Revision)
 				continue
 			}
-
-			chunks := manager.GetSnapshotChunks(snapshot, false)
-
-			for _, chunk := range chunks {
-				// The initial value is 'false'.  When a referenced chunk is found it will change the value to 'true'.
-				referencedChunks[chunk] = false
+			if !processedSnapshots[getSnapshotKey(snapshot)] {
+				snapshotsToLoad = append(snapshotsToLoad, snapshot)
 			}
 		}
 	}
 
-	allFiles, _ := manager.ListAllFiles(manager.storage, chunkDir)
-	uniqueFiles := make(map[string]bool)
-	for _, file := range allFiles {
-		if _, found := uniqueFiles[file]; found {
-			continue
+	lastSaveTime := time.Now().Unix()
+	manager.loadSnapshotChunks(snapshotsToLoad, threads, func(snapshot *Snapshot, chunks []string) {
+		checkpoint.addSnapshotChunks(snapshot, chunks)
+		if now := time.Now().Unix(); now > lastSaveTime+pruneCheckpointInterval {
+			lastSaveTime = now
+			checkpoint.save()
+		}
+	})
+	checkpoint.save()
+
+	if !manager.listChunks(checkpoint) {
+		return false
+	}
+
+	referencedChunks := checkpoint.referenced
+	err = referencedChunks.Seal()
+	if err != nil {
+		LOG_ERROR("CHUNK_INDEX", "Failed to build the index of referenced chunks: %v", err)
+		return false
+	}
+
+	// For each referenced chunk, the nesting level plus one of the first copy found, or 0 if no copy has been found.
+	// A copy at a different level is redundant, while one at the same level is the same file listed twice.
+	chunkLevels := make([]uint8, referencedChunks.Len())
+
+	// Some storages may list the same file more than once.  Each file is processed only once; files are tracked by
+	// the hashes of their paths in a chunk index so that they don't have to be kept in memory.
+	listedFiles := CreateChunkIndex()
+	defer listedFiles.Close()
+	err = checkpoint.forEachListedFile(func(file string) {
+		listedFiles.Add(getListedFileKey(file), 0)
+	})
+	if err == nil {
+		err = listedFiles.Seal()
+	}
+	if err != nil {
+		LOG_ERROR("LIST_FILES", "Failed to index the list of chunk files: %v", err)
+		return false
+	}
+	processedFiles := make([]bool, listedFiles.Len())
+
+	numberOfFiles := 0
+	progress := newPruneProgress("Checking chunks", checkpoint.NumberOfListedFiles)
+	err = checkpoint.forEachListedFile(func(file string) {
+		progress.report(numberOfFiles, false)
+		numberOfFiles++
+		if entry, found := listedFiles.Find(getListedFileKey(file)); found {
+			if processedFiles[entry.position] {
+				return
+			}
+			processedFiles[entry.position] = true
 		}
-		uniqueFiles[file] = true
 
 		if len(file) == 0 || file[len(file)-1] == '/' {
-			continue
+			return
 		}
 
 		if strings.HasSuffix(file, ".tmp") {
@@ -2457,7 +2826,7 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 			// a left-over from a restore operation that was terminated abruptly.
 			if dryRun {
 				LOG_INFO("CHUNK_TEMPORARY", "Found temporary file %s", file)
-				continue
+				return
 			}
 
 			if exclusive {
@@ -2465,9 +2834,9 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 				manager.chunkOperator.Delete("", chunkDir+file)
 				fmt.Fprintf(logFile, "Deleted temporary %s\n", file)
 			} else {
-				collection.AddTemporary(file)
+				collection.AddTemporary(chunkDir + file)
 			}
-			continue
+			return
 		} else if strings.HasSuffix(file, ".fsl") {
 			// This is a fossil.  If it is unreferenced, it can be a result of failing to save the fossil
 			// collection file after making it a fossil.
@@ -2476,11 +2845,11 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 				chunk := strings.Replace(file, "/", "", -1)
 				chunk = strings.Replace(chunk, ".fsl", "", -1)
 
-				if _, found := referencedChunks[chunk]; found {
+				if _, found := referencedChunks.Find(chunk); found {
 
 					if dryRun {
 						LOG_INFO("FOSSIL_REFERENCED", "Found referenced fossil %s", file)
-						continue
+						return
 					}
 
 					manager.chunkOperator.Resurrect(chunk, chunkDir+file)
@@ -2490,7 +2859,7 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 
 					if dryRun {
 						LOG_INFO("FOSSIL_UNREFERENCED", "Found unreferenced fossil %s", file)
-						continue
+						return
 					}
 
 					if exclusive {
@@ -2503,46 +2872,79 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 				}
 			}
 
-			continue
+			return
 		}
 
 		chunk := strings.Replace(file, "/", "", -1)
 
 		if !chunkRegex.MatchString(chunk) {
 			LOG_WARN("CHUNK_UNKNOWN_FILE", "File %s is not a chunk", file)
-			continue
+			return
 		}
 
-		if value, found := referencedChunks[chunk]; !found {
+		level := uint8(strings.Count(file, "/") + 1)
+		if entry, found := referencedChunks.Find(chunk); !found {
 			if dryRun {
 				LOG_INFO("CHUNK_UNREFERENCED", "Found unreferenced chunk %s", chunk)
-				continue
+				return
 			}
 
-			manager.fossilizeChunk(chunk, chunkDir+file, exclusive)
+			if !manager.fossilizeChunk(chunk, chunkDir+file, exclusive) {
+				return
+			}
 			if exclusive {
 				fmt.Fprintf(logFile, "Deleted chunk %s (exclusive mode)\n", chunk)
 			} else {
 				fmt.Fprintf(logFile, "Marked fossil %s\n", chunk)
 			}
-		} else if value {
-			// Note that the initial value is false.  So if the value is true it means another copy of the chunk
-			// exists in a higher-level directory.
+		} else if chunkLevels[entry.position] == level {
+			return
+		} else if chunkLevels[entry.position] != 0 {
+			// Another copy of the chunk exists in a directory at a different level.
 
 			if dryRun {
 				LOG_INFO("CHUNK_REDUNDANT", "Found redundant chunk %s", chunk)
-				continue
+				return
 			}
 
 			// This is a redundant chunk file (for instance D3/495A8D and D3/49/5A8D )
 			manager.chunkOperator.Delete(chunk, chunkDir+file)
 			fmt.Fprintf(logFile, "Deleted redundant chunk %s\n", file)
 		} else {
-			referencedChunks[chunk] = true
+			chunkLevels[entry.position] = level
 			LOG_DEBUG("CHUNK_KEEP", "Chunk %s is referenced", chunk)
 		}
+	})
+	if err != nil {
+		LOG_ERROR("LIST_FILES", "Failed to read the list of chunk files: %v", err)
+		return false
+	}
+	progress.report(numberOfFiles, true)
+
+	// Snapshot files left over by an interrupted upload.  Clients in the append-only mode don't remove them.
+	for snapshotID := range allSnapshots {
+		snapshotDir := "snapshots/" + snapshotID + "/"
+		files, _, err := manager.storage.ListFiles(0, snapshotDir)
+		if err != nil {
+			LOG_WARN("SNAPSHOT_LIST", "Failed to list the directory %s: %v", snapshotDir, err)
+			continue
+		}
+		for _, file := range files {
+			if !strings.HasSuffix(file, ".tmp") {
+				continue
+			}
+			if dryRun {
+				LOG_INFO("SNAPSHOT_TEMPORARY", "Found temporary file %s", snapshotDir+file)
+			} else if exclusive {
+				manager.chunkOperator.Delete("", snapshotDir+file)
+				fmt.Fprintf(logFile, "Deleted temporary %s\n", snapshotDir+file)
+			} else {
+				collection.AddTemporary(snapshotDir + file)
+			}
+		}
 	}
 
+	completed = true
 	return true
 }
 
@@ -2713,3 +3115,67 @@ func (manager *SnapshotManager) UploadFile(path string, derivationKey string, co
 	return true
 
 }
+
+// UploadFileIfNotExist is the same as UploadFile, except that nothing is uploaded if the file already exists in the
+// storage, in which case 'exist' is true.  An existing file with the same content is taken as uploaded by this call.
+func (manager *SnapshotManager) UploadFileIfNotExist(path string, derivationKey string, content []byte) (exist bool) {
+	manager.fileChunk.Reset(false)
+	manager.fileChunk.Write(content)
+
+	if len(derivationKey) > 64 {
+		derivationKey = derivationKey[len(derivationKey)-64:]
+	}
+
+	err := manager.fileChunk.Encrypt(manager.config.FileKey, derivationKey, true)
+	if err != nil {
+		LOG_ERROR("UPLOAD_File", "Failed to encrypt the file %s: %v", path, err)
+		return false
+	}
+
+	exist, err = uploadFileIfNotExist(manager.storage, 0, path, manager.fileChunk.GetBytes())
+	if err != nil {
+		LOG_ERROR("UPLOAD_File", "Failed to upload the file %s: %v", path, err)
+		return false
+	} else if exist {
+		if !manager.hasFileContent(path, derivationKey, content) {
+			LOG_DEBUG("UPLOAD_FILE", "File %s already exists", path)
+			return true
+		}
+		LOG_DEBUG("UPLOAD_FILE", "File %s has already been uploaded with the same content", path)
+	}
+
+	// The file is cached only once it is known to be the one in the storage
+	if manager.storage.IsCacheNeeded() {
+		err = manager.snapshotCache.UploadFile(0, path, content)
+		if err != nil {
+			LOG_WARN("UPLOAD_CACHE", "Failed to cache the file %s: %v", path, err)
+		} else {
+			LOG_DEBUG("UPLOAD_FILE_CACHE", "Saved file %s to the snapshot cache", path)
+		}
+	}
+
+	LOG_DEBUG("UPLOAD_FILE", "Uploaded file %s", path)
+	return false
+}
+
+// hasFileContent returns true if the file at 'path' in the storage decrypts to 'content'.  A conditional upload that
+// succeeded but whose response was lost finds the file existing when it is retried, and must not take it as a file
+// uploaded by another client.
+func (manager *SnapshotManager) hasFileContent(path string, derivationKey string, content []byte) bool {
+	chunk := manager.config.GetChunk()
+	defer manager.config.PutChunk(chunk)
+
+	chunk.Reset(false)
+	err := manager.storage.DownloadFile(0, path, chunk)
+	if err != nil {
+		LOG_DEBUG("DOWNLOAD_FILE", "Failed to download the file %s: %v", path, err)
+		return false
+	}
+
+	err, _ = chunk.Decrypt(manager.config.FileKey, derivationKey)
+	if err != nil {
+		LOG_DEBUG("DOWNLOAD_DECRYPT", "Failed to decrypt the file %s: %v", path, err)
+		return false
+	}
+	return bytes.Equal(chunk.GetBytes(), content)
+}
@@ -6,12 +6,14 @@ package duplicacy
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -268,11 +270,11 @@ func TestPruneSingleRepository(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 4, 0)
 
 	t.Logf("Removing snapshot repository1 revisions 1 and 2 with --exclusive")
-	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1, 2}, []string{}, []string{}, false, true, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1, 2}, []string{}, []string{}, nil, false, true, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 0)
 
 	t.Logf("Removing snapshot repository1 revision 3 without --exclusive")
-	snapshotManager.PruneSnapshots("repository1", "repository1", []int{3}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{3}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 1, 2)
 
 	t.Logf("Creating 1 snapshot")
@@ -281,7 +283,7 @@ func TestPruneSingleRepository(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 2, 2)
 
 	t.Logf("Prune without removing any snapshots -- fossils will be deleted")
-	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 0)
 }
 
@@ -308,11 +310,11 @@ func TestPruneSingleHost(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 3, 0)
 
 	t.Logf("Removing snapshot vm1@host1 revision 1 without --exclusive")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 2)
 
 	t.Logf("Prune without removing any snapshots -- no fossils will be deleted")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 2)
 
 	t.Logf("Creating 1 snapshot")
@@ -321,7 +323,7 @@ func TestPruneSingleHost(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 3, 2)
 
 	t.Logf("Prune without removing any snapshots -- fossils will be deleted")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 3, 0)
 
 }
@@ -349,11 +351,11 @@ func TestPruneMultipleHost(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 3, 0)
 
 	t.Logf("Removing snapshot vm1@host1 revision 1 without --exclusive")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 2)
 
 	t.Logf("Prune without removing any snapshots -- no fossils will be deleted")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 2)
 
 	t.Logf("Creating 1 snapshot")
@@ -362,7 +364,7 @@ func TestPruneMultipleHost(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 3, 2)
 
 	t.Logf("Prune without removing any snapshots -- no fossils will be deleted")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 3, 2)
 
 	t.Logf("Creating 1 snapshot")
@@ -371,7 +373,7 @@ func TestPruneMultipleHost(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 4, 2)
 
 	t.Logf("Prune without removing any snapshots -- fossils will be deleted")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 4, 0)
 }
 
@@ -396,7 +398,7 @@ func TestPruneAndResurrect(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 2, 0)
 
 	t.Logf("Removing snapshot vm1@host1 revision 1 without --exclusive")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 1, 2)
 
 	t.Logf("Creating 1 snapshot")
@@ -405,7 +407,7 @@ func TestPruneAndResurrect(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 2, 2)
 
 	t.Logf("Prune without removing any snapshots -- one fossil will be resurrected")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 0)
 }
 
@@ -433,11 +435,11 @@ func TestPruneWithInactiveHost(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 3, 0)
 
 	t.Logf("Removing snapshot vm1@host1 revision 1")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 2)
 
 	t.Logf("Prune without removing any snapshots -- no fossils will be deleted")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 2)
 
 	t.Logf("Creating 1 snapshot")
@@ -446,7 +448,7 @@ func TestPruneWithInactiveHost(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 3, 2)
 
 	t.Logf("Prune without removing any snapshots -- fossils will be deleted")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 3, 0)
 }
 
@@ -474,15 +476,15 @@ func TestPruneWithRetentionPolicy(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 30, 0)
 
 	t.Logf("Removing snapshot vm1@host1 0:20 with --exclusive")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{"0:20"}, false, true, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{"0:20"}, nil, false, true, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 19, 0)
 
 	t.Logf("Removing snapshot vm1@host1 -k 0:20 with --exclusive")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{"0:20"}, false, true, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{"0:20"}, nil, false, true, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 19, 0)
 
 	t.Logf("Removing snapshot vm1@host1 -k 3:14 -k 2:7 with --exclusive")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{"3:14", "2:7"}, false, true, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{"3:14", "2:7"}, nil, false, true, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 12, 0)
 }
 
@@ -514,7 +516,7 @@ func TestPruneWithRetentionPolicyAndTag(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 30, 0)
 
 	t.Logf("Removing snapshot vm1@host1 0:20 with --exclusive and --tag manual")
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{"manual"}, []string{"0:7"}, false, true, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{"manual"}, []string{"0:7"}, nil, false, true, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 22, 0)
 }
 
@@ -542,12 +544,12 @@ func TestPruneWithFossils(t *testing.T) {
 
 	t.Logf("Prune without removing any snapshots but with --exhaustive")
 	// The unreferenced fossil shouldn't be removed
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, true, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, true, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 1)
 
 	t.Logf("Prune without removing any snapshots but with --exclusive")
 	// Now the unreferenced fossil should be removed
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, true, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, true, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 0)
 }
 
@@ -574,7 +576,7 @@ func TestPruneMultipleThread(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 2, 0)
 
 	t.Logf("Removing snapshot revisions 1 with --exclusive")
-	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1}, []string{}, []string{}, false, true, []string{}, false, false, false, numberOfThreads)
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1}, []string{}, []string{}, nil, false, true, []string{}, false, false, false, numberOfThreads)
 	checkTestSnapshots(snapshotManager, 1, 0)
 
 	t.Logf("Creating 1 more snapshot")
@@ -582,10 +584,10 @@ func TestPruneMultipleThread(t *testing.T) {
 	createTestSnapshot(snapshotManager, "repository1", 3, now-2*day-3600, now-1*day-60, chunkList3, "tag")
 
 	t.Logf("Removing snapshot repository1 revision 2 without --exclusive")
-	snapshotManager.PruneSnapshots("repository1", "repository1", []int{2}, []string{}, []string{}, false, false, []string{}, false, false, false, numberOfThreads)
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{2}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, numberOfThreads)
 
 	t.Logf("Prune without removing any snapshots but with --exclusive")
-	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, false, true, []string{}, false, false, false, numberOfThreads)
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, nil, false, true, []string{}, false, false, false, numberOfThreads)
 	checkTestSnapshots(snapshotManager, 1, 0)
 }
 
@@ -613,7 +615,7 @@ func TestPruneNewSnapshots(t *testing.T) {
 
 	t.Logf("Prune snapshot 1")
 	// chunkHash1 should be marked as fossil
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 2)
 
 	chunkHash5 := uploadRandomChunk(snapshotManager, chunkSize)
@@ -623,9 +625,9 @@ func TestPruneNewSnapshots(t *testing.T) {
 	createTestSnapshot(snapshotManager, "vm2@host1", 2, now+3600, now+3600*2, []string{chunkHash4, chunkHash5}, "tag")
 
 	// Now chunkHash1 wil be resurrected
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 4, 0)
-	snapshotManager.CheckSnapshots("vm1@host1", []int{2, 3}, "", false, false, false, false, false, false, false, 1, false)
+	snapshotManager.CheckSnapshots("vm1@host1", []int{2, 3}, "", false, false, false, false, false, false, false, 1, false, nil, false)
 }
 
 // A fossil collection left by an aborted prune should be ignored if any supposedly deleted snapshot exists
@@ -657,7 +659,7 @@ func TestPruneGhostSnapshots(t *testing.T) {
 
 	t.Logf("Prune snapshot 1")
 	// chunkHash1 should be marked as fossil
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 1, 2)
 
 	// Recover the snapshot file for revision 1; this is to simulate a scenario where prune may encounter a network error after
@@ -672,12 +674,12 @@ func TestPruneGhostSnapshots(t *testing.T) {
 	createTestSnapshot(snapshotManager, "vm1@host1", 3, now-day-3600, now-day-60, []string{chunkHash3, chunkHash4}, "tag")
 
 	// Run the prune again but the fossil collection should be igored, since revision 1 still exists
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 3, 2)
-	snapshotManager.CheckSnapshots("vm1@host1", []int{1, 2, 3}, "", false, false, false, false, true /*searchFossils*/, false, false, 1, false)
+	snapshotManager.CheckSnapshots("vm1@host1", []int{1, 2, 3}, "", false, false, false, false, true /*searchFossils*/, false, false, 1, false /*verifyBudget*/, nil /*ledgerInStorage*/, false)
 
 	// Prune snapshot 1 again
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 2, 2)
 
 	// Create another snapshot
@@ -686,7 +688,560 @@ func TestPruneGhostSnapshots(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 3, 2)
 
 	// Run the prune again and this time the fossil collection will be processed and the fossils removed
-	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
 	checkTestSnapshots(snapshotManager, 3, 0)
-	snapshotManager.CheckSnapshots("vm1@host1", []int{2, 3, 4}, "", false, false, false, false, false, false, false, 1, false)
+	snapshotManager.CheckSnapshots("vm1@host1", []int{2, 3, 4}, "", false, false, false, false, false, false, false, 1, false, nil, false)
+}
+
+func TestCalendarRetention(t *testing.T) {
+
+	policy, err := parseCalendarRetention([]string{"last:2", "daily:3", "weekly:2", "monthly:all", "tag:keep"}, time.UTC)
+	if err != nil {
+		t.Fatalf("Failed to parse the retention rules: %v", err)
+	}
+
+	// One snapshot every 12 hours from 2026-01-01 00:00 to 2026-02-28 12:00 (Saturday)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var snapshots []*Snapshot
+	for i := 0; i < 118; i++ {
+		snapshot := createDummySnapshot("host1", i+1, 0)
+		snapshot.StartTime = start.Add(time.Duration(i) * 12 * time.Hour).Unix()
+		snapshots = append(snapshots, snapshot)
+	}
+	snapshots[10].Tag = "keep"
+
+	reasons := policy.apply(snapshots, time.Unix(snapshots[len(snapshots)-1].StartTime, 0))
+
+	var kept []int
+	for i, reason := range reasons {
+		if len(reason) > 0 {
+			kept = append(kept, snapshots[i].Revision)
+		}
+	}
+
+	// 118 and 117 by last; 118, 116, 114 by daily; 118 and 106 (2026-02-22, Sunday) by weekly;
+	// 118 and 62 (2026-01-31) by monthly; 11 by tag
+	expected := []int{11, 62, 106, 114, 116, 117, 118}
+	if fmt.Sprintf("%v", kept) != fmt.Sprintf("%v", expected) {
+		t.Errorf("Kept revisions: %v; expected: %v", kept, expected)
+	}
+
+	if strings.Join(reasons[105], ", ") != "weekly 2/2 (2026-W08)" {
+		t.Errorf("Unexpected reasons for revision 106: %v", reasons[105])
+	}
+
+	// At UTC-11, the snapshot at 00:00 UTC belongs to the previous day
+	policy, err = parseCalendarRetention([]string{"daily:2"}, time.FixedZone("UTC-11", -11*3600))
+	if err != nil {
+		t.Fatalf("Failed to parse the retention rules: %v", err)
+	}
+	reasons = policy.apply(snapshots, time.Unix(snapshots[len(snapshots)-1].StartTime, 0))
+	if len(reasons[117]) == 0 || len(reasons[116]) == 0 || len(reasons[115]) > 0 {
+		t.Errorf("The daily rule was not evaluated in the given time zone: %v", reasons[115:])
+	}
+
+	policy, err = parseCalendarRetention([]string{"within:1w"}, time.UTC)
+	if err != nil {
+		t.Fatalf("Failed to parse the retention rules: %v", err)
+	}
+	reasons = policy.apply(snapshots, time.Unix(snapshots[len(snapshots)-1].StartTime, 0))
+	numberOfKept := 0
+	for _, reason := range reasons {
+		if len(reason) > 0 {
+			numberOfKept++
+		}
+	}
+	if numberOfKept != 15 {
+		t.Errorf("%d snapshots were kept by the within rule; expected 15", numberOfKept)
+	}
+
+	for _, invalid := range [][]string{{"daily:x"}, {"daily:1", "daily:2"}, {"within:"}, {"within:3q"}} {
+		if _, err = parseCalendarRetention(invalid, nil); err == nil {
+			t.Errorf("Invalid retention rules %v were accepted", invalid)
+		}
+	}
+}
+
+func TestPruneWithHold(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash4 := uploadRandomChunk(snapshotManager, chunkSize)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	t.Logf("Creating 3 snapshots")
+	createTestSnapshot(snapshotManager, "repository1", 1, now-3*day-3600, now-3*day-60, []string{chunkHash1, chunkHash2}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 2, now-2*day-3600, now-2*day-60, []string{chunkHash2, chunkHash3}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 3, now-1*day-3600, now-1*day-60, []string{chunkHash3, chunkHash4}, "tag")
+	checkTestSnapshots(snapshotManager, 3, 0)
+
+	t.Logf("Pinning snapshot repository1 revision 1")
+	if !snapshotManager.PinSnapshot("repository1", []int{1}, "legal hold") {
+		t.Fatalf("Failed to pin revision 1")
+	}
+
+	holds, err := snapshotManager.ListHolds("repository1")
+	if err != nil || len(holds) != 1 || holds[1] == nil || holds[1].Reason != "legal hold" {
+		t.Fatalf("Unexpected holds: %v (error: %v)", holds, err)
+	}
+
+	t.Logf("Removing snapshot repository1 revisions 1 and 2; revision 1 is pinned")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1, 2}, []string{}, []string{}, nil, false, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 2, 1)
+
+	t.Logf("Removing snapshots older than 1 day; revision 1 is pinned")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{"0:1"}, nil, false, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 2, 1)
+
+	t.Logf("Unpinning snapshot repository1 revision 1")
+	if !snapshotManager.UnpinSnapshot("repository1", []int{1}) {
+		t.Fatalf("Failed to unpin revision 1")
+	}
+	holds, err = snapshotManager.ListHolds("repository1")
+	if err != nil || len(holds) != 0 {
+		t.Fatalf("Unexpected holds after unpinning: %v (error: %v)", holds, err)
+	}
+
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1}, []string{}, []string{}, nil, false, true, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 1, 0)
+}
+
+func TestPruneWithObjectLock(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	// Setting the immutable flag requires CAP_LINUX_IMMUTABLE and a file system that supports it
+	probe := path.Join(testDir, "probe")
+	ioutil.WriteFile(probe, []byte("probe"), 0644)
+	if err := lockFile(probe, time.Now().Add(-time.Second)); err != nil {
+		t.Skipf("Files can't be locked: %v", err)
+	}
+	getFileLockExpiry(probe, true)
+
+	storage := snapshotManager.storage.(*FileStorage)
+	err := storage.SetObjectLock("governance", 3*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to enable object lock: %v", err)
+	}
+
+	// Release all locks so the test directory can be removed
+	lockExpiry := time.Now().Add(3 * time.Second)
+	defer func() {
+		time.Sleep(time.Until(lockExpiry))
+		allFiles, _ := snapshotManager.ListAllFiles(storage, "")
+		for _, file := range allFiles {
+			getFileLockExpiry(path.Join(testDir, file), true)
+		}
+	}()
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+	uploadRandomChunk(snapshotManager, chunkSize)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	createTestSnapshot(snapshotManager, "repository1", 1, now-2*day-3600, now-2*day-60, []string{chunkHash1, chunkHash2}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 2, now-1*day-3600, now-1*day-60, []string{chunkHash2, chunkHash3}, "tag")
+	lockExpiry = time.Now().Add(3 * time.Second)
+	checkTestSnapshots(snapshotManager, 2, 1)
+
+	if expiry, err := storage.GetObjectLockExpiry(0, "snapshots/repository1/1"); err != nil || expiry.IsZero() {
+		t.Fatalf("The snapshot file is not locked: %v", err)
+	}
+
+	t.Logf("Removing snapshot repository1 revision 1 while it is locked")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1}, []string{}, []string{}, nil, true, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 2, 1)
+	if snapshotManager.numberOfLockedChunks != 1 {
+		t.Errorf("%d locked chunks were reported; expected 1", snapshotManager.numberOfLockedChunks)
+	}
+
+	time.Sleep(time.Until(lockExpiry.Add(time.Second)))
+
+	t.Logf("Removing snapshot repository1 revision 1 after the lock has expired")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1}, []string{}, []string{}, nil, true, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 1, 3)
+	if snapshotManager.numberOfLockedChunks != 0 {
+		t.Errorf("%d locked chunks were reported; expected 0", snapshotManager.numberOfLockedChunks)
+	}
+}
+
+func TestPruneAppendOnly(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	t.Logf("Creating 2 snapshots")
+	createTestSnapshot(snapshotManager, "repository1", 1, now-2*day-3600, now-2*day-60, []string{chunkHash1, chunkHash2}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 2, now-1*day-3600, now-1*day-60, []string{chunkHash2, chunkHash3}, "tag")
+	checkTestSnapshots(snapshotManager, 2, 0)
+
+	appendOnlyStorage, _ := CreateFileStorage(testDir, false, 1)
+	appendOnlyStorage.rejectDeletions = true
+	appendOnlyStorage.SetAppendOnly(true)
+
+	chunkPath, exist, _, _ := appendOnlyStorage.FindChunk(0, snapshotManager.config.GetChunkIDFromHash(chunkHash1), false)
+	if !exist {
+		t.Fatalf("Chunk %s does not exist", chunkHash1)
+	}
+	if err := appendOnlyStorage.DeleteFile(0, chunkPath); !os.IsPermission(err) {
+		t.Errorf("Deleting %s from an append-only storage returned %v", chunkPath, err)
+	}
+	if err := appendOnlyStorage.MoveFile(0, chunkPath, chunkPath+".fsl"); !os.IsPermission(err) {
+		t.Errorf("Renaming %s in an append-only storage returned %v", chunkPath, err)
+	}
+	if err := appendOnlyStorage.UploadFile(0, "snapshots/repository1/2", []byte("overwritten")); !os.IsPermission(err) {
+		t.Errorf("Overwriting a snapshot file in an append-only storage returned %v", err)
+	}
+
+	if !VerifyAppendOnly(appendOnlyStorage) {
+		t.Errorf("The append-only storage allows deleting or renaming files")
+	}
+	if VerifyAppendOnly(snapshotManager.storage) {
+		t.Errorf("The regular storage doesn't allow deleting or renaming files")
+	}
+
+	// A snapshot file from an interrupted upload
+	appendOnlyStorage.UploadFile(0, "snapshots/repository1/3.abcdefgh.tmp", []byte("incomplete"))
+
+	t.Logf("Removing temporary files from the trusted host")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, nil, true, true, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 2, 0)
+
+	for _, dir := range []string{"chunks/", "snapshots/repository1/"} {
+		files, _ := snapshotManager.ListAllFiles(snapshotManager.storage, dir)
+		for _, file := range files {
+			if strings.HasSuffix(file, ".tmp") {
+				t.Errorf("Temporary file %s%s has not been removed", dir, file)
+			}
+		}
+	}
+}
+
+func TestPruneResumeFromCheckpoint(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash4 := uploadRandomChunk(snapshotManager, chunkSize)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	t.Logf("Creating 2 snapshots")
+	createTestSnapshot(snapshotManager, "repository1", 1, now-2*day-3600, now-2*day-60, []string{chunkHash1, chunkHash2}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 2, now-1*day-3600, now-1*day-60, []string{chunkHash2, chunkHash3}, "tag")
+
+	getChunkPath := func(chunkHash string, isFossil bool) (string, bool) {
+		chunkPath, exist, _, _ := snapshotManager.storage.FindChunk(0, snapshotManager.config.GetChunkIDFromHash(chunkHash), isFossil)
+		return chunkPath[len(chunkDir):], exist
+	}
+
+	// Pretend that an earlier run has processed the first snapshot and listed all chunks but the unreferenced one
+	checkpoint, err := snapshotManager.openPruneCheckpoint(map[string][]*Snapshot{}, false)
+	if err != nil {
+		t.Fatalf("Failed to create the prune checkpoint: %v", err)
+	}
+	var chunks []string
+	for _, chunkHash := range []string{chunkHash1, chunkHash2} {
+		chunks = append(chunks, snapshotManager.config.GetChunkIDFromHash(chunkHash))
+	}
+	checkpoint.addSnapshotChunks(&Snapshot{ID: "repository1", Revision: 1}, chunks)
+	for _, chunkHash := range []string{chunkHash1, chunkHash2, chunkHash3} {
+		chunkPath, _ := getChunkPath(chunkHash, false)
+		checkpoint.listingWriter.WriteString(chunkPath + "\n")
+		checkpoint.NumberOfListedFiles++
+	}
+	checkpoint.ListingCompleted = true
+	checkpoint.save()
+	checkpoint.close()
+
+	t.Logf("Resuming an exhaustive prune from the checkpoint")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, nil, true, false, []string{}, false, false, false, 2)
+	for _, chunkHash := range []string{chunkHash1, chunkHash2, chunkHash3, chunkHash4} {
+		if _, exist := getChunkPath(chunkHash, false); !exist {
+			t.Errorf("Chunk %s has been removed", chunkHash)
+		}
+	}
+	if exist, _, _, _ := snapshotManager.snapshotCache.GetFileInfo(0, pruneCheckpointFile); exist {
+		t.Errorf("The prune checkpoint has not been removed")
+	}
+
+	t.Logf("Running an exhaustive prune without the checkpoint")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, nil, true, false, []string{}, false, false, false, 2)
+	if _, exist := getChunkPath(chunkHash4, true); !exist {
+		t.Errorf("Unreferenced chunk %s has not been turned into a fossil", chunkHash4)
+	}
+	checkTestSnapshots(snapshotManager, 2, 1)
+}
+
+func TestPruneDuplicateListing(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	createTestSnapshot(snapshotManager, "repository1", 1, now-1*day-3600, now-1*day-60, []string{chunkHash1, chunkHash2}, "tag")
+
+	// A storage may list the same file more than once, and not necessarily one after another
+	checkpoint, err := snapshotManager.openPruneCheckpoint(map[string][]*Snapshot{}, false)
+	if err != nil {
+		t.Fatalf("Failed to create the prune checkpoint: %v", err)
+	}
+	for _, chunkHash := range []string{chunkHash3, chunkHash1, chunkHash2, chunkHash3, chunkHash1} {
+		chunkPath, _, _, _ := snapshotManager.storage.FindChunk(0, snapshotManager.config.GetChunkIDFromHash(chunkHash), false)
+		checkpoint.listingWriter.WriteString(chunkPath[len(chunkDir):] + "\n")
+		checkpoint.NumberOfListedFiles++
+	}
+	checkpoint.ListingCompleted = true
+	checkpoint.modified = true
+	checkpoint.save()
+	checkpoint.close()
+
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, nil, true, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 1, 1)
+
+	// The unreferenced chunk is turned into a fossil only once
+	logs, _ := filepath.Glob(path.Join(testDir, ".duplicacy", "logs", "prune-log-*"))
+	numberOfFossils := 0
+	for _, log := range logs {
+		content, _ := ioutil.ReadFile(log)
+		numberOfFossils += strings.Count(string(content), "Marked fossil")
+	}
+	if numberOfFossils != 1 {
+		t.Errorf("%d chunks were marked as fossils; expected 1", numberOfFossils)
+	}
+}
+
+func TestCheckVerificationLedger(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+	snapshotManager.config.FileKey = make([]byte, 32)
+	rand.Read(snapshotManager.config.FileKey)
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkID1 := snapshotManager.config.GetChunkIDFromHash(chunkHash1)
+	chunkID2 := snapshotManager.config.GetChunkIDFromHash(chunkHash2)
+	chunkID3 := snapshotManager.config.GetChunkIDFromHash(chunkHash3)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	createTestSnapshot(snapshotManager, "repository1", 1, now-2*day-3600, now-2*day-60, []string{chunkHash1, chunkHash2}, "tag")
+
+	t.Logf("Verifying all chunks")
+	snapshotManager.CheckSnapshots("repository1", []int{1}, "", false, false, false, true, false, false, false, 1, false, nil, false)
+
+	ledger := snapshotManager.loadVerificationLedger(false)
+	if len(ledger) != 3 || ledger[chunkID1] == 0 || ledger[chunkID2] == 0 {
+		t.Errorf("The verification ledger has %d chunks: %v", len(ledger), ledger)
+	}
+
+	// Make the first two chunks look like they were verified a long time ago
+	ledger[chunkID1] = 1
+	ledger[chunkID2] = 2
+	snapshotManager.saveVerificationLedger(ledger, false)
+
+	createTestSnapshot(snapshotManager, "repository1", 2, now-1*day-3600, now-1*day-60, []string{chunkHash2, chunkHash3}, "tag")
+
+	t.Logf("Verifying new chunks and the least recently verified chunk")
+	snapshotManager.CheckSnapshots("repository1", []int{}, "", false, false, false, true, false, false, false, 1, false,
+		&VerifyBudget{Percentage: 1}, true)
+
+	ledger = snapshotManager.loadVerificationLedger(false)
+	if len(ledger) != 5 {
+		t.Errorf("The verification ledger has %d chunks instead of 5", len(ledger))
+	}
+	if ledger[chunkID1] < now {
+		t.Errorf("Chunk %s was not verified again", chunkID1)
+	}
+	if ledger[chunkID2] != 2 {
+		t.Errorf("Chunk %s should not have been verified again", chunkID2)
+	}
+	if ledger[chunkID3] < now {
+		t.Errorf("New chunk %s was not verified", chunkID3)
+	}
+
+	storageLedger := snapshotManager.loadVerificationLedger(true)
+	if len(storageLedger) != len(ledger) || storageLedger[chunkID1] != ledger[chunkID1] {
+		t.Errorf("The verification ledger in the storage is different from the one in the cache")
+	}
+	description, _ := ioutil.ReadFile(path.Join(testDir, verificationLedgerFile))
+	if len(description) == 0 || strings.Contains(string(description), chunkID1) {
+		t.Errorf("The verification ledger in the storage is not encrypted")
+	}
+
+	// Entries saved by another check since the ledger was loaded are kept
+	allChunkHashes := map[string]bool{chunkHash1: true, chunkHash2: true, chunkHash3: true}
+	chunkSizeIndex := CreateChunkIndex()
+	for _, chunkID := range []string{chunkID1, chunkID2, chunkID3} {
+		chunkSizeIndex.Add(chunkID, int64(chunkSize))
+	}
+	chunkSizeIndex.Seal()
+	verification := snapshotManager.loadChunkVerification(allChunkHashes, chunkSizeIndex, nil, true)
+	storageLedger[chunkID2] = now + 100
+	snapshotManager.saveVerificationLedger(storageLedger, true)
+	verification.record(chunkHash3)
+	verification.save()
+	storageLedger = snapshotManager.loadVerificationLedger(true)
+	if storageLedger[chunkID2] != now+100 || storageLedger[chunkID3] < now {
+		t.Errorf("The verification ledger saved by another check was overwritten: %v", storageLedger)
+	}
+
+
+	for budget, expected := range map[string]VerifyBudget{
+		"500MB": {Size: 500 * 1024 * 1024},
+		"2gb":   {Size: 2 * 1024 * 1024 * 1024},
+		"100b":  {Size: 100},
+		"90m":   {Duration: 90 * time.Minute},
+		"2h":    {Duration: 2 * time.Hour},
+		"5%":    {Percentage: 5},
+	} {
+		parsed, err := ParseVerifyBudget(budget)
+		if err != nil || *parsed != expected {
+			t.Errorf("Budget %s was parsed as %v: %v", budget, parsed, err)
+		}
+	}
+	for _, budget := range []string{"", "100", "0%", "150%", "-1h", "2x"} {
+		if _, err := ParseVerifyBudget(budget); err == nil {
+			t.Errorf("Invalid budget %s was accepted", budget)
+		}
+	}
+}
+
+// checksumFileStorage is a file storage that reports SHA256 checksums of files when listing them
+type checksumFileStorage struct {
+	*FileStorage
+}
+
+func (storage *checksumFileStorage) ListFilesWithChecksums(threadIndex int, dir string) (files []string, sizes []int64, checksums []string, err error) {
+	top := path.Join(storage.storageDir, dir)
+	err = filepath.Walk(top, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		relativePath, _ := filepath.Rel(top, filePath)
+		files = append(files, filepath.ToSlash(relativePath))
+		sizes = append(sizes, info.Size())
+		checksums = append(checksums, storage.ComputeChecksum(content))
+		return nil
+	})
+	return files, sizes, checksums, err
+}
+
+func (storage *checksumFileStorage) ComputeChecksum(content []byte) string {
+	digest := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(digest[:])
+}
+
+func TestCheckRemoteChecksums(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+	snapshotManager.storage = &checksumFileStorage{snapshotManager.storage.(*FileStorage)}
+
+	// Chunks uploaded with the snapshot cache have their checksums recorded
+	chunkOperator := CreateChunkOperator(snapshotManager.config, snapshotManager.storage, snapshotManager.snapshotCache, false, false, 1, false)
+	chunkOperator.UploadCompletionFunc = func(chunk *Chunk, chunkIndex int, skipped bool, chunkSize int, uploadSize int) {}
+	var chunkHashes []string
+	for i := 0; i < 2; i++ {
+		content := make([]byte, 1024)
+		rand.Read(content)
+		chunk := CreateChunk(snapshotManager.config, true)
+		chunk.Reset(true)
+		chunk.Write(content)
+		chunkOperator.Upload(chunk, i, false)
+		chunkOperator.WaitForCompletion()
+		chunkHashes = append(chunkHashes, chunk.GetHash())
+	}
+	chunkOperator.Stop()
+
+	checksums, _ := snapshotManager.loadChunkChecksums()
+	if len(checksums) != 2 {
+		t.Errorf("%d checksums were recorded at upload time instead of 2", len(checksums))
+	}
+
+	// This chunk and the chunk sequence of the snapshot are not recorded at upload time
+	chunkHashes = append(chunkHashes, uploadRandomChunk(snapshotManager, 1024))
+
+	now := time.Now().Unix()
+	createTestSnapshot(snapshotManager, "repository1", 1, now-3600, now-60, chunkHashes, "tag")
+
+	snapshotManager.SetRemoteChecksums(true)
+	if !snapshotManager.CheckSnapshots("repository1", []int{1}, "", false, false, false, false, false, false, false, 1, false, nil, false) {
+		t.Errorf("Failed to check checksums of chunks")
+	}
+
+	checksums, _ = snapshotManager.loadChunkChecksums()
+	if len(checksums) != 4 {
+		t.Errorf("The checksum index has %d chunks instead of 4", len(checksums))
+	}
+
+	chunkID := snapshotManager.config.GetChunkIDFromHash(chunkHashes[0])
+	chunkPath, _, _, _ := snapshotManager.storage.FindChunk(0, chunkID, false)
+	corruptFile(path.Join(testDir, chunkPath), 16, 16, 1)
+
+	mismatches, ok := snapshotManager.checkRemoteChecksums(func(file string, size int64) {})
+	if !ok || mismatches != 1 {
+		t.Errorf("Found %d chunks with mismatched checksums instead of 1", mismatches)
+	}
+
+	// The mismatch is reported again by later checks
+	mismatches, _ = snapshotManager.checkRemoteChecksums(func(file string, size int64) {})
+	if mismatches != 1 {
+		t.Errorf("Found %d chunks with mismatched checksums in the second check instead of 1", mismatches)
+	}
 }
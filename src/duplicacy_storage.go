@@ -15,6 +15,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -69,6 +70,70 @@ type Storage interface {
 
 	// Set the maximum transfer speeds.
 	SetRateLimits(downloadRateLimit int, uploadRateLimit int)
+
+	// Set the append-only mode in which the client must not delete or rename any file.
+	SetAppendOnly(appendOnly bool)
+
+	// If the client is in the append-only mode.
+	IsAppendOnly() bool
+}
+
+// ObjectLockStorage is implemented by storages that can make files immutable for a retention period, so that they
+// can't be overwritten or deleted before then even by a client with valid credentials.
+type ObjectLockStorage interface {
+	// SetObjectLock makes chunks and snapshot files uploaded afterwards locked for 'retention'.  'mode' is either
+	// 'governance' or 'compliance'.
+	SetObjectLock(mode string, retention time.Duration) (err error)
+
+	// IsObjectLockEnabled returns true if files in the storage may be locked.
+	IsObjectLockEnabled() bool
+
+	// GetObjectLockExpiry returns the time until which the file at 'filePath' is locked, or the zero time if it
+	// isn't locked (any more).
+	GetObjectLockExpiry(threadIndex int, filePath string) (expiry time.Time, err error)
+}
+
+// ConditionalUploadStorage is implemented by storages that can upload a file only if no file exists at the same path,
+// in a single operation, so that of two clients uploading the same file only one succeeds.
+type ConditionalUploadStorage interface {
+	// UploadFileIfNotExist uploads 'content' to 'filePath' unless the file already exists, in which case nothing is
+	// uploaded and 'exist' is true.
+	UploadFileIfNotExist(threadIndex int, filePath string, content []byte) (exist bool, err error)
+}
+
+// uploadFileIfNotExist uploads 'content' to 'filePath' unless the file already exists.  Storages that can't upload
+// conditionally are checked before the upload, which still leaves a short window for another client to upload the
+// same file.
+func uploadFileIfNotExist(storage Storage, threadIndex int, filePath string, content []byte) (exist bool, err error) {
+	if conditionalStorage, ok := storage.(ConditionalUploadStorage); ok {
+		return conditionalStorage.UploadFileIfNotExist(threadIndex, filePath, content)
+	}
+
+	exist, _, _, err = storage.GetFileInfo(threadIndex, filePath)
+	if err != nil || exist {
+		return exist, err
+	}
+	return false, storage.UploadFile(threadIndex, filePath, content)
+}
+
+// ChecksumStorage is implemented by storages whose file listings include a checksum computed by the storage service,
+// which allows chunks to be checked for corruption or truncation without downloading them.  Checksums are in the form
+// of '<algorithm>:<hex value>'.
+type ChecksumStorage interface {
+	// ListFilesWithChecksums returns all files under 'dir' recursively, along with their sizes and checksums.  The
+	// checksum is empty if the storage service doesn't have one for the file.
+	ListFilesWithChecksums(threadIndex int, dir string) (files []string, sizes []int64, checksums []string, err error)
+
+	// ComputeChecksum returns the checksum the storage service will report for a file with 'content'.
+	ComputeChecksum(content []byte) string
+}
+
+var objectLockRegex = regexp.MustCompile(`^(chunks/.+|snapshots/[^/]+/[0-9]+)$`)
+
+// isObjectLockRequired returns true if the file should be locked when object lock is enabled.  Only chunks and
+// snapshot files are locked; other files such as holds must remain removable.
+func isObjectLockRequired(filePath string) bool {
+	return objectLockRegex.MatchString(filePath)
 }
 
 // StorageBase is the base struct from which all storages are derived from
@@ -80,6 +145,8 @@ type StorageBase struct {
 
 	readLevels []int // At which nesting level to find the chunk with the given id
 	writeLevel int   // Store the uploaded chunk to this level
+
+	appendOnly bool // Files are never deleted or renamed; pruning is left to a trusted host
 }
 
 // SetRateLimits sets the maximum download and upload rates
@@ -88,6 +155,17 @@ func (storage *StorageBase) SetRateLimits(downloadRateLimit int, uploadRateLimit
 	storage.UploadRateLimit = uploadRateLimit
 }
 
+// SetAppendOnly enables or disables the append-only mode.  In this mode the client only needs permissions to list,
+// download and upload files, so operations that delete or rename files are refused.
+func (storage *StorageBase) SetAppendOnly(appendOnly bool) {
+	storage.appendOnly = appendOnly
+}
+
+// IsAppendOnly returns true if the client must not delete or rename any file in the storage.
+func (storage *StorageBase) IsAppendOnly() bool {
+	return storage.appendOnly
+}
+
 // SetDefaultNestingLevels sets the default read and write levels.  This is usually called by
 // derived storages to set the levels with old values so that storages initialized by earlier versions
 // will continue to work.
@@ -215,6 +293,38 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 
 	storageURL := preference.StorageURL
 
+	if preference.ObjectLockDays > 0 {
+		defer func() {
+			if storage == nil {
+				return
+			}
+			lockStorage, ok := storage.(ObjectLockStorage)
+			if !ok {
+				LOG_ERROR("STORAGE_LOCK", "Object lock is not supported by the storage %s", storageURL)
+				return
+			}
+			mode := preference.ObjectLockMode
+			if mode == "" {
+				mode = "governance"
+			}
+			err := lockStorage.SetObjectLock(mode, time.Duration(preference.ObjectLockDays)*24*time.Hour)
+			if err != nil {
+				LOG_ERROR("STORAGE_LOCK", "Failed to enable object lock for the storage %s: %v", storageURL, err)
+				return
+			}
+			LOG_DEBUG("STORAGE_LOCK", "Files uploaded to %s will be locked for %d days in %s mode", storageURL,
+				preference.ObjectLockDays, mode)
+		}()
+	}
+
+	if preference.AppendOnly {
+		defer func() {
+			if storage != nil {
+				storage.SetAppendOnly(true)
+			}
+		}()
+	}
+
 	isFileStorage := false
 	isCacheNeeded := false
 
@@ -252,6 +362,18 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 		return fileStorage
 	}
 
+	// A local storage that refuses to delete, rename or overwrite files, like a server that only grants the
+	// list, get and put permissions
+	if strings.HasPrefix(storageURL, "append-only://") {
+		fileStorage, err := CreateFileStorage(storageURL[14:], false, threads)
+		if err != nil {
+			LOG_ERROR("STORAGE_CREATE", "Failed to load the file storage at %s: %v", storageURL, err)
+			return nil
+		}
+		fileStorage.rejectDeletions = true
+		return fileStorage
+	}
+
 	if strings.HasPrefix(storageURL, "samba://") {
 		fileStorage, err := CreateFileStorage(storageURL[8:], true, threads)
 		if err != nil {
@@ -29,6 +29,7 @@ var testThreads = flag.Int("threads", 1, "number of downloading/uploading thread
 var testFixedChunkSize = flag.Bool("fixed-chunk-size", false, "fixed chunk size")
 var testRSAEncryption = flag.Bool("rsa", false, "enable RSA encryption")
 var testErasureCoding = flag.Bool("erasure-coding", false, "enable Erasure Coding")
+var testFileBoundarySize = flag.Int("file-boundary-size", 0, "force chunk boundaries at files of this size or larger")
 
 func loadStorage(localStoragePath string, threads int) (Storage, error) {
 
@@ -162,44 +162,57 @@ func GenerateKeyFromPassword(password string, salt []byte, iterations int) []byt
 	return pbkdf2.Key([]byte(password), salt, iterations, 32, sha256.New)
 }
 
-// Get password from preference, env, but don't start any keyring request
+// GetPasswordFromPreference gets the password from the sources below without starting any keyring request or
+// prompting the user.  'id' is the password type prefixed by the storage name and '_' for storages other than the
+// default one, e.g. 'password' or 'offsite_s3_secret'.  The sources are consulted in this order:
+//
+//  1. the environment variable DUPLICACY_<ID>
+//  2. the file named by the environment variable DUPLICACY_<ID>_FILE
+//  3. the output of the command in the environment variable DUPLICACY_<ID>_COMMAND
+//  4. the systemd credential <id>, i.e. the file $CREDENTIALS_DIRECTORY/<id>
+//  5. the secret <id> in the encrypted secrets store of the repository, if there is one and its passphrase is
+//     available from the credential sources or it has already been unlocked
+//  6. the file named by the preference key <id>_file, the output of the command in the preference key <id>_command,
+//     or the preference key <id> itself
+//  7. the same preference keys without the storage name prefix
+//
+// Commands are run with the shell and may prompt on the terminal; the trailing line break of files and command
+// outputs is removed.
 func GetPasswordFromPreference(preference Preference, passwordType string) string {
 	passwordID := passwordType
 	if preference.Name != "default" {
 		passwordID = preference.Name + "_" + passwordID
 	}
 
-	{
-		name := strings.ToUpper("duplicacy_" + passwordID)
-		LOG_DEBUG("PASSWORD_ENV_VAR", "Reading the environment variable %s", name)
-		if password, found := os.LookupEnv(name); found && password != "" {
-			return password
-		}
+	name := strings.ToUpper("duplicacy_" + passwordID)
+	if password := getCredentialFromEnvironment(name, ""); password != "" {
+		return password
+	}
 
-		re := regexp.MustCompile(`[^a-zA-Z0-9_]`)
-		namePlain := re.ReplaceAllString(name, "_")
-		if namePlain != name {
-			LOG_DEBUG("PASSWORD_ENV_VAR", "Reading the environment variable %s", namePlain)
-			if password, found := os.LookupEnv(namePlain); found && password != "" {
-				return password
-			}
-		}
+	if filePath := getCredentialFromEnvironment(name, "_FILE"); filePath != "" {
+		return readCredentialFile(filePath)
+	}
+
+	if command := getCredentialFromEnvironment(name, "_COMMAND"); command != "" {
+		return runCredentialCommand(command)
+	}
+
+	if password := getCredentialFromSystemd(passwordID); password != "" {
+		return password
+	}
+
+	if password := getSecret(passwordID, false); password != "" {
+		return password
 	}
 
 	// If the password is stored in the preference, there is no need to include the storage name
 	// (i.e., preference.Name) in the key, so the key name should really be passwordType rather
 	// than passwordID; we're using passwordID here only for backward compatibility
-	if len(preference.Keys) > 0 && len(preference.Keys[passwordID]) > 0 {
-		LOG_DEBUG("PASSWORD_PREFERENCE", "Reading %s from preferences", passwordID)
-		return preference.Keys[passwordID]
-	}
-
-	if len(preference.Keys) > 0 && len(preference.Keys[passwordType]) > 0 {
-		LOG_DEBUG("PASSWORD_PREFERENCE", "Reading %s from preferences", passwordType)
-		return preference.Keys[passwordType]
+	if password := getCredentialFromPreference(preference, passwordID); password != "" {
+		return password
 	}
 
-	return ""
+	return getCredentialFromPreference(preference, passwordType)
 }
 
 // GetPassword attempts to get the password from KeyChain/KeyRing, environment variables, or keyboard input.
@@ -216,6 +229,14 @@ func GetPassword(preference Preference, passwordType string, prompt string,
 		passwordID = preference.Name + "_" + passwordID
 	}
 
+	// Only here, where the user would be prompted for the password anyway, is the secrets store unlocked by
+	// prompting for its passphrase
+	if !resetPassword {
+		if password := getSecret(passwordID, true); password != "" {
+			return password
+		}
+	}
+
 	if resetPassword && !RunInBackground {
 		keyringSet(passwordID, "")
 	} else {
@@ -250,7 +271,7 @@ func GetPassword(preference Preference, passwordType string, prompt string,
 	return password
 }
 
-// SavePassword saves the specified password in the keyring/keychain.
+// SavePassword saves the specified password in the secrets store of the repository or the keyring/keychain.
 func SavePassword(preference Preference, passwordType string, password string) {
 
 	if password == "" || RunInBackground {
@@ -270,6 +291,11 @@ func SavePassword(preference Preference, passwordType string, password string) {
 	if preference.Name != "default" {
 		passwordID = preference.Name + "_" + passwordID
 	}
+
+	// The secrets store takes the place of the keyring if the repository has one
+	if saveSecret(passwordID, password) {
+		return
+	}
 	keyringSet(passwordID, password)
 }
 
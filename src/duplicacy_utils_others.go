@@ -112,3 +112,12 @@ func joinPath(components ...string) string {
 func SplitDir(fullPath string) (dir string, file string) {
 	return path.Split(fullPath)
 }
+
+// isProcessRunning returns true if a process with the given pid exists, even if it belongs to another user.
+func isProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
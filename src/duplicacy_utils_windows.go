@@ -48,6 +48,9 @@ const (
 	SYMBOLIC_LINK_FLAG_DIRECTORY     = 0x1
 
 	FILE_READ_ATTRIBUTES = 0x0080
+
+	PROCESS_QUERY_LIMITED_INFORMATION = 0x1000
+	STILL_ACTIVE                      = 259
 )
 
 // We copied golang source code for Readlink but made a simple modification here:  use FILE_READ_ATTRIBUTES instead of
@@ -166,3 +169,24 @@ const invalidFsId fsId = -1
 func getFsId(fi os.FileInfo) fsId {
 	return 0
 }
+
+// getInodeInfo returns 0 for both the inode number and the change time since neither is available on Windows.
+func getInodeInfo(fi os.FileInfo) (inode uint64, ctime int64) {
+	return 0, 0
+}
+
+// isProcessRunning returns true if a process with the given pid exists.
+func isProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	handle, err := syscall.OpenProcess(PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(handle)
+
+	var exitCode uint32
+	err = syscall.GetExitCodeProcess(handle, &exitCode)
+	return err != nil || exitCode == STILL_ACTIVE
+}
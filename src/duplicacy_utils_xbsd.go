@@ -44,3 +44,9 @@ const invalidFsId fsId = 0
 func getFsId(fi os.FileInfo) fsId {
 	return fsId(fi.Sys().(*syscall.Stat_t).Dev)
 }
+
+// getInodeInfo returns the inode number and the change time (in nanoseconds) of a file.
+func getInodeInfo(fi os.FileInfo) (inode uint64, ctime int64) {
+	stat := fi.Sys().(*syscall.Stat_t)
+	return uint64(stat.Ino), stat.Ctimespec.Nano()
+}
@@ -0,0 +1,357 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The verification ledger is saved under this name in the snapshot cache and, optionally and encrypted, in the storage
+const verificationLedgerFile = "verified_chunks"
+
+// How often the ledger is saved while chunks are being verified
+const verificationSaveInterval = 5 * 60
+
+// VerifyBudget limits how many previously verified chunks are verified again by 'check -chunks' or 'check -files'.
+// Only one of the fields is set.
+type VerifyBudget struct {
+	Size       int64
+	Duration   time.Duration
+	Percentage float64
+}
+
+// ParseVerifyBudget parses a budget given as a size (e.g. 500MB, 2GB), a duration (e.g. 45m, 2h) or a percentage
+// of the previously verified chunks (e.g. 5%).
+func ParseVerifyBudget(budget string) (*VerifyBudget, error) {
+
+	budget = strings.TrimSpace(budget)
+
+	if strings.HasSuffix(budget, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(budget, "%"), 64)
+		if err != nil || percentage <= 0 || percentage > 100 {
+			return nil, fmt.Errorf("invalid percentage '%s'", budget)
+		}
+		return &VerifyBudget{Percentage: percentage}, nil
+	}
+
+	sizeRegex := regexp.MustCompile(`^([0-9]+)([kmgt]?)b$`)
+	if matched := sizeRegex.FindStringSubmatch(strings.ToLower(budget)); matched != nil {
+		size, err := strconv.ParseInt(matched[1], 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid size '%s'", budget)
+		}
+		if matched[2] != "" {
+			size <<= uint(10 * (strings.Index("kmgt", matched[2]) + 1))
+		}
+		return &VerifyBudget{Size: size}, nil
+	}
+
+	duration, err := time.ParseDuration(budget)
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("'%s' is neither a size, a duration, nor a percentage", budget)
+	}
+	return &VerifyBudget{Duration: duration}, nil
+}
+
+func (budget *VerifyBudget) String() string {
+	if budget.Size > 0 {
+		return PrettyNumber(budget.Size) + " bytes"
+	} else if budget.Duration > 0 {
+		return budget.Duration.String()
+	} else {
+		return fmt.Sprintf("%g%% of verified chunks", budget.Percentage)
+	}
+}
+
+// chunkVerification decides which chunks 'check -chunks' or 'check -files' needs to download.  Chunks that have never
+// been verified are always selected; those found in the verification ledger are only selected, least recently verified
+// first, as long as the verification budget allows.  The ledger maps chunk ids (not chunk hashes) to the time of the
+// last successful verification.
+type chunkVerification struct {
+	manager *SnapshotManager
+
+	ledger       map[string]int64
+	ledgerLock   sync.Mutex
+	modified     bool
+	lastSaveTime int64
+
+	// Whether to also keep the ledger in the storage so that it can be shared with other clients
+	inStorage bool
+
+	budget    *VerifyBudget
+	startTime time.Time
+
+	// Chunks to be verified, those never verified before come first
+	chunkHashes       []string
+	numberOfNewChunks int
+
+	// Maps selected chunk hashes to true if they are new
+	selected map[string]bool
+}
+
+// loadChunkVerification loads the verification ledger and selects the chunks to verify among 'allChunkHashes'.
+// Entries of chunks no longer in the storage, as given by 'chunkSizeIndex', are removed from the ledger.
+func (manager *SnapshotManager) loadChunkVerification(allChunkHashes map[string]bool, chunkSizeIndex *ChunkIndex,
+	budget *VerifyBudget, inStorage bool) *chunkVerification {
+
+	verification := &chunkVerification{
+		manager:      manager,
+		lastSaveTime: time.Now().Unix(),
+		inStorage:    inStorage,
+		budget:       budget,
+		selected:     make(map[string]bool),
+	}
+
+	// The ledger in the storage may contain chunks verified by other clients; keep the latest time for each chunk,
+	// and remember if either copy needs to be updated.
+	verification.ledger = manager.loadVerificationLedger(false)
+	if inStorage {
+		storageLedger := manager.loadVerificationLedger(true)
+		if mergeVerificationLedger(verification.ledger, storageLedger) {
+			verification.modified = true
+		}
+		for chunkID, lastVerified := range verification.ledger {
+			if storageLedger[chunkID] != lastVerified {
+				verification.modified = true
+				break
+			}
+		}
+	}
+
+	for chunkID := range verification.ledger {
+		if _, found := chunkSizeIndex.Find(chunkID); !found {
+			delete(verification.ledger, chunkID)
+			verification.modified = true
+		}
+	}
+
+	type verifiedChunk struct {
+		hash         string
+		id           string
+		lastVerified int64
+	}
+
+	var verifiedChunks []verifiedChunk
+	for chunkHash := range allChunkHashes {
+		chunkID := manager.config.GetChunkIDFromHash(chunkHash)
+		if lastVerified, found := verification.ledger[chunkID]; found {
+			verifiedChunks = append(verifiedChunks, verifiedChunk{chunkHash, chunkID, lastVerified})
+		} else {
+			verification.chunkHashes = append(verification.chunkHashes, chunkHash)
+			verification.selected[chunkHash] = true
+		}
+	}
+	verification.numberOfNewChunks = len(verification.chunkHashes)
+
+	if len(verifiedChunks) > 0 {
+		LOG_INFO("SNAPSHOT_VERIFY", "Skipped %d chunks that have already been verified before", len(verifiedChunks))
+	}
+
+	if budget == nil || len(verifiedChunks) == 0 {
+		return verification
+	}
+
+	// Shuffle first so that chunks verified at the same time are sampled randomly
+	rand.Shuffle(len(verifiedChunks), func(i, j int) {
+		verifiedChunks[i], verifiedChunks[j] = verifiedChunks[j], verifiedChunks[i]
+	})
+	sort.SliceStable(verifiedChunks, func(i, j int) bool {
+		return verifiedChunks[i].lastVerified < verifiedChunks[j].lastVerified
+	})
+
+	numberOfSampledChunks := len(verifiedChunks)
+	if budget.Percentage > 0 {
+		numberOfSampledChunks = int(math.Ceil(float64(len(verifiedChunks)) * budget.Percentage / 100))
+	} else if budget.Size > 0 {
+		var totalSize int64
+		for i, chunk := range verifiedChunks {
+			if totalSize >= budget.Size {
+				numberOfSampledChunks = i
+				break
+			}
+			if entry, found := chunkSizeIndex.Find(chunk.id); found {
+				totalSize += entry.value
+			}
+		}
+	}
+
+	for _, chunk := range verifiedChunks[:numberOfSampledChunks] {
+		verification.chunkHashes = append(verification.chunkHashes, chunk.hash)
+		verification.selected[chunk.hash] = false
+	}
+
+	if budget.Duration > 0 {
+		LOG_INFO("SNAPSHOT_VERIFY", "Verifying previously verified chunks for up to %s", budget)
+	} else {
+		LOG_INFO("SNAPSHOT_VERIFY", "Selected %d previously verified chunks to verify again within the budget of %s",
+			numberOfSampledChunks, budget)
+	}
+	return verification
+}
+
+// loadVerificationLedger loads the ledger from the snapshot cache, or from the storage if 'inStorage' is true, where
+// it is encrypted with the file key like other metadata files.  A missing or unreadable ledger is treated as empty.
+func (manager *SnapshotManager) loadVerificationLedger(inStorage bool) map[string]int64 {
+
+	ledger := make(map[string]int64)
+
+	storage, name := Storage(manager.snapshotCache), "cache"
+	if inStorage {
+		storage, name = manager.storage, "storage"
+	}
+
+	exist, _, _, err := storage.GetFileInfo(0, verificationLedgerFile)
+	if err != nil {
+		LOG_WARN("SNAPSHOT_VERIFY", "Failed to check the verification ledger in the %s: %v", name, err)
+		return ledger
+	}
+	if !exist {
+		return ledger
+	}
+
+	chunk := manager.config.GetChunk()
+	defer manager.config.PutChunk(chunk)
+	chunk.Reset(false)
+	err = storage.DownloadFile(0, verificationLedgerFile, chunk)
+	if err != nil {
+		LOG_WARN("SNAPSHOT_VERIFY", "Failed to load the verification ledger from the %s: %v", name, err)
+		return ledger
+	}
+
+	if inStorage {
+		err, _ = chunk.Decrypt(manager.config.FileKey, verificationLedgerFile)
+		if err != nil {
+			LOG_WARN("SNAPSHOT_VERIFY", "Failed to decrypt the verification ledger from the %s: %v", name, err)
+			return ledger
+		}
+	}
+
+	err = json.Unmarshal(chunk.GetBytes(), &ledger)
+	if err != nil {
+		LOG_WARN("SNAPSHOT_VERIFY", "Failed to parse the verification ledger from the %s: %v", name, err)
+		return make(map[string]int64)
+	}
+
+	LOG_DEBUG("SNAPSHOT_VERIFY", "Loaded %d verified chunks from the %s", len(ledger), name)
+	return ledger
+}
+
+// saveVerificationLedger writes the ledger to the snapshot cache, or to the storage if 'inStorage' is true.
+func (manager *SnapshotManager) saveVerificationLedger(ledger map[string]int64, inStorage bool) error {
+
+	description, err := json.Marshal(ledger)
+	if err != nil {
+		return err
+	}
+
+	if !inStorage {
+		return manager.snapshotCache.UploadFile(0, verificationLedgerFile, description)
+	}
+
+	chunk := manager.config.GetChunk()
+	defer manager.config.PutChunk(chunk)
+	chunk.Reset(false)
+	chunk.Write(description)
+	err = chunk.Encrypt(manager.config.FileKey, verificationLedgerFile, true)
+	if err != nil {
+		return err
+	}
+	return manager.storage.UploadFile(0, verificationLedgerFile, chunk.GetBytes())
+}
+
+// mergeVerificationLedger adds the entries of 'other' to 'ledger', keeping the latest time for each chunk, and
+// returns true if 'ledger' has been changed.
+func mergeVerificationLedger(ledger map[string]int64, other map[string]int64) (changed bool) {
+	for chunkID, lastVerified := range other {
+		if lastVerified > ledger[chunkID] {
+			ledger[chunkID] = lastVerified
+			changed = true
+		}
+	}
+	return changed
+}
+
+// needsVerification returns true if the chunk is new, or if it has been sampled and the budget isn't used up yet.
+func (verification *chunkVerification) needsVerification(chunkHash string) bool {
+	verification.ledgerLock.Lock()
+	isNew, found := verification.selected[chunkHash]
+	verification.ledgerLock.Unlock()
+	if !found {
+		return false
+	}
+	return isNew || verification.withinBudget()
+}
+
+// withinBudget returns false if the time allowed for verifying previously verified chunks has passed.
+func (verification *chunkVerification) withinBudget() bool {
+	if verification.budget == nil || verification.budget.Duration == 0 {
+		return true
+	}
+	return time.Since(verification.startTime) < verification.budget.Duration
+}
+
+// start marks the start of the verification, against which the duration budget is measured.
+func (verification *chunkVerification) start() {
+	verification.startTime = time.Now()
+}
+
+// record adds the chunk to the ledger and saves the ledger if it hasn't been saved for a while.  The chunk won't need
+// to be verified again in this run.
+func (verification *chunkVerification) record(chunkHash string) {
+	chunkID := verification.manager.config.GetChunkIDFromHash(chunkHash)
+
+	verification.ledgerLock.Lock()
+	delete(verification.selected, chunkHash)
+	now := time.Now().Unix()
+	verification.ledger[chunkID] = now
+	verification.modified = true
+	if now <= verification.lastSaveTime+verificationSaveInterval {
+		verification.ledgerLock.Unlock()
+		return
+	}
+	verification.lastSaveTime = now
+	verification.ledgerLock.Unlock()
+	verification.save()
+}
+
+// save writes the ledger to the snapshot cache, and to the storage if requested.  Another check may have saved its
+// own ledger since this one was loaded, so the saved ledger is merged with this one before being overwritten.
+func (verification *chunkVerification) save() {
+	verification.ledgerLock.Lock()
+	defer verification.ledgerLock.Unlock()
+
+	if !verification.modified {
+		return
+	}
+
+	manager := verification.manager
+	mergeVerificationLedger(verification.ledger, manager.loadVerificationLedger(false))
+	err := manager.saveVerificationLedger(verification.ledger, false)
+	if err != nil {
+		LOG_WARN("SNAPSHOT_VERIFY", "Failed to save the verification ledger: %v", err)
+		return
+	}
+
+	if verification.inStorage {
+		mergeVerificationLedger(verification.ledger, manager.loadVerificationLedger(true))
+		err = manager.saveVerificationLedger(verification.ledger, true)
+		if err != nil {
+			LOG_WARN("SNAPSHOT_VERIFY", "Failed to save the verification ledger to the storage: %v", err)
+			return
+		}
+	}
+
+	verification.modified = false
+	LOG_INFO("SNAPSHOT_VERIFY", "Saved the verification ledger with %d verified chunks", len(verification.ledger))
+}
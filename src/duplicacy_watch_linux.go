@@ -0,0 +1,264 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotify is used instead of fanotify because reporting directory events with fanotify requires CAP_SYS_ADMIN
+const watchMask = unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM |
+	unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW
+
+type repositoryWatcher struct {
+	fd          int
+	top         string
+	directories map[int]string  // watch descriptor to directory path
+	dirty       map[string]bool // directories changed since the last flush
+	unwatched   map[string]bool // directories that couldn't be watched and are therefore always dirty
+	overflow    bool
+	lock        sync.Mutex
+}
+
+// WatchRepository watches the repository 'top' and records every directory in which a change has occurred in the
+// change journals under 'cachePaths', so that the next backup to each storage can skip directories that haven't
+// changed.  It never returns unless an error occurs.
+func WatchRepository(top string, cachePaths []string) {
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		LOG_ERROR("WATCH_INIT", "Failed to initialize inotify: %v", err)
+		return
+	}
+	defer unix.Close(fd)
+
+	watcher := &repositoryWatcher{
+		fd:          fd,
+		top:         top,
+		directories: make(map[int]string),
+		dirty:       make(map[string]bool),
+		unwatched:   make(map[string]bool),
+	}
+
+	LOG_INFO("WATCH_START", "Adding watches for %s", top)
+	watcher.addWatches("")
+	watcher.dirty = make(map[string]bool)
+
+	// A journal can only be trusted by backups that started after all watches have been added
+	session := fmt.Sprintf("%d %d", os.Getpid(), time.Now().UnixNano())
+	watcher.flush(session, cachePaths)
+	LOG_INFO("WATCH_START", "Watching %d directories", len(watcher.directories))
+
+	go func() {
+		defer CatchLogException()
+		buffer := make([]byte, 256*1024)
+		for {
+			n, err := unix.Read(fd, buffer)
+			if err == unix.EINTR {
+				continue
+			} else if err != nil {
+				LOG_ERROR("WATCH_READ", "Failed to read inotify events: %v", err)
+				return
+			}
+			watcher.processEvents(buffer[:n])
+		}
+	}()
+
+	for range time.Tick(time.Second) {
+		watcher.flush(session, cachePaths)
+	}
+}
+
+// addWatches adds a watch for 'dir' and all its subdirectories, marking them as dirty.
+func (watcher *repositoryWatcher) addWatches(dir string) {
+
+	watcher.dirty[dir] = true
+
+	fullPath := joinPath(watcher.top, dir)
+	wd, err := unix.InotifyAddWatch(watcher.fd, fullPath, watchMask)
+	if err == unix.ENOSPC {
+		LOG_ERROR("WATCH_LIMIT", "Too many directories to watch; consider increasing fs.inotify.max_user_watches")
+		return
+	} else if err != nil {
+		if err != unix.ENOENT {
+			LOG_WARN("WATCH_ADD", "Failed to watch %s: %v", fullPath, err)
+			watcher.unwatched[dir] = true
+		}
+		return
+	}
+	watcher.directories[wd] = dir
+
+	files, err := ioutil.ReadDir(fullPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LOG_WARN("WATCH_LIST", "Failed to list %s: %v", fullPath, err)
+			watcher.unwatched[dir] = true
+		}
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() && f.Name() != DUPLICACY_DIRECTORY {
+			watcher.addWatches(dir + f.Name() + "/")
+		}
+	}
+}
+
+// removeWatches removes the watches for 'dir' and all its subdirectories.
+func (watcher *repositoryWatcher) removeWatches(dir string) {
+	for wd, path := range watcher.directories {
+		if strings.HasPrefix(path, dir) {
+			unix.InotifyRmWatch(watcher.fd, uint32(wd))
+			delete(watcher.directories, wd)
+		}
+	}
+	for path := range watcher.unwatched {
+		if strings.HasPrefix(path, dir) {
+			delete(watcher.unwatched, path)
+		}
+	}
+}
+
+func (watcher *repositoryWatcher) processEvents(buffer []byte) {
+
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buffer); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+		nameStart := offset + unix.SizeofInotifyEvent
+		offset = nameStart + int(event.Len)
+
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+			LOG_WARN("WATCH_OVERFLOW", "The inotify event queue overflowed")
+			watcher.overflow = true
+			continue
+		}
+
+		dir, found := watcher.directories[int(event.Wd)]
+		if !found {
+			continue
+		}
+
+		if event.Mask&unix.IN_IGNORED != 0 {
+			delete(watcher.directories, int(event.Wd))
+			continue
+		}
+
+		name := string(bytes.TrimRight(buffer[nameStart:offset], "\x00"))
+		if name == DUPLICACY_DIRECTORY {
+			continue
+		}
+
+		watcher.dirty[dir] = true
+		LOG_TRACE("WATCH_EVENT", "Event 0x%x on %s%s", event.Mask, dir, name)
+
+		if event.Mask&unix.IN_ISDIR == 0 || name == "" {
+			continue
+		}
+
+		subdirectory := dir + name + "/"
+		watcher.dirty[subdirectory] = true
+		if event.Mask&unix.IN_MOVED_FROM != 0 {
+			watcher.removeWatches(subdirectory)
+		} else if event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+			// Subdirectories moved here have the same inodes and timestamps as before so they must all be marked
+			watcher.addWatches(subdirectory)
+		}
+	}
+}
+
+// flush appends the dirty directories to the change journals.
+func (watcher *repositoryWatcher) flush(session string, cachePaths []string) {
+
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	var dirtyPaths []string
+	for dir := range watcher.dirty {
+		dirtyPaths = append(dirtyPaths, dir)
+	}
+	for dir := range watcher.unwatched {
+		if !watcher.dirty[dir] {
+			dirtyPaths = append(dirtyPaths, dir)
+		}
+	}
+	sort.Strings(dirtyPaths)
+
+	for _, cachePath := range cachePaths {
+		err := appendChangeJournal(cachePath, session, dirtyPaths, watcher.overflow)
+		if err != nil {
+			LOG_ERROR("WATCH_JOURNAL", "Failed to write the change journal under %s: %v", cachePath, err)
+			return
+		}
+	}
+
+	if len(watcher.dirty) > 0 {
+		LOG_DEBUG("WATCH_FLUSH", "%d directories have been changed", len(watcher.dirty))
+	}
+
+	watcher.dirty = make(map[string]bool)
+	watcher.overflow = false
+}
+
+// lockChangeJournal locks the journal for writing and returns true if it has been renamed after it was opened.
+func lockChangeJournal(journal *os.File, journalPath string) (renamed bool, err error) {
+	err = unix.Flock(int(journal.Fd()), unix.LOCK_EX)
+	if err != nil {
+		return false, err
+	}
+
+	opened, err := journal.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	current, err := os.Stat(journalPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return !os.SameFile(opened, current), nil
+}
+
+// readChangeJournal reads the journal after the watch command has finished writing to it.
+func readChangeJournal(journalPath string) ([]byte, error) {
+	journal, err := os.Open(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	defer journal.Close()
+
+	err = unix.Flock(int(journal.Fd()), unix.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(journal)
+}
+
+// isWatchSessionRunning returns true if the process that started the watch session is still running.
+func isWatchSessionRunning(session string) bool {
+	pid, err := strconv.Atoi(strings.Fields(session + " ")[0])
+	if err != nil || pid <= 0 {
+		return false
+	}
+
+	err = unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
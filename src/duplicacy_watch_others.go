@@ -0,0 +1,30 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+//go:build !linux
+// +build !linux
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// WatchRepository is only supported on Linux.
+func WatchRepository(top string, cachePaths []string) {
+	LOG_ERROR("WATCH_UNSUPPORTED", "Watching for changes is only supported on Linux")
+}
+
+func lockChangeJournal(journal *os.File, journalPath string) (renamed bool, err error) {
+	return false, nil
+}
+
+func readChangeJournal(journalPath string) ([]byte, error) {
+	return ioutil.ReadFile(journalPath)
+}
+
+func isWatchSessionRunning(session string) bool {
+	return false
+}
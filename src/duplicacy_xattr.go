@@ -33,3 +33,14 @@ func (entry *Entry) RestoreLateFileFlags(fullPath string, fileInfo os.FileInfo,
 func (entry *Entry) SetAttributesToFile(fullPath string, normalize bool) error {
 	return entry.setAttributesToFile(fullPath, normalize)
 }
+
+// hasExtendedAttributes returns true if 'attributes' contains anything other than the internal entries, such as file
+// flags, whose names start with '\x00'.
+func hasExtendedAttributes(attributes map[string][]byte) bool {
+	for name := range attributes {
+		if len(name) == 0 || name[0] != '\x00' {
+			return true
+		}
+	}
+	return false
+}
@@ -110,7 +110,7 @@ func (entry *Entry) setAttributesToFile(fullPath string, normalize bool) error {
 	}
 	attributes := *entry.Attributes
 
-	if _, haveFlags := attributes[linuxFileFlagsKey]; haveFlags && len(attributes) <= 1 {
+	if !hasExtendedAttributes(attributes) {
 		return nil
 	}
 